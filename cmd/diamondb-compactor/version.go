@@ -0,0 +1,11 @@
+package main
+
+// Name is application name
+const Name = "diamondb-compactor"
+
+// Version is application version
+const Version string = "0.1.0"
+
+// GitCommit describes latest commit hash.
+// This is automatically extracted by git describe --always.
+var GitCommit string
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/yuuki/diamondb/pkg/config"
+	"github.com/yuuki/diamondb/pkg/flusher"
+	"github.com/yuuki/diamondb/pkg/storage"
+)
+
+// CLI is the command line object.
+type CLI struct {
+	// outStream and errStream are the stdout and stderr
+	// to write message from the CLI.
+	outStream, errStream io.Writer
+}
+
+func main() {
+	cli := &CLI{outStream: os.Stdout, errStream: os.Stderr}
+	os.Exit(cli.Run(os.Args))
+}
+
+// Run invokes the CLI with the given arguments.
+func (cli *CLI) Run(args []string) int {
+	if err := config.Load(); err != nil {
+		log.Printf("Failed to load the config: %s\n", err)
+		return 2
+	}
+
+	var (
+		once    bool
+		version bool
+	)
+
+	flags := flag.NewFlagSet(Name, flag.ContinueOnError)
+	flags.SetOutput(cli.errStream)
+	flags.Usage = func() {
+		fmt.Fprint(cli.errStream, helpText)
+	}
+	flags.BoolVar(&once, "once", false, "")
+	flags.BoolVar(&version, "version", false, "")
+	flags.BoolVar(&version, "v", false, "")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return 1
+	}
+
+	if version {
+		fmt.Fprintf(cli.errStream, "%s version %s, build %s \n", Name, Version, GitCommit)
+		return 0
+	}
+
+	clients, err := storage.NewClients()
+	if err != nil {
+		log.Printf("failed to start fetcher session. %s\n", err)
+		return -1
+	}
+
+	f := flusher.New(&flusher.Option{
+		Sweeper:  storage.NewStore(clients.Tiers()...),
+		Locker:   clients.Redis,
+		Interval: config.Config.FlusherInterval,
+		IdleAge:  config.Config.FlusherIdleAge,
+		LockTTL:  config.Config.FlusherLockTTL,
+	})
+	if once {
+		if !f.Sweep(time.Now()) {
+			log.Println("Another flusher holds the lock")
+			return 0
+		}
+		if f.Stats().Failed > 0 {
+			return 3
+		}
+		return 0
+	}
+	go func() {
+		if err := f.Run(); err != nil {
+			log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+		}
+	}()
+
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGTERM, syscall.SIGINT)
+	s := <-sigch
+	if err := f.Shutdown(s); err != nil {
+		log.Println(err)
+		return 3
+	}
+
+	return 0
+}
+
+var helpText = `
+Usage: diamondb-flusher [options]
+
+  Flush the series left in the Redis buffer of DiamonDB into DynamoDB.
+
+Options:
+  --once               Sweep once and exit
+`
@@ -9,8 +9,20 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/yuuki/diamondb/pkg/carbon"
+	"github.com/yuuki/diamondb/pkg/collectd"
+	"github.com/yuuki/diamondb/pkg/compactor"
 	"github.com/yuuki/diamondb/pkg/config"
+	"github.com/yuuki/diamondb/pkg/flusher"
+	"github.com/yuuki/diamondb/pkg/influxdb"
+	"github.com/yuuki/diamondb/pkg/opentsdb"
+	"github.com/yuuki/diamondb/pkg/otlp"
+	"github.com/yuuki/diamondb/pkg/prometheus"
+	"github.com/yuuki/diamondb/pkg/queue"
+	"github.com/yuuki/diamondb/pkg/statsd"
 	"github.com/yuuki/diamondb/pkg/storage"
+	"github.com/yuuki/diamondb/pkg/storage/embedded"
+	"github.com/yuuki/diamondb/pkg/storage/wal"
 	"github.com/yuuki/diamondb/pkg/web"
 )
 
@@ -32,6 +44,21 @@ func (cli *CLI) Run(args []string) int {
 		log.Printf("Failed to load the config: %s\n", err)
 		return 2
 	}
+	promTmpl, err := prometheus.ParseNameTemplate(config.Config.PrometheusNameTemplate)
+	if err != nil {
+		log.Printf("Failed to load the config: DIAMONDB_PROMETHEUS_NAME_TEMPLATE is invalid. %s\n", err)
+		return 2
+	}
+	influxTmpl, err := influxdb.ParseNameTemplate(config.Config.InfluxDBNameTemplate)
+	if err != nil {
+		log.Printf("Failed to load the config: DIAMONDB_INFLUXDB_NAME_TEMPLATE is invalid. %s\n", err)
+		return 2
+	}
+	otlpTmpl, err := otlp.ParseNameTemplate(config.Config.OTLPNameTemplate)
+	if err != nil {
+		log.Printf("Failed to load the config: DIAMONDB_OTLP_NAME_TEMPLATE is invalid. %s\n", err)
+		return 2
+	}
 
 	var (
 		port    string
@@ -57,35 +84,319 @@ func (cli *CLI) Run(args []string) int {
 		return 0
 	}
 
-	store, err := storage.New()
-	if err != nil {
-		log.Printf("failed to start fetcher session. %s\n", err)
-		return -1
+	// The embedded backend stores the datapoints on the local disk instead of
+	// Redis and DynamoDB, so the store and the clients are nil with it.
+	var (
+		store   *storage.Store
+		clients *storage.Clients
+		db      *embedded.DB
+		backend storage.ReadWriter
+	)
+	if config.Config.StorageBackend == "embedded" {
+		db, err = newEmbeddedDB()
+		if err != nil {
+			log.Printf("failed to open embedded store. %s\n", err)
+			return -1
+		}
+		backend = db
+	} else {
+		clients, err = storage.NewClients()
+		if err != nil {
+			log.Printf("failed to start fetcher session. %s\n", err)
+			return -1
+		}
+		store = storage.NewStore(clients.Tiers()...)
+		backend = store
+	}
+
+	// The metrics are appended into the write-ahead log before written into the
+	// store if it is enabled, and spooled while the store is unreachable.
+	var walStore *storage.WALStore
+	if config.Config.WALDir != "" {
+		walStore, err = newWALStore(backend)
+		if err != nil {
+			log.Printf("failed to open write-ahead log. %s\n", err)
+			return -1
+		}
+		backend = walStore
 	}
 
 	log.Println("Initializing storage...")
-	if err := store.Init(); err != nil {
+	if err := backend.Init(); err != nil {
 		log.Printf("failed to initialize storage. %s\n", err)
 		return -1
 	}
 
-	handler := web.New(&web.Option{
-		Port:  port,
-		Store: store,
+	// The receivers publish the metrics into the ingestion queue if it is enabled,
+	// and the consumer writes them into the store.
+	var writer storage.ReadWriter = backend
+	q, err := queue.New()
+	if err != nil {
+		log.Printf("failed to start ingestion queue. %s\n", err)
+		return -1
+	}
+	var consumer *queue.Consumer
+	if q != nil {
+		writer = queue.NewPublisher(backend, q)
+		if config.Config.QueueConsumer {
+			checkpointer, err := queue.NewFileCheckpointer(config.Config.QueueCheckpointFile)
+			if err != nil {
+				log.Printf("failed to start queue consumer. %s\n", err)
+				return -1
+			}
+			consumer = queue.NewConsumer(&queue.ConsumerOption{
+				Queue:        q,
+				Store:        backend,
+				Checkpointer: checkpointer,
+				BatchSize:    config.Config.QueueBatchSize,
+			})
+			go func() {
+				if err := consumer.Run(); err != nil {
+					log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+				}
+			}()
+		}
+	}
+
+	// The metrics are validated and normalized before published or written.
+	writer = storage.NewValidator(writer, &storage.ValidationPolicy{
+		SanitizeName:       config.Config.ValidationInvalidChars == "sanitize",
+		MaxNameLength:      config.Config.ValidationMaxNameLength,
+		MaxNameDepth:       config.Config.ValidationMaxNameDepth,
+		MaxPast:            config.Config.ValidationMaxPast,
+		MaxFuture:          config.Config.ValidationMaxFuture,
+		StampZeroTimestamp: config.Config.ValidationZeroTimestamp == "now",
+		DropNaN:            config.Config.ValidationNaN == "drop",
 	})
+
+	webOption := &web.Option{
+		Port:                   port,
+		Store:                  writer,
+		PrometheusNameTemplate: promTmpl,
+		InfluxDBNameTemplate:   influxTmpl,
+		OTLPNameTemplate:       otlpTmpl,
+	}
+	if store != nil {
+		webOption.TierStats = store.Stats
+	}
+	handler := web.New(webOption)
 	go handler.Run()
 
+	// The flusher can also run as diamondb-flusher instead of in-process.
+	var flusherServer *flusher.Flusher
+	if config.Config.Flusher {
+		flusherServer = flusher.New(&flusher.Option{
+			Sweeper:  store,
+			Locker:   clients.Redis,
+			Interval: config.Config.FlusherInterval,
+			IdleAge:  config.Config.FlusherIdleAge,
+			LockTTL:  config.Config.FlusherLockTTL,
+		})
+		go func() {
+			if err := flusherServer.Run(); err != nil {
+				log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+			}
+		}()
+	}
+
+	// The compactor can also run as diamondb-compactor instead of in-process.
+	var compactorServer *compactor.Compactor
+	if config.Config.Compactor {
+		compactorServer = compactor.New(&compactor.Option{
+			Source:   clients.DynamoDB,
+			Cold:     clients.Cold,
+			Locker:   clients.Redis,
+			Interval: config.Config.CompactorInterval,
+			Age:      config.Config.CompactorAge,
+			LockTTL:  config.Config.CompactorLockTTL,
+			MaxItems: config.Config.CompactorMaxItems,
+		})
+		go func() {
+			if err := compactorServer.Run(); err != nil {
+				log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+			}
+		}()
+	}
+
+	var carbonServer *carbon.Server
+	if config.Config.CarbonTCPAddr != "" || config.Config.CarbonUDPAddr != "" {
+		carbonServer = carbon.New(&carbon.Option{
+			TCPAddr:       config.Config.CarbonTCPAddr,
+			UDPAddr:       config.Config.CarbonUDPAddr,
+			Store:         writer,
+			FlushInterval: config.Config.CarbonFlushInterval,
+		})
+		go func() {
+			if err := carbonServer.Run(); err != nil {
+				log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+			}
+		}()
+	}
+
+	var openTSDBServer *opentsdb.Server
+	if config.Config.OpenTSDBTelnetAddr != "" {
+		openTSDBServer = opentsdb.New(&opentsdb.Option{
+			Addr:          config.Config.OpenTSDBTelnetAddr,
+			Store:         writer,
+			FlushInterval: config.Config.OpenTSDBFlushInterval,
+		})
+		go func() {
+			if err := openTSDBServer.Run(); err != nil {
+				log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+			}
+		}()
+	}
+
+	var statsdServer *statsd.Server
+	if config.Config.StatsdAddr != "" {
+		statsdServer = statsd.New(&statsd.Option{
+			Addr:          config.Config.StatsdAddr,
+			Store:         writer,
+			FlushInterval: config.Config.StatsdFlushInterval,
+			Percentiles:   config.Config.StatsdPercentiles,
+			GaugeIdleAge:  config.Config.StatsdGaugeIdleAge,
+		})
+		go func() {
+			if err := statsdServer.Run(); err != nil {
+				log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+			}
+		}()
+	}
+
+	var collectdServer *collectd.Server
+	if config.Config.CollectdAddr != "" {
+		collectdServer, err = newCollectdServer(writer)
+		if err != nil {
+			log.Printf("failed to start collectd listener. %s\n", err)
+			return -1
+		}
+		go func() {
+			if err := collectdServer.Run(); err != nil {
+				log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+			}
+		}()
+	}
+
 	sigch := make(chan os.Signal, 1)
 	signal.Notify(sigch, syscall.SIGTERM, syscall.SIGINT)
 	s := <-sigch
+	if carbonServer != nil {
+		if err := carbonServer.Shutdown(s); err != nil {
+			log.Println(err)
+			return 3
+		}
+	}
+	if openTSDBServer != nil {
+		if err := openTSDBServer.Shutdown(s); err != nil {
+			log.Println(err)
+			return 3
+		}
+	}
+	if statsdServer != nil {
+		if err := statsdServer.Shutdown(s); err != nil {
+			log.Println(err)
+			return 3
+		}
+	}
+	if collectdServer != nil {
+		if err := collectdServer.Shutdown(s); err != nil {
+			log.Println(err)
+			return 3
+		}
+	}
 	if err := handler.Shutdown(s); err != nil {
 		log.Println(err)
 		return 3
 	}
+	if consumer != nil {
+		if err := consumer.Shutdown(s); err != nil {
+			log.Println(err)
+			return 3
+		}
+	}
+	if flusherServer != nil {
+		if err := flusherServer.Shutdown(s); err != nil {
+			log.Println(err)
+			return 3
+		}
+	}
+	if compactorServer != nil {
+		if err := compactorServer.Shutdown(s); err != nil {
+			log.Println(err)
+			return 3
+		}
+	}
+	if walStore != nil {
+		if err := walStore.Close(); err != nil {
+			log.Println(err)
+			return 3
+		}
+	}
+	if db != nil {
+		if err := db.Close(); err != nil {
+			log.Println(err)
+			return 3
+		}
+	}
 
 	return 0
 }
 
+func newWALStore(store storage.ReadWriter) (*storage.WALStore, error) {
+	policy, err := wal.ParseSyncPolicy(config.Config.WALSync)
+	if err != nil {
+		return nil, err
+	}
+	w, err := wal.Open(&wal.Option{
+		Dir:          config.Config.WALDir,
+		SegmentSize:  config.Config.WALSegmentSize,
+		Sync:         policy,
+		SyncInterval: config.Config.WALSyncInterval,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewWALStore(store, w), nil
+}
+
+func newEmbeddedDB() (*embedded.DB, error) {
+	policy, err := wal.ParseSyncPolicy(config.Config.WALSync)
+	if err != nil {
+		return nil, err
+	}
+	return embedded.Open(&embedded.Option{
+		Dir:           config.Config.EmbeddedDir,
+		FlushInterval: config.Config.EmbeddedFlushInterval,
+		Sync:          policy,
+	})
+}
+
+func newCollectdServer(store storage.ReadWriter) (*collectd.Server, error) {
+	level, err := collectd.ParseSecurityLevel(config.Config.CollectdSecurityLevel)
+	if err != nil {
+		return nil, err
+	}
+	var users map[string]string
+	if config.Config.CollectdAuthFile != "" {
+		users, err = collectd.LoadAuthFile(config.Config.CollectdAuthFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	typesDB, err := collectd.LoadTypesDB(config.Config.CollectdTypesDB)
+	if err != nil {
+		return nil, err
+	}
+	return collectd.New(&collectd.Option{
+		Addr:          config.Config.CollectdAddr,
+		Store:         store,
+		FlushInterval: config.Config.CollectdFlushInterval,
+		SecurityLevel: level,
+		Users:         users,
+		TypesDB:       typesDB,
+	}), nil
+}
+
 var helpText = `
 Usage: diamondb-server [options]
 
@@ -0,0 +1,217 @@
+package carbon
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/storage"
+	"github.com/yuuki/diamondb/pkg/udp"
+)
+
+// Server receives datapoints by the carbon plaintext protocol over TCP and UDP,
+// and writes them into the store in batches per series.
+type Server struct {
+	tcpAddr string
+	batcher *storage.Batcher
+
+	tcpListener net.Listener
+	udpListener *udp.Listener
+	connsMu     sync.Mutex // guards tcpListener and conns
+	conns       map[net.Conn]struct{}
+	done        chan struct{}
+	wg          sync.WaitGroup
+
+	received  uint64
+	malformed uint64
+}
+
+// Stats represents the counters of the Server.
+type Stats struct {
+	Received  uint64 `json:"received"`
+	Malformed uint64 `json:"malformed"`
+	Written   uint64 `json:"written"`
+	Failed    uint64 `json:"failed"`
+}
+
+// Option for the carbon Server.
+type Option struct {
+	TCPAddr       string
+	UDPAddr       string
+	Store         storage.ReadWriter
+	FlushInterval time.Duration
+}
+
+// New initializes a new carbon Server.
+func New(o *Option) *Server {
+	s := &Server{
+		tcpAddr: o.TCPAddr,
+		batcher: storage.NewBatcher(o.Store, o.FlushInterval),
+		conns:   make(map[net.Conn]struct{}),
+		done:    make(chan struct{}),
+	}
+	if o.UDPAddr != "" {
+		s.udpListener = udp.NewListener("carbon", o.UDPAddr, s.handlePacket)
+	}
+	return s
+}
+
+// Run listens on the TCP and UDP addresses and serves until Shutdown is called.
+func (s *Server) Run() error {
+	if s.tcpAddr != "" {
+		l, err := net.Listen("tcp", s.tcpAddr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to listen carbon tcp (%s)", s.tcpAddr)
+		}
+		// Shutdown may be called before listening.
+		s.connsMu.Lock()
+		select {
+		case <-s.done:
+			s.connsMu.Unlock()
+			return l.Close()
+		default:
+		}
+		s.tcpListener = l
+		s.wg.Add(1)
+		s.connsMu.Unlock()
+		log.Printf("Listening carbon on tcp %s\n", s.tcpAddr)
+		go s.serveTCP(l)
+	}
+	if s.udpListener != nil {
+		if err := s.udpListener.Listen(); err != nil {
+			s.closeTCP()
+			return err
+		}
+	}
+
+	s.batcher.Run(s.done)
+	return nil
+}
+
+// closeTCP closes the TCP listener if it is listening, and returns the error of
+// closing it.
+func (s *Server) closeTCP() error {
+	s.connsMu.Lock()
+	tcpListener := s.tcpListener
+	s.tcpListener = nil
+	s.connsMu.Unlock()
+	if tcpListener == nil {
+		return nil
+	}
+	if err := tcpListener.Close(); err != nil {
+		return errors.Wrap(err, "failed to close carbon tcp listener")
+	}
+	return nil
+}
+
+// Shutdown closes the listeners and flushes the buffered datapoints. The
+// datapoints are flushed even if the listeners fail to be closed, and the first
+// error of closing them is returned.
+func (s *Server) Shutdown(sig os.Signal) error {
+	log.Printf("Received %s shutdown carbon listeners...\n", sig)
+	s.connsMu.Lock()
+	close(s.done)
+	s.connsMu.Unlock()
+	firstErr := s.closeTCP()
+	if s.udpListener != nil {
+		if err := s.udpListener.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	// Close the idle connections kept open by the clients.
+	s.connsMu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connsMu.Unlock()
+	s.wg.Wait()
+	s.batcher.Flush()
+	return firstErr
+}
+
+// Stats returns the snapshot of the counters.
+func (s *Server) Stats() Stats {
+	return Stats{
+		Received:  atomic.LoadUint64(&s.received),
+		Malformed: atomic.LoadUint64(&s.malformed),
+		Written:   s.batcher.Written(),
+		Failed:    s.batcher.Failed(),
+	}
+}
+
+func (s *Server) serveTCP(l net.Listener) {
+	defer s.wg.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			log.Printf("failed to accept carbon connection: %s\n", err)
+			if nerr, ok := err.(net.Error); !ok || !nerr.Temporary() {
+				// The listener is closed by Run failing to listen udp.
+				return
+			}
+			continue
+		}
+		s.connsMu.Lock()
+		select {
+		case <-s.done:
+			// Shutdown has already closed the tracked connections.
+			s.connsMu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.connsMu.Unlock()
+		go func(conn net.Conn) {
+			defer s.wg.Done()
+			defer func() {
+				s.connsMu.Lock()
+				delete(s.conns, conn)
+				s.connsMu.Unlock()
+				conn.Close()
+			}()
+			s.handleReader(conn)
+		}(conn)
+	}
+}
+
+func (s *Server) handlePacket(packet []byte) {
+	udp.SplitLines(packet, s.handleLine)
+}
+
+func (s *Server) handleReader(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		s.handleLine(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("failed to read carbon stream: %s\n", err)
+	}
+}
+
+func (s *Server) handleLine(line string) {
+	if len(line) == 0 || line == "\r" {
+		return
+	}
+	atomic.AddUint64(&s.received, 1)
+	name, p, err := ParseLine(line)
+	if err != nil {
+		atomic.AddUint64(&s.malformed, 1)
+		log.Println(err)
+		return
+	}
+	s.batcher.Add(name, p)
+}
@@ -0,0 +1,120 @@
+package carbon
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage"
+)
+
+func TestServerHandleReader(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got = map[string][]*model.Datapoint{}
+	)
+	s := New(&Option{
+		Store: &storage.FakeReadWriter{
+			FakeInsertMetric: func(m *model.Metric) error {
+				mu.Lock()
+				defer mu.Unlock()
+				got[m.Name] = append(got[m.Name], m.Datapoints...)
+				return nil
+			},
+		},
+		FlushInterval: time.Second,
+	})
+
+	s.handleReader(strings.NewReader(strings.Join([]string{
+		"server1.loadavg5 10.0 100",
+		"server2.loadavg5 8.0 100",
+		"malformed line",
+		"",
+		"server1.loadavg5 11.0 160",
+	}, "\n")))
+	s.batcher.Flush()
+
+	expected := map[string][]*model.Datapoint{
+		"server1.loadavg5": {{Timestamp: 100, Value: 10.0}, {Timestamp: 160, Value: 11.0}},
+		"server2.loadavg5": {{Timestamp: 100, Value: 8.0}},
+	}
+	if diff := pretty.Compare(got, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	expectedStats := Stats{Received: 4, Malformed: 1, Written: 3, Failed: 0}
+	if diff := pretty.Compare(s.Stats(), expectedStats); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestServerHandlePacket(t *testing.T) {
+	s := New(&Option{
+		Store: &storage.FakeReadWriter{
+			FakeInsertMetric: func(m *model.Metric) error {
+				return errors.New("error")
+			},
+		},
+		FlushInterval: time.Second,
+	})
+
+	s.handlePacket([]byte("server1.loadavg5 10.0 100\nserver1.loadavg5 11.0 160"))
+	s.batcher.Flush()
+
+	expectedStats := Stats{Received: 2, Malformed: 0, Written: 0, Failed: 2}
+	if diff := pretty.Compare(s.Stats(), expectedStats); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestServerRun_UDPError(t *testing.T) {
+	// The udp address is taken, so Run fails after listening tcp.
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer udpConn.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	tcpAddr := l.Addr().String()
+	l.Close()
+
+	var written []*model.Metric
+	s := New(&Option{
+		TCPAddr: tcpAddr,
+		UDPAddr: udpConn.LocalAddr().String(),
+		Store: &storage.FakeReadWriter{
+			FakeInsertMetric: func(m *model.Metric) error {
+				written = append(written, m)
+				return nil
+			},
+		},
+		FlushInterval: time.Hour,
+	})
+	if err := s.Run(); err == nil {
+		t.Fatal("should raise err")
+	}
+	// The tcp listener is closed.
+	l, err = net.Listen("tcp", tcpAddr)
+	if err != nil {
+		t.Fatalf("tcp listener should be closed: %s", err)
+	}
+	l.Close()
+
+	// The buffered datapoints are flushed on shutdown.
+	s.handlePacket([]byte("server1.loadavg5 10.0 100"))
+	if err := s.Shutdown(os.Interrupt); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if len(written) != 1 {
+		t.Fatalf("datapoints should be flushed: %v", written)
+	}
+}
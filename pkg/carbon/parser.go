@@ -0,0 +1,44 @@
+package carbon
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/yuuki/diamondb/pkg/model"
+)
+
+// ParseError represents an error of parsing a malformed line.
+type ParseError struct {
+	line string
+	msg  string
+}
+
+// Error returns the error message for ParseError.
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("malformed line %q: %s", e.line, e.msg)
+}
+
+// ParseLine parses a line of the Graphite plaintext protocol
+// "<metric path> <metric value> <metric timestamp>".
+func ParseLine(line string) (string, *model.Datapoint, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return "", nil, &ParseError{
+			line: line,
+			msg:  fmt.Sprintf("wrong number of fields (%d for 3)", len(fields)),
+		}
+	}
+	name := fields[0]
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return "", nil, &ParseError{line: line, msg: "invalid value"}
+	}
+	// carbon accepts the float timestamp such as '1500000000.5'.
+	ts, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil || math.IsNaN(ts) || math.IsInf(ts, 0) {
+		return "", nil, &ParseError{line: line, msg: "invalid timestamp"}
+	}
+	return name, &model.Datapoint{Timestamp: int64(ts), Value: value}, nil
+}
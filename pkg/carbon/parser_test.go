@@ -0,0 +1,71 @@
+package carbon
+
+import (
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		desc          string
+		line          string
+		expectedName  string
+		expectedPoint *model.Datapoint
+	}{
+		{
+			"integer timestamp",
+			"server1.loadavg5 10.5 1500000000",
+			"server1.loadavg5",
+			&model.Datapoint{Timestamp: 1500000000, Value: 10.5},
+		},
+		{
+			"float timestamp",
+			"server1.loadavg5 1 1500000000.7",
+			"server1.loadavg5",
+			&model.Datapoint{Timestamp: 1500000000, Value: 1},
+		},
+		{
+			"surrounding spaces",
+			"  server1.loadavg5\t-0.1   100 \r",
+			"server1.loadavg5",
+			&model.Datapoint{Timestamp: 100, Value: -0.1},
+		},
+	}
+	for _, tc := range tests {
+		name, p, err := ParseLine(tc.line)
+		if err != nil {
+			t.Fatalf("desc: %s, should not raise err: %s", tc.desc, err)
+		}
+		if name != tc.expectedName {
+			t.Fatalf("desc: %s, name should be %s, not %s", tc.desc, tc.expectedName, name)
+		}
+		if diff := pretty.Compare(p, tc.expectedPoint); diff != "" {
+			t.Fatalf("desc: %s, diff: (-actual +expected)\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestParseLine_Malformed(t *testing.T) {
+	tests := []struct {
+		desc string
+		line string
+	}{
+		{"missing timestamp", "server1.loadavg5 10.5"},
+		{"too many fields", "server1.loadavg5 10.5 100 200"},
+		{"invalid value", "server1.loadavg5 abc 100"},
+		{"invalid timestamp", "server1.loadavg5 10.5 abc"},
+		{"NaN timestamp", "server1.loadavg5 10.5 NaN"},
+	}
+	for _, tc := range tests {
+		_, _, err := ParseLine(tc.line)
+		if err == nil {
+			t.Fatalf("desc: %s, should raise err", tc.desc)
+		}
+		if _, ok := err.(*ParseError); !ok {
+			t.Fatalf("desc: %s, err should be *ParseError, not %T", tc.desc, err)
+		}
+	}
+}
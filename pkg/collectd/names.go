@@ -0,0 +1,115 @@
+package collectd
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/storage/util"
+)
+
+// TypesDB is the map from the type to the names of the data sources defined by types.db.
+type TypesDB map[string][]string
+
+// LoadTypesDB loads the types.db files.
+func LoadTypesDB(paths []string) (TypesDB, error) {
+	db := TypesDB{}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open types.db (%s)", path)
+		}
+		err = db.parse(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse types.db (%s)", path)
+		}
+	}
+	return db, nil
+}
+
+// parse parses lines such as 'load shortterm:GAUGE:0:5000, midterm:GAUGE:0:5000, longterm:GAUGE:0:5000'.
+func (db TypesDB) parse(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return errors.Errorf("invalid line %q", line)
+		}
+		var sources []string
+		for _, ds := range strings.Split(strings.Join(fields[1:], ""), ",") {
+			i := strings.IndexByte(ds, ':')
+			if i <= 0 {
+				return errors.Errorf("invalid data source %q", ds)
+			}
+			sources = append(sources, ds[:i])
+		}
+		db[fields[0]] = sources
+	}
+	return scanner.Err()
+}
+
+// LoadAuthFile loads the auth file of the network plugin, whose lines are '<user>: <password>'.
+func LoadAuthFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open auth file (%s)", path)
+	}
+	defer f.Close()
+
+	users := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, errors.Errorf("invalid line of auth file (%s)", path)
+		}
+		users[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read auth file (%s)", path)
+	}
+	return users, nil
+}
+
+// Names returns the series names of the values as the write_graphite plugin does,
+// such as 'host.plugin-instance.type-instance.datasource'. The data source is omitted
+// if the type has a single value. The data sources are named by db or by the index
+// if the type is unknown.
+func (vl *ValueList) Names(db TypesDB) []string {
+	prefix := util.SanitizeNode(vl.Host) + "." +
+		joinInstance(vl.Plugin, vl.PluginInstance) + "." +
+		joinInstance(vl.Type, vl.TypeInstance)
+	if len(vl.Values) == 1 {
+		return []string{prefix}
+	}
+	sources := db[vl.Type]
+	names := make([]string, len(vl.Values))
+	for i := range vl.Values {
+		ds := strconv.Itoa(i)
+		if len(sources) == len(vl.Values) {
+			ds = util.SanitizeNode(sources[i])
+		}
+		names[i] = prefix + "." + ds
+	}
+	return names
+}
+
+func joinInstance(name, instance string) string {
+	if instance == "" {
+		return util.SanitizeNode(name)
+	}
+	return util.SanitizeNode(name) + "-" + util.SanitizeNode(instance)
+}
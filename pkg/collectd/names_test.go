@@ -0,0 +1,103 @@
+package collectd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func writeTempFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadTypesDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diamondb-collectd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeTempFile(t, dir, "types.db", `
+# comment
+load			shortterm:GAUGE:0:5000, midterm:GAUGE:0:5000, longterm:GAUGE:0:5000
+if_octets		rx:DERIVE:0:U, tx:DERIVE:0:U
+`)
+	db, err := LoadTypesDB([]string{path})
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	expected := TypesDB{
+		"load":      {"shortterm", "midterm", "longterm"},
+		"if_octets": {"rx", "tx"},
+	}
+	if diff := pretty.Compare(db, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	invalid := writeTempFile(t, dir, "invalid.db", "load shortterm\n")
+	if _, err := LoadTypesDB([]string{invalid}); err == nil {
+		t.Fatalf("should raise err")
+	}
+}
+
+func TestLoadAuthFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diamondb-collectd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeTempFile(t, dir, "passwd", "# comment\nalice: secret\nbob:  p:ss \n")
+	users, err := LoadAuthFile(path)
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	expected := map[string]string{"alice": "secret", "bob": "p:ss"}
+	if diff := pretty.Compare(users, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	if _, err := LoadAuthFile(filepath.Join(dir, "notfound")); err == nil {
+		t.Fatalf("should raise err")
+	}
+}
+
+func TestValueListNames(t *testing.T) {
+	db := TypesDB{"load": {"shortterm", "midterm", "longterm"}}
+	tests := []struct {
+		vl       *ValueList
+		expected []string
+	}{
+		{
+			testValueLists[0],
+			[]string{
+				"host1_example_com.load.load.shortterm",
+				"host1_example_com.load.load.midterm",
+				"host1_example_com.load.load.longterm",
+			},
+		},
+		{
+			testValueLists[1],
+			[]string{
+				"host1_example_com.interface-eth0.if_octets.0",
+				"host1_example_com.interface-eth0.if_octets.1",
+			},
+		},
+		{
+			testValueLists[2],
+			[]string{"host1_example_com.interface-eth0.if_dropped-rx"},
+		},
+	}
+	for _, tc := range tests {
+		if diff := pretty.Compare(tc.vl.Names(db), tc.expected); diff != "" {
+			t.Fatalf("diff: (-actual +expected)\n%s", diff)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Package collectd receives the values sent by the network plugin of collectd.
+package collectd
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Part types of the binary protocol.
+const (
+	partHost           = 0x0000
+	partTime           = 0x0001
+	partPlugin         = 0x0002
+	partPluginInstance = 0x0003
+	partType           = 0x0004
+	partTypeInstance   = 0x0005
+	partValues         = 0x0006
+	partTimeHR         = 0x0008
+	partSignature      = 0x0200
+	partEncryption     = 0x0210
+)
+
+// Data source types of the values.
+const (
+	TypeCounter  = 0
+	TypeGauge    = 1
+	TypeDerive   = 2
+	TypeAbsolute = 3
+)
+
+const (
+	headerSize    = 4
+	signatureSize = sha256.Size
+	hashSize      = sha1.Size
+)
+
+// SecurityLevel is the minimum security level of the packets to be accepted.
+type SecurityLevel int
+
+// Security levels same as the network plugin.
+const (
+	SecurityNone SecurityLevel = iota
+	SecuritySign
+	SecurityEncrypt
+)
+
+// ParseSecurityLevel parses "none", "sign" or "encrypt".
+func ParseSecurityLevel(s string) (SecurityLevel, error) {
+	switch s {
+	case "", "none":
+		return SecurityNone, nil
+	case "sign":
+		return SecuritySign, nil
+	case "encrypt":
+		return SecurityEncrypt, nil
+	}
+	return SecurityNone, errors.Errorf("invalid security level %q", s)
+}
+
+// Value is a value of a data source.
+type Value struct {
+	Type  int
+	Value float64
+}
+
+// ValueList is the values of an identifier at a time.
+type ValueList struct {
+	Host           string
+	Plugin         string
+	PluginInstance string
+	Type           string
+	TypeInstance   string
+	Time           int64 // UNIX Timestamp
+	Values         []Value
+}
+
+// Parser decodes the packets of the binary protocol.
+type Parser struct {
+	level SecurityLevel
+	// users is the map from the username to the password to verify signed
+	// packets and decrypt encrypted packets.
+	users map[string]string
+}
+
+// NewParser creates a new Parser accepting the packets at least the level.
+func NewParser(level SecurityLevel, users map[string]string) *Parser {
+	return &Parser{level: level, users: users}
+}
+
+// Parse decodes the packet. The value lists below the security level are dropped.
+// It returns the value lists decoded before the error if the packet is malformed.
+func (p *Parser) Parse(b []byte) ([]*ValueList, error) {
+	return p.parse(b, SecurityNone)
+}
+
+func (p *Parser) parse(b []byte, level SecurityLevel) ([]*ValueList, error) {
+	var (
+		vls []*ValueList
+		cur ValueList
+	)
+	for len(b) > 0 {
+		if len(b) < headerSize {
+			return vls, errors.New("collectd: truncated part header")
+		}
+		typ := binary.BigEndian.Uint16(b[0:2])
+		length := int(binary.BigEndian.Uint16(b[2:4]))
+		if length < headerSize || length > len(b) {
+			return vls, errors.Errorf("collectd: invalid part length %d", length)
+		}
+		payload := b[headerSize:length]
+
+		switch typ {
+		case partHost, partPlugin, partPluginInstance, partType, partTypeInstance:
+			s, err := parseString(payload)
+			if err != nil {
+				return vls, err
+			}
+			switch typ {
+			case partHost:
+				cur.Host = s
+			case partPlugin:
+				cur.Plugin = s
+			case partPluginInstance:
+				cur.PluginInstance = s
+			case partType:
+				cur.Type = s
+			case partTypeInstance:
+				cur.TypeInstance = s
+			}
+		case partTime, partTimeHR:
+			if len(payload) != 8 {
+				return vls, errors.New("collectd: invalid time part")
+			}
+			t := binary.BigEndian.Uint64(payload)
+			if typ == partTimeHR {
+				// The high resolution time is in 2^-30 seconds.
+				t >>= 30
+			}
+			cur.Time = int64(t)
+		case partValues:
+			values, err := parseValues(payload)
+			if err != nil {
+				return vls, err
+			}
+			if level < p.level {
+				break
+			}
+			vl := cur
+			vl.Values = values
+			vls = append(vls, &vl)
+		case partSignature:
+			rest := b[length:]
+			if err := p.verify(payload, rest); err != nil {
+				return vls, err
+			}
+			signed, err := p.parse(rest, maxLevel(level, SecuritySign))
+			return append(vls, signed...), err
+		case partEncryption:
+			plain, err := p.decrypt(payload)
+			if err != nil {
+				return vls, err
+			}
+			decrypted, err := p.parse(plain, SecurityEncrypt)
+			vls = append(vls, decrypted...)
+			if err != nil {
+				return vls, err
+			}
+		}
+		b = b[length:]
+	}
+	return vls, nil
+}
+
+func maxLevel(a, b SecurityLevel) SecurityLevel {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// parseString parses a null-terminated string.
+func parseString(b []byte) (string, error) {
+	if len(b) == 0 || b[len(b)-1] != 0 {
+		return "", errors.New("collectd: string is not null-terminated")
+	}
+	return string(b[:len(b)-1]), nil
+}
+
+// parseValues parses the values part, which consists of the number of values,
+// the data source types and the values.
+func parseValues(b []byte) ([]Value, error) {
+	if len(b) < 2 {
+		return nil, errors.New("collectd: truncated values part")
+	}
+	n := int(binary.BigEndian.Uint16(b[0:2]))
+	if len(b) != 2+n*9 {
+		return nil, errors.Errorf("collectd: invalid values part length for %d values", n)
+	}
+	types, data := b[2:2+n], b[2+n:]
+	values := make([]Value, n)
+	for i := 0; i < n; i++ {
+		raw := data[i*8 : (i+1)*8]
+		values[i].Type = int(types[i])
+		switch types[i] {
+		case TypeCounter, TypeAbsolute:
+			values[i].Value = float64(binary.BigEndian.Uint64(raw))
+		case TypeGauge:
+			// Only gauges are encoded in little endian.
+			values[i].Value = math.Float64frombits(binary.LittleEndian.Uint64(raw))
+		case TypeDerive:
+			values[i].Value = float64(int64(binary.BigEndian.Uint64(raw)))
+		default:
+			return nil, errors.Errorf("collectd: unknown data source type %d", types[i])
+		}
+	}
+	return values, nil
+}
+
+// verify verifies the signature part, which consists of HMAC-SHA256 and the username.
+// The HMAC is calculated over the username and the rest of the packet.
+func (p *Parser) verify(payload, rest []byte) error {
+	if len(payload) <= signatureSize {
+		return errors.New("collectd: truncated signature part")
+	}
+	sig, username := payload[:signatureSize], payload[signatureSize:]
+	password, ok := p.users[string(username)]
+	if !ok {
+		return errors.Errorf("collectd: unknown user %q", username)
+	}
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(username)
+	mac.Write(rest)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return errors.Errorf("collectd: invalid signature of user %q", username)
+	}
+	return nil
+}
+
+// decrypt decrypts the encryption part, which consists of the username length, the
+// username, the IV and the data encrypted by AES-256 in OFB mode with the key of
+// SHA-256 of the password. The decrypted data consists of SHA-1 of the rest and the rest.
+func (p *Parser) decrypt(payload []byte) ([]byte, error) {
+	if len(payload) < 2 {
+		return nil, errors.New("collectd: truncated encryption part")
+	}
+	n := int(binary.BigEndian.Uint16(payload[0:2]))
+	if len(payload) < 2+n+aes.BlockSize+hashSize {
+		return nil, errors.New("collectd: truncated encryption part")
+	}
+	username := string(payload[2 : 2+n])
+	password, ok := p.users[username]
+	if !ok {
+		return nil, errors.Errorf("collectd: unknown user %q", username)
+	}
+	iv := payload[2+n : 2+n+aes.BlockSize]
+	encrypted := payload[2+n+aes.BlockSize:]
+
+	key := sha256.Sum256([]byte(password))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "collectd: failed to create cipher")
+	}
+	plain := make([]byte, len(encrypted))
+	cipher.NewOFB(block, iv).XORKeyStream(plain, encrypted)
+
+	hash, data := plain[:hashSize], plain[hashSize:]
+	sum := sha1.Sum(data)
+	if !bytes.Equal(hash, sum[:]) {
+		return nil, errors.Errorf("collectd: failed to decrypt the packet of user %q", username)
+	}
+	return data, nil
+}
@@ -0,0 +1,188 @@
+package collectd
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func encodePart(typ uint16, payload []byte) []byte {
+	b := make([]byte, headerSize, headerSize+len(payload))
+	binary.BigEndian.PutUint16(b[0:2], typ)
+	binary.BigEndian.PutUint16(b[2:4], uint16(headerSize+len(payload)))
+	return append(b, payload...)
+}
+
+func encodeString(typ uint16, s string) []byte {
+	return encodePart(typ, append([]byte(s), 0))
+}
+
+func encodeNumber(typ uint16, v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return encodePart(typ, b)
+}
+
+func encodeValues(values ...Value) []byte {
+	b := make([]byte, 2+len(values)*9)
+	binary.BigEndian.PutUint16(b[0:2], uint16(len(values)))
+	for i, v := range values {
+		b[2+i] = byte(v.Type)
+		raw := b[2+len(values)+i*8:]
+		switch v.Type {
+		case TypeGauge:
+			binary.LittleEndian.PutUint64(raw, math.Float64bits(v.Value))
+		case TypeDerive:
+			binary.BigEndian.PutUint64(raw, uint64(int64(v.Value)))
+		default:
+			binary.BigEndian.PutUint64(raw, uint64(v.Value))
+		}
+	}
+	return encodePart(partValues, b)
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func sign(packet []byte, username, password string) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write([]byte(username))
+	mac.Write(packet)
+	return concat(encodePart(partSignature, append(mac.Sum(nil), username...)), packet)
+}
+
+func encrypt(packet []byte, username, password string) []byte {
+	hash := sha1.Sum(packet)
+	plain := append(hash[:], packet...)
+	key := sha256.Sum256([]byte(password))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err)
+	}
+	iv := make([]byte, aes.BlockSize)
+	for i := range iv {
+		iv[i] = byte(i)
+	}
+	encrypted := make([]byte, len(plain))
+	cipher.NewOFB(block, iv).XORKeyStream(encrypted, plain)
+
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(len(username)))
+	payload = concat(payload, []byte(username), iv, encrypted)
+	return encodePart(partEncryption, payload)
+}
+
+// testPacket builds a packet with the load and the interface values of host1.
+func testPacket() []byte {
+	return concat(
+		encodeString(partHost, "host1.example.com"),
+		encodeNumber(partTimeHR, 1500000000<<30),
+		encodeString(partPlugin, "load"),
+		encodeString(partType, "load"),
+		encodeValues(
+			Value{Type: TypeGauge, Value: 0.5},
+			Value{Type: TypeGauge, Value: 0.25},
+			Value{Type: TypeGauge, Value: 0.125},
+		),
+		encodeNumber(partTime, 1500000010),
+		encodeString(partPlugin, "interface"),
+		encodeString(partPluginInstance, "eth0"),
+		encodeString(partType, "if_octets"),
+		encodeValues(
+			Value{Type: TypeDerive, Value: 100},
+			Value{Type: TypeCounter, Value: 200},
+		),
+		encodeString(partType, "if_dropped"),
+		encodeString(partTypeInstance, "rx"),
+		encodeValues(Value{Type: TypeAbsolute, Value: 3}),
+	)
+}
+
+var testValueLists = []*ValueList{
+	{
+		Host: "host1.example.com", Plugin: "load", Type: "load", Time: 1500000000,
+		Values: []Value{{TypeGauge, 0.5}, {TypeGauge, 0.25}, {TypeGauge, 0.125}},
+	},
+	{
+		Host: "host1.example.com", Plugin: "interface", PluginInstance: "eth0", Type: "if_octets", Time: 1500000010,
+		Values: []Value{{TypeDerive, 100}, {TypeCounter, 200}},
+	},
+	{
+		Host: "host1.example.com", Plugin: "interface", PluginInstance: "eth0", Type: "if_dropped", TypeInstance: "rx", Time: 1500000010,
+		Values: []Value{{TypeAbsolute, 3}},
+	},
+}
+
+func TestParserParse(t *testing.T) {
+	users := map[string]string{"alice": "secret"}
+	tests := []struct {
+		desc     string
+		level    SecurityLevel
+		packet   []byte
+		expected []*ValueList
+	}{
+		{"plain", SecurityNone, testPacket(), testValueLists},
+		{"signed", SecuritySign, sign(testPacket(), "alice", "secret"), testValueLists},
+		{"encrypted", SecurityEncrypt, encrypt(testPacket(), "alice", "secret"), testValueLists},
+		{"plain packet below sign level", SecuritySign, testPacket(), nil},
+		{"signed packet below encrypt level", SecurityEncrypt, sign(testPacket(), "alice", "secret"), nil},
+	}
+	for _, tc := range tests {
+		got, err := NewParser(tc.level, users).Parse(tc.packet)
+		if err != nil {
+			t.Fatalf("desc: %s, should not raise err: %s", tc.desc, err)
+		}
+		if diff := pretty.Compare(got, tc.expected); diff != "" {
+			t.Fatalf("desc: %s, diff: (-actual +expected)\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestParserParse_Error(t *testing.T) {
+	users := map[string]string{"alice": "secret"}
+	packet := testPacket()
+	tests := []struct {
+		desc   string
+		packet []byte
+	}{
+		{"truncated", packet[:len(packet)-1]},
+		{"string without null", encodePart(partHost, []byte("host1"))},
+		{"invalid values length", encodePart(partValues, []byte{0, 2, 1})},
+		{"unknown data source type", encodeValues(Value{Type: 9, Value: 1})},
+		{"wrong password", sign(testPacket(), "alice", "wrong")},
+		{"unknown user", sign(testPacket(), "bob", "secret")},
+		{"tampered", concat(sign(testPacket(), "alice", "secret"), encodeString(partHost, "host2"))},
+		{"wrong key", encrypt(testPacket(), "alice", "wrong")},
+	}
+	for _, tc := range tests {
+		if _, err := NewParser(SecurityNone, users).Parse(tc.packet); err == nil {
+			t.Fatalf("desc: %s, should raise err", tc.desc)
+		}
+	}
+}
+
+func TestParseSecurityLevel(t *testing.T) {
+	for s, expected := range map[string]SecurityLevel{
+		"": SecurityNone, "none": SecurityNone, "sign": SecuritySign, "encrypt": SecurityEncrypt,
+	} {
+		level, err := ParseSecurityLevel(s)
+		if err != nil || level != expected {
+			t.Fatalf("level of %q should be %d, not (%d, %v)", s, expected, level, err)
+		}
+	}
+	if _, err := ParseSecurityLevel("unknown"); err == nil {
+		t.Fatalf("should raise err")
+	}
+}
@@ -0,0 +1,103 @@
+package collectd
+
+import (
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage"
+	"github.com/yuuki/diamondb/pkg/udp"
+)
+
+// Server receives the values by the binary protocol over UDP, and writes them
+// into the store in batches per series. COUNTER, DERIVE and ABSOLUTE values are
+// written as they are without converting into rates.
+type Server struct {
+	parser  *Parser
+	typesDB TypesDB
+	batcher *storage.Batcher
+
+	listener *udp.Listener
+	done     chan struct{}
+
+	received  uint64
+	malformed uint64
+}
+
+// Stats represents the counters of the Server.
+type Stats struct {
+	Received  uint64 `json:"received"`
+	Malformed uint64 `json:"malformed"`
+	Written   uint64 `json:"written"`
+	Failed    uint64 `json:"failed"`
+}
+
+// Option for the collectd Server.
+type Option struct {
+	Addr          string
+	Store         storage.ReadWriter
+	FlushInterval time.Duration
+	SecurityLevel SecurityLevel
+	Users         map[string]string // loaded from the auth file
+	TypesDB       TypesDB
+}
+
+// New initializes a new collectd Server.
+func New(o *Option) *Server {
+	s := &Server{
+		parser:  NewParser(o.SecurityLevel, o.Users),
+		typesDB: o.TypesDB,
+		batcher: storage.NewBatcher(o.Store, o.FlushInterval),
+		done:    make(chan struct{}),
+	}
+	s.listener = udp.NewListener("collectd", o.Addr, s.handlePacket)
+	return s
+}
+
+// Run listens on the UDP address and serves until Shutdown is called.
+func (s *Server) Run() error {
+	if err := s.listener.Listen(); err != nil {
+		return err
+	}
+
+	s.batcher.Run(s.done)
+	return nil
+}
+
+// Shutdown closes the listener and flushes the buffered datapoints.
+func (s *Server) Shutdown(sig os.Signal) error {
+	log.Printf("Received %s shutdown collectd listener...\n", sig)
+	close(s.done)
+	if err := s.listener.Close(); err != nil {
+		return err
+	}
+	s.batcher.Flush()
+	return nil
+}
+
+// Stats returns the snapshot of the counters. Received and Malformed are counted by packet.
+func (s *Server) Stats() Stats {
+	return Stats{
+		Received:  atomic.LoadUint64(&s.received),
+		Malformed: atomic.LoadUint64(&s.malformed),
+		Written:   s.batcher.Written(),
+		Failed:    s.batcher.Failed(),
+	}
+}
+
+func (s *Server) handlePacket(packet []byte) {
+	atomic.AddUint64(&s.received, 1)
+	vls, err := s.parser.Parse(packet)
+	if err != nil {
+		// The value lists decoded before the error are still written.
+		atomic.AddUint64(&s.malformed, 1)
+		log.Println(err)
+	}
+	for _, vl := range vls {
+		for i, name := range vl.Names(s.typesDB) {
+			s.batcher.Add(name, &model.Datapoint{Timestamp: vl.Time, Value: vl.Values[i].Value})
+		}
+	}
+}
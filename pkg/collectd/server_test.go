@@ -0,0 +1,54 @@
+package collectd
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage"
+)
+
+func TestServerHandlePacket(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got = map[string][]*model.Datapoint{}
+	)
+	s := New(&Option{
+		Store: &storage.FakeReadWriter{
+			FakeInsertMetric: func(m *model.Metric) error {
+				mu.Lock()
+				defer mu.Unlock()
+				got[m.Name] = append(got[m.Name], m.Datapoints...)
+				return nil
+			},
+		},
+		FlushInterval: time.Second,
+		SecurityLevel: SecuritySign,
+		Users:         map[string]string{"alice": "secret"},
+		TypesDB:       TypesDB{"if_octets": {"rx", "tx"}},
+	})
+
+	s.handlePacket(sign(testPacket(), "alice", "secret"))
+	s.handlePacket(testPacket()) // dropped by the security level
+	s.handlePacket([]byte{0x00})
+	s.batcher.Flush()
+
+	expected := map[string][]*model.Datapoint{
+		"host1_example_com.load.load.0":                  {{Timestamp: 1500000000, Value: 0.5}},
+		"host1_example_com.load.load.1":                  {{Timestamp: 1500000000, Value: 0.25}},
+		"host1_example_com.load.load.2":                  {{Timestamp: 1500000000, Value: 0.125}},
+		"host1_example_com.interface-eth0.if_octets.rx":  {{Timestamp: 1500000010, Value: 100}},
+		"host1_example_com.interface-eth0.if_octets.tx":  {{Timestamp: 1500000010, Value: 200}},
+		"host1_example_com.interface-eth0.if_dropped-rx": {{Timestamp: 1500000010, Value: 3}},
+	}
+	if diff := pretty.Compare(got, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	expectedStats := Stats{Received: 3, Malformed: 1, Written: 6, Failed: 0}
+	if diff := pretty.Compare(s.Stats(), expectedStats); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
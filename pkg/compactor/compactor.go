@@ -0,0 +1,316 @@
+package compactor
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/cold"
+	"github.com/yuuki/diamondb/pkg/storage/dynamodb"
+	"github.com/yuuki/diamondb/pkg/storage/redis"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
+)
+
+const (
+	// DefaultInterval is the default interval to compact the old items.
+	DefaultInterval = 1 * time.Hour
+	// DefaultAge is the default age of the items compacted into the cold tier.
+	DefaultAge = 7 * 24 * time.Hour
+	// DefaultLockTTL is the default expiration of the lock, which is extended while compacting.
+	DefaultLockTTL = 1 * time.Minute
+	// DefaultMaxItems is the default maximum number of the items compacted at once.
+	DefaultMaxItems = 10000
+
+	// LockKey is the key of the Redis lock to elect the node which compacts.
+	LockKey = "diamondb:compactor:lock"
+)
+
+// errEnough stops scanning the items when enough items are collected.
+var errEnough = errors.New("enough items to compact")
+
+// Source is the items compacted and evicted. dynamodb.ReadWriter implements it.
+type Source interface {
+	ScanItems(fn func([]*dynamodb.Item) error) error
+	Evict(item *dynamodb.Item) error
+}
+
+var _ Source = &dynamodb.DynamoDB{}
+
+// BlockWriter writes and expires the blocks of the cold tier. cold.ReadWriter
+// implements it.
+type BlockWriter interface {
+	WriteBlock(step, partition int64, series map[string]map[int64]*model.Aggregate) error
+	Expire(now time.Time) (int, error)
+}
+
+var _ BlockWriter = &cold.Cold{}
+
+// Locker is the lock to elect the node which compacts. redis.ReadWriter implements it.
+type Locker interface {
+	AcquireLock(key string, owner string, ttl time.Duration) (bool, error)
+	ReleaseLock(key string, owner string) error
+}
+
+var _ Locker = &redis.Redis{}
+
+// Compactor compacts the old DynamoDB items into the blocks of the cold tier
+// periodically, and evicts them from DynamoDB once the blocks are written. Only
+// the node holding the lock compacts at a time, so it can run on every node.
+type Compactor struct {
+	source   Source
+	cold     BlockWriter
+	locker   Locker
+	owner    string
+	interval time.Duration
+	age      time.Duration
+	lockTTL  time.Duration
+	maxItems int
+
+	done chan struct{}
+	// mu is held while compacting to wait for the compaction in progress on shutdown.
+	mu sync.Mutex
+
+	compactions uint64
+	blocks      uint64
+	evicted     uint64
+	expired     uint64
+	failed      uint64
+}
+
+// Stats represents the counters of the Compactor.
+type Stats struct {
+	Compactions uint64 `json:"compactions"`
+	Blocks      uint64 `json:"blocks"`
+	Evicted     uint64 `json:"evicted"`
+	Expired     uint64 `json:"expired"`
+	Failed      uint64 `json:"failed"`
+}
+
+// Option for the Compactor.
+type Option struct {
+	Source   Source
+	Cold     BlockWriter
+	Locker   Locker
+	Interval time.Duration
+	Age      time.Duration
+	LockTTL  time.Duration
+	MaxItems int
+}
+
+// New creates a new Compactor.
+func New(o *Option) *Compactor {
+	c := &Compactor{
+		source:   o.Source,
+		cold:     o.Cold,
+		locker:   o.Locker,
+		owner:    newOwner(),
+		interval: o.Interval,
+		age:      o.Age,
+		lockTTL:  o.LockTTL,
+		maxItems: o.MaxItems,
+		done:     make(chan struct{}),
+	}
+	if c.interval <= 0 {
+		c.interval = DefaultInterval
+	}
+	if c.age <= 0 {
+		c.age = DefaultAge
+	}
+	if c.lockTTL <= 0 {
+		c.lockTTL = DefaultLockTTL
+	}
+	if c.maxItems <= 0 {
+		c.maxItems = DefaultMaxItems
+	}
+	return c
+}
+
+// newOwner returns the identifier of the lock owner unique among the nodes.
+func newOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d:%d", host, os.Getpid(), rand.New(rand.NewSource(time.Now().UnixNano())).Int63())
+}
+
+// Run compacts every interval until Shutdown is called.
+func (c *Compactor) Run() error {
+	log.Printf("Compacting the items older than %s every %s\n", c.age, c.interval)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Compact(time.Now())
+		case <-c.done:
+			return nil
+		}
+	}
+}
+
+// Shutdown stops compacting and waits for the compaction in progress.
+func (c *Compactor) Shutdown(sig os.Signal) error {
+	log.Printf("Received %s shutdown compactor...\n", sig)
+	close(c.done)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return nil
+}
+
+// Stats returns the snapshot of the counters.
+func (c *Compactor) Stats() Stats {
+	return Stats{
+		Compactions: atomic.LoadUint64(&c.compactions),
+		Blocks:      atomic.LoadUint64(&c.blocks),
+		Evicted:     atomic.LoadUint64(&c.evicted),
+		Expired:     atomic.LoadUint64(&c.expired),
+		Failed:      atomic.LoadUint64(&c.failed),
+	}
+}
+
+// Compact compacts the old items and expires the old partitions of the cold
+// tier if it acquires the lock. It returns false if
+// another node holds the lock.
+func (c *Compactor) Compact(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ok, err := c.locker.AcquireLock(LockKey, c.owner, c.lockTTL)
+	if err != nil {
+		log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+		return false
+	}
+	if !ok {
+		return false
+	}
+	defer func() {
+		if err := c.locker.ReleaseLock(LockKey, c.owner); err != nil {
+			log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+		}
+	}()
+
+	// Extend the lock while compacting so that no other node starts compacting.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(c.lockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := c.locker.AcquireLock(LockKey, c.owner, c.lockTTL); err != nil {
+					log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	atomic.AddUint64(&c.compactions, 1)
+	n, err := c.compact(now)
+	if err != nil {
+		atomic.AddUint64(&c.failed, 1)
+		log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+	}
+	if n > 0 {
+		log.Printf("Compacted %d items into the cold tier\n", n)
+	}
+
+	expired, err := c.cold.Expire(now)
+	if err != nil {
+		atomic.AddUint64(&c.failed, 1)
+		log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+	}
+	atomic.AddUint64(&c.expired, uint64(expired))
+	if expired > 0 {
+		log.Printf("Expired %d partitions of the cold tier\n", expired)
+	}
+	return true
+}
+
+// block is the key of a block, which is the partition of the step.
+type block struct {
+	step      int64
+	partition int64
+}
+
+// compact collects the items whose all the datapoints are older than the age,
+// writes them into the blocks by partition, and evicts the items whose blocks
+// are all written. An item is compacted again later if it fails to write a
+// block or evict it, which is read once with the same aggregates of the block
+// written before. It returns the number of the evicted items.
+func (c *Compactor) compact(now time.Time) (int, error) {
+	cutoff := now.Add(-c.age).Unix()
+	var items []*dynamodb.Item
+	err := c.source.ScanItems(func(page []*dynamodb.Item) error {
+		for _, item := range page {
+			if len(item.Points) == 0 || item.ItemEpoch+schema.ItemEpochStep(item.Step) > cutoff {
+				continue
+			}
+			items = append(items, item)
+			if len(items) >= c.maxItems {
+				return errEnough
+			}
+		}
+		return nil
+	})
+	if err != nil && err != errEnough {
+		return 0, err
+	}
+
+	blocks := map[block]map[string]map[int64]*model.Aggregate{}
+	for _, item := range items {
+		for t, a := range item.Points {
+			b := block{step: item.Step, partition: cold.Partition(item.Step, t)}
+			if _, ok := blocks[b]; !ok {
+				blocks[b] = map[string]map[int64]*model.Aggregate{}
+			}
+			if _, ok := blocks[b][item.Name]; !ok {
+				blocks[b][item.Name] = map[int64]*model.Aggregate{}
+			}
+			blocks[b][item.Name][t] = a
+		}
+	}
+
+	var firstErr error
+	failed := map[block]bool{}
+	for b, series := range blocks {
+		if err := c.cold.WriteBlock(b.step, b.partition, series); err != nil {
+			failed[b] = true
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		atomic.AddUint64(&c.blocks, 1)
+	}
+
+	evicted := 0
+	for _, item := range items {
+		written := true
+		for t := range item.Points {
+			if failed[block{step: item.Step, partition: cold.Partition(item.Step, t)}] {
+				written = false
+				break
+			}
+		}
+		if !written {
+			continue
+		}
+		if err := c.source.Evict(item); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		evicted++
+	}
+	atomic.AddUint64(&c.evicted, uint64(evicted))
+	return evicted, firstErr
+}
@@ -0,0 +1,174 @@
+package compactor
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/cold"
+	"github.com/yuuki/diamondb/pkg/storage/dynamodb"
+)
+
+// fakeSource is the items on the fake DynamoDB.
+type fakeSource struct {
+	items   []*dynamodb.Item
+	evicted []string
+}
+
+func (s *fakeSource) ScanItems(fn func([]*dynamodb.Item) error) error {
+	// One item per page
+	for _, item := range s.items {
+		if err := fn([]*dynamodb.Item{item}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fakeSource) Evict(item *dynamodb.Item) error {
+	s.evicted = append(s.evicted, item.Name)
+	return nil
+}
+
+// fakeLocker is the in-memory lock ignoring the expiration.
+type fakeLocker struct {
+	mu    sync.Mutex
+	owner string
+}
+
+func (l *fakeLocker) AcquireLock(key string, owner string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.owner != "" && l.owner != owner {
+		return false, nil
+	}
+	l.owner = owner
+	return true, nil
+}
+
+func (l *fakeLocker) ReleaseLock(key string, owner string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.owner == owner {
+		l.owner = ""
+	}
+	return nil
+}
+
+func TestCompactorCompact(t *testing.T) {
+	day := int64(86400)
+	now := time.Unix(100*day, 0)
+	source := &fakeSource{
+		items: []*dynamodb.Item{
+			dynamodb.NewTestItem("server1.loadavg5", 0, 60, map[int64]*model.Aggregate{
+				60:  model.NewAggregate(60, 0.1),
+				120: model.NewAggregate(120, 0.2),
+			}),
+			dynamodb.NewTestItem("server2.loadavg5", 3600, 60, map[int64]*model.Aggregate{
+				3600: model.NewAggregate(3600, 1.1),
+			}),
+			dynamodb.NewTestItem("server1.loadavg5", 0, 3600, map[int64]*model.Aggregate{
+				day: {Min: 1, Max: 2, Sum: 3, Count: 2, Last: 2, LastTimestamp: day + 60, RolledUp: true},
+			}),
+			// The item not old enough
+			dynamodb.NewTestItem("server3.loadavg5", 99*day, 60, map[int64]*model.Aggregate{
+				99 * day: model.NewAggregate(99*day, 3.1),
+			}),
+		},
+	}
+	written := map[block]map[string]map[int64]*model.Aggregate{}
+	writer := &cold.FakeReadWriter{
+		FakeWriteBlock: func(step, partition int64, series map[string]map[int64]*model.Aggregate) error {
+			if step == 3600 {
+				return errors.New("failed to write block")
+			}
+			written[block{step: step, partition: partition}] = series
+			return nil
+		},
+		FakeExpire: func(now time.Time) (int, error) {
+			return 2, nil
+		},
+	}
+	locker := &fakeLocker{}
+	c := New(&Option{Source: source, Cold: writer, Locker: locker, Age: 7 * 24 * time.Hour})
+
+	if !c.Compact(now) {
+		t.Fatal("should compact with the lock")
+	}
+	if locker.owner != "" {
+		t.Fatalf("lock should be released, but held by %s", locker.owner)
+	}
+	expected := map[block]map[string]map[int64]*model.Aggregate{
+		{step: 60, partition: 0}: {
+			"server1.loadavg5": {
+				60:  model.NewAggregate(60, 0.1),
+				120: model.NewAggregate(120, 0.2),
+			},
+			"server2.loadavg5": {
+				3600: model.NewAggregate(3600, 1.1),
+			},
+		},
+	}
+	if diff := pretty.Compare(written, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	// The item of the block failed to write is not evicted.
+	if diff := pretty.Compare(source.evicted, []string{"server1.loadavg5", "server2.loadavg5"}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	if diff := pretty.Compare(c.Stats(), Stats{Compactions: 1, Blocks: 1, Evicted: 2, Expired: 2, Failed: 1}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	// Another node holds the lock.
+	locker.owner = "other"
+	if c.Compact(now) {
+		t.Fatal("should not compact without the lock")
+	}
+}
+
+func TestCompactorCompact_MaxItems(t *testing.T) {
+	source := &fakeSource{}
+	for i := int64(0); i < 5; i++ {
+		source.items = append(source.items, dynamodb.NewTestItem("server1.loadavg5", i*3600, 60, map[int64]*model.Aggregate{
+			i * 3600: model.NewAggregate(i*3600, 0.1),
+		}))
+	}
+	writer := &cold.FakeReadWriter{
+		FakeWriteBlock: func(step, partition int64, series map[string]map[int64]*model.Aggregate) error {
+			return nil
+		},
+		FakeExpire: func(now time.Time) (int, error) {
+			return 0, nil
+		},
+	}
+	c := New(&Option{Source: source, Cold: writer, Locker: &fakeLocker{}, MaxItems: 3})
+	c.Compact(time.Unix(100*86400, 0))
+	if len(source.evicted) != 3 {
+		t.Fatalf("should evict 3 items, not %d", len(source.evicted))
+	}
+	if c.Stats().Failed != 0 {
+		t.Fatal("should not fail to stop scanning at MaxItems")
+	}
+}
+
+func TestCompactorRun(t *testing.T) {
+	writer := &cold.FakeReadWriter{
+		FakeExpire: func(now time.Time) (int, error) {
+			return 0, nil
+		},
+	}
+	c := New(&Option{Source: &fakeSource{}, Cold: writer, Locker: &fakeLocker{}, Interval: 10 * time.Millisecond})
+	go c.Run()
+	time.Sleep(50 * time.Millisecond)
+	if err := c.Shutdown(nil); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if c.Stats().Compactions == 0 {
+		t.Fatal("should compact periodically")
+	}
+}
@@ -7,24 +7,87 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/storage/schema"
 )
 
 type config struct {
-	ShutdownTimeout                 time.Duration  `json:"shutdown_timeout"`
-	HTTPRenderTimeout               time.Duration  `json:"http_render_timeout"`
-	TimeZoneName                    string         `json:"timezone"`
-	TimeZone                        *time.Location `json:"-"`
-	RedisCluster                    bool           `json:"redis_cluster"`
-	RedisAddrs                      []string       `json:"redis_addrs"`
-	RedisPassword                   string         `json:"-"`
-	RedisDB                         int            `json:"redis_db"`
-	RedisPoolSize                   int            `json:"redis_pool_size"`
-	DynamoDBRegion                  string         `json:"dynamodb_region"`
-	DynamoDBEndpoint                string         `json:"dynamodb_endpoint"`
-	DynamoDBTableName               string         `json:"dynamodb_table_name"`
-	DynamoDBTableReadCapacityUnits  int64          `json:"dynamodb_table_read_capacity_units"`
-	DynamoDBTableWriteCapacityUnits int64          `json:"dynamodb_table_write_capacity_units"`
-	DynamoDBTTL                     bool           `json:"dynamodb_ttl"`
+	ShutdownTimeout                 time.Duration       `json:"shutdown_timeout"`
+	HTTPRenderTimeout               time.Duration       `json:"http_render_timeout"`
+	HTTPWriteConcurrency            int                 `json:"http_write_concurrency"`
+	TimeZoneName                    string              `json:"timezone"`
+	TimeZone                        *time.Location      `json:"-"`
+	RedisCluster                    bool                `json:"redis_cluster"`
+	RedisAddrs                      []string            `json:"redis_addrs"`
+	RedisPassword                   string              `json:"-"`
+	RedisDB                         int                 `json:"redis_db"`
+	RedisPoolSize                   int                 `json:"redis_pool_size"`
+	RedisBufferEncoding             string              `json:"redis_buffer_encoding"`
+	DynamoDBRegion                  string              `json:"dynamodb_region"`
+	DynamoDBEndpoint                string              `json:"dynamodb_endpoint"`
+	DynamoDBTableName               string              `json:"dynamodb_table_name"`
+	DynamoDBTableReadCapacityUnits  int64               `json:"dynamodb_table_read_capacity_units"`
+	DynamoDBTableWriteCapacityUnits int64               `json:"dynamodb_table_write_capacity_units"`
+	DynamoDBTTL                     bool                `json:"dynamodb_ttl"`
+	DynamoDBValueEncoding           string              `json:"dynamodb_value_encoding"`
+	DynamoDBRetryBudget             int                 `json:"dynamodb_retry_budget"`
+	DynamoDBRequestTimeout          time.Duration       `json:"dynamodb_request_timeout"`
+	StorageSchemasFile              string              `json:"storage_schemas_file"`
+	StorageSchemas                  schema.Schemas      `json:"-"`
+	StorageAggregationFile          string              `json:"storage_aggregation_file"`
+	StorageAggregations             schema.Aggregations `json:"-"`
+	ColdStorage                     string              `json:"cold_storage"`
+	S3Region                        string              `json:"s3_region"`
+	S3Endpoint                      string              `json:"s3_endpoint"`
+	Queue                           string              `json:"queue"`
+	QueueFileDir                    string              `json:"queue_file_dir"`
+	QueueCheckpointFile             string              `json:"queue_checkpoint_file"`
+	QueueBatchSize                  int                 `json:"queue_batch_size"`
+	QueueConsumer                   bool                `json:"queue_consumer"`
+	ValidationInvalidChars          string              `json:"validation_invalid_chars"`
+	ValidationMaxNameLength         int                 `json:"validation_max_name_length"`
+	ValidationMaxNameDepth          int                 `json:"validation_max_name_depth"`
+	ValidationMaxPast               time.Duration       `json:"validation_max_past"`
+	ValidationMaxFuture             time.Duration       `json:"validation_max_future"`
+	ValidationZeroTimestamp         string              `json:"validation_zero_timestamp"`
+	ValidationNaN                   string              `json:"validation_nan"`
+	RouteByFlushed                  bool                `json:"route_by_flushed"`
+	Flusher                         bool                `json:"flusher"`
+	FlusherInterval                 time.Duration       `json:"flusher_interval"`
+	FlusherIdleAge                  time.Duration       `json:"flusher_idle_age"`
+	FlusherLockTTL                  time.Duration       `json:"flusher_lock_ttl"`
+	Compactor                       bool                `json:"compactor"`
+	CompactorInterval               time.Duration       `json:"compactor_interval"`
+	CompactorAge                    time.Duration       `json:"compactor_age"`
+	CompactorLockTTL                time.Duration       `json:"compactor_lock_ttl"`
+	CompactorMaxItems               int                 `json:"compactor_max_items"`
+	StorageBackend                  string              `json:"storage_backend"`
+	EmbeddedDir                     string              `json:"embedded_dir"`
+	EmbeddedFlushInterval           time.Duration       `json:"embedded_flush_interval"`
+	WALDir                          string              `json:"wal_dir"`
+	WALSegmentSize                  int64               `json:"wal_segment_size"`
+	WALSync                         string              `json:"wal_sync"`
+	WALSyncInterval                 time.Duration       `json:"wal_sync_interval"`
+	KinesisStreamName               string              `json:"kinesis_stream_name"`
+	KinesisRegion                   string              `json:"kinesis_region"`
+	KinesisEndpoint                 string              `json:"kinesis_endpoint"`
+	PrometheusNameTemplate          string              `json:"prometheus_name_template"`
+	InfluxDBNameTemplate            string              `json:"influxdb_name_template"`
+	OTLPNameTemplate                string              `json:"otlp_name_template"`
+	CarbonTCPAddr                   string              `json:"carbon_tcp_addr"`
+	CarbonUDPAddr                   string              `json:"carbon_udp_addr"`
+	CarbonFlushInterval             time.Duration       `json:"carbon_flush_interval"`
+	OpenTSDBTelnetAddr              string              `json:"opentsdb_telnet_addr"`
+	OpenTSDBFlushInterval           time.Duration       `json:"opentsdb_flush_interval"`
+	StatsdAddr                      string              `json:"statsd_addr"`
+	StatsdFlushInterval             time.Duration       `json:"statsd_flush_interval"`
+	StatsdPercentiles               []float64           `json:"statsd_percentiles"`
+	StatsdGaugeIdleAge              time.Duration       `json:"statsd_gauge_idle_age"`
+	CollectdAddr                    string              `json:"collectd_addr"`
+	CollectdFlushInterval           time.Duration       `json:"collectd_flush_interval"`
+	CollectdSecurityLevel           string              `json:"collectd_security_level"`
+	CollectdAuthFile                string              `json:"collectd_auth_file"`
+	CollectdTypesDB                 []string            `json:"collectd_typesdb"`
 
 	Debug bool `json:"debug"`
 }
@@ -36,6 +99,8 @@ const (
 	DefaultShutdownTimeout = 10 * time.Second
 	// DefaultHTTPRenderTimeout is the default timeout seconds for /render.
 	DefaultHTTPRenderTimeout = 30 * time.Second
+	// DefaultHTTPWriteConcurrency is the default number of workers to insert metrics of /datapoints/batch.
+	DefaultHTTPWriteConcurrency = 16
 	// DefaultTimeZone is the default timezone.
 	DefaultTimeZone = "UTC"
 	// DefaultRedisAddr is the port to connect to redis-server process.
@@ -46,6 +111,8 @@ const (
 	DefaultRedisDB = 0
 	// DefaultRedisPoolSize is the redis pool size.
 	DefaultRedisPoolSize = 50
+	// DefaultRedisBufferEncoding is the encoding of the datapoints buffered into Redis.
+	DefaultRedisBufferEncoding = "hash"
 	// DefaultDynamoDBRegion is the DynamoDB region.
 	DefaultDynamoDBRegion = "ap-northeast-1"
 	// DefaultDynamoDBTableName is the name of DynamoDB table.
@@ -56,6 +123,77 @@ const (
 	DefaultDynamoDBTableWriteCapacityUnits int64 = 5
 	// DefaultDynamoDBTTL is the flag of enabling DynamoDB TTL
 	DefaultDynamoDBTTL = true
+	// DefaultDynamoDBValueEncoding is the encoding of the datapoints written into DynamoDB.
+	DefaultDynamoDBValueEncoding = "plain"
+	// DefaultDynamoDBRetryBudget is the number of the retries of the throttled calls to DynamoDB per request.
+	DefaultDynamoDBRetryBudget = 10
+	// DefaultDynamoDBRequestTimeout is the total time of the calls to DynamoDB per request including the retries.
+	DefaultDynamoDBRequestTimeout = 10 * time.Second
+	// DefaultQueueFileDir is the directory of the file-backed ingestion queue.
+	DefaultQueueFileDir = "diamondb-queue"
+	// DefaultQueueCheckpointFile is the file to store the checkpoints of the queue consumer.
+	DefaultQueueCheckpointFile = "diamondb-queue-checkpoint.json"
+	// DefaultQueueBatchSize is the number of records read at once by the queue consumer.
+	DefaultQueueBatchSize = 500
+	// DefaultValidationInvalidChars is the policy for the invalid characters in a metric name.
+	DefaultValidationInvalidChars = "reject"
+	// DefaultValidationMaxNameLength is the maximum length of a metric name in bytes.
+	DefaultValidationMaxNameLength = 1024
+	// DefaultValidationMaxNameDepth is the maximum number of the nodes of a metric name.
+	DefaultValidationMaxNameDepth = 0
+	// DefaultValidationMaxPast is the oldest timestamp accepted relative to now.
+	DefaultValidationMaxPast = 0
+	// DefaultValidationMaxFuture is the latest timestamp accepted relative to now.
+	DefaultValidationMaxFuture = 1 * time.Hour
+	// DefaultValidationZeroTimestamp is the policy for the datapoints with the timestamp 0.
+	DefaultValidationZeroTimestamp = "now"
+	// DefaultValidationNaN is the policy for the datapoints with NaN or Inf.
+	DefaultValidationNaN = "reject"
+	// DefaultFlusherInterval is the interval to sweep the series left in Redis.
+	DefaultFlusherInterval = 1 * time.Minute
+	// DefaultFlusherIdleAge is the age of the latest datapoint to regard a series as idle.
+	DefaultFlusherIdleAge = 1 * time.Hour
+	// DefaultFlusherLockTTL is the expiration of the Redis lock to elect the flusher.
+	DefaultFlusherLockTTL = 1 * time.Minute
+	// DefaultCompactorInterval is the interval to compact the DynamoDB items into the cold storage.
+	DefaultCompactorInterval = 1 * time.Hour
+	// DefaultCompactorAge is the age of the DynamoDB items compacted into the cold storage.
+	DefaultCompactorAge = 7 * 24 * time.Hour
+	// DefaultCompactorLockTTL is the expiration of the Redis lock to elect the compactor.
+	DefaultCompactorLockTTL = 1 * time.Minute
+	// DefaultCompactorMaxItems is the maximum number of the DynamoDB items compacted at once.
+	DefaultCompactorMaxItems = 10000
+	// DefaultStorageBackend is the backend storing the datapoints on Redis and DynamoDB.
+	DefaultStorageBackend = "redis-dynamodb"
+	// DefaultEmbeddedDir is the directory of the embedded storage backend.
+	DefaultEmbeddedDir = "diamondb-data"
+	// DefaultEmbeddedFlushInterval is the interval to flush the memtable of the embedded storage backend.
+	DefaultEmbeddedFlushInterval = 1 * time.Minute
+	// DefaultWALSegmentSize is the size in bytes to rotate the segment of the write-ahead log.
+	DefaultWALSegmentSize int64 = 64 * 1024 * 1024
+	// DefaultWALSync is the policy to fsync the write-ahead log.
+	DefaultWALSync = "interval"
+	// DefaultWALSyncInterval is the interval to fsync the write-ahead log with the 'interval' policy.
+	DefaultWALSyncInterval = 1 * time.Second
+	// DefaultKinesisStreamName is the name of the Kinesis stream provisioned by _cloudformation/storage.
+	DefaultKinesisStreamName = "diamondb-storage"
+	// DefaultCarbonFlushInterval is the interval to write the datapoints buffered by carbon listeners.
+	DefaultCarbonFlushInterval = 1 * time.Second
+	// DefaultOpenTSDBFlushInterval is the interval to write the datapoints buffered by the OpenTSDB telnet listener.
+	DefaultOpenTSDBFlushInterval = 1 * time.Second
+	// DefaultStatsdFlushInterval is the interval to write the series aggregated by the statsd listener.
+	DefaultStatsdFlushInterval = 10 * time.Second
+	// DefaultStatsdGaugeIdleAge is the age after which the gauges not updated stop being written.
+	DefaultStatsdGaugeIdleAge = 1 * time.Hour
+	// DefaultCollectdFlushInterval is the interval to write the datapoints buffered by the collectd listener.
+	DefaultCollectdFlushInterval = 1 * time.Second
+	// DefaultCollectdSecurityLevel is the minimum security level of the collectd packets.
+	DefaultCollectdSecurityLevel = "none"
+)
+
+var (
+	// DefaultStatsdPercentiles is the default percentiles calculated for statsd timers.
+	DefaultStatsdPercentiles = []float64{90}
 )
 
 // Config is set from the environment variables.
@@ -84,6 +222,17 @@ func Load() error {
 		Config.HTTPRenderTimeout = time.Duration(v) * time.Second
 	}
 
+	writeConcurrency := os.Getenv("DIAMONDB_HTTP_WRITE_CONCURRENCY")
+	if writeConcurrency == "" {
+		Config.HTTPWriteConcurrency = DefaultHTTPWriteConcurrency
+	} else {
+		v, err := strconv.Atoi(writeConcurrency)
+		if err != nil || v < 1 {
+			return errors.New("DIAMONDB_HTTP_WRITE_CONCURRENCY must be a positive integer")
+		}
+		Config.HTTPWriteConcurrency = v
+	}
+
 	Config.TimeZoneName = os.Getenv("DIAMONDB_TIMEZONE")
 	if Config.TimeZoneName == "" {
 		Config.TimeZone, _ = time.LoadLocation(DefaultTimeZone)
@@ -126,6 +275,16 @@ func Load() error {
 		}
 		Config.RedisPoolSize = v
 	}
+	// The nodes of this version read and convert the keys of both encodings, so
+	// 'blob' should be enabled after all the nodes are upgraded.
+	Config.RedisBufferEncoding = os.Getenv("DIAMONDB_REDIS_BUFFER_ENCODING")
+	switch Config.RedisBufferEncoding {
+	case "":
+		Config.RedisBufferEncoding = DefaultRedisBufferEncoding
+	case "hash", "blob":
+	default:
+		return errors.New("DIAMONDB_REDIS_BUFFER_ENCODING must be 'hash' or 'blob'")
+	}
 	Config.DynamoDBRegion = os.Getenv("DIAMONDB_DYNAMODB_REGION")
 	if Config.DynamoDBRegion == "" {
 		Config.DynamoDBRegion = DefaultDynamoDBRegion
@@ -160,6 +319,390 @@ func Load() error {
 	if v := os.Getenv("DIAMONDB_DYNAMODB_DISABLE_TTL"); v != "" {
 		Config.DynamoDBTTL = false
 	}
+	// The nodes of this version read both encodings, so 'gorilla' should be
+	// enabled after all the nodes are upgraded.
+	Config.DynamoDBValueEncoding = os.Getenv("DIAMONDB_DYNAMODB_VALUE_ENCODING")
+	switch Config.DynamoDBValueEncoding {
+	case "":
+		Config.DynamoDBValueEncoding = DefaultDynamoDBValueEncoding
+	case "plain", "gorilla":
+	default:
+		return errors.New("DIAMONDB_DYNAMODB_VALUE_ENCODING must be 'plain' or 'gorilla'")
+	}
+	retryBudget := os.Getenv("DIAMONDB_DYNAMODB_RETRY_BUDGET")
+	if retryBudget == "" {
+		Config.DynamoDBRetryBudget = DefaultDynamoDBRetryBudget
+	} else {
+		v, err := strconv.Atoi(retryBudget)
+		if err != nil || v < 0 {
+			return errors.New("DIAMONDB_DYNAMODB_RETRY_BUDGET must be a non-negative integer")
+		}
+		Config.DynamoDBRetryBudget = v
+	}
+	requestTimeout := os.Getenv("DIAMONDB_DYNAMODB_REQUEST_TIMEOUT")
+	if requestTimeout == "" {
+		Config.DynamoDBRequestTimeout = DefaultDynamoDBRequestTimeout
+	} else {
+		v, err := strconv.Atoi(requestTimeout)
+		if err != nil || v < 1 {
+			return errors.New("DIAMONDB_DYNAMODB_REQUEST_TIMEOUT must be a positive integer")
+		}
+		Config.DynamoDBRequestTimeout = time.Duration(v) * time.Second
+	}
+	Config.StorageSchemasFile = os.Getenv("DIAMONDB_STORAGE_SCHEMAS_FILE")
+	if Config.StorageSchemasFile != "" {
+		ss, err := schema.Load(Config.StorageSchemasFile)
+		if err != nil {
+			return errors.Wrap(err, "DIAMONDB_STORAGE_SCHEMAS_FILE must be a storage-schemas.conf")
+		}
+		Config.StorageSchemas = ss
+	}
+	Config.StorageAggregationFile = os.Getenv("DIAMONDB_STORAGE_AGGREGATION_FILE")
+	if Config.StorageAggregationFile != "" {
+		as, err := schema.LoadAggregations(Config.StorageAggregationFile)
+		if err != nil {
+			return errors.Wrap(err, "DIAMONDB_STORAGE_AGGREGATION_FILE must be a storage-aggregation.conf")
+		}
+		Config.StorageAggregations = as
+	}
+	Config.ColdStorage = os.Getenv("DIAMONDB_COLD_STORAGE")
+	Config.S3Region = os.Getenv("DIAMONDB_S3_REGION")
+	if Config.S3Region == "" {
+		Config.S3Region = Config.DynamoDBRegion
+	}
+	Config.S3Endpoint = os.Getenv("DIAMONDB_S3_ENDPOINT")
+
+	Config.Queue = os.Getenv("DIAMONDB_QUEUE")
+	switch Config.Queue {
+	case "", "kinesis", "file":
+	default:
+		return errors.New("DIAMONDB_QUEUE must be 'kinesis' or 'file'")
+	}
+	Config.QueueFileDir = os.Getenv("DIAMONDB_QUEUE_FILE_DIR")
+	if Config.QueueFileDir == "" {
+		Config.QueueFileDir = DefaultQueueFileDir
+	}
+	Config.QueueCheckpointFile = os.Getenv("DIAMONDB_QUEUE_CHECKPOINT_FILE")
+	if Config.QueueCheckpointFile == "" {
+		Config.QueueCheckpointFile = DefaultQueueCheckpointFile
+	}
+	queueBatchSize := os.Getenv("DIAMONDB_QUEUE_BATCH_SIZE")
+	if queueBatchSize == "" {
+		Config.QueueBatchSize = DefaultQueueBatchSize
+	} else {
+		v, err := strconv.Atoi(queueBatchSize)
+		if err != nil || v < 1 {
+			return errors.New("DIAMONDB_QUEUE_BATCH_SIZE must be a positive integer")
+		}
+		Config.QueueBatchSize = v
+	}
+	Config.QueueConsumer = Config.Queue != ""
+	if v := os.Getenv("DIAMONDB_QUEUE_DISABLE_CONSUMER"); v != "" {
+		Config.QueueConsumer = false
+	}
+	Config.ValidationInvalidChars = os.Getenv("DIAMONDB_VALIDATION_INVALID_CHARS")
+	switch Config.ValidationInvalidChars {
+	case "":
+		Config.ValidationInvalidChars = DefaultValidationInvalidChars
+	case "reject", "sanitize":
+	default:
+		return errors.New("DIAMONDB_VALIDATION_INVALID_CHARS must be 'reject' or 'sanitize'")
+	}
+	maxNameLength := os.Getenv("DIAMONDB_VALIDATION_MAX_NAME_LENGTH")
+	if maxNameLength == "" {
+		Config.ValidationMaxNameLength = DefaultValidationMaxNameLength
+	} else {
+		v, err := strconv.Atoi(maxNameLength)
+		if err != nil || v < 0 {
+			return errors.New("DIAMONDB_VALIDATION_MAX_NAME_LENGTH must be a non-negative integer")
+		}
+		Config.ValidationMaxNameLength = v
+	}
+	maxNameDepth := os.Getenv("DIAMONDB_VALIDATION_MAX_NAME_DEPTH")
+	if maxNameDepth == "" {
+		Config.ValidationMaxNameDepth = DefaultValidationMaxNameDepth
+	} else {
+		v, err := strconv.Atoi(maxNameDepth)
+		if err != nil || v < 0 {
+			return errors.New("DIAMONDB_VALIDATION_MAX_NAME_DEPTH must be a non-negative integer")
+		}
+		Config.ValidationMaxNameDepth = v
+	}
+	maxPast := os.Getenv("DIAMONDB_VALIDATION_MAX_PAST")
+	if maxPast == "" {
+		Config.ValidationMaxPast = DefaultValidationMaxPast
+	} else {
+		v, err := strconv.Atoi(maxPast)
+		if err != nil || v < 0 {
+			return errors.New("DIAMONDB_VALIDATION_MAX_PAST must be a non-negative integer")
+		}
+		Config.ValidationMaxPast = time.Duration(v) * time.Second
+	}
+	maxFuture := os.Getenv("DIAMONDB_VALIDATION_MAX_FUTURE")
+	if maxFuture == "" {
+		Config.ValidationMaxFuture = DefaultValidationMaxFuture
+	} else {
+		v, err := strconv.Atoi(maxFuture)
+		if err != nil || v < 0 {
+			return errors.New("DIAMONDB_VALIDATION_MAX_FUTURE must be a non-negative integer")
+		}
+		Config.ValidationMaxFuture = time.Duration(v) * time.Second
+	}
+	Config.ValidationZeroTimestamp = os.Getenv("DIAMONDB_VALIDATION_ZERO_TIMESTAMP")
+	switch Config.ValidationZeroTimestamp {
+	case "":
+		Config.ValidationZeroTimestamp = DefaultValidationZeroTimestamp
+	case "reject", "now":
+	default:
+		return errors.New("DIAMONDB_VALIDATION_ZERO_TIMESTAMP must be 'reject' or 'now'")
+	}
+	Config.ValidationNaN = os.Getenv("DIAMONDB_VALIDATION_NAN")
+	switch Config.ValidationNaN {
+	case "":
+		Config.ValidationNaN = DefaultValidationNaN
+	case "reject", "drop":
+	default:
+		return errors.New("DIAMONDB_VALIDATION_NAN must be 'reject' or 'drop'")
+	}
+	// The fetches from DynamoDB are narrowed to the timestamps flushed out of
+	// Redis unless it is disabled, which is needed while backfilling the older
+	// datapoints of the series flushed before the timestamps were recorded.
+	Config.RouteByFlushed = os.Getenv("DIAMONDB_DISABLE_ROUTE_BY_FLUSHED") == ""
+	if v := os.Getenv("DIAMONDB_ENABLE_FLUSHER"); v != "" {
+		Config.Flusher = true
+	}
+	flusherInterval := os.Getenv("DIAMONDB_FLUSHER_INTERVAL")
+	if flusherInterval == "" {
+		Config.FlusherInterval = DefaultFlusherInterval
+	} else {
+		v, err := strconv.Atoi(flusherInterval)
+		if err != nil || v < 1 {
+			return errors.New("DIAMONDB_FLUSHER_INTERVAL must be a positive integer")
+		}
+		Config.FlusherInterval = time.Duration(v) * time.Second
+	}
+	flusherIdleAge := os.Getenv("DIAMONDB_FLUSHER_IDLE_AGE")
+	if flusherIdleAge == "" {
+		Config.FlusherIdleAge = DefaultFlusherIdleAge
+	} else {
+		v, err := strconv.Atoi(flusherIdleAge)
+		if err != nil || v < 1 {
+			return errors.New("DIAMONDB_FLUSHER_IDLE_AGE must be a positive integer")
+		}
+		Config.FlusherIdleAge = time.Duration(v) * time.Second
+	}
+	flusherLockTTL := os.Getenv("DIAMONDB_FLUSHER_LOCK_TTL")
+	if flusherLockTTL == "" {
+		Config.FlusherLockTTL = DefaultFlusherLockTTL
+	} else {
+		v, err := strconv.Atoi(flusherLockTTL)
+		if err != nil || v < 1 {
+			return errors.New("DIAMONDB_FLUSHER_LOCK_TTL must be a positive integer")
+		}
+		Config.FlusherLockTTL = time.Duration(v) * time.Second
+	}
+	if v := os.Getenv("DIAMONDB_ENABLE_COMPACTOR"); v != "" {
+		Config.Compactor = true
+	}
+	compactorInterval := os.Getenv("DIAMONDB_COMPACTOR_INTERVAL")
+	if compactorInterval == "" {
+		Config.CompactorInterval = DefaultCompactorInterval
+	} else {
+		v, err := strconv.Atoi(compactorInterval)
+		if err != nil || v < 1 {
+			return errors.New("DIAMONDB_COMPACTOR_INTERVAL must be a positive integer")
+		}
+		Config.CompactorInterval = time.Duration(v) * time.Second
+	}
+	compactorAge := os.Getenv("DIAMONDB_COMPACTOR_AGE")
+	if compactorAge == "" {
+		Config.CompactorAge = DefaultCompactorAge
+	} else {
+		v, err := strconv.Atoi(compactorAge)
+		if err != nil || v < 1 {
+			return errors.New("DIAMONDB_COMPACTOR_AGE must be a positive integer")
+		}
+		Config.CompactorAge = time.Duration(v) * time.Second
+	}
+	compactorLockTTL := os.Getenv("DIAMONDB_COMPACTOR_LOCK_TTL")
+	if compactorLockTTL == "" {
+		Config.CompactorLockTTL = DefaultCompactorLockTTL
+	} else {
+		v, err := strconv.Atoi(compactorLockTTL)
+		if err != nil || v < 1 {
+			return errors.New("DIAMONDB_COMPACTOR_LOCK_TTL must be a positive integer")
+		}
+		Config.CompactorLockTTL = time.Duration(v) * time.Second
+	}
+	compactorMaxItems := os.Getenv("DIAMONDB_COMPACTOR_MAX_ITEMS")
+	if compactorMaxItems == "" {
+		Config.CompactorMaxItems = DefaultCompactorMaxItems
+	} else {
+		v, err := strconv.Atoi(compactorMaxItems)
+		if err != nil || v < 1 {
+			return errors.New("DIAMONDB_COMPACTOR_MAX_ITEMS must be a positive integer")
+		}
+		Config.CompactorMaxItems = v
+	}
+	if Config.Compactor && Config.ColdStorage == "" {
+		return errors.New("DIAMONDB_COLD_STORAGE must be set to enable the compactor")
+	}
+	Config.StorageBackend = os.Getenv("DIAMONDB_STORAGE_BACKEND")
+	switch Config.StorageBackend {
+	case "":
+		Config.StorageBackend = DefaultStorageBackend
+	case "redis-dynamodb", "embedded":
+	default:
+		return errors.New("DIAMONDB_STORAGE_BACKEND must be 'redis-dynamodb' or 'embedded'")
+	}
+	Config.EmbeddedDir = os.Getenv("DIAMONDB_EMBEDDED_DIR")
+	if Config.EmbeddedDir == "" {
+		Config.EmbeddedDir = DefaultEmbeddedDir
+	}
+	embeddedFlushInterval := os.Getenv("DIAMONDB_EMBEDDED_FLUSH_INTERVAL")
+	if embeddedFlushInterval == "" {
+		Config.EmbeddedFlushInterval = DefaultEmbeddedFlushInterval
+	} else {
+		v, err := strconv.Atoi(embeddedFlushInterval)
+		if err != nil || v < 1 {
+			return errors.New("DIAMONDB_EMBEDDED_FLUSH_INTERVAL must be a positive integer")
+		}
+		Config.EmbeddedFlushInterval = time.Duration(v) * time.Second
+	}
+	if Config.StorageBackend == "embedded" && (Config.Flusher || Config.Compactor) {
+		return errors.New("the flusher and the compactor are not available with the embedded storage backend")
+	}
+	Config.WALDir = os.Getenv("DIAMONDB_WAL_DIR")
+	if Config.StorageBackend == "embedded" && Config.WALDir != "" {
+		return errors.New("DIAMONDB_WAL_DIR is not available with the embedded storage backend, which has its own write-ahead log")
+	}
+	walSegmentSize := os.Getenv("DIAMONDB_WAL_SEGMENT_SIZE")
+	if walSegmentSize == "" {
+		Config.WALSegmentSize = DefaultWALSegmentSize
+	} else {
+		v, err := strconv.ParseInt(walSegmentSize, 10, 64)
+		if err != nil || v < 1 {
+			return errors.New("DIAMONDB_WAL_SEGMENT_SIZE must be a positive integer")
+		}
+		Config.WALSegmentSize = v
+	}
+	Config.WALSync = os.Getenv("DIAMONDB_WAL_SYNC")
+	switch Config.WALSync {
+	case "":
+		Config.WALSync = DefaultWALSync
+	case "always", "interval", "never":
+	default:
+		return errors.New("DIAMONDB_WAL_SYNC must be 'always', 'interval' or 'never'")
+	}
+	walSyncInterval := os.Getenv("DIAMONDB_WAL_SYNC_INTERVAL")
+	if walSyncInterval == "" {
+		Config.WALSyncInterval = DefaultWALSyncInterval
+	} else {
+		v, err := strconv.Atoi(walSyncInterval)
+		if err != nil || v < 1 {
+			return errors.New("DIAMONDB_WAL_SYNC_INTERVAL must be a positive integer")
+		}
+		Config.WALSyncInterval = time.Duration(v) * time.Second
+	}
+	Config.KinesisStreamName = os.Getenv("DIAMONDB_KINESIS_STREAM_NAME")
+	if Config.KinesisStreamName == "" {
+		Config.KinesisStreamName = DefaultKinesisStreamName
+	}
+	Config.KinesisRegion = os.Getenv("DIAMONDB_KINESIS_REGION")
+	if Config.KinesisRegion == "" {
+		Config.KinesisRegion = Config.DynamoDBRegion
+	}
+	Config.KinesisEndpoint = os.Getenv("DIAMONDB_KINESIS_ENDPOINT")
+
+	// The name templates are parsed at startup, and the empty ones are the default
+	// templates of each protocol.
+	Config.PrometheusNameTemplate = os.Getenv("DIAMONDB_PROMETHEUS_NAME_TEMPLATE")
+	Config.InfluxDBNameTemplate = os.Getenv("DIAMONDB_INFLUXDB_NAME_TEMPLATE")
+	Config.OTLPNameTemplate = os.Getenv("DIAMONDB_OTLP_NAME_TEMPLATE")
+	Config.CarbonTCPAddr = os.Getenv("DIAMONDB_CARBON_TCP_ADDR")
+	Config.CarbonUDPAddr = os.Getenv("DIAMONDB_CARBON_UDP_ADDR")
+	carbonFlushInterval := os.Getenv("DIAMONDB_CARBON_FLUSH_INTERVAL")
+	if carbonFlushInterval == "" {
+		Config.CarbonFlushInterval = DefaultCarbonFlushInterval
+	} else {
+		v, err := strconv.Atoi(carbonFlushInterval)
+		if err != nil || v < 1 {
+			return errors.New("DIAMONDB_CARBON_FLUSH_INTERVAL must be a positive integer")
+		}
+		Config.CarbonFlushInterval = time.Duration(v) * time.Second
+	}
+	Config.OpenTSDBTelnetAddr = os.Getenv("DIAMONDB_OPENTSDB_TELNET_ADDR")
+	openTSDBFlushInterval := os.Getenv("DIAMONDB_OPENTSDB_FLUSH_INTERVAL")
+	if openTSDBFlushInterval == "" {
+		Config.OpenTSDBFlushInterval = DefaultOpenTSDBFlushInterval
+	} else {
+		v, err := strconv.Atoi(openTSDBFlushInterval)
+		if err != nil || v < 1 {
+			return errors.New("DIAMONDB_OPENTSDB_FLUSH_INTERVAL must be a positive integer")
+		}
+		Config.OpenTSDBFlushInterval = time.Duration(v) * time.Second
+	}
+	Config.StatsdAddr = os.Getenv("DIAMONDB_STATSD_ADDR")
+	statsdFlushInterval := os.Getenv("DIAMONDB_STATSD_FLUSH_INTERVAL")
+	if statsdFlushInterval == "" {
+		Config.StatsdFlushInterval = DefaultStatsdFlushInterval
+	} else {
+		v, err := strconv.Atoi(statsdFlushInterval)
+		if err != nil || v < 1 {
+			return errors.New("DIAMONDB_STATSD_FLUSH_INTERVAL must be a positive integer")
+		}
+		Config.StatsdFlushInterval = time.Duration(v) * time.Second
+	}
+	statsdPercentiles := os.Getenv("DIAMONDB_STATSD_PERCENTILES")
+	if statsdPercentiles == "" {
+		Config.StatsdPercentiles = DefaultStatsdPercentiles
+	} else {
+		Config.StatsdPercentiles = nil
+		for _, s := range strings.Split(statsdPercentiles, ",") {
+			v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil || v <= 0 || v > 100 {
+				return errors.New("DIAMONDB_STATSD_PERCENTILES must be comma-separated numbers in (0, 100]")
+			}
+			Config.StatsdPercentiles = append(Config.StatsdPercentiles, v)
+		}
+	}
+	statsdGaugeIdleAge := os.Getenv("DIAMONDB_STATSD_GAUGE_IDLE_AGE")
+	if statsdGaugeIdleAge == "" {
+		Config.StatsdGaugeIdleAge = DefaultStatsdGaugeIdleAge
+	} else {
+		v, err := strconv.Atoi(statsdGaugeIdleAge)
+		if err != nil || v < 1 {
+			return errors.New("DIAMONDB_STATSD_GAUGE_IDLE_AGE must be a positive integer")
+		}
+		Config.StatsdGaugeIdleAge = time.Duration(v) * time.Second
+	}
+	Config.CollectdAddr = os.Getenv("DIAMONDB_COLLECTD_ADDR")
+	collectdFlushInterval := os.Getenv("DIAMONDB_COLLECTD_FLUSH_INTERVAL")
+	if collectdFlushInterval == "" {
+		Config.CollectdFlushInterval = DefaultCollectdFlushInterval
+	} else {
+		v, err := strconv.Atoi(collectdFlushInterval)
+		if err != nil || v < 1 {
+			return errors.New("DIAMONDB_COLLECTD_FLUSH_INTERVAL must be a positive integer")
+		}
+		Config.CollectdFlushInterval = time.Duration(v) * time.Second
+	}
+	Config.CollectdSecurityLevel = os.Getenv("DIAMONDB_COLLECTD_SECURITY_LEVEL")
+	switch Config.CollectdSecurityLevel {
+	case "":
+		Config.CollectdSecurityLevel = DefaultCollectdSecurityLevel
+	case "none", "sign", "encrypt":
+	default:
+		return errors.New("DIAMONDB_COLLECTD_SECURITY_LEVEL must be 'none', 'sign' or 'encrypt'")
+	}
+	Config.CollectdAuthFile = os.Getenv("DIAMONDB_COLLECTD_AUTH_FILE")
+	if Config.CollectdSecurityLevel != "none" && Config.CollectdAuthFile == "" {
+		return errors.New("DIAMONDB_COLLECTD_AUTH_FILE is required for DIAMONDB_COLLECTD_SECURITY_LEVEL")
+	}
+	Config.CollectdTypesDB = nil
+	if v := os.Getenv("DIAMONDB_COLLECTD_TYPESDB"); v != "" {
+		Config.CollectdTypesDB = strings.Split(v, ",")
+	}
 
 	if os.Getenv("DIAMONDB_DEBUG") != "" {
 		Config.Debug = true
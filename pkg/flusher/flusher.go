@@ -0,0 +1,189 @@
+package flusher
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yuuki/diamondb/pkg/storage"
+	"github.com/yuuki/diamondb/pkg/storage/redis"
+)
+
+const (
+	// DefaultInterval is the default interval to sweep the idle series.
+	DefaultInterval = 1 * time.Minute
+	// DefaultIdleAge is the default age of the latest datapoint to regard a series as idle.
+	DefaultIdleAge = 1 * time.Hour
+	// DefaultLockTTL is the default expiration of the lock, which is extended while sweeping.
+	DefaultLockTTL = 1 * time.Minute
+
+	// LockKey is the key of the Redis lock to elect the node which sweeps.
+	LockKey = "diamondb:flusher:lock"
+)
+
+// Sweeper sweeps the idle series. *storage.Store implements it.
+type Sweeper interface {
+	SweepIdle(now time.Time, age time.Duration) (int, error)
+}
+
+var _ Sweeper = &storage.Store{}
+
+// Locker is the lock to elect the node which sweeps. redis.ReadWriter implements it.
+type Locker interface {
+	AcquireLock(key string, owner string, ttl time.Duration) (bool, error)
+	ReleaseLock(key string, owner string) error
+}
+
+var _ Locker = &redis.Redis{}
+
+// Flusher sweeps the series left in Redis periodically. Only the node holding the
+// lock sweeps at a time, so it can run on every node.
+type Flusher struct {
+	sweeper  Sweeper
+	locker   Locker
+	owner    string
+	interval time.Duration
+	idleAge  time.Duration
+	lockTTL  time.Duration
+
+	done chan struct{}
+	// mu is held while sweeping to wait for the sweep in progress on shutdown.
+	mu sync.Mutex
+
+	sweeps  uint64
+	flushed uint64
+	failed  uint64
+}
+
+// Stats represents the counters of the Flusher.
+type Stats struct {
+	Sweeps  uint64 `json:"sweeps"`
+	Flushed uint64 `json:"flushed"`
+	Failed  uint64 `json:"failed"`
+}
+
+// Option for the Flusher.
+type Option struct {
+	Sweeper  Sweeper
+	Locker   Locker
+	Interval time.Duration
+	IdleAge  time.Duration
+	LockTTL  time.Duration
+}
+
+// New creates a new Flusher.
+func New(o *Option) *Flusher {
+	f := &Flusher{
+		sweeper:  o.Sweeper,
+		locker:   o.Locker,
+		owner:    newOwner(),
+		interval: o.Interval,
+		idleAge:  o.IdleAge,
+		lockTTL:  o.LockTTL,
+		done:     make(chan struct{}),
+	}
+	if f.interval <= 0 {
+		f.interval = DefaultInterval
+	}
+	if f.idleAge <= 0 {
+		f.idleAge = DefaultIdleAge
+	}
+	if f.lockTTL <= 0 {
+		f.lockTTL = DefaultLockTTL
+	}
+	return f
+}
+
+// newOwner returns the identifier of the lock owner unique among the nodes.
+func newOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d:%d", host, os.Getpid(), rand.New(rand.NewSource(time.Now().UnixNano())).Int63())
+}
+
+// Run sweeps every interval until Shutdown is called.
+func (f *Flusher) Run() error {
+	log.Printf("Sweeping the idle series every %s\n", f.interval)
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.Sweep(time.Now())
+		case <-f.done:
+			return nil
+		}
+	}
+}
+
+// Shutdown stops sweeping and waits for the sweep in progress.
+func (f *Flusher) Shutdown(sig os.Signal) error {
+	log.Printf("Received %s shutdown flusher...\n", sig)
+	close(f.done)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return nil
+}
+
+// Stats returns the snapshot of the counters.
+func (f *Flusher) Stats() Stats {
+	return Stats{
+		Sweeps:  atomic.LoadUint64(&f.sweeps),
+		Flushed: atomic.LoadUint64(&f.flushed),
+		Failed:  atomic.LoadUint64(&f.failed),
+	}
+}
+
+// Sweep sweeps the idle series if it acquires the lock. It returns false if
+// another node holds the lock.
+func (f *Flusher) Sweep(now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ok, err := f.locker.AcquireLock(LockKey, f.owner, f.lockTTL)
+	if err != nil {
+		log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+		return false
+	}
+	if !ok {
+		return false
+	}
+	defer func() {
+		if err := f.locker.ReleaseLock(LockKey, f.owner); err != nil {
+			log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+		}
+	}()
+
+	// Extend the lock while sweeping so that no other node starts sweeping.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(f.lockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := f.locker.AcquireLock(LockKey, f.owner, f.lockTTL); err != nil {
+					log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	atomic.AddUint64(&f.sweeps, 1)
+	n, err := f.sweeper.SweepIdle(now, f.idleAge)
+	atomic.AddUint64(&f.flushed, uint64(n))
+	if err != nil {
+		atomic.AddUint64(&f.failed, 1)
+		log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+	}
+	if n > 0 {
+		log.Printf("Flushed %d idle series buffers\n", n)
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package flusher
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+type fakeSweeper struct {
+	n     int
+	err   error
+	calls int
+}
+
+func (s *fakeSweeper) SweepIdle(now time.Time, age time.Duration) (int, error) {
+	s.calls++
+	return s.n, s.err
+}
+
+// fakeLocker is the in-memory lock ignoring the expiration.
+type fakeLocker struct {
+	mu    sync.Mutex
+	owner string
+}
+
+func (l *fakeLocker) AcquireLock(key string, owner string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.owner != "" && l.owner != owner {
+		return false, nil
+	}
+	l.owner = owner
+	return true, nil
+}
+
+func (l *fakeLocker) ReleaseLock(key string, owner string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.owner == owner {
+		l.owner = ""
+	}
+	return nil
+}
+
+func TestFlusherSweep(t *testing.T) {
+	sweeper := &fakeSweeper{n: 2}
+	locker := &fakeLocker{}
+	f := New(&Option{Sweeper: sweeper, Locker: locker})
+
+	if !f.Sweep(time.Now()) {
+		t.Fatal("should sweep with the lock")
+	}
+	if locker.owner != "" {
+		t.Fatalf("lock should be released, but held by %s", locker.owner)
+	}
+
+	// Another node holds the lock.
+	locker.owner = "other"
+	if f.Sweep(time.Now()) {
+		t.Fatal("should not sweep without the lock")
+	}
+	if locker.owner != "other" {
+		t.Fatalf("lock of another node should not be released")
+	}
+
+	locker.owner = ""
+	sweeper.err = errors.New("failed to flush")
+	f.Sweep(time.Now())
+
+	expected := Stats{Sweeps: 2, Flushed: 4, Failed: 1}
+	if diff := pretty.Compare(f.Stats(), expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	if sweeper.calls != 2 {
+		t.Fatalf("sweeper should be called twice, not %d", sweeper.calls)
+	}
+}
+
+func TestFlusherRun(t *testing.T) {
+	sweeper := &fakeSweeper{}
+	f := New(&Option{Sweeper: sweeper, Locker: &fakeLocker{}, Interval: 10 * time.Millisecond})
+	go f.Run()
+	time.Sleep(50 * time.Millisecond)
+	if err := f.Shutdown(nil); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if f.Stats().Sweeps == 0 {
+		t.Fatal("should sweep periodically")
+	}
+}
@@ -0,0 +1,244 @@
+// Package influxdb parses the InfluxDB line protocol.
+package influxdb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Tag is a pair of tag key and value.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Field is a pair of field key and numeric value.
+type Field struct {
+	Key   string
+	Value float64
+}
+
+// Point represents a line of the line protocol.
+type Point struct {
+	Measurement string
+	Tags        []Tag // sorted by the key
+	Fields      []Field
+	Timestamp   int64 // UNIX Timestamp
+}
+
+// ParseError represents an error of parsing a malformed line.
+type ParseError struct {
+	line string
+	msg  string
+}
+
+// Error returns the error message for ParseError.
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("unable to parse '%s': %s", e.line, e.msg)
+}
+
+// PrecisionToDuration returns the unit of timestamps for the precision parameter.
+func PrecisionToDuration(precision string) (time.Duration, error) {
+	switch precision {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, errors.Errorf("invalid precision %q", precision)
+}
+
+// ParsePoints parses the lines in b. The timestamps are converted from the unit
+// into seconds, and the points without timestamp are stamped with now. It returns
+// the successfully parsed points with the errors of the malformed lines.
+func ParsePoints(b []byte, unit time.Duration, now time.Time) ([]*Point, []error) {
+	var (
+		points []*Point
+		errs   []error
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 64*1024), len(b)+1)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		p, err := ParsePoint(line, unit, now)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		points = append(points, p)
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return points, errs
+}
+
+// ParsePoint parses a line such as 'cpu,host=server1 usage_user=0.5,usage_system=1i 1500000000000000000'.
+// String fields are skipped because they can't be stored as datapoints.
+func ParsePoint(line string, unit time.Duration, now time.Time) (*Point, error) {
+	// Double quotes are significant only in the field set.
+	keyEnd := indexUnescaped(line, ' ')
+	if keyEnd < 0 {
+		return nil, &ParseError{line: line, msg: "missing fields"}
+	}
+	sections := splitUnescaped(line[keyEnd+1:], ' ', true)
+	if len(sections) < 1 {
+		return nil, &ParseError{line: line, msg: "missing fields"}
+	}
+	if len(sections) > 2 {
+		return nil, &ParseError{line: line, msg: "invalid field format"}
+	}
+
+	p := &Point{}
+	keys := splitUnescaped(line[:keyEnd], ',', false)
+	p.Measurement = unescape(keys[0])
+	if p.Measurement == "" {
+		return nil, &ParseError{line: line, msg: "missing measurement"}
+	}
+	for _, kv := range keys[1:] {
+		pair := splitUnescaped(kv, '=', false)
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			return nil, &ParseError{line: line, msg: fmt.Sprintf("invalid tag format %q", kv)}
+		}
+		p.Tags = append(p.Tags, Tag{Key: unescape(pair[0]), Value: unescape(pair[1])})
+	}
+	sort.Slice(p.Tags, func(i, j int) bool { return p.Tags[i].Key < p.Tags[j].Key })
+
+	numFields := 0
+	for _, kv := range splitUnescaped(sections[0], ',', true) {
+		i := indexUnescaped(kv, '=')
+		if i <= 0 || i == len(kv)-1 {
+			return nil, &ParseError{line: line, msg: fmt.Sprintf("invalid field format %q", kv)}
+		}
+		numFields++
+		key, raw := unescape(kv[:i]), kv[i+1:]
+		v, ok, err := parseFieldValue(raw)
+		if err != nil {
+			return nil, &ParseError{line: line, msg: fmt.Sprintf("invalid field value %q", raw)}
+		}
+		if !ok {
+			continue
+		}
+		p.Fields = append(p.Fields, Field{Key: key, Value: v})
+	}
+	if numFields == 0 {
+		return nil, &ParseError{line: line, msg: "missing fields"}
+	}
+
+	if len(sections) == 2 {
+		ts, err := strconv.ParseInt(sections[1], 10, 64)
+		if err != nil {
+			return nil, &ParseError{line: line, msg: fmt.Sprintf("bad timestamp %q", sections[1])}
+		}
+		if unit < time.Second {
+			p.Timestamp = ts / int64(time.Second/unit)
+		} else {
+			p.Timestamp = ts * int64(unit/time.Second)
+		}
+	} else {
+		p.Timestamp = now.Unix()
+	}
+	return p, nil
+}
+
+// parseFieldValue parses a field value. It returns false if the value is a string.
+func parseFieldValue(s string) (float64, bool, error) {
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	if s[0] == '"' {
+		if len(s) < 2 || s[len(s)-1] != '"' {
+			return 0, false, errors.New("unterminated string")
+		}
+		return 0, false, nil
+	}
+	switch s[len(s)-1] {
+	case 'i':
+		v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		return float64(v), err == nil, err
+	case 'u':
+		v, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		return float64(v), err == nil, err
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	return v, err == nil, err
+}
+
+// splitUnescaped splits s by sep which is neither escaped by backslash
+// nor, if quoted is true, enclosed in double quotes.
+func splitUnescaped(s string, sep byte, quoted bool) []string {
+	var (
+		parts   []string
+		start   = 0
+		inQuote = false
+	)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case quoted && c == '"':
+			inQuote = !inQuote
+		case c == sep && !inQuote:
+			// Consecutive separators such as multiple spaces are regarded as one.
+			if sep != ' ' || i > start {
+				parts = append(parts, s[start:i])
+			}
+			start = i + 1
+		}
+	}
+	if start < len(s) || sep != ' ' {
+		parts = append(parts, s[start:])
+	}
+	return parts
+}
+
+func indexUnescaped(s string, c byte) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == c {
+			return i
+		}
+	}
+	return -1
+}
+
+func unescape(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			switch s[i+1] {
+			case ',', ' ', '=', '"', '\\':
+				i++
+			}
+		}
+		buf = append(buf, s[i])
+	}
+	return string(buf)
+}
@@ -0,0 +1,142 @@
+package influxdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestParsePoint(t *testing.T) {
+	now := time.Unix(1500000100, 0)
+	tests := []struct {
+		desc     string
+		line     string
+		unit     time.Duration
+		expected *Point
+	}{
+		{
+			"tags, multiple fields and nanosecond timestamp",
+			"cpu,host=server1,cpu=cpu0 usage_user=0.5,usage_system=1i,up=true 1500000000123456789",
+			time.Nanosecond,
+			&Point{
+				Measurement: "cpu",
+				Tags:        []Tag{{"cpu", "cpu0"}, {"host", "server1"}},
+				Fields:      []Field{{"usage_user", 0.5}, {"usage_system", 1}, {"up", 1}},
+				Timestamp:   1500000000,
+			},
+		},
+		{
+			"no tags and no timestamp",
+			"loadavg value=1.5",
+			time.Nanosecond,
+			&Point{
+				Measurement: "loadavg",
+				Fields:      []Field{{"value", 1.5}},
+				Timestamp:   1500000100,
+			},
+		},
+		{
+			"millisecond precision and unsigned integer",
+			"mem free=10u 1500000000999",
+			time.Millisecond,
+			&Point{
+				Measurement: "mem",
+				Fields:      []Field{{"free", 10}},
+				Timestamp:   1500000000,
+			},
+		},
+		{
+			"second precision",
+			"mem free=-1.5e3,ok=F 1500000000",
+			time.Second,
+			&Point{
+				Measurement: "mem",
+				Fields:      []Field{{"free", -1500}, {"ok", 0}},
+				Timestamp:   1500000000,
+			},
+		},
+		{
+			"escaped characters and string fields",
+			`disk\ io,path=/var\,log,dev\=ice=sda msg="a b, c=d",read\ bytes=3 1500000000000000`,
+			time.Microsecond,
+			&Point{
+				Measurement: "disk io",
+				Tags:        []Tag{{"dev=ice", "sda"}, {"path", "/var,log"}},
+				Fields:      []Field{{"read bytes", 3}},
+				Timestamp:   1500000000,
+			},
+		},
+	}
+	for _, tc := range tests {
+		p, err := ParsePoint(tc.line, tc.unit, now)
+		if err != nil {
+			t.Fatalf("desc: %s, should not raise err: %s", tc.desc, err)
+		}
+		if diff := pretty.Compare(p, tc.expected); diff != "" {
+			t.Fatalf("desc: %s, diff: (-actual +expected)\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestParsePoint_Malformed(t *testing.T) {
+	tests := []struct {
+		desc string
+		line string
+	}{
+		{"missing fields", "cpu,host=server1"},
+		{"empty field set", "cpu,host=server1 "},
+		{"missing measurement", ",host=server1 value=1"},
+		{"invalid tag", "cpu,host value=1"},
+		{"invalid field", "cpu value 100"},
+		{"invalid field value", "cpu value=abc"},
+		{"unterminated string", `cpu msg="abc`},
+		{"bad timestamp", "cpu value=1 abc"},
+		{"too many sections", "cpu value=1 100 200"},
+	}
+	for _, tc := range tests {
+		_, err := ParsePoint(tc.line, time.Nanosecond, time.Now())
+		if err == nil {
+			t.Fatalf("desc: %s, should raise err", tc.desc)
+		}
+		if _, ok := err.(*ParseError); !ok {
+			t.Fatalf("desc: %s, err should be *ParseError, not %T", tc.desc, err)
+		}
+	}
+}
+
+func TestParsePoints(t *testing.T) {
+	body := []byte("# comment\ncpu value=1 1500000000\n\ncpu value=abc\nmem value=2 1500000060\n")
+	points, errs := ParsePoints(body, time.Second, time.Now())
+	if len(points) != 2 {
+		t.Fatalf("the number of points should be 2, not %d", len(points))
+	}
+	if len(errs) != 1 {
+		t.Fatalf("the number of errors should be 1, not %d", len(errs))
+	}
+}
+
+func TestPrecisionToDuration(t *testing.T) {
+	tests := []struct {
+		precision string
+		expected  time.Duration
+	}{
+		{"", time.Nanosecond},
+		{"ns", time.Nanosecond},
+		{"us", time.Microsecond},
+		{"ms", time.Millisecond},
+		{"s", time.Second},
+	}
+	for _, tc := range tests {
+		got, err := PrecisionToDuration(tc.precision)
+		if err != nil {
+			t.Fatalf("precision: %q, should not raise err: %s", tc.precision, err)
+		}
+		if got != tc.expected {
+			t.Fatalf("precision: %q, unit should be %s, not %s", tc.precision, tc.expected, got)
+		}
+	}
+	if _, err := PrecisionToDuration("d"); err == nil {
+		t.Fatalf("should raise err")
+	}
+}
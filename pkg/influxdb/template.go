@@ -0,0 +1,96 @@
+package influxdb
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/util"
+)
+
+// DefaultNameTemplate is the default template to flatten a field into a series name.
+const DefaultNameTemplate = "measurement.tags.field"
+
+// NameTemplate flattens each field of a point into a dotted series name as
+// the graphite serializer of Telegraf does. The template is the dot-separated list
+// of 'measurement', 'field', 'tags' and tag keys. 'tags' is replaced with the values
+// of the rest of tags sorted by the key. The field named 'value' is omitted.
+//
+// ex. "measurement.tags.field" maps 'cpu,host=server1,cpu=cpu0 usage_user=0.5'
+// into "cpu.cpu0.server1.usage_user".
+type NameTemplate []string
+
+// ParseNameTemplate parses the template string.
+func ParseNameTemplate(s string) (NameTemplate, error) {
+	if s == "" {
+		s = DefaultNameTemplate
+	}
+	nodes := strings.Split(s, ".")
+	for _, node := range nodes {
+		if node == "" {
+			return nil, errors.Errorf("empty node in the name template %q", s)
+		}
+	}
+	return NameTemplate(nodes), nil
+}
+
+// Name returns the series name of the field of the point.
+func (tmpl NameTemplate) Name(p *Point, field string) string {
+	used := make(map[string]bool, len(tmpl))
+	for _, node := range tmpl {
+		used[node] = true
+	}
+	nodes := make([]string, 0, len(tmpl)+len(p.Tags))
+	for _, node := range tmpl {
+		switch node {
+		case "measurement":
+			nodes = append(nodes, util.SanitizeNode(p.Measurement))
+		case "field":
+			if field != "value" {
+				nodes = append(nodes, util.SanitizeNode(field))
+			}
+		case "tags":
+			// p.Tags is already sorted by the key.
+			for _, tag := range p.Tags {
+				if !used[tag.Key] {
+					nodes = append(nodes, util.SanitizeNode(tag.Value))
+				}
+			}
+		default:
+			for _, tag := range p.Tags {
+				if tag.Key == node {
+					nodes = append(nodes, util.SanitizeNode(tag.Value))
+					break
+				}
+			}
+		}
+	}
+	return strings.Join(nodes, ".")
+}
+
+// ToMetrics converts the points into metrics named by tmpl.
+func ToMetrics(points []*Point, tmpl NameTemplate) []*model.Metric {
+	metrics := make(map[string]*model.Metric, len(points))
+	names := make([]string, 0, len(points))
+	for _, p := range points {
+		for _, f := range p.Fields {
+			name := tmpl.Name(p, f.Key)
+			m, ok := metrics[name]
+			if !ok {
+				m = &model.Metric{Name: name}
+				metrics[name] = m
+				names = append(names, name)
+			}
+			m.Datapoints = append(m.Datapoints, &model.Datapoint{
+				Timestamp: p.Timestamp,
+				Value:     f.Value,
+			})
+		}
+	}
+	result := make([]*model.Metric, 0, len(names))
+	for _, name := range names {
+		result = append(result, metrics[name])
+	}
+	return result
+}
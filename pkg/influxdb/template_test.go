@@ -0,0 +1,72 @@
+package influxdb
+
+import (
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+)
+
+func TestNameTemplate(t *testing.T) {
+	p := &Point{
+		Measurement: "cpu",
+		Tags:        []Tag{{"cpu", "cpu0"}, {"host", "server1.example.com"}},
+	}
+	tests := []struct {
+		template string
+		field    string
+		expected string
+	}{
+		{"", "usage_user", "cpu.cpu0.server1_example_com.usage_user"},
+		{"host.tags.measurement.field", "usage_user", "server1_example_com.cpu0.cpu.usage_user"},
+		{"measurement.host.field", "value", "cpu.server1_example_com"},
+		{"notfound.measurement.field", "usage_user", "cpu.usage_user"},
+	}
+	for _, tc := range tests {
+		tmpl, err := ParseNameTemplate(tc.template)
+		if err != nil {
+			t.Fatalf("template: %q, should not raise err: %s", tc.template, err)
+		}
+		if got := tmpl.Name(p, tc.field); got != tc.expected {
+			t.Fatalf("template: %q, name should be %s, not %s", tc.template, tc.expected, got)
+		}
+	}
+	if _, err := ParseNameTemplate("measurement..field"); err == nil {
+		t.Fatalf("should raise err")
+	}
+}
+
+func TestToMetrics(t *testing.T) {
+	tmpl, _ := ParseNameTemplate(DefaultNameTemplate)
+	points := []*Point{
+		{
+			Measurement: "cpu",
+			Tags:        []Tag{{"host", "server1"}},
+			Fields:      []Field{{"user", 1}, {"system", 2}},
+			Timestamp:   100,
+		},
+		{
+			Measurement: "cpu",
+			Tags:        []Tag{{"host", "server1"}},
+			Fields:      []Field{{"user", 3}},
+			Timestamp:   160,
+		},
+	}
+	expected := []*model.Metric{
+		{
+			Name: "cpu.server1.user",
+			Datapoints: []*model.Datapoint{
+				{Timestamp: 100, Value: 1},
+				{Timestamp: 160, Value: 3},
+			},
+		},
+		{
+			Name:       "cpu.server1.system",
+			Datapoints: []*model.Datapoint{{Timestamp: 100, Value: 2}},
+		},
+	}
+	if diff := pretty.Compare(ToMetrics(points, tmpl), expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
@@ -0,0 +1,105 @@
+package model
+
+import (
+	"math"
+)
+
+// Aggregate represents a datapoint rolled up from the raw datapoints. Min, Max,
+// Sum, Count and Last are the accumulators of the raw datapoints, which are
+// merged with the other partial aggregates of the same timestamp rolled up
+// later, so they are the same as rolling up all the raw datapoints at once.
+// Value is the value aggregated from the accumulators by the aggregation
+// method of the series. A raw datapoint is the Aggregate of itself.
+type Aggregate struct {
+	Value float64
+	Min   float64
+	Max   float64
+	Sum   float64
+	Count int64
+	// Last is the value of the latest raw datapoint at LastTimestamp.
+	Last          float64
+	LastTimestamp int64
+	// RolledUp is whether the aggregate is rolled up. The aggregates rolled up
+	// into the same timestamp are merged, while a raw datapoint overwrites the
+	// datapoint of the same timestamp.
+	RolledUp bool
+}
+
+// NewAggregate returns the Aggregate of a raw datapoint.
+func NewAggregate(t int64, v float64) *Aggregate {
+	return &Aggregate{Value: v, Min: v, Max: v, Sum: v, Count: 1, Last: v, LastTimestamp: t}
+}
+
+// IsRaw returns whether a is a raw datapoint.
+func (a *Aggregate) IsRaw() bool {
+	return !a.RolledUp
+}
+
+// Merge merges the accumulators of b into a. Value is not changed.
+func (a *Aggregate) Merge(b *Aggregate) {
+	if b.Count == 0 {
+		return
+	}
+	if a.Count == 0 {
+		a.Min, a.Max, a.Sum, a.Count = b.Min, b.Max, b.Sum, b.Count
+		a.Last, a.LastTimestamp = b.Last, b.LastTimestamp
+		return
+	}
+	a.Min = math.Min(a.Min, b.Min)
+	a.Max = math.Max(a.Max, b.Max)
+	a.Sum += b.Sum
+	a.Count += b.Count
+	if b.LastTimestamp >= a.LastTimestamp {
+		a.Last, a.LastTimestamp = b.Last, b.LastTimestamp
+	}
+}
+
+// MergeDistinct merges the aggregates of the same timestamp read from the
+// different places such as the blocks of the cold tier. The same aggregate is
+// the datapoint written twice, so it is merged once. A raw datapoint is taken
+// as it is if any.
+func MergeDistinct(as []*Aggregate) *Aggregate {
+	merged := &Aggregate{RolledUp: true}
+	for i, a := range as {
+		if a.IsRaw() {
+			return a
+		}
+		if containsAggregate(as[:i], a) {
+			continue
+		}
+		merged.Merge(a)
+	}
+	return merged
+}
+
+func containsAggregate(as []*Aggregate, a *Aggregate) bool {
+	for _, b := range as {
+		if *a == *b {
+			return true
+		}
+	}
+	return false
+}
+
+// Consolidate returns the aggregate by the function such as 'max'. It returns
+// NaN if Value is NaN, which means the datapoint is null, and Value if the
+// function is unknown.
+func (a *Aggregate) Consolidate(function string) float64 {
+	if math.IsNaN(a.Value) {
+		return math.NaN()
+	}
+	switch function {
+	case "min":
+		return a.Min
+	case "max":
+		return a.Max
+	case "sum":
+		return a.Sum
+	case "average", "avg":
+		if a.Count == 0 {
+			return math.NaN()
+		}
+		return a.Sum / float64(a.Count)
+	}
+	return a.Value
+}
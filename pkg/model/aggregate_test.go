@@ -0,0 +1,87 @@
+package model
+
+import (
+	"math"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestAggregateMerge(t *testing.T) {
+	a := &Aggregate{RolledUp: true}
+	a.Merge(NewAggregate(120, 3.0))
+	a.Merge(&Aggregate{Min: 1.0, Max: 4.0, Sum: 6.0, Count: 3, Last: 2.0, LastTimestamp: 60, RolledUp: true})
+	a.Merge(&Aggregate{})
+	// The distinct partial aggregate of the same last timestamp is merged.
+	a.Merge(&Aggregate{Min: 5.0, Max: 5.0, Sum: 5.0, Count: 1, Last: 5.0, LastTimestamp: 120, RolledUp: true})
+	expected := &Aggregate{Min: 1.0, Max: 5.0, Sum: 14.0, Count: 5, Last: 5.0, LastTimestamp: 120, RolledUp: true}
+	if diff := pretty.Compare(a, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestMergeDistinct(t *testing.T) {
+	partial1 := &Aggregate{Min: 1.0, Max: 3.0, Sum: 4.0, Count: 2, Last: 3.0, LastTimestamp: 60, RolledUp: true}
+	partial2 := &Aggregate{Min: 2.0, Max: 2.0, Sum: 2.0, Count: 1, Last: 2.0, LastTimestamp: 120, RolledUp: true}
+	partial3 := &Aggregate{Min: 4.0, Max: 4.0, Sum: 4.0, Count: 1, Last: 4.0, LastTimestamp: 120, RolledUp: true}
+	copied := *partial1
+	tests := []struct {
+		desc     string
+		as       []*Aggregate
+		expected *Aggregate
+	}{
+		{
+			"the partial aggregates are merged",
+			[]*Aggregate{partial1, partial2},
+			&Aggregate{Min: 1.0, Max: 3.0, Sum: 6.0, Count: 3, Last: 2.0, LastTimestamp: 120, RolledUp: true},
+		},
+		{
+			"the same aggregate is merged once",
+			[]*Aggregate{partial1, partial2, &copied},
+			&Aggregate{Min: 1.0, Max: 3.0, Sum: 6.0, Count: 3, Last: 2.0, LastTimestamp: 120, RolledUp: true},
+		},
+		{
+			"the same aggregate delivered out of order is merged once",
+			[]*Aggregate{&copied, partial2, partial1},
+			&Aggregate{Min: 1.0, Max: 3.0, Sum: 6.0, Count: 3, Last: 2.0, LastTimestamp: 120, RolledUp: true},
+		},
+		{
+			"the distinct aggregates of the same last timestamp are merged",
+			[]*Aggregate{partial2, partial3},
+			&Aggregate{Min: 2.0, Max: 4.0, Sum: 6.0, Count: 2, Last: 4.0, LastTimestamp: 120, RolledUp: true},
+		},
+		{
+			"the raw datapoint is taken",
+			[]*Aggregate{partial1, NewAggregate(60, 5.0)},
+			NewAggregate(60, 5.0),
+		},
+	}
+	for _, tc := range tests {
+		if diff := pretty.Compare(MergeDistinct(tc.as), tc.expected); diff != "" {
+			t.Fatalf("desc: %s, diff: (-actual +expected)\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestAggregateConsolidate(t *testing.T) {
+	a := &Aggregate{Value: 2.0, Min: 1.0, Max: 4.0, Sum: 9.0, Count: 3, RolledUp: true}
+	tests := []struct {
+		function string
+		expected float64
+	}{
+		{"min", 1.0},
+		{"max", 4.0},
+		{"sum", 9.0},
+		{"average", 3.0},
+		{"last", 2.0},
+	}
+	for _, tc := range tests {
+		if got := a.Consolidate(tc.function); got != tc.expected {
+			t.Fatalf("Consolidate(%s) should be %v, not %v", tc.function, tc.expected, got)
+		}
+	}
+	null := &Aggregate{Value: math.NaN(), Min: 1.0, Max: 4.0, Sum: 5.0, Count: 2, RolledUp: true}
+	if got := null.Consolidate("max"); !math.IsNaN(got) {
+		t.Fatalf("Consolidate of null should be NaN, not %v", got)
+	}
+}
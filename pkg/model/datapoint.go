@@ -10,6 +10,7 @@ import (
 type DataPoint struct {
 	timestamp int64 // UNIX Timestamp
 	value     float64
+	aggregate *Aggregate // nil unless rolled up
 }
 
 // NewDataPoint returns the pointer of the DataPoint object.
@@ -20,6 +21,19 @@ func NewDataPoint(t int64, v float64) *DataPoint {
 	}
 }
 
+// NewAggregatedDataPoint returns the pointer of the DataPoint object rolled up
+// into the aggregate. The value is the Value of the aggregate.
+func NewAggregatedDataPoint(t int64, a *Aggregate) *DataPoint {
+	if a.IsRaw() {
+		return NewDataPoint(t, a.Value)
+	}
+	return &DataPoint{
+		timestamp: t,
+		value:     a.Value,
+		aggregate: a,
+	}
+}
+
 // Timestamp returns timestamp.
 func (d *DataPoint) Timestamp() int64 {
 	return d.timestamp
@@ -30,6 +44,11 @@ func (d *DataPoint) Value() float64 {
 	return d.value
 }
 
+// Aggregate returns the aggregate of the datapoint rolled up, or nil.
+func (d *DataPoint) Aggregate() *Aggregate {
+	return d.aggregate
+}
+
 // MarshalJSON marshals DataPoint into JSON.
 func (d *DataPoint) MarshalJSON() ([]byte, error) {
 	if math.IsNaN(d.Value()) {
@@ -56,7 +75,7 @@ func (ds DataPoints) Sort() DataPoints {
 
 // Deduplicate eliminates duplications of DataPoints with the same timestamp.
 func (ds DataPoints) Deduplicate() DataPoints {
-	deduplicated := make(map[int64]float64, ds.Len())
+	deduplicated := make(map[int64]*DataPoint, ds.Len())
 	for _, d := range ds {
 		key := d.Timestamp()
 		if _, ok := deduplicated[key]; ok {
@@ -65,11 +84,11 @@ func (ds DataPoints) Deduplicate() DataPoints {
 				continue
 			}
 		}
-		deduplicated[key] = d.Value()
+		deduplicated[key] = d
 	}
 	points := make(DataPoints, 0, len(deduplicated))
-	for t, v := range deduplicated {
-		points = append(points, NewDataPoint(t, v))
+	for _, d := range deduplicated {
+		points = append(points, d)
 	}
 	return points.Sort()
 }
@@ -9,6 +9,8 @@ type Series struct {
 	start  int64 // timestamp of start.
 	step   int   // the interval seconds of values.
 	alias  string
+	// aggregates are the aggregates of the values rolled up, or nil.
+	aggregates []*Aggregate
 }
 
 // NewSeries returns the Series object.
@@ -21,6 +23,14 @@ func NewSeries(name string, values []float64, start int64, step int) *Series {
 	}
 }
 
+// NewAggregatedSeries returns the Series object with the aggregates of the values
+// rolled up. The aggregate of the value not rolled up is nil.
+func NewAggregatedSeries(name string, values []float64, aggregates []*Aggregate, start int64, step int) *Series {
+	s := NewSeries(name, values, start, step)
+	s.aggregates = aggregates
+	return s
+}
+
 // Name returns the name.
 func (s *Series) Name() string {
 	return s.name
@@ -78,6 +88,22 @@ func (s *Series) Alias() string {
 	return s.alias
 }
 
+// ConsolidateBy returns the copy of the series whose values rolled up are
+// replaced with the aggregates by the function such as 'max'. The values not
+// rolled up are kept.
+func (s *Series) ConsolidateBy(function string) *Series {
+	vals := make([]float64, len(s.values))
+	for i, v := range s.values {
+		if i < len(s.aggregates) && s.aggregates[i] != nil {
+			v = s.aggregates[i].Consolidate(function)
+		}
+		vals[i] = v
+	}
+	ns := NewAggregatedSeries(s.name, vals, s.aggregates, s.start, s.step)
+	ns.alias = s.alias
+	return ns
+}
+
 // Points returns DataPoints converted from values.
 func (s *Series) Points() DataPoints {
 	if s.Len() == 0 {
@@ -51,6 +51,22 @@ func (s *SeriesPoint) Values() []float64 {
 	return vals
 }
 
+// aggregates returns the aggregates of the values in the same layout as Values,
+// or nil if no point is rolled up.
+func (s *SeriesPoint) aggregates() []*Aggregate {
+	var aggs []*Aggregate
+	for i, p := range s.Points() {
+		if p.Aggregate() == nil || p.Timestamp() != (s.Start()+int64(s.Step()*i)) {
+			continue
+		}
+		if aggs == nil {
+			aggs = make([]*Aggregate, s.Len())
+		}
+		aggs[i] = p.Aggregate()
+	}
+	return aggs
+}
+
 // Start returns the unix timestamp of the beginning of the data points.
 func (s *SeriesPoint) Start() int64 {
 	if len(s.Points()) == 0 {
@@ -79,5 +95,5 @@ func (s *SeriesPoint) Len() int {
 
 // ToSeries converts s into Series.
 func (s *SeriesPoint) ToSeries() *Series {
-	return NewSeries(s.Name(), s.Values(), s.Start(), s.Step())
+	return NewAggregatedSeries(s.Name(), s.Values(), s.aggregates(), s.Start(), s.Step())
 }
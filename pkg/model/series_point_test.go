@@ -86,3 +86,15 @@ func TestNewSeriesPoint(t *testing.T) {
 		}
 	}
 }
+
+func TestSeriesPointToSeries_Aggregates(t *testing.T) {
+	agg := &Aggregate{Value: 2.0, Min: 1.0, Max: 4.0, Sum: 6.0, Count: 3, RolledUp: true}
+	sp := NewSeriesPoint("server1.loadavg5", DataPoints{
+		NewAggregatedDataPoint(0, agg),
+		NewAggregatedDataPoint(300, NewAggregate(300, 0.5)),
+	}, 300)
+	expected := NewAggregatedSeries("server1.loadavg5", []float64{2.0, 0.5}, []*Aggregate{agg, nil}, 0, 300)
+	if diff := pretty.Compare(sp.ToSeries(), expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
@@ -96,6 +96,21 @@ func TestMarshalJSON(t *testing.T) {
 	}
 }
 
+func TestSeriesConsolidateBy(t *testing.T) {
+	s := NewAggregatedSeries("server1.loadavg5", []float64{2.0, 0.5, math.NaN()}, []*Aggregate{
+		{Value: 2.0, Min: 1.0, Max: 4.0, Sum: 6.0, Count: 3},
+		nil,
+		{Value: math.NaN(), Min: 1.0, Max: 1.0, Sum: 1.0, Count: 1},
+	}, 0, 300)
+	got := s.ConsolidateBy("max")
+	if diff := pretty.Compare(got.Values(), []float64{4.0, 0.5, math.NaN()}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	if diff := pretty.Compare(s.Values(), []float64{2.0, 0.5, math.NaN()}); diff != "" {
+		t.Fatalf("original series should not be changed: (-actual +expected)\n%s", diff)
+	}
+}
+
 func TestSeriesPoints(t *testing.T) {
 	tests := []struct {
 		desc     string
@@ -0,0 +1,151 @@
+// Package opentsdb receives datapoints by the OpenTSDB HTTP /api/put and telnet put protocol.
+package opentsdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/util"
+)
+
+// maxSecondsTimestamp is the largest timestamp in seconds. OpenTSDB regards
+// the larger timestamps as milliseconds.
+const maxSecondsTimestamp = 9999999999
+
+// DataPoint is a datapoint of /api/put.
+type DataPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp json.Number       `json:"timestamp"`
+	Value     json.Number       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// UnmarshalJSON unmarshals the datapoint. OpenTSDB accepts the value
+// not only as number but as string such as "42.5".
+func (d *DataPoint) UnmarshalJSON(b []byte) error {
+	var v struct {
+		Metric    string            `json:"metric"`
+		Timestamp json.Number       `json:"timestamp"`
+		Value     interface{}       `json:"value"`
+		Tags      map[string]string `json:"tags"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	d.Metric, d.Timestamp, d.Tags = v.Metric, v.Timestamp, v.Tags
+	switch val := v.Value.(type) {
+	case json.Number:
+		d.Value = val
+	case string:
+		d.Value = json.Number(val)
+	case nil:
+		d.Value = ""
+	default:
+		return errors.Errorf("invalid value %v", val)
+	}
+	return nil
+}
+
+// DecodePut decodes the body of /api/put, which is either a datapoint or an array of datapoints.
+func DecodePut(b []byte) ([]*DataPoint, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil, errors.New("empty body")
+	}
+	if b[0] == '[' {
+		var points []*DataPoint
+		if err := json.Unmarshal(b, &points); err != nil {
+			return nil, err
+		}
+		return points, nil
+	}
+	var p DataPoint
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	return []*DataPoint{&p}, nil
+}
+
+// ToDatapoint validates the datapoint and converts it into the series name and the datapoint.
+func (d *DataPoint) ToDatapoint() (string, *model.Datapoint, error) {
+	if d.Metric == "" {
+		return "", nil, errors.New("metric name is empty")
+	}
+	ts, err := parseTimestamp(string(d.Timestamp))
+	if err != nil {
+		return "", nil, err
+	}
+	v, err := strconv.ParseFloat(string(d.Value), 64)
+	if err != nil {
+		return "", nil, errors.Errorf("invalid value %q", d.Value)
+	}
+	return Name(d.Metric, d.Tags), &model.Datapoint{Timestamp: ts, Value: v}, nil
+}
+
+// Name converts the metric and the tags into a dotted series name. The tags are
+// sorted by the key and appended as '<key>.<value>'.
+// ex. sys.cpu.user {host=web01, cpu=0} => sys.cpu.user.cpu.0.host.web01
+func Name(metric string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	nodes := make([]string, 0, 1+len(tags)*2)
+	nodes = append(nodes, metric)
+	for _, k := range keys {
+		nodes = append(nodes, util.SanitizeNode(k), util.SanitizeNode(tags[k]))
+	}
+	return strings.Join(nodes, ".")
+}
+
+func parseTimestamp(s string) (int64, error) {
+	ts, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || ts <= 0 {
+		return 0, errors.Errorf("invalid timestamp %q", s)
+	}
+	if ts > maxSecondsTimestamp {
+		ts /= 1000
+	}
+	return ts, nil
+}
+
+// ParsePutLine parses a line of the telnet put command such as
+// 'put <metric> <timestamp> <value> <tagk1=tagv1 ...>'.
+func ParsePutLine(line string) (string, *model.Datapoint, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 1 || fields[0] != "put" {
+		return "", nil, errors.Errorf("unknown command %q", line)
+	}
+	if len(fields) < 4 {
+		return "", nil, errors.Errorf(
+			"put: illegal argument: not enough arguments (need least 4, got %d)", len(fields))
+	}
+	tags := make(map[string]string, len(fields)-4)
+	for _, kv := range fields[4:] {
+		i := strings.IndexByte(kv, '=')
+		if i <= 0 || i == len(kv)-1 {
+			return "", nil, errors.Errorf("put: invalid tag %q", kv)
+		}
+		tags[kv[:i]] = kv[i+1:]
+	}
+	d := &DataPoint{
+		Metric:    fields[1],
+		Timestamp: json.Number(fields[2]),
+		Value:     json.Number(fields[3]),
+		Tags:      tags,
+	}
+	name, p, err := d.ToDatapoint()
+	if err != nil {
+		return "", nil, errors.Wrap(err, "put")
+	}
+	return name, p, nil
+}
@@ -0,0 +1,104 @@
+package opentsdb
+
+import (
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+)
+
+func TestDecodePut(t *testing.T) {
+	tests := []struct {
+		desc     string
+		body     string
+		expected []*DataPoint
+	}{
+		{
+			"single datapoint",
+			`{"metric":"sys.cpu.user","timestamp":1500000000,"value":42.5,"tags":{"host":"web01"}}`,
+			[]*DataPoint{
+				{Metric: "sys.cpu.user", Timestamp: "1500000000", Value: "42.5", Tags: map[string]string{"host": "web01"}},
+			},
+		},
+		{
+			"array with string value",
+			`[{"metric":"sys.cpu.user","timestamp":1500000000,"value":"1","tags":{"host":"web01"}},
+			  {"metric":"sys.cpu.nice","timestamp":1500000000000,"value":2,"tags":{"host":"web02"}}]`,
+			[]*DataPoint{
+				{Metric: "sys.cpu.user", Timestamp: "1500000000", Value: "1", Tags: map[string]string{"host": "web01"}},
+				{Metric: "sys.cpu.nice", Timestamp: "1500000000000", Value: "2", Tags: map[string]string{"host": "web02"}},
+			},
+		},
+	}
+	for _, tc := range tests {
+		got, err := DecodePut([]byte(tc.body))
+		if err != nil {
+			t.Fatalf("desc: %s, should not raise err: %s", tc.desc, err)
+		}
+		if diff := pretty.Compare(got, tc.expected); diff != "" {
+			t.Fatalf("desc: %s, diff: (-actual +expected)\n%s", tc.desc, diff)
+		}
+	}
+	for _, body := range []string{"", "{", `{"value":true}`} {
+		if _, err := DecodePut([]byte(body)); err == nil {
+			t.Fatalf("body: %q, should raise err", body)
+		}
+	}
+}
+
+func TestDataPointToDatapoint(t *testing.T) {
+	d := &DataPoint{
+		Metric:    "sys.cpu.user",
+		Timestamp: "1500000000123",
+		Value:     "42.5",
+		Tags:      map[string]string{"host": "web01.example.com", "cpu": "0"},
+	}
+	name, p, err := d.ToDatapoint()
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if expected := "sys.cpu.user.cpu.0.host.web01_example_com"; name != expected {
+		t.Fatalf("name should be %s, not %s", expected, name)
+	}
+	if diff := pretty.Compare(p, &model.Datapoint{Timestamp: 1500000000, Value: 42.5}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	invalids := []*DataPoint{
+		{Metric: "", Timestamp: "1500000000", Value: "1"},
+		{Metric: "sys.cpu.user", Timestamp: "abc", Value: "1"},
+		{Metric: "sys.cpu.user", Timestamp: "-1", Value: "1"},
+		{Metric: "sys.cpu.user", Timestamp: "1500000000", Value: ""},
+	}
+	for _, d := range invalids {
+		if _, _, err := d.ToDatapoint(); err == nil {
+			t.Fatalf("%+v should raise err", d)
+		}
+	}
+}
+
+func TestParsePutLine(t *testing.T) {
+	name, p, err := ParsePutLine("put sys.cpu.user 1500000000 42.5 host=web01 cpu=0")
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if expected := "sys.cpu.user.cpu.0.host.web01"; name != expected {
+		t.Fatalf("name should be %s, not %s", expected, name)
+	}
+	if diff := pretty.Compare(p, &model.Datapoint{Timestamp: 1500000000, Value: 42.5}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	invalids := []string{
+		"get sys.cpu.user 1500000000 42.5",
+		"put sys.cpu.user 1500000000",
+		"put sys.cpu.user 1500000000 42.5 host",
+		"put sys.cpu.user 1500000000 abc host=web01",
+	}
+	for _, line := range invalids {
+		if _, _, err := ParsePutLine(line); err == nil {
+			t.Fatalf("line: %q, should raise err", line)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package opentsdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/storage"
+)
+
+// Server receives datapoints by the telnet-style put protocol over TCP,
+// and writes them into the store in batches per series.
+type Server struct {
+	addr    string
+	batcher *storage.Batcher
+
+	listener net.Listener
+	connsMu  sync.Mutex // guards listener and conns
+	conns    map[net.Conn]struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	received  uint64
+	malformed uint64
+}
+
+// Stats represents the counters of the Server.
+type Stats struct {
+	Received  uint64 `json:"received"`
+	Malformed uint64 `json:"malformed"`
+	Written   uint64 `json:"written"`
+	Failed    uint64 `json:"failed"`
+}
+
+// Option for the telnet Server.
+type Option struct {
+	Addr          string
+	Store         storage.ReadWriter
+	FlushInterval time.Duration
+}
+
+// New initializes a new telnet Server.
+func New(o *Option) *Server {
+	return &Server{
+		addr:    o.Addr,
+		batcher: storage.NewBatcher(o.Store, o.FlushInterval),
+		conns:   make(map[net.Conn]struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Run listens on the TCP address and serves until Shutdown is called.
+func (s *Server) Run() error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen opentsdb telnet (%s)", s.addr)
+	}
+	// Shutdown may be called before listening.
+	s.connsMu.Lock()
+	select {
+	case <-s.done:
+		s.connsMu.Unlock()
+		return l.Close()
+	default:
+	}
+	s.listener = l
+	s.wg.Add(1)
+	s.connsMu.Unlock()
+	log.Printf("Listening opentsdb telnet on tcp %s\n", s.addr)
+	go s.serve(l)
+
+	s.batcher.Run(s.done)
+	return nil
+}
+
+// Shutdown closes the listener and flushes the buffered datapoints.
+func (s *Server) Shutdown(sig os.Signal) error {
+	log.Printf("Received %s shutdown opentsdb telnet listener...\n", sig)
+	s.connsMu.Lock()
+	close(s.done)
+	listener := s.listener
+	s.connsMu.Unlock()
+	if listener != nil {
+		if err := listener.Close(); err != nil {
+			return errors.Wrap(err, "failed to close opentsdb telnet listener")
+		}
+	}
+	// Close the idle connections kept open by the clients.
+	s.connsMu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connsMu.Unlock()
+	s.wg.Wait()
+	s.batcher.Flush()
+	return nil
+}
+
+// Stats returns the snapshot of the counters.
+func (s *Server) Stats() Stats {
+	return Stats{
+		Received:  atomic.LoadUint64(&s.received),
+		Malformed: atomic.LoadUint64(&s.malformed),
+		Written:   s.batcher.Written(),
+		Failed:    s.batcher.Failed(),
+	}
+}
+
+func (s *Server) serve(l net.Listener) {
+	defer s.wg.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			log.Printf("failed to accept opentsdb telnet connection: %s\n", err)
+			continue
+		}
+		s.connsMu.Lock()
+		select {
+		case <-s.done:
+			// Shutdown has already closed the tracked connections.
+			s.connsMu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.connsMu.Unlock()
+		go func(conn net.Conn) {
+			defer s.wg.Done()
+			defer func() {
+				s.connsMu.Lock()
+				delete(s.conns, conn)
+				s.connsMu.Unlock()
+				conn.Close()
+			}()
+			s.handleConn(conn, conn)
+		}(conn)
+	}
+}
+
+// handleConn handles the commands. Same as OpenTSDB, nothing is replied to
+// the successful put and the error message is replied to the failed command.
+func (s *Server) handleConn(r io.Reader, w io.Writer) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		switch strings.SplitN(line, " ", 2)[0] {
+		case "put":
+			atomic.AddUint64(&s.received, 1)
+			name, p, err := ParsePutLine(line)
+			if err != nil {
+				atomic.AddUint64(&s.malformed, 1)
+				log.Println(err)
+				fmt.Fprintf(w, "%s\n", err)
+				continue
+			}
+			s.batcher.Add(name, p)
+		case "version":
+			fmt.Fprintf(w, "diamondb opentsdb-compatible telnet server\n")
+		case "exit":
+			return
+		default:
+			fmt.Fprintf(w, "unknown command: %s.\n", strings.SplitN(line, " ", 2)[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("failed to read opentsdb telnet stream: %s\n", err)
+	}
+}
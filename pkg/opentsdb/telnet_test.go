@@ -0,0 +1,57 @@
+package opentsdb
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage"
+)
+
+func TestServerHandleConn(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got = map[string][]*model.Datapoint{}
+	)
+	s := New(&Option{
+		Store: &storage.FakeReadWriter{
+			FakeInsertMetric: func(m *model.Metric) error {
+				mu.Lock()
+				defer mu.Unlock()
+				got[m.Name] = append(got[m.Name], m.Datapoints...)
+				return nil
+			},
+		},
+		FlushInterval: time.Second,
+	})
+
+	out := new(bytes.Buffer)
+	s.handleConn(strings.NewReader(strings.Join([]string{
+		"put sys.cpu.user 1500000000 1 host=web01",
+		"put sys.cpu.user 1500000060 2 host=web01",
+		"put sys.cpu.user abc 2 host=web01",
+		"unknown",
+		"exit",
+		"put sys.cpu.user 1500000120 3 host=web01",
+	}, "\n")), out)
+	s.batcher.Flush()
+
+	expected := map[string][]*model.Datapoint{
+		"sys.cpu.user.host.web01": {{Timestamp: 1500000000, Value: 1}, {Timestamp: 1500000060, Value: 2}},
+	}
+	if diff := pretty.Compare(got, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 2 {
+		t.Fatalf("should reply 2 error lines, not %q", out.String())
+	}
+	expectedStats := Stats{Received: 3, Malformed: 1, Written: 2, Failed: 0}
+	if diff := pretty.Compare(s.Stats(), expectedStats); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
@@ -0,0 +1,98 @@
+package otlp
+
+import (
+	"strconv"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/util"
+)
+
+// Converter converts the OTLP metrics into DiamonDB series.
+//
+// The data points are written as they are. The delta sums and histograms are
+// written as the increments over each interval, not converted into cumulative
+// series, since the running totals kept in memory would be lost on restart and
+// counted twice on retried requests. The totals over a period are read by
+// summarize() with the sum function.
+//
+// A histogram is flattened into the series '<metric>.count', '<metric>.sum' and
+// '<metric>.bucket.<upper bound>', whose buckets are cumulative as Prometheus.
+type Converter struct {
+	tmpl NameTemplate
+}
+
+// NewConverter creates a new Converter naming series by tmpl.
+func NewConverter(tmpl NameTemplate) *Converter {
+	return &Converter{tmpl: tmpl}
+}
+
+// ToMetrics converts rms into metrics. It returns the number of data points
+// rejected because of the unsupported kinds such as summaries.
+func (c *Converter) ToMetrics(rms []*ResourceMetrics) ([]*model.Metric, int) {
+	var (
+		metrics  = make(map[string]*model.Metric)
+		names    []string
+		rejected = 0
+	)
+	add := func(name string, ts int64, v float64) {
+		m, ok := metrics[name]
+		if !ok {
+			m = &model.Metric{Name: name}
+			metrics[name] = m
+			names = append(names, name)
+		}
+		m.Datapoints = append(m.Datapoints, &model.Datapoint{Timestamp: ts, Value: v})
+	}
+
+	for _, rm := range rms {
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				name := func(suffix string, attrs []KeyValue) string {
+					return c.tmpl.Name(rm.Resource, &sm.Scope, m.Name+suffix, attrs)
+				}
+				switch m.Kind {
+				case KindGauge, KindSum:
+					for _, p := range m.NumberPoints {
+						if p.Flags&flagNoRecordedValue != 0 {
+							continue
+						}
+						ts := int64(p.TimeUnixNano / 1e9)
+						n := name("", p.Attributes)
+						add(n, ts, p.Value)
+					}
+				case KindHistogram:
+					for _, p := range m.HistogramPoints {
+						if p.Flags&flagNoRecordedValue != 0 {
+							continue
+						}
+						ts := int64(p.TimeUnixNano / 1e9)
+						n := name(".count", p.Attributes)
+						add(n, ts, float64(p.Count))
+						if p.HasSum {
+							n = name(".sum", p.Attributes)
+							add(n, ts, p.Sum)
+						}
+						cumulative := uint64(0)
+						for i, count := range p.BucketCounts {
+							cumulative += count
+							bound := "inf"
+							if i < len(p.ExplicitBounds) {
+								bound = util.SanitizeNode(strconv.FormatFloat(p.ExplicitBounds[i], 'f', -1, 64))
+							}
+							n = name(".bucket."+bound, p.Attributes)
+							add(n, ts, float64(cumulative))
+						}
+					}
+				default:
+					rejected += m.UnsupportedPoints
+				}
+			}
+		}
+	}
+
+	result := make([]*model.Metric, 0, len(names))
+	for _, name := range names {
+		result = append(result, metrics[name])
+	}
+	return result, rejected
+}
@@ -0,0 +1,65 @@
+package otlp
+
+import (
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+)
+
+func TestConverterToMetrics(t *testing.T) {
+	rms, err := DecodeExportRequest(testExportRequest())
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	tmpl, _ := ParseNameTemplate("")
+	c := NewConverter(tmpl)
+
+	metrics, rejected := c.ToMetrics(rms)
+	if rejected != 2 {
+		t.Fatalf("rejected should be 2, not %d", rejected)
+	}
+	expected := []*model.Metric{
+		{Name: "api.process.threads", Datapoints: []*model.Datapoint{{Timestamp: 1500000000, Value: 12}}},
+		{Name: "api.http.requests.http_method.GET", Datapoints: []*model.Datapoint{{Timestamp: 1500000000, Value: 3}}},
+		{Name: "api.http.duration.count", Datapoints: []*model.Datapoint{{Timestamp: 1500000000, Value: 6}}},
+		{Name: "api.http.duration.sum", Datapoints: []*model.Datapoint{{Timestamp: 1500000000, Value: 2.5}}},
+		{Name: "api.http.duration.bucket.0_1", Datapoints: []*model.Datapoint{{Timestamp: 1500000000, Value: 1}}},
+		{Name: "api.http.duration.bucket.1", Datapoints: []*model.Datapoint{{Timestamp: 1500000000, Value: 3}}},
+		{Name: "api.http.duration.bucket.inf", Datapoints: []*model.Datapoint{{Timestamp: 1500000000, Value: 6}}},
+	}
+	if diff := pretty.Compare(metrics, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	// The delta sum is not accumulated across the requests, so the retried request
+	// is converted into the same metrics.
+	metrics, _ = c.ToMetrics(rms)
+	if diff := pretty.Compare(metrics, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestConverterToMetrics_NoRecordedValue(t *testing.T) {
+	rms := []*ResourceMetrics{{
+		ScopeMetrics: []*ScopeMetrics{{
+			Metrics: []*Metric{{
+				Name: "up",
+				Kind: KindGauge,
+				NumberPoints: []*NumberDataPoint{
+					{TimeUnixNano: 1500000000 * 1e9, Value: 1},
+					{TimeUnixNano: 1500000060 * 1e9, Flags: flagNoRecordedValue},
+				},
+			}},
+		}},
+	}}
+	tmpl, _ := ParseNameTemplate("{metric}")
+	metrics, _ := NewConverter(tmpl).ToMetrics(rms)
+	expected := []*model.Metric{
+		{Name: "up", Datapoints: []*model.Datapoint{{Timestamp: 1500000000, Value: 1}}},
+	}
+	if diff := pretty.Compare(metrics, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
@@ -0,0 +1,495 @@
+// Package otlp receives the metrics exported by OpenTelemetry Protocol (OTLP).
+package otlp
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/protowire"
+)
+
+// Kind is the type of the data of a metric.
+type Kind int
+
+// Kinds of the metric data.
+const (
+	KindEmpty Kind = iota
+	KindGauge
+	KindSum
+	KindHistogram
+	KindExponentialHistogram
+	KindSummary
+)
+
+// Temporality is the aggregation temporality of sums and histograms.
+type Temporality int
+
+// Aggregation temporalities.
+const (
+	TemporalityUnspecified Temporality = 0
+	TemporalityDelta       Temporality = 1
+	TemporalityCumulative  Temporality = 2
+)
+
+// flagNoRecordedValue is the data point flag to indicate the absence of the value.
+const flagNoRecordedValue = 1
+
+// KeyValue is an attribute. The value is formatted as a string.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// Scope is the instrumentation scope.
+type Scope struct {
+	Name       string
+	Version    string
+	Attributes []KeyValue
+}
+
+// NumberDataPoint is a data point of gauges and sums.
+type NumberDataPoint struct {
+	Attributes   []KeyValue
+	TimeUnixNano uint64
+	Value        float64
+	Flags        uint32
+}
+
+// HistogramDataPoint is a data point of histograms with explicit bounds.
+type HistogramDataPoint struct {
+	Attributes     []KeyValue
+	TimeUnixNano   uint64
+	Count          uint64
+	Sum            float64
+	HasSum         bool
+	BucketCounts   []uint64
+	ExplicitBounds []float64
+	Flags          uint32
+}
+
+// Metric is a metric with the data points.
+type Metric struct {
+	Name            string
+	Kind            Kind
+	Temporality     Temporality
+	NumberPoints    []*NumberDataPoint
+	HistogramPoints []*HistogramDataPoint
+	// UnsupportedPoints is the number of data points of the unsupported kinds.
+	UnsupportedPoints int
+}
+
+// ScopeMetrics is the metrics of an instrumentation scope.
+type ScopeMetrics struct {
+	Scope   Scope
+	Metrics []*Metric
+}
+
+// ResourceMetrics is the metrics of a resource.
+type ResourceMetrics struct {
+	Resource     []KeyValue
+	ScopeMetrics []*ScopeMetrics
+}
+
+// walk calls fn for each field of the message b. The fields not handled by fn are skipped.
+func walk(b []byte, fn func(r *protowire.Reader, field, wireType int) (bool, error)) error {
+	r := protowire.NewReader(b)
+	for !r.EOF() {
+		field, wireType, err := r.Next()
+		if err != nil {
+			return err
+		}
+		handled, err := fn(r, field, wireType)
+		if err != nil {
+			return err
+		}
+		if !handled {
+			if err := r.Skip(wireType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// walkMessages calls fn for each embedded message of the field.
+func walkMessages(b []byte, field int, fn func([]byte) error) error {
+	return walk(b, func(r *protowire.Reader, f, wireType int) (bool, error) {
+		if f != field || wireType != protowire.WireBytes {
+			return false, nil
+		}
+		msg, err := r.Bytes()
+		if err != nil {
+			return true, err
+		}
+		return true, fn(msg)
+	})
+}
+
+// DecodeExportRequest decodes the protobuf ExportMetricsServiceRequest.
+func DecodeExportRequest(b []byte) ([]*ResourceMetrics, error) {
+	var rms []*ResourceMetrics
+	err := walkMessages(b, 1, func(msg []byte) error {
+		rm, err := decodeResourceMetrics(msg)
+		if err != nil {
+			return err
+		}
+		rms = append(rms, rm)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode ExportMetricsServiceRequest")
+	}
+	return rms, nil
+}
+
+func decodeResourceMetrics(b []byte) (*ResourceMetrics, error) {
+	rm := &ResourceMetrics{}
+	err := walk(b, func(r *protowire.Reader, field, wireType int) (bool, error) {
+		if wireType != protowire.WireBytes {
+			return false, nil
+		}
+		switch field {
+		case 1:
+			msg, err := r.Bytes()
+			if err != nil {
+				return true, err
+			}
+			rm.Resource, err = decodeAttributes(msg, 1)
+			return true, err
+		// 1000 is the deprecated instrumentation_library_metrics, which has
+		// the same structure as scope_metrics.
+		case 2, 1000:
+			msg, err := r.Bytes()
+			if err != nil {
+				return true, err
+			}
+			sm, err := decodeScopeMetrics(msg)
+			if err != nil {
+				return true, err
+			}
+			rm.ScopeMetrics = append(rm.ScopeMetrics, sm)
+			return true, nil
+		}
+		return false, nil
+	})
+	return rm, err
+}
+
+func decodeScopeMetrics(b []byte) (*ScopeMetrics, error) {
+	sm := &ScopeMetrics{}
+	err := walk(b, func(r *protowire.Reader, field, wireType int) (bool, error) {
+		if wireType != protowire.WireBytes {
+			return false, nil
+		}
+		switch field {
+		case 1:
+			msg, err := r.Bytes()
+			if err != nil {
+				return true, err
+			}
+			sm.Scope, err = decodeScope(msg)
+			return true, err
+		case 2:
+			msg, err := r.Bytes()
+			if err != nil {
+				return true, err
+			}
+			m, err := decodeMetric(msg)
+			if err != nil {
+				return true, err
+			}
+			sm.Metrics = append(sm.Metrics, m)
+			return true, nil
+		}
+		return false, nil
+	})
+	return sm, err
+}
+
+func decodeScope(b []byte) (Scope, error) {
+	var s Scope
+	err := walk(b, func(r *protowire.Reader, field, wireType int) (bool, error) {
+		if wireType != protowire.WireBytes {
+			return false, nil
+		}
+		var err error
+		switch field {
+		case 1:
+			s.Name, err = r.String()
+		case 2:
+			s.Version, err = r.String()
+		case 3:
+			var msg []byte
+			if msg, err = r.Bytes(); err == nil {
+				var kv KeyValue
+				if kv, err = decodeKeyValue(msg); err == nil {
+					s.Attributes = append(s.Attributes, kv)
+				}
+			}
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	return s, err
+}
+
+// decodeAttributes decodes the repeated KeyValue field of the message b.
+func decodeAttributes(b []byte, field int) ([]KeyValue, error) {
+	var attrs []KeyValue
+	err := walkMessages(b, field, func(msg []byte) error {
+		kv, err := decodeKeyValue(msg)
+		if err != nil {
+			return err
+		}
+		attrs = append(attrs, kv)
+		return nil
+	})
+	return attrs, err
+}
+
+func decodeKeyValue(b []byte) (KeyValue, error) {
+	var kv KeyValue
+	err := walk(b, func(r *protowire.Reader, field, wireType int) (bool, error) {
+		if wireType != protowire.WireBytes {
+			return false, nil
+		}
+		var err error
+		switch field {
+		case 1:
+			kv.Key, err = r.String()
+		case 2:
+			var msg []byte
+			if msg, err = r.Bytes(); err == nil {
+				kv.Value, err = decodeAnyValue(msg)
+			}
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	return kv, err
+}
+
+// decodeAnyValue formats the scalar AnyValue as a string. The arrays, key-value
+// lists and bytes are regarded as empty.
+func decodeAnyValue(b []byte) (string, error) {
+	var s string
+	err := walk(b, func(r *protowire.Reader, field, wireType int) (bool, error) {
+		switch {
+		case field == 1 && wireType == protowire.WireBytes:
+			v, err := r.String()
+			s = v
+			return true, err
+		case field == 2 && wireType == protowire.WireVarint:
+			v, err := r.Varint()
+			s = strconv.FormatBool(v != 0)
+			return true, err
+		case field == 3 && wireType == protowire.WireVarint:
+			v, err := r.Varint()
+			s = strconv.FormatInt(int64(v), 10)
+			return true, err
+		case field == 4 && wireType == protowire.WireFixed64:
+			v, err := r.Double()
+			s = strconv.FormatFloat(v, 'f', -1, 64)
+			return true, err
+		}
+		return false, nil
+	})
+	return s, err
+}
+
+func decodeMetric(b []byte) (*Metric, error) {
+	m := &Metric{}
+	err := walk(b, func(r *protowire.Reader, field, wireType int) (bool, error) {
+		if wireType != protowire.WireBytes {
+			return false, nil
+		}
+		var err error
+		switch field {
+		case 1:
+			m.Name, err = r.String()
+		case 5, 7:
+			var msg []byte
+			if msg, err = r.Bytes(); err == nil {
+				m.Kind = KindGauge
+				if field == 7 {
+					m.Kind = KindSum
+				}
+				err = decodeNumberData(msg, m)
+			}
+		case 9:
+			var msg []byte
+			if msg, err = r.Bytes(); err == nil {
+				m.Kind = KindHistogram
+				err = decodeHistogramData(msg, m)
+			}
+		case 10, 11:
+			var msg []byte
+			if msg, err = r.Bytes(); err == nil {
+				m.Kind = KindExponentialHistogram
+				if field == 11 {
+					m.Kind = KindSummary
+				}
+				err = walkMessages(msg, 1, func([]byte) error {
+					m.UnsupportedPoints++
+					return nil
+				})
+			}
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	return m, err
+}
+
+// decodeNumberData decodes Gauge or Sum into m.
+func decodeNumberData(b []byte, m *Metric) error {
+	return walk(b, func(r *protowire.Reader, field, wireType int) (bool, error) {
+		switch {
+		case field == 1 && wireType == protowire.WireBytes:
+			msg, err := r.Bytes()
+			if err != nil {
+				return true, err
+			}
+			p, err := decodeNumberDataPoint(msg)
+			if err != nil {
+				return true, err
+			}
+			m.NumberPoints = append(m.NumberPoints, p)
+			return true, nil
+		case field == 2 && wireType == protowire.WireVarint:
+			v, err := r.Varint()
+			m.Temporality = Temporality(v)
+			return true, err
+		}
+		return false, nil
+	})
+}
+
+func decodeNumberDataPoint(b []byte) (*NumberDataPoint, error) {
+	p := &NumberDataPoint{}
+	err := walk(b, func(r *protowire.Reader, field, wireType int) (bool, error) {
+		switch {
+		case field == 7 && wireType == protowire.WireBytes:
+			msg, err := r.Bytes()
+			if err != nil {
+				return true, err
+			}
+			kv, err := decodeKeyValue(msg)
+			p.Attributes = append(p.Attributes, kv)
+			return true, err
+		case field == 3 && wireType == protowire.WireFixed64:
+			v, err := r.Fixed64()
+			p.TimeUnixNano = v
+			return true, err
+		case field == 4 && wireType == protowire.WireFixed64:
+			v, err := r.Double()
+			p.Value = v
+			return true, err
+		case field == 6 && wireType == protowire.WireFixed64:
+			v, err := r.Fixed64()
+			p.Value = float64(int64(v))
+			return true, err
+		case field == 8 && wireType == protowire.WireVarint:
+			v, err := r.Varint()
+			p.Flags = uint32(v)
+			return true, err
+		}
+		return false, nil
+	})
+	return p, err
+}
+
+// decodeHistogramData decodes Histogram into m.
+func decodeHistogramData(b []byte, m *Metric) error {
+	return walk(b, func(r *protowire.Reader, field, wireType int) (bool, error) {
+		switch {
+		case field == 1 && wireType == protowire.WireBytes:
+			msg, err := r.Bytes()
+			if err != nil {
+				return true, err
+			}
+			p, err := decodeHistogramDataPoint(msg)
+			if err != nil {
+				return true, err
+			}
+			m.HistogramPoints = append(m.HistogramPoints, p)
+			return true, nil
+		case field == 2 && wireType == protowire.WireVarint:
+			v, err := r.Varint()
+			m.Temporality = Temporality(v)
+			return true, err
+		}
+		return false, nil
+	})
+}
+
+func decodeHistogramDataPoint(b []byte) (*HistogramDataPoint, error) {
+	p := &HistogramDataPoint{}
+	err := walk(b, func(r *protowire.Reader, field, wireType int) (bool, error) {
+		switch {
+		case field == 9 && wireType == protowire.WireBytes:
+			msg, err := r.Bytes()
+			if err != nil {
+				return true, err
+			}
+			kv, err := decodeKeyValue(msg)
+			p.Attributes = append(p.Attributes, kv)
+			return true, err
+		case field == 3 && wireType == protowire.WireFixed64:
+			v, err := r.Fixed64()
+			p.TimeUnixNano = v
+			return true, err
+		case field == 4 && wireType == protowire.WireFixed64:
+			v, err := r.Fixed64()
+			p.Count = v
+			return true, err
+		case field == 5 && wireType == protowire.WireFixed64:
+			v, err := r.Double()
+			p.Sum, p.HasSum = v, true
+			return true, err
+		// The repeated fields are packed by default, but the unpacked ones are also valid.
+		case field == 6 && wireType == protowire.WireBytes:
+			vs, err := r.PackedFixed64()
+			p.BucketCounts = append(p.BucketCounts, vs...)
+			return true, err
+		case field == 6 && wireType == protowire.WireFixed64:
+			v, err := r.Fixed64()
+			p.BucketCounts = append(p.BucketCounts, v)
+			return true, err
+		case field == 7 && wireType == protowire.WireBytes:
+			vs, err := r.PackedFixed64()
+			for _, v := range vs {
+				p.ExplicitBounds = append(p.ExplicitBounds, math.Float64frombits(v))
+			}
+			return true, err
+		case field == 7 && wireType == protowire.WireFixed64:
+			v, err := r.Double()
+			p.ExplicitBounds = append(p.ExplicitBounds, v)
+			return true, err
+		case field == 10 && wireType == protowire.WireVarint:
+			v, err := r.Varint()
+			p.Flags = uint32(v)
+			return true, err
+		}
+		return false, nil
+	})
+	return p, err
+}
+
+// EncodeExportResponse encodes the protobuf ExportMetricsServiceResponse. The partial
+// success is set only if some data points are rejected.
+func EncodeExportResponse(rejected int, msg string) []byte {
+	w := &protowire.Writer{}
+	if rejected > 0 {
+		partial := &protowire.Writer{}
+		partial.Varint(1, uint64(rejected))
+		partial.String(2, msg)
+		w.BytesField(1, partial.Bytes())
+	}
+	return w.Bytes()
+}
@@ -0,0 +1,166 @@
+package otlp
+
+import (
+	"math"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/protowire"
+)
+
+func encodeKeyValue(field int, key, value string) func(w *protowire.Writer) {
+	return func(w *protowire.Writer) {
+		any := &protowire.Writer{}
+		any.String(1, value)
+		kv := &protowire.Writer{}
+		kv.String(1, key)
+		kv.BytesField(2, any.Bytes())
+		w.BytesField(field, kv.Bytes())
+	}
+}
+
+func message(fns ...func(w *protowire.Writer)) []byte {
+	w := &protowire.Writer{}
+	for _, fn := range fns {
+		fn(w)
+	}
+	return w.Bytes()
+}
+
+func field(n int, fns ...func(w *protowire.Writer)) func(w *protowire.Writer) {
+	return func(w *protowire.Writer) {
+		w.BytesField(n, message(fns...))
+	}
+}
+
+// testExportRequest builds an ExportMetricsServiceRequest with a gauge, a delta sum,
+// a histogram and a summary.
+func testExportRequest() []byte {
+	const ts = 1500000000 * 1e9
+	return message(field(1, // resource_metrics
+		field(1, encodeKeyValue(1, "service.name", "api")), // resource
+		field(2, // scope_metrics
+			field(1, func(w *protowire.Writer) { w.String(1, "otel.http") }), // scope
+			field(2, // metric
+				func(w *protowire.Writer) { w.String(1, "process.threads") },
+				field(5, field(1, // gauge.data_points
+					func(w *protowire.Writer) { w.Fixed64(3, ts) },
+					func(w *protowire.Writer) { w.Fixed64(6, uint64(12)) },
+				)),
+			),
+			field(2,
+				func(w *protowire.Writer) { w.String(1, "http.requests") },
+				field(7, // sum
+					field(1,
+						encodeKeyValue(7, "http.method", "GET"),
+						func(w *protowire.Writer) { w.Fixed64(3, ts) },
+						func(w *protowire.Writer) { w.Double(4, 3) },
+					),
+					func(w *protowire.Writer) { w.Varint(2, uint64(TemporalityDelta)) },
+					func(w *protowire.Writer) { w.Varint(3, 1) },
+				),
+			),
+			field(2,
+				func(w *protowire.Writer) { w.String(1, "http.duration") },
+				field(9, // histogram
+					field(1,
+						func(w *protowire.Writer) { w.Fixed64(3, ts) },
+						func(w *protowire.Writer) { w.Fixed64(4, 6) },
+						func(w *protowire.Writer) { w.Double(5, 2.5) },
+						func(w *protowire.Writer) { w.PackedFixed64(6, []uint64{1, 2, 3}) },
+						func(w *protowire.Writer) {
+							w.PackedFixed64(7, []uint64{math.Float64bits(0.1), math.Float64bits(1)})
+						},
+					),
+					func(w *protowire.Writer) { w.Varint(2, uint64(TemporalityCumulative)) },
+				),
+			),
+			field(2,
+				func(w *protowire.Writer) { w.String(1, "rpc.duration") },
+				field(11, field(1), field(1)), // summary
+			),
+		),
+	))
+}
+
+func TestDecodeExportRequest(t *testing.T) {
+	got, err := DecodeExportRequest(testExportRequest())
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	expected := []*ResourceMetrics{
+		{
+			Resource: []KeyValue{{Key: "service.name", Value: "api"}},
+			ScopeMetrics: []*ScopeMetrics{
+				{
+					Scope: Scope{Name: "otel.http"},
+					Metrics: []*Metric{
+						{
+							Name: "process.threads",
+							Kind: KindGauge,
+							NumberPoints: []*NumberDataPoint{
+								{TimeUnixNano: 1500000000 * 1e9, Value: 12},
+							},
+						},
+						{
+							Name:        "http.requests",
+							Kind:        KindSum,
+							Temporality: TemporalityDelta,
+							NumberPoints: []*NumberDataPoint{
+								{
+									Attributes:   []KeyValue{{Key: "http.method", Value: "GET"}},
+									TimeUnixNano: 1500000000 * 1e9,
+									Value:        3,
+								},
+							},
+						},
+						{
+							Name:        "http.duration",
+							Kind:        KindHistogram,
+							Temporality: TemporalityCumulative,
+							HistogramPoints: []*HistogramDataPoint{
+								{
+									TimeUnixNano:   1500000000 * 1e9,
+									Count:          6,
+									Sum:            2.5,
+									HasSum:         true,
+									BucketCounts:   []uint64{1, 2, 3},
+									ExplicitBounds: []float64{0.1, 1},
+								},
+							},
+						},
+						{
+							Name:              "rpc.duration",
+							Kind:              KindSummary,
+							UnsupportedPoints: 2,
+						},
+					},
+				},
+			},
+		},
+	}
+	if diff := pretty.Compare(got, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestDecodeExportRequest_Truncated(t *testing.T) {
+	b := testExportRequest()
+	if _, err := DecodeExportRequest(b[:len(b)-1]); err == nil {
+		t.Fatalf("should raise err")
+	}
+}
+
+func TestEncodeExportResponse(t *testing.T) {
+	if b := EncodeExportResponse(0, ""); len(b) != 0 {
+		t.Fatalf("response should be empty, not %v", b)
+	}
+	expected := message(field(1,
+		func(w *protowire.Writer) { w.Varint(1, 2) },
+		func(w *protowire.Writer) { w.String(2, "unsupported") },
+	))
+	if diff := pretty.Compare(EncodeExportResponse(2, "unsupported"), expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
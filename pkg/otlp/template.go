@@ -0,0 +1,150 @@
+package otlp
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/storage/util"
+)
+
+// DefaultNameTemplate is the default template to map a data point into a series name.
+const DefaultNameTemplate = "{resource.service.name}.{metric}.{attributes}"
+
+// NameTemplate maps a data point with the resource and the scope into a dotted
+// series name. The template is the dot-separated list of literal nodes and the
+// placeholders. {metric} is the metric name, whose dots are kept as the hierarchy.
+// {attributes} is the data point attributes sorted by the key as '<key>.<value>'.
+// {resource.<key>} is the value of the resource attribute, and {resource} is the rest
+// of the resource attributes sorted by the key as '<key>.<value>'. {scope.name},
+// {scope.version} and {scope.<key>} are the name, the version and the attribute of
+// the instrumentation scope. The attribute keys may contain dots in the braces.
+// The placeholders of the missing values are omitted.
+// ex. the default template maps the metric 'http.server.duration' of the service
+// 'api' with {http.method="GET"} into "api.http.server.duration.http_method.GET".
+type NameTemplate []string
+
+// ParseNameTemplate parses the template string.
+func ParseNameTemplate(s string) (NameTemplate, error) {
+	if s == "" {
+		s = DefaultNameTemplate
+	}
+	var (
+		nodes  []string
+		start  = 0
+		depth  = 0
+		metric = false
+	)
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) {
+			switch s[i] {
+			case '{':
+				depth++
+				continue
+			case '}':
+				depth--
+				continue
+			case '.':
+				if depth > 0 {
+					continue
+				}
+			default:
+				continue
+			}
+		}
+		node := s[start:i]
+		start = i + 1
+		if node == "" {
+			return nil, errors.Errorf("empty node in the name template %q", s)
+		}
+		if strings.ContainsAny(node, "{}") {
+			if node[0] != '{' || node[len(node)-1] != '}' || strings.Count(node, "{") != 1 {
+				return nil, errors.Errorf("invalid placeholder %q in the name template %q", node, s)
+			}
+			switch p := node[1 : len(node)-1]; {
+			case p == "metric":
+				metric = true
+			case p == "attributes", p == "resource":
+			case strings.HasPrefix(p, "resource.") && len(p) > len("resource."):
+			case strings.HasPrefix(p, "scope.") && len(p) > len("scope."):
+			default:
+				return nil, errors.Errorf("unknown placeholder %q in the name template %q", node, s)
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	if depth != 0 {
+		return nil, errors.Errorf("unbalanced braces in the name template %q", s)
+	}
+	if !metric {
+		return nil, errors.Errorf("{metric} is required in the name template %q", s)
+	}
+	return NameTemplate(nodes), nil
+}
+
+// Name returns the series name of the metric named metric with the attributes.
+func (tmpl NameTemplate) Name(resource []KeyValue, scope *Scope, metric string, attrs []KeyValue) string {
+	resourceValues := make(map[string]string, len(resource))
+	for _, kv := range resource {
+		resourceValues[kv.Key] = kv.Value
+	}
+	used := make(map[string]bool, len(tmpl))
+	for _, node := range tmpl {
+		if strings.HasPrefix(node, "{resource.") {
+			used[node[len("{resource."):len(node)-1]] = true
+		}
+	}
+
+	nodes := make([]string, 0, len(tmpl)+len(attrs)*2)
+	appendValue := func(v string) {
+		if v != "" {
+			nodes = append(nodes, util.SanitizeNode(v))
+		}
+	}
+	for _, node := range tmpl {
+		if node[0] != '{' {
+			nodes = append(nodes, node)
+			continue
+		}
+		switch p := node[1 : len(node)-1]; {
+		case p == "metric":
+			for _, n := range strings.Split(metric, ".") {
+				appendValue(n)
+			}
+		case p == "attributes":
+			nodes = appendKeyValues(nodes, attrs, nil)
+		case p == "resource":
+			nodes = appendKeyValues(nodes, resource, used)
+		case p == "scope.name":
+			appendValue(scope.Name)
+		case p == "scope.version":
+			appendValue(scope.Version)
+		case strings.HasPrefix(p, "scope."):
+			key := p[len("scope."):]
+			for _, kv := range scope.Attributes {
+				if kv.Key == key {
+					appendValue(kv.Value)
+				}
+			}
+		case strings.HasPrefix(p, "resource."):
+			appendValue(resourceValues[p[len("resource."):]])
+		}
+	}
+	return strings.Join(nodes, ".")
+}
+
+// appendKeyValues appends the attributes not in excluded sorted by the key as '<key>.<value>'.
+func appendKeyValues(nodes []string, kvs []KeyValue, excluded map[string]bool) []string {
+	sorted := make([]KeyValue, 0, len(kvs))
+	for _, kv := range kvs {
+		if kv.Value != "" && !excluded[kv.Key] {
+			sorted = append(sorted, kv)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	for _, kv := range sorted {
+		nodes = append(nodes, util.SanitizeNode(kv.Key), util.SanitizeNode(kv.Value))
+	}
+	return nodes
+}
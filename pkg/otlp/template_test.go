@@ -0,0 +1,81 @@
+package otlp
+
+import (
+	"testing"
+)
+
+func TestParseNameTemplate(t *testing.T) {
+	valids := []string{
+		"",
+		"{metric}",
+		"otel.{resource.service.name}.{scope.name}.{metric}.{resource}.{attributes}",
+		"{scope.version}.{scope.library.language}.{metric}",
+	}
+	for _, s := range valids {
+		if _, err := ParseNameTemplate(s); err != nil {
+			t.Fatalf("template: %q, should not raise err: %s", s, err)
+		}
+	}
+	invalids := []string{
+		"{resource.service.name}",
+		"{metric}..{attributes}",
+		"{metric",
+		"{metric}}",
+		"x{metric}",
+		"{metric}.{unknown}",
+		"{metric}.{resource.}",
+	}
+	for _, s := range invalids {
+		if _, err := ParseNameTemplate(s); err == nil {
+			t.Fatalf("template: %q, should raise err", s)
+		}
+	}
+}
+
+func TestNameTemplateName(t *testing.T) {
+	resource := []KeyValue{
+		{Key: "service.name", Value: "api"},
+		{Key: "host.name", Value: "web01.example.com"},
+		{Key: "cloud.region", Value: "ap-northeast-1"},
+	}
+	scope := &Scope{
+		Name:       "otel.http",
+		Version:    "1.0",
+		Attributes: []KeyValue{{Key: "team", Value: "sre"}},
+	}
+	attrs := []KeyValue{
+		{Key: "http.status_code", Value: "200"},
+		{Key: "http.method", Value: "GET"},
+		{Key: "empty", Value: ""},
+	}
+	tests := []struct {
+		tmpl     string
+		expected string
+	}{
+		{
+			"",
+			"api.http.server.duration.http_method.GET.http_status_code.200",
+		},
+		{
+			"{resource.service.name}.{metric}.{resource}",
+			"api.http.server.duration.cloud_region.ap-northeast-1.host_name.web01_example_com",
+		},
+		{
+			"otel.{scope.name}.{scope.version}.{scope.team}.{metric}",
+			"otel.otel_http.1_0.sre.http.server.duration",
+		},
+		{
+			"{resource.missing}.{metric}",
+			"http.server.duration",
+		},
+	}
+	for _, tc := range tests {
+		tmpl, err := ParseNameTemplate(tc.tmpl)
+		if err != nil {
+			t.Fatalf("template: %q, should not raise err: %s", tc.tmpl, err)
+		}
+		if got := tmpl.Name(resource, scope, "http.server.duration", attrs); got != tc.expected {
+			t.Fatalf("template: %q, name should be %q, not %q", tc.tmpl, tc.expected, got)
+		}
+	}
+}
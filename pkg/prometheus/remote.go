@@ -0,0 +1,257 @@
+// Package prometheus receives the samples sent by Prometheus remote_write.
+package prometheus
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/protowire"
+	"github.com/yuuki/diamondb/pkg/storage/util"
+)
+
+const (
+	// MetricNameLabel is the label name indicating the metric name.
+	MetricNameLabel = "__name__"
+	// DefaultNameTemplate is the default template to map labels into a series name.
+	DefaultNameTemplate = MetricNameLabel + ".*"
+
+	// staleNaN is the bit pattern of the staleness marker of Prometheus.
+	staleNaN uint64 = 0x7ff0000000000002
+)
+
+// Label is a pair of label name and value.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a pair of value and timestamp in milliseconds.
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// TimeSeries is a labeled series of samples.
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+// DecodeWriteRequest decodes the snappy-compressed protobuf WriteRequest.
+func DecodeWriteRequest(compressed []byte) ([]*TimeSeries, error) {
+	b, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode snappy")
+	}
+	var tss []*TimeSeries
+	r := protowire.NewReader(b)
+	for !r.EOF() {
+		field, wireType, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if field != 1 || wireType != protowire.WireBytes {
+			// Skip metadata and unknown fields.
+			if err := r.Skip(wireType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		msg, err := r.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		ts, err := decodeTimeSeries(msg)
+		if err != nil {
+			return nil, err
+		}
+		tss = append(tss, ts)
+	}
+	return tss, nil
+}
+
+func decodeTimeSeries(b []byte) (*TimeSeries, error) {
+	ts := &TimeSeries{}
+	r := protowire.NewReader(b)
+	for !r.EOF() {
+		field, wireType, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if wireType != protowire.WireBytes || (field != 1 && field != 2) {
+			if err := r.Skip(wireType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		msg, err := r.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case 1:
+			l, err := decodeLabel(msg)
+			if err != nil {
+				return nil, err
+			}
+			ts.Labels = append(ts.Labels, l)
+		case 2:
+			s, err := decodeSample(msg)
+			if err != nil {
+				return nil, err
+			}
+			ts.Samples = append(ts.Samples, s)
+		}
+	}
+	return ts, nil
+}
+
+func decodeLabel(b []byte) (Label, error) {
+	var l Label
+	r := protowire.NewReader(b)
+	for !r.EOF() {
+		field, wireType, err := r.Next()
+		if err != nil {
+			return l, err
+		}
+		switch {
+		case field == 1 && wireType == protowire.WireBytes:
+			l.Name, err = r.String()
+		case field == 2 && wireType == protowire.WireBytes:
+			l.Value, err = r.String()
+		default:
+			err = r.Skip(wireType)
+		}
+		if err != nil {
+			return l, err
+		}
+	}
+	return l, nil
+}
+
+func decodeSample(b []byte) (Sample, error) {
+	var s Sample
+	r := protowire.NewReader(b)
+	for !r.EOF() {
+		field, wireType, err := r.Next()
+		if err != nil {
+			return s, err
+		}
+		switch {
+		case field == 1 && wireType == protowire.WireFixed64:
+			s.Value, err = r.Double()
+		case field == 2 && wireType == protowire.WireVarint:
+			var v uint64
+			v, err = r.Varint()
+			s.Timestamp = int64(v)
+		default:
+			err = r.Skip(wireType)
+		}
+		if err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// NameTemplate maps a label set into a dotted series name. The template is the
+// dot-separated list of label names. Each label name is replaced with the label value,
+// and '*' is replaced with the rest of labels sorted by the name as '<name>.<value>'.
+//
+// ex. "__name__.*" maps {__name__="up", job="node", instance="host1:9100"}
+// into "up.instance.host1:9100.job.node".
+type NameTemplate []string
+
+// ParseNameTemplate parses the template string.
+func ParseNameTemplate(s string) (NameTemplate, error) {
+	if s == "" {
+		s = DefaultNameTemplate
+	}
+	nodes := strings.Split(s, ".")
+	wildcard := false
+	for _, node := range nodes {
+		if node == "" {
+			return nil, errors.Errorf("empty node in the name template %q", s)
+		}
+		if node == "*" {
+			if wildcard {
+				return nil, errors.Errorf("multiple '*' in the name template %q", s)
+			}
+			wildcard = true
+		}
+	}
+	return NameTemplate(nodes), nil
+}
+
+// Name returns the series name of the labels.
+func (tmpl NameTemplate) Name(labels []Label) string {
+	values := make(map[string]string, len(labels))
+	for _, l := range labels {
+		values[l.Name] = l.Value
+	}
+	used := make(map[string]bool, len(tmpl))
+	for _, node := range tmpl {
+		used[node] = true
+	}
+
+	nodes := make([]string, 0, len(tmpl)+len(labels)*2)
+	for _, node := range tmpl {
+		if node != "*" {
+			if v, ok := values[node]; ok && v != "" {
+				nodes = append(nodes, util.SanitizeNode(v))
+			}
+			continue
+		}
+		rest := make([]string, 0, len(labels))
+		for _, l := range labels {
+			if !used[l.Name] && l.Value != "" {
+				rest = append(rest, l.Name)
+			}
+		}
+		sort.Strings(rest)
+		for _, name := range rest {
+			nodes = append(nodes, util.SanitizeNode(name), util.SanitizeNode(values[name]))
+		}
+	}
+	return strings.Join(nodes, ".")
+}
+
+// ToMetrics converts the time series into metrics named by tmpl. The timestamps
+// in milliseconds are truncated into seconds and the staleness markers are dropped.
+func ToMetrics(tss []*TimeSeries, tmpl NameTemplate) []*model.Metric {
+	metrics := make(map[string]*model.Metric, len(tss))
+	names := make([]string, 0, len(tss))
+	for _, ts := range tss {
+		name := tmpl.Name(ts.Labels)
+		if name == "" {
+			continue
+		}
+		m, ok := metrics[name]
+		if !ok {
+			m = &model.Metric{Name: name}
+			metrics[name] = m
+			names = append(names, name)
+		}
+		for _, s := range ts.Samples {
+			if math.Float64bits(s.Value) == staleNaN {
+				continue
+			}
+			m.Datapoints = append(m.Datapoints, &model.Datapoint{
+				Timestamp: s.Timestamp / 1000,
+				Value:     s.Value,
+			})
+		}
+	}
+	result := make([]*model.Metric, 0, len(names))
+	for _, name := range names {
+		if len(metrics[name].Datapoints) > 0 {
+			result = append(result, metrics[name])
+		}
+	}
+	return result
+}
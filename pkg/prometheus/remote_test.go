@@ -0,0 +1,129 @@
+package prometheus
+
+import (
+	"math"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/protowire"
+)
+
+func encodeWriteRequest(tss []*TimeSeries) []byte {
+	req := &protowire.Writer{}
+	for _, ts := range tss {
+		w := &protowire.Writer{}
+		for _, l := range ts.Labels {
+			lw := &protowire.Writer{}
+			lw.String(1, l.Name)
+			lw.String(2, l.Value)
+			w.BytesField(1, lw.Bytes())
+		}
+		for _, s := range ts.Samples {
+			sw := &protowire.Writer{}
+			sw.Double(1, s.Value)
+			sw.Varint(2, uint64(s.Timestamp))
+			w.BytesField(2, sw.Bytes())
+		}
+		req.BytesField(1, w.Bytes())
+	}
+	return snappy.Encode(nil, req.Bytes())
+}
+
+func TestDecodeWriteRequest(t *testing.T) {
+	expected := []*TimeSeries{
+		{
+			Labels:  []Label{{"__name__", "up"}, {"job", "node"}},
+			Samples: []Sample{{1, 1500000000000}, {0, 1500000015000}},
+		},
+	}
+	got, err := DecodeWriteRequest(encodeWriteRequest(expected))
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if diff := pretty.Compare(got, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestDecodeWriteRequest_Corrupted(t *testing.T) {
+	if _, err := DecodeWriteRequest([]byte("not snappy")); err == nil {
+		t.Fatalf("should raise err")
+	}
+	b := snappy.Encode(nil, []byte{0x0a, 0x10, 0x0a})
+	if _, err := DecodeWriteRequest(b); err == nil {
+		t.Fatalf("should raise err")
+	}
+}
+
+func TestNameTemplate(t *testing.T) {
+	labels := []Label{
+		{"job", "node"},
+		{"__name__", "node_cpu"},
+		{"instance", "host1.example.com:9100"},
+		{"mode", "idle"},
+		{"empty", ""},
+	}
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"", "node_cpu.instance.host1_example_com:9100.job.node.mode.idle"},
+		{"__name__.*", "node_cpu.instance.host1_example_com:9100.job.node.mode.idle"},
+		{"job.instance.__name__.*", "node.host1_example_com:9100.node_cpu.mode.idle"},
+		{"job.__name__.mode", "node.node_cpu.idle"},
+		{"notfound.__name__", "node_cpu"},
+	}
+	for _, tc := range tests {
+		tmpl, err := ParseNameTemplate(tc.template)
+		if err != nil {
+			t.Fatalf("template: %q, should not raise err: %s", tc.template, err)
+		}
+		if got := tmpl.Name(labels); got != tc.expected {
+			t.Fatalf("template: %q, name should be %s, not %s", tc.template, tc.expected, got)
+		}
+	}
+}
+
+func TestParseNameTemplate_Invalid(t *testing.T) {
+	for _, template := range []string{"__name__..*", "*.__name__.*"} {
+		if _, err := ParseNameTemplate(template); err == nil {
+			t.Fatalf("template: %q, should raise err", template)
+		}
+	}
+}
+
+func TestToMetrics(t *testing.T) {
+	tmpl, _ := ParseNameTemplate(DefaultNameTemplate)
+	tss := []*TimeSeries{
+		{
+			Labels: []Label{{"__name__", "up"}, {"job", "node"}},
+			Samples: []Sample{
+				{1, 1500000000999},
+				{math.Float64frombits(staleNaN), 1500000015000},
+			},
+		},
+		{
+			Labels:  []Label{{"__name__", "up"}, {"job", "node"}},
+			Samples: []Sample{{0, 1500000030000}},
+		},
+		{
+			Labels:  []Label{{"__name__", "down"}},
+			Samples: []Sample{{math.Float64frombits(staleNaN), 1500000015000}},
+		},
+	}
+	expected := []*model.Metric{
+		{
+			Name: "up.job.node",
+			Datapoints: []*model.Datapoint{
+				{Timestamp: 1500000000, Value: 1},
+				{Timestamp: 1500000030, Value: 0},
+			},
+		},
+	}
+	if diff := pretty.Compare(ToMetrics(tss, tmpl), expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
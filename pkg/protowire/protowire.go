@@ -0,0 +1,211 @@
+// Package protowire provides a minimal decoder of the protocol buffers wire format
+// to read the payloads of the ingestion protocols without generated code.
+package protowire
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Wire types of protocol buffers.
+const (
+	WireVarint  = 0
+	WireFixed64 = 1
+	WireBytes   = 2
+	WireFixed32 = 5
+)
+
+// ErrTruncated is returned when the buffer ends in the middle of a field.
+var ErrTruncated = errors.New("protowire: truncated message")
+
+// Reader reads fields from a protocol buffers message.
+type Reader struct {
+	buf []byte
+	pos int
+}
+
+// NewReader creates a new Reader reading b.
+func NewReader(b []byte) *Reader {
+	return &Reader{buf: b}
+}
+
+// EOF returns whether the reader reaches the end of the message.
+func (r *Reader) EOF() bool {
+	return r.pos >= len(r.buf)
+}
+
+// Next reads the key of the next field and returns the field number and the wire type.
+func (r *Reader) Next() (int, int, error) {
+	key, err := r.Varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	field, wireType := int(key>>3), int(key&0x7)
+	if field <= 0 {
+		return 0, 0, errors.Errorf("protowire: invalid field number %d", field)
+	}
+	return field, wireType, nil
+}
+
+// Varint reads a varint value.
+func (r *Reader) Varint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	if n == 0 {
+		return 0, ErrTruncated
+	}
+	if n < 0 {
+		return 0, errors.New("protowire: varint overflows 64 bits")
+	}
+	r.pos += n
+	return v, nil
+}
+
+// Fixed64 reads a little endian 64bit value.
+func (r *Reader) Fixed64() (uint64, error) {
+	if len(r.buf)-r.pos < 8 {
+		return 0, ErrTruncated
+	}
+	v := binary.LittleEndian.Uint64(r.buf[r.pos:])
+	r.pos += 8
+	return v, nil
+}
+
+// Fixed32 reads a little endian 32bit value.
+func (r *Reader) Fixed32() (uint32, error) {
+	if len(r.buf)-r.pos < 4 {
+		return 0, ErrTruncated
+	}
+	v := binary.LittleEndian.Uint32(r.buf[r.pos:])
+	r.pos += 4
+	return v, nil
+}
+
+// Double reads a double value.
+func (r *Reader) Double() (float64, error) {
+	v, err := r.Fixed64()
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(v), nil
+}
+
+// Bytes reads a length-delimited value. The returned slice shares the buffer.
+func (r *Reader) Bytes() ([]byte, error) {
+	n, err := r.Varint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(r.buf)-r.pos) < n {
+		return nil, ErrTruncated
+	}
+	b := r.buf[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+// String reads a length-delimited value as string.
+func (r *Reader) String() (string, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// PackedFixed64 reads a packed repeated fixed 64bit field such as
+// 'repeated fixed64' and 'repeated double'.
+func (r *Reader) PackedFixed64() ([]uint64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if len(b)%8 != 0 {
+		return nil, ErrTruncated
+	}
+	vs := make([]uint64, 0, len(b)/8)
+	for i := 0; i < len(b); i += 8 {
+		vs = append(vs, binary.LittleEndian.Uint64(b[i:]))
+	}
+	return vs, nil
+}
+
+// Skip skips the value of the wire type.
+func (r *Reader) Skip(wireType int) error {
+	var err error
+	switch wireType {
+	case WireVarint:
+		_, err = r.Varint()
+	case WireFixed64:
+		_, err = r.Fixed64()
+	case WireBytes:
+		_, err = r.Bytes()
+	case WireFixed32:
+		_, err = r.Fixed32()
+	default:
+		err = errors.Errorf("protowire: unsupported wire type %d", wireType)
+	}
+	return err
+}
+
+// Writer writes fields of a protocol buffers message. It is mainly used to build
+// payloads in tests.
+type Writer struct {
+	buf []byte
+}
+
+// Bytes returns the written message.
+func (w *Writer) Bytes() []byte {
+	return w.buf
+}
+
+func (w *Writer) key(field, wireType int) {
+	w.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (w *Writer) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	w.buf = append(w.buf, b[:n]...)
+}
+
+// Varint writes a varint field.
+func (w *Writer) Varint(field int, v uint64) {
+	w.key(field, WireVarint)
+	w.varint(v)
+}
+
+// Fixed64 writes a fixed 64bit field.
+func (w *Writer) Fixed64(field int, v uint64) {
+	w.key(field, WireFixed64)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	w.buf = append(w.buf, b[:]...)
+}
+
+// Double writes a double field.
+func (w *Writer) Double(field int, v float64) {
+	w.Fixed64(field, math.Float64bits(v))
+}
+
+// BytesField writes a length-delimited field.
+func (w *Writer) BytesField(field int, b []byte) {
+	w.key(field, WireBytes)
+	w.varint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+// String writes a string field.
+func (w *Writer) String(field int, s string) {
+	w.BytesField(field, []byte(s))
+}
+
+// PackedFixed64 writes a packed repeated fixed 64bit field.
+func (w *Writer) PackedFixed64(field int, vs []uint64) {
+	b := make([]byte, 8*len(vs))
+	for i, v := range vs {
+		binary.LittleEndian.PutUint64(b[i*8:], v)
+	}
+	w.BytesField(field, b)
+}
@@ -0,0 +1,88 @@
+package protowire
+
+import (
+	"testing"
+)
+
+func TestReaderWriter(t *testing.T) {
+	w := &Writer{}
+	w.Varint(1, 300)
+	w.Double(2, 1.5)
+	w.String(3, "diamondb")
+	w.Fixed64(15, 42)
+
+	r := NewReader(w.Bytes())
+	field, wireType, err := r.Next()
+	if err != nil || field != 1 || wireType != WireVarint {
+		t.Fatalf("unexpected key (%d,%d,%v)", field, wireType, err)
+	}
+	if v, err := r.Varint(); err != nil || v != 300 {
+		t.Fatalf("varint should be 300, not (%d,%v)", v, err)
+	}
+	field, wireType, err = r.Next()
+	if err != nil || field != 2 || wireType != WireFixed64 {
+		t.Fatalf("unexpected key (%d,%d,%v)", field, wireType, err)
+	}
+	if v, err := r.Double(); err != nil || v != 1.5 {
+		t.Fatalf("double should be 1.5, not (%g,%v)", v, err)
+	}
+	field, wireType, err = r.Next()
+	if err != nil || field != 3 || wireType != WireBytes {
+		t.Fatalf("unexpected key (%d,%d,%v)", field, wireType, err)
+	}
+	if v, err := r.String(); err != nil || v != "diamondb" {
+		t.Fatalf("string should be diamondb, not (%s,%v)", v, err)
+	}
+	_, wireType, err = r.Next()
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if err := r.Skip(wireType); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if !r.EOF() {
+		t.Fatalf("reader should reach EOF")
+	}
+}
+
+func TestReader_Truncated(t *testing.T) {
+	w := &Writer{}
+	w.String(1, "diamondb")
+	b := w.Bytes()
+
+	r := NewReader(b[:len(b)-1])
+	if _, _, err := r.Next(); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if _, err := r.Bytes(); err != ErrTruncated {
+		t.Fatalf("err should be ErrTruncated, not %v", err)
+	}
+	if err := NewReader([]byte{0x00}).Skip(WireFixed64); err != ErrTruncated {
+		t.Fatalf("err should be ErrTruncated, not %v", err)
+	}
+}
+
+func TestReaderPackedFixed64(t *testing.T) {
+	w := &Writer{}
+	w.PackedFixed64(1, []uint64{1, 2, 1 << 40})
+
+	r := NewReader(w.Bytes())
+	if _, _, err := r.Next(); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	vs, err := r.PackedFixed64()
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if len(vs) != 3 || vs[0] != 1 || vs[1] != 2 || vs[2] != 1<<40 {
+		t.Fatalf("values should be [1 2 %d], not %v", uint64(1<<40), vs)
+	}
+
+	w = &Writer{}
+	w.BytesField(1, []byte{0x01, 0x02, 0x03})
+	r = NewReader(w.Bytes())
+	r.Next()
+	if _, err := r.PackedFixed64(); err != ErrTruncated {
+		t.Fatalf("err should be ErrTruncated, not %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package query
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/sync/errgroup"
@@ -28,15 +29,41 @@ type funcArg struct {
 	seriesSlice model.SeriesSlice
 }
 
+// partialReader is the reader which evaluates the series fetched with
+// *storage.PartialError, and keeps the first error to be returned after all.
+type partialReader struct {
+	storage.ReadWriter
+	mu  sync.Mutex
+	err error
+}
+
+// Fetch fetches the series, and keeps *storage.PartialError instead of
+// returning it.
+func (r *partialReader) Fetch(name string, start, end time.Time) (model.SeriesSlice, error) {
+	ss, err := r.ReadWriter.Fetch(name, start, end)
+	if perr, ok := err.(*storage.PartialError); ok {
+		r.mu.Lock()
+		if r.err == nil {
+			r.err = perr
+		}
+		r.mu.Unlock()
+		return ss, nil
+	}
+	return ss, err
+}
+
 // EvalTargets evaluates the targets concurrently. It is guaranteed that the order
-// of the targets as input value and SeriesSlice as retuen value is the same.
+// of the targets as input value and SeriesSlice as retuen value is the same. If
+// some of the datapoints are given up, it returns the series evaluated from the
+// others with *storage.PartialError.
 func EvalTargets(reader storage.ReadWriter, targets []string, startTime, endTime time.Time) (model.SeriesSlice, error) {
 	var eg errgroup.Group
+	pr := &partialReader{ReadWriter: reader}
 	ordered := make([]model.SeriesSlice, len(targets))
 	for i, target := range targets {
 		i, target := i, target
 		eg.Go(func() error {
-			ss, err := EvalTarget(reader, target, startTime, endTime)
+			ss, err := EvalTarget(pr, target, startTime, endTime)
 			if err != nil {
 				return err
 			}
@@ -51,6 +78,9 @@ func EvalTargets(reader storage.ReadWriter, targets []string, startTime, endTime
 	for _, ss := range ordered {
 		results = append(results, ss...)
 	}
+	if pr.err != nil {
+		return results, pr.err
+	}
 	return results, nil
 }
 
@@ -123,6 +153,8 @@ func invokeExpr(reader storage.ReadWriter, expr Expr, startTime, endTime time.Ti
 			ss, err = doPercentileOfSeries(args)
 		case "summarize":
 			ss, err = doSummarize(args)
+		case "consolidateBy":
+			ss, err = doConsolidateBy(args)
 		case "sumSeriesWithWildcards":
 			ss, err = doSumSeriesWithWildcards(args)
 		case "doLinerRegression":
@@ -87,6 +87,29 @@ func TestEvalTargets(t *testing.T) {
 			SeriesSlice{},
 			errors.New("some accident occur"),
 		},
+		{
+			"return the series fetched partially",
+			[]string{"server1.loadavg5", "sumSeries(server2.loadavg5)"},
+			func(name string, start, end time.Time) (SeriesSlice, error) {
+				switch name {
+				case "server1.loadavg5":
+					return SeriesSlice{
+						NewSeries("server1.loadavg5", []float64{10.0}, 1000, 60),
+					}, nil
+				case "server2.loadavg5":
+					return SeriesSlice{
+						NewSeries("server2.loadavg5", []float64{11.0}, 1000, 60),
+					}, &storage.PartialError{Err: errors.New("throttled")}
+				default:
+					return nil, errors.Errorf("unexpected name %s", name)
+				}
+			},
+			SeriesSlice{
+				NewSeries("server1.loadavg5", []float64{10.0}, 1000, 60),
+				NewSeries("sumSeries(server2.loadavg5)", []float64{11.0}, 1000, 60),
+			},
+			&storage.PartialError{Err: errors.New("throttled")},
+		},
 	}
 
 	for _, tc := range tests {
@@ -104,6 +127,11 @@ func TestEvalTargets(t *testing.T) {
 				t.Fatalf("err: %s", err)
 			}
 		}
+		if _, ok := tc.err.(*storage.PartialError); ok {
+			if _, ok := err.(*storage.PartialError); !ok {
+				t.Fatalf("desc: %s, err should be *storage.PartialError: %v", tc.desc, err)
+			}
+		}
 		if diff := pretty.Compare(got, tc.expected); diff != "" {
 			t.Fatalf("desc: %s diff: (-actual +expected)\n%s", tc.desc, diff)
 		}
@@ -460,6 +460,52 @@ func summarize(ss model.SeriesSlice, interval string, function string) (model.Se
 	return result, nil
 }
 
+func doConsolidateBy(args []*funcArg) (model.SeriesSlice, error) {
+	if len(args) != 2 {
+		return nil, &ArgumentError{
+			funcName: "consolidateBy",
+			msg:      fmt.Sprintf("wrong number of arguments (%d for 2)", len(args)),
+		}
+	}
+	_, ok := args[0].expr.(SeriesListExpr)
+	if !ok {
+		return nil, &ArgumentError{
+			funcName: "consolidateBy",
+			msg:      fmt.Sprintf("invalid argument type (%s)", args[0].expr),
+		}
+	}
+	functionExpr, ok := args[1].expr.(StringExpr)
+	if !ok {
+		return nil, &ArgumentError{
+			funcName: "consolidateBy",
+			msg:      fmt.Sprintf("invalid argument type (%s)", args[1].expr),
+		}
+	}
+	switch functionExpr.Literal {
+	case "sum", "average", "min", "max":
+	default:
+		return nil, &ArgumentError{
+			funcName: "consolidateBy",
+			msg:      fmt.Sprintf("unknown consolidation function (%s)", functionExpr.Literal),
+		}
+	}
+	return consolidateBy(args[0].seriesSlice, functionExpr.Literal), nil
+}
+
+// http://graphite.readthedocs.io/en/latest/functions.html#graphite.render.functions.consolidateBy
+// The values rolled up into the coarser slots are replaced with the aggregate
+// stored with them. The series computed by other functions are not changed
+// because they have no aggregate.
+func consolidateBy(ss model.SeriesSlice, function string) model.SeriesSlice {
+	result := make(model.SeriesSlice, 0, len(ss))
+	for _, s := range ss {
+		cs := s.ConsolidateBy(function)
+		cs.SetName(fmt.Sprintf("consolidateBy(%s, \"%s\")", s.Name(), function))
+		result = append(result, cs)
+	}
+	return result
+}
+
 func doSumSeriesWithWildcards(args []*funcArg) (model.SeriesSlice, error) {
 	if len(args) < 2 {
 		return nil, &ArgumentError{
@@ -907,6 +907,48 @@ func TestPercentileOfSeries(t *testing.T) {
 	}
 }
 
+func TestConsolidateBy(t *testing.T) {
+	aggs := []*Aggregate{
+		{Value: 2.0, Min: 1.0, Max: 4.0, Sum: 6.0, Count: 3},
+		{Value: 5.0, Min: 5.0, Max: 5.0, Sum: 10.0, Count: 2},
+	}
+	tests := []struct {
+		function string
+		expected []float64
+	}{
+		{"max", []float64{4.0, 5.0, 0.5}},
+		{"min", []float64{1.0, 5.0, 0.5}},
+		{"sum", []float64{6.0, 10.0, 0.5}},
+		{"average", []float64{2.0, 5.0, 0.5}},
+	}
+	for _, tc := range tests {
+		ss := SeriesSlice{
+			NewAggregatedSeries("server1.loadavg5", []float64{2.0, 5.0, 0.5}, append(aggs, nil), 0, 300),
+		}
+		got, err := doConsolidateBy([]*funcArg{
+			{expr: SeriesListExpr{Literal: "server1.loadavg5"}, seriesSlice: ss},
+			{expr: StringExpr{Literal: tc.function}},
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		expected := SeriesSlice{
+			NewAggregatedSeries("consolidateBy(server1.loadavg5, \""+tc.function+"\")", tc.expected, append(aggs, nil), 0, 300),
+		}
+		if diff := pretty.Compare(got, expected); diff != "" {
+			t.Fatalf("consolidateBy(%s); diff: (-actual +expected)\n%s", tc.function, diff)
+		}
+	}
+
+	_, err := doConsolidateBy([]*funcArg{
+		{expr: SeriesListExpr{Literal: "server1.loadavg5"}},
+		{expr: StringExpr{Literal: "median"}},
+	})
+	if _, ok := err.(*ArgumentError); !ok {
+		t.Fatalf("should raise ArgumentError: %v", err)
+	}
+}
+
 func TestDoSumSeriesWithWildcards(t *testing.T) {
 	tests := []struct {
 		desc string
@@ -0,0 +1,86 @@
+package queue
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Checkpointer stores the sequence number of the last record written into the store per shard.
+type Checkpointer interface {
+	Get(shard string) (string, error)
+	Set(shard, seq string) error
+}
+
+// FileCheckpointer is a Checkpointer on a JSON file.
+type FileCheckpointer struct {
+	path string
+
+	mu          sync.Mutex
+	checkpoints map[string]string
+}
+
+var _ Checkpointer = &FileCheckpointer{}
+
+// NewFileCheckpointer loads the checkpoints from the file if it exists.
+func NewFileCheckpointer(path string) (*FileCheckpointer, error) {
+	c := &FileCheckpointer{path: path, checkpoints: map[string]string{}}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, errors.Wrapf(err, "failed to read checkpoint file (%s)", path)
+	}
+	if err := json.Unmarshal(b, &c.checkpoints); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode checkpoint file (%s)", path)
+	}
+	return c, nil
+}
+
+// Get returns the checkpoint of the shard. It returns empty if no checkpoint exists.
+func (c *FileCheckpointer) Get(shard string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.checkpoints[shard], nil
+}
+
+// Set updates the checkpoint of the shard and writes the checkpoints into the file
+// by renaming the temporary file not to be broken by a crash.
+func (c *FileCheckpointer) Set(shard, seq string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checkpoints[shard] = seq
+
+	b, err := json.Marshal(c.checkpoints)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode checkpoints")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create checkpoint file (%s)", c.path)
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "failed to write checkpoint file (%s)", c.path)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "failed to sync checkpoint file (%s)", c.path)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "failed to close checkpoint file (%s)", c.path)
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "failed to rename checkpoint file (%s)", c.path)
+	}
+	return nil
+}
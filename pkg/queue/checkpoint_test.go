@@ -0,0 +1,49 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileCheckpointer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diamondb-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.json")
+
+	c, err := NewFileCheckpointer(path)
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if seq, _ := c.Get("shard-0"); seq != "" {
+		t.Fatalf("checkpoint should be empty, not %q", seq)
+	}
+	if err := c.Set("shard-0", "100"); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if err := c.Set("shard-1", "200"); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+
+	// Reload from the file.
+	c, err = NewFileCheckpointer(path)
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	for shard, expected := range map[string]string{"shard-0": "100", "shard-1": "200"} {
+		if seq, _ := c.Get(shard); seq != expected {
+			t.Fatalf("checkpoint of %s should be %q, not %q", shard, expected, seq)
+		}
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileCheckpointer(path); err == nil {
+		t.Fatalf("broken checkpoint file should raise err")
+	}
+}
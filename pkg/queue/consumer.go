@@ -0,0 +1,285 @@
+package queue
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage"
+)
+
+const (
+	// DefaultConsumerBatchSize is the default number of records read at once.
+	DefaultConsumerBatchSize = 500
+	// DefaultConsumerPollInterval is the default interval to poll the shard with no new records.
+	DefaultConsumerPollInterval = 1 * time.Second
+	// DefaultConsumerShardInterval is the default interval to list the shards to
+	// consume the new ones after resharding.
+	DefaultConsumerShardInterval = 1 * time.Minute
+
+	minRetryInterval = 100 * time.Millisecond
+	maxRetryInterval = 10 * time.Second
+)
+
+// Consumer reads the metrics from the queue and writes them into the store.
+// The checkpoint of a shard is advanced after all the metrics of the batch are
+// written, so the metrics are written at least once. The failed writes are
+// retried with backoff until they succeed or the consumer is shut down, except
+// for the metrics rejected permanently, which never succeed.
+type Consumer struct {
+	queue         Queue
+	store         storage.ReadWriter
+	checkpointer  Checkpointer
+	batchSize     int
+	pollInterval  time.Duration
+	shardInterval time.Duration
+
+	done chan struct{}
+	wg   sync.WaitGroup
+	// mu guards the shards started and finished, and wg.Add after done.
+	mu       sync.Mutex
+	started  map[string]bool
+	finished map[string]bool
+
+	consumed  uint64
+	malformed uint64
+	retried   uint64
+}
+
+// ConsumerStats represents the counters of the Consumer.
+type ConsumerStats struct {
+	Consumed  uint64 `json:"consumed"`
+	Malformed uint64 `json:"malformed"`
+	Retried   uint64 `json:"retried"`
+}
+
+// ConsumerOption for the Consumer.
+type ConsumerOption struct {
+	Queue         Queue
+	Store         storage.ReadWriter
+	Checkpointer  Checkpointer
+	BatchSize     int
+	PollInterval  time.Duration
+	ShardInterval time.Duration
+}
+
+// NewConsumer initializes a new Consumer.
+func NewConsumer(o *ConsumerOption) *Consumer {
+	c := &Consumer{
+		queue:         o.Queue,
+		store:         o.Store,
+		checkpointer:  o.Checkpointer,
+		batchSize:     o.BatchSize,
+		pollInterval:  o.PollInterval,
+		shardInterval: o.ShardInterval,
+		done:          make(chan struct{}),
+		started:       map[string]bool{},
+		finished:      map[string]bool{},
+	}
+	if c.batchSize < 1 {
+		c.batchSize = DefaultConsumerBatchSize
+	}
+	if c.pollInterval <= 0 {
+		c.pollInterval = DefaultConsumerPollInterval
+	}
+	if c.shardInterval <= 0 {
+		c.shardInterval = DefaultConsumerShardInterval
+	}
+	return c
+}
+
+// Run consumes the shards until Shutdown is called. The shards are listed every
+// shard interval to consume the children split or merged after the parents,
+// and retried on the interval if they fail to be listed.
+func (c *Consumer) Run() error {
+	if err := c.startShards(); err != nil {
+		log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+	}
+	ticker := time.NewTicker(c.shardInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.startShards(); err != nil {
+				log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+			}
+		case <-c.done:
+			return nil
+		}
+	}
+}
+
+// startShards starts consuming the shards not started yet whose parents are
+// finished. The parents not listed are expired, so they are finished as well.
+func (c *Consumer) startShards() error {
+	shards, err := c.queue.Shards()
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool, len(shards))
+	for _, shard := range shards {
+		listed[shard.ID] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+	for _, shard := range shards {
+		if c.started[shard.ID] {
+			continue
+		}
+		ready := true
+		for _, parent := range shard.Parents {
+			if listed[parent] && !c.finished[parent] {
+				ready = false
+			}
+		}
+		if !ready {
+			continue
+		}
+		log.Printf("Consuming the shard %s of the ingestion queue\n", shard.ID)
+		c.started[shard.ID] = true
+		c.wg.Add(1)
+		go func(shard string) {
+			defer c.wg.Done()
+			finished, err := c.consumeShard(shard)
+			if err != nil {
+				log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+			}
+			if !finished {
+				return
+			}
+			c.mu.Lock()
+			c.finished[shard] = true
+			c.mu.Unlock()
+			// Start the children without waiting for the next listing.
+			if err := c.startShards(); err != nil {
+				log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+			}
+		}(shard.ID)
+	}
+	return nil
+}
+
+// Shutdown stops consuming and waits for the batches being written.
+func (c *Consumer) Shutdown(sig os.Signal) error {
+	log.Printf("Received %s shutdown queue consumer...\n", sig)
+	c.mu.Lock()
+	close(c.done)
+	c.mu.Unlock()
+	c.wg.Wait()
+	return nil
+}
+
+// Stats returns the snapshot of the counters.
+func (c *Consumer) Stats() ConsumerStats {
+	return ConsumerStats{
+		Consumed:  atomic.LoadUint64(&c.consumed),
+		Malformed: atomic.LoadUint64(&c.malformed),
+		Retried:   atomic.LoadUint64(&c.retried),
+	}
+}
+
+// consumeShard consumes the shard until it is closed or the consumer is shut
+// down. It returns true if all the records of the closed shard are consumed.
+func (c *Consumer) consumeShard(shard string) (bool, error) {
+	after, err := c.checkpointer.Get(shard)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get checkpoint of shard %s", shard)
+	}
+	reader, err := c.queue.NewReader(shard, after)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+
+	for {
+		records, err := reader.Read(c.batchSize)
+		if err == io.EOF {
+			log.Printf("Finished consuming the closed shard %s\n", shard)
+			return true, nil
+		}
+		if err != nil {
+			log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+		}
+		if len(records) == 0 {
+			if !c.sleep(c.pollInterval) {
+				return false, nil
+			}
+			continue
+		}
+		if !c.writeRecords(records) {
+			// Shut down in the middle of the batch, which is consumed again after restart.
+			return false, nil
+		}
+		if err := c.checkpointer.Set(shard, records[len(records)-1].SequenceNumber); err != nil {
+			log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+		}
+	}
+}
+
+// writeRecords writes the metrics of the records. It returns false if the consumer
+// is shut down before all of them are written.
+func (c *Consumer) writeRecords(records []*Record) bool {
+	for _, r := range records {
+		m, err := decodeMetric(r.Data)
+		if err != nil {
+			// The malformed record never succeeds, so it is skipped.
+			atomic.AddUint64(&c.malformed, 1)
+			log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+			continue
+		}
+		if !c.writeMetric(m) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeMetric writes the metric with retries. The metric rejected permanently
+// such as by the validation is skipped as the malformed record, because it never
+// succeeds. It returns false if the consumer is shut down before it is written.
+func (c *Consumer) writeMetric(m *model.Metric) bool {
+	interval := minRetryInterval
+	for {
+		err := c.store.InsertMetric(m)
+		if err == nil {
+			atomic.AddUint64(&c.consumed, 1)
+			return true
+		}
+		log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+		if storage.IsPermanent(err) {
+			atomic.AddUint64(&c.malformed, 1)
+			return true
+		}
+		atomic.AddUint64(&c.retried, 1)
+		if !c.sleep(interval) {
+			return false
+		}
+		if interval *= 2; interval > maxRetryInterval {
+			interval = maxRetryInterval
+		}
+	}
+}
+
+// sleep sleeps for d. It returns false if the consumer is shut down.
+func (c *Consumer) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-c.done:
+		return false
+	}
+}
@@ -0,0 +1,273 @@
+package queue
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage"
+)
+
+func TestConsumer(t *testing.T) {
+	q, cleanup := newTestFile(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "diamondb-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkpointer, err := NewFileCheckpointer(filepath.Join(dir, "checkpoint.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []*Message
+	for _, m := range []*model.Metric{
+		{Name: "server1.loadavg5", Datapoints: []*model.Datapoint{{Timestamp: 100, Value: 1}}},
+		{Name: "server2.loadavg5", Datapoints: []*model.Datapoint{{Timestamp: 100, Value: 2}}},
+	} {
+		data, _ := encodeMetric(m)
+		msgs = append(msgs, &Message{Key: m.Name, Data: data})
+	}
+	msgs = append(msgs, &Message{Key: "malformed", Data: []byte("{")})
+	if err := q.Publish(msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu       sync.Mutex
+		got      []string
+		attempts = 0
+		done     = make(chan struct{})
+	)
+	c := NewConsumer(&ConsumerOption{
+		Queue: q,
+		Store: &storage.FakeReadWriter{
+			FakeInsertMetric: func(m *model.Metric) error {
+				mu.Lock()
+				defer mu.Unlock()
+				attempts++
+				// The first write of server2 fails and is retried.
+				if m.Name == "server2.loadavg5" && attempts == 2 {
+					return errors.New("failed to write")
+				}
+				got = append(got, m.Name)
+				if len(got) == 2 {
+					close(done)
+				}
+				return nil
+			},
+		},
+		Checkpointer: checkpointer,
+		PollInterval: 10 * time.Millisecond,
+	})
+	go c.Run()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer timed out")
+	}
+	// Wait for the checkpoint of the batch.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if seq, _ := checkpointer.Get("0"); seq != "" || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Shutdown(syscall.SIGTERM)
+
+	if diff := pretty.Compare(got, []string{"server1.loadavg5", "server2.loadavg5"}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	expectedStats := ConsumerStats{Consumed: 2, Malformed: 1, Retried: 1}
+	if diff := pretty.Compare(c.Stats(), expectedStats); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	r, _ := q.NewReader("0", "")
+	defer r.Close()
+	records, _ := r.Read(10)
+	if seq, _ := checkpointer.Get("0"); seq != records[len(records)-1].SequenceNumber {
+		t.Fatalf("checkpoint should be %s, not %s", records[len(records)-1].SequenceNumber, seq)
+	}
+}
+
+// fakeQueue is the closed shards whose records are read at once. The shards
+// fail to be listed the first fails times.
+type fakeQueue struct {
+	mu      sync.Mutex
+	shards  []*Shard
+	records map[string][]*Record
+	fails   int
+}
+
+func (q *fakeQueue) Publish(msgs []*Message) error {
+	return nil
+}
+
+func (q *fakeQueue) Shards() ([]*Shard, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.fails > 0 {
+		q.fails--
+		return nil, errors.New("unavailable")
+	}
+	return append([]*Shard{}, q.shards...), nil
+}
+
+func (q *fakeQueue) addShard(shard *Shard, names ...string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.shards = append(q.shards, shard)
+	for i, name := range names {
+		data, _ := encodeMetric(&model.Metric{Name: name, Datapoints: []*model.Datapoint{{Timestamp: 100, Value: 1}}})
+		q.records[shard.ID] = append(q.records[shard.ID], &Record{SequenceNumber: strconv.Itoa(i), Data: data})
+	}
+}
+
+func (q *fakeQueue) NewReader(shard, after string) (Reader, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return &fakeReader{records: q.records[shard]}, nil
+}
+
+type fakeReader struct {
+	records []*Record
+}
+
+func (r *fakeReader) Read(limit int) ([]*Record, error) {
+	if len(r.records) == 0 {
+		return nil, io.EOF
+	}
+	records := r.records
+	r.records = nil
+	return records, nil
+}
+
+func (r *fakeReader) Close() error {
+	return nil
+}
+
+func TestConsumer_Reshard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diamondb-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkpointer, err := NewFileCheckpointer(filepath.Join(dir, "checkpoint.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := &fakeQueue{records: map[string][]*Record{}}
+	// The child is listed before the parent.
+	q.addShard(&Shard{ID: "1", Parents: []string{"0"}}, "b")
+	q.addShard(&Shard{ID: "0"}, "a", "invalid")
+
+	var (
+		mu       sync.Mutex
+		got      []string
+		attempts int
+		done     = make(chan struct{})
+	)
+	c := NewConsumer(&ConsumerOption{
+		Queue: q,
+		Store: &storage.FakeReadWriter{
+			FakeInsertMetric: func(m *model.Metric) error {
+				mu.Lock()
+				defer mu.Unlock()
+				attempts++
+				// The metric rejected permanently is not retried.
+				if m.Name == "invalid" {
+					return &storage.ValidationError{Name: m.Name, Reason: "invalid"}
+				}
+				got = append(got, m.Name)
+				if len(got) == 3 {
+					close(done)
+				}
+				return nil
+			},
+		},
+		Checkpointer:  checkpointer,
+		PollInterval:  10 * time.Millisecond,
+		ShardInterval: 10 * time.Millisecond,
+	})
+	go c.Run()
+
+	// The shard split after the consumer starts, whose other parent is expired.
+	time.Sleep(50 * time.Millisecond)
+	q.addShard(&Shard{ID: "2", Parents: []string{"1", "expired"}}, "c")
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer timed out")
+	}
+	c.Shutdown(syscall.SIGTERM)
+
+	if diff := pretty.Compare(got, []string{"a", "b", "c"}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	if attempts != 4 {
+		t.Fatalf("should write 4 times, not %d", attempts)
+	}
+	expectedStats := ConsumerStats{Consumed: 3, Malformed: 1, Retried: 0}
+	if diff := pretty.Compare(c.Stats(), expectedStats); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestConsumer_ShardsError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diamondb-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkpointer, err := NewFileCheckpointer(filepath.Join(dir, "checkpoint.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The shards fail to be listed when the consumer starts.
+	q := &fakeQueue{records: map[string][]*Record{}, fails: 2}
+	q.addShard(&Shard{ID: "0"}, "a")
+
+	done := make(chan struct{})
+	c := NewConsumer(&ConsumerOption{
+		Queue: q,
+		Store: &storage.FakeReadWriter{
+			FakeInsertMetric: func(m *model.Metric) error {
+				close(done)
+				return nil
+			},
+		},
+		Checkpointer:  checkpointer,
+		PollInterval:  10 * time.Millisecond,
+		ShardInterval: 10 * time.Millisecond,
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- c.Run() }()
+
+	select {
+	case <-done:
+	case err := <-errc:
+		t.Fatalf("consumer should not stop: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("consumer timed out")
+	}
+	c.Shutdown(syscall.SIGTERM)
+	if err := <-errc; err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+}
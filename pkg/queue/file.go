@@ -0,0 +1,135 @@
+package queue
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	fileShardID   = "0"
+	fileQueueName = "queue.log"
+	// fileRecordHeaderSize is the size of the length prefix of a record.
+	fileRecordHeaderSize = 4
+)
+
+// File is a Queue on the local file to run the pipeline offline. It has a single
+// shard, which is an append-only log of the length-prefixed records. The sequence
+// number of a record is the offset of the end of the record.
+type File struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+var _ Queue = &File{}
+
+// NewFile opens the queue in the directory.
+func NewFile(dir string) (*File, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create queue directory (%s)", dir)
+	}
+	path := filepath.Join(dir, fileQueueName)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open queue file (%s)", path)
+	}
+	return &File{path: path, f: f}, nil
+}
+
+// Close closes the queue file.
+func (q *File) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.f.Close()
+}
+
+// Publish appends the messages and syncs the file.
+func (q *File) Publish(msgs []*Message) error {
+	var buf []byte
+	for _, msg := range msgs {
+		var header [fileRecordHeaderSize]byte
+		binary.BigEndian.PutUint32(header[:], uint32(len(msg.Data)))
+		buf = append(buf, header[:]...)
+		buf = append(buf, msg.Data...)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, err := q.f.Write(buf); err != nil {
+		return errors.Wrapf(err, "failed to write queue file (%s)", q.path)
+	}
+	if err := q.f.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to sync queue file (%s)", q.path)
+	}
+	return nil
+}
+
+// Shards returns the single shard.
+func (q *File) Shards() ([]*Shard, error) {
+	return []*Shard{{ID: fileShardID}}, nil
+}
+
+// NewReader returns a reader starting at the offset of after.
+func (q *File) NewReader(shard, after string) (Reader, error) {
+	if shard != fileShardID {
+		return nil, errors.Errorf("unknown shard %q", shard)
+	}
+	var offset int64
+	if after != "" {
+		v, err := strconv.ParseInt(after, 10, 64)
+		if err != nil || v < 0 {
+			return nil, errors.Errorf("invalid sequence number %q", after)
+		}
+		offset = v
+	}
+	f, err := os.Open(q.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open queue file (%s)", q.path)
+	}
+	return &fileReader{f: f, offset: offset}, nil
+}
+
+type fileReader struct {
+	f      *os.File
+	offset int64
+}
+
+// Read reads the records after the offset. The record being written is regarded
+// as not arrived yet.
+func (r *fileReader) Read(limit int) ([]*Record, error) {
+	var records []*Record
+	for len(records) < limit {
+		var header [fileRecordHeaderSize]byte
+		if _, err := r.f.ReadAt(header[:], r.offset); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return records, errors.Wrap(err, "failed to read queue file")
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header[:]))
+		if _, err := r.f.ReadAt(data, r.offset+fileRecordHeaderSize); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return records, errors.Wrap(err, "failed to read queue file")
+		}
+		r.offset += fileRecordHeaderSize + int64(len(data))
+		records = append(records, &Record{
+			SequenceNumber: strconv.FormatInt(r.offset, 10),
+			Data:           data,
+		})
+	}
+	return records, nil
+}
+
+// Close closes the queue file opened by the reader.
+func (r *fileReader) Close() error {
+	return r.f.Close()
+}
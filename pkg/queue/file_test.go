@@ -0,0 +1,117 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func newTestFile(t *testing.T) (*File, func()) {
+	dir, err := ioutil.TempDir("", "diamondb-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q, func() {
+		q.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFile(t *testing.T) {
+	q, cleanup := newTestFile(t)
+	defer cleanup()
+
+	shards, _ := q.Shards()
+	if diff := pretty.Compare(shards, []*Shard{{ID: "0"}}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	err := q.Publish([]*Message{{Key: "a", Data: []byte("aaa")}, {Key: "b", Data: []byte("b")}})
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	r, err := q.NewReader("0", "")
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	defer r.Close()
+
+	records, err := r.Read(1)
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	expected := []*Record{{SequenceNumber: "7", Data: []byte("aaa")}}
+	if diff := pretty.Compare(records, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	if err := q.Publish([]*Message{{Key: "c", Data: []byte("cc")}}); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	records, err = r.Read(10)
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	expected = []*Record{
+		{SequenceNumber: "12", Data: []byte("b")},
+		{SequenceNumber: "18", Data: []byte("cc")},
+	}
+	if diff := pretty.Compare(records, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	if records, err := r.Read(10); err != nil || len(records) != 0 {
+		t.Fatalf("should read no records, not (%v, %v)", records, err)
+	}
+
+	// Resume after the checkpoint.
+	r2, err := q.NewReader("0", "12")
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	defer r2.Close()
+	records, _ = r2.Read(10)
+	expected = []*Record{{SequenceNumber: "18", Data: []byte("cc")}}
+	if diff := pretty.Compare(records, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	if _, err := q.NewReader("1", ""); err == nil {
+		t.Fatalf("unknown shard should raise err")
+	}
+	if _, err := q.NewReader("0", "abc"); err == nil {
+		t.Fatalf("invalid sequence number should raise err")
+	}
+}
+
+func TestFile_PartialRecord(t *testing.T) {
+	q, cleanup := newTestFile(t)
+	defer cleanup()
+
+	if err := q.Publish([]*Message{{Key: "a", Data: []byte("aaa")}}); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	// Append the header of the record being written.
+	f, err := os.OpenFile(filepath.Join(filepath.Dir(q.path), fileQueueName), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 5, 'x'})
+	f.Close()
+
+	r, _ := q.NewReader("0", "")
+	defer r.Close()
+	records, err := r.Read(10)
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("the partial record should not be read: %v", records)
+	}
+}
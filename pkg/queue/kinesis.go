@@ -0,0 +1,219 @@
+package queue
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	gokinesis "github.com/aws/aws-sdk-go/service/kinesis"
+	gokinesisiface "github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/config"
+)
+
+const (
+	// kinesisPutRecordsLimit is the maximum number of records of a PutRecords request.
+	kinesisPutRecordsLimit = 500
+	// kinesisPutRetries is the number of retries of the records failed by PutRecords.
+	kinesisPutRetries  = 3
+	kinesisHTTPTimeout = 10 * time.Second
+)
+
+// kinesisRetryInterval is the first interval to retry PutRecords, which is doubled for each retry.
+var kinesisRetryInterval = 100 * time.Millisecond
+
+// Kinesis is a Queue on Kinesis Data Streams. The messages are partitioned by the key.
+type Kinesis struct {
+	svc    gokinesisiface.KinesisAPI
+	stream string
+}
+
+var _ Queue = &Kinesis{}
+
+// NewKinesis creates a new Kinesis.
+func NewKinesis() (*Kinesis, error) {
+	awsConf := aws.NewConfig().WithRegion(config.Config.KinesisRegion)
+	if config.Config.KinesisEndpoint != "" {
+		// For kinesalite configuration
+		awsConf.WithEndpoint(config.Config.KinesisEndpoint)
+		awsConf.WithCredentials(credentials.NewStaticCredentials("dummy", "dummy", "dummy"))
+	}
+	awsConf.WithHTTPClient(&http.Client{
+		Timeout:   kinesisHTTPTimeout,
+		Transport: http.DefaultTransport,
+	})
+	sess, err := session.NewSession(awsConf)
+	if err != nil {
+		return nil, errors.Wrapf(err,
+			"failed to create session for kinesis (%s,%s)",
+			config.Config.KinesisRegion,
+			config.Config.KinesisEndpoint,
+		)
+	}
+	return &Kinesis{
+		svc:    gokinesis.New(sess),
+		stream: config.Config.KinesisStreamName,
+	}, nil
+}
+
+// Publish puts the messages by PutRecords. The records failed by throttling are retried.
+func (k *Kinesis) Publish(msgs []*Message) error {
+	for i := 0; i < len(msgs); i += kinesisPutRecordsLimit {
+		end := i + kinesisPutRecordsLimit
+		if end > len(msgs) {
+			end = len(msgs)
+		}
+		entries := make([]*gokinesis.PutRecordsRequestEntry, 0, end-i)
+		for _, msg := range msgs[i:end] {
+			entries = append(entries, &gokinesis.PutRecordsRequestEntry{
+				Data:         msg.Data,
+				PartitionKey: aws.String(msg.Key),
+			})
+		}
+		if err := k.putRecords(entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *Kinesis) putRecords(entries []*gokinesis.PutRecordsRequestEntry) error {
+	interval := kinesisRetryInterval
+	for retry := 0; ; retry++ {
+		out, err := k.svc.PutRecords(&gokinesis.PutRecordsInput{
+			Records:    entries,
+			StreamName: aws.String(k.stream),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to call kinesis PutRecords (%s)", k.stream)
+		}
+		if aws.Int64Value(out.FailedRecordCount) == 0 {
+			return nil
+		}
+		// The results are in the same order as the requested records.
+		var (
+			failed  []*gokinesis.PutRecordsRequestEntry
+			lastErr string
+		)
+		for j, r := range out.Records {
+			if r.ErrorCode != nil {
+				failed = append(failed, entries[j])
+				lastErr = aws.StringValue(r.ErrorCode) + ": " + aws.StringValue(r.ErrorMessage)
+			}
+		}
+		if retry >= kinesisPutRetries {
+			return errors.Errorf("failed to put %d records into kinesis (%s): %s", len(failed), k.stream, lastErr)
+		}
+		entries = failed
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+// Shards returns all the shards including the closed ones, whose records may be
+// left. The parents of a shard are the shards split or merged into it.
+func (k *Kinesis) Shards() ([]*Shard, error) {
+	var (
+		shards []*Shard
+		start  *string
+	)
+	for {
+		out, err := k.svc.DescribeStream(&gokinesis.DescribeStreamInput{
+			StreamName:            aws.String(k.stream),
+			ExclusiveStartShardId: start,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to call kinesis DescribeStream (%s)", k.stream)
+		}
+		for _, s := range out.StreamDescription.Shards {
+			shard := &Shard{ID: aws.StringValue(s.ShardId)}
+			for _, parent := range []*string{s.ParentShardId, s.AdjacentParentShardId} {
+				if parent != nil {
+					shard.Parents = append(shard.Parents, aws.StringValue(parent))
+				}
+			}
+			shards = append(shards, shard)
+		}
+		if !aws.BoolValue(out.StreamDescription.HasMoreShards) || len(shards) == 0 {
+			return shards, nil
+		}
+		start = aws.String(shards[len(shards)-1].ID)
+	}
+}
+
+// NewReader returns a reader of the shard.
+func (k *Kinesis) NewReader(shard, after string) (Reader, error) {
+	r := &kinesisReader{kinesis: k, shard: shard, last: after}
+	if err := r.refreshIterator(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+type kinesisReader struct {
+	kinesis  *Kinesis
+	shard    string
+	iterator *string
+	last     string // the sequence number of the last record read
+}
+
+func (r *kinesisReader) refreshIterator() error {
+	in := &gokinesis.GetShardIteratorInput{
+		StreamName:        aws.String(r.kinesis.stream),
+		ShardId:           aws.String(r.shard),
+		ShardIteratorType: aws.String(gokinesis.ShardIteratorTypeTrimHorizon),
+	}
+	if r.last != "" {
+		in.ShardIteratorType = aws.String(gokinesis.ShardIteratorTypeAfterSequenceNumber)
+		in.StartingSequenceNumber = aws.String(r.last)
+	}
+	out, err := r.kinesis.svc.GetShardIterator(in)
+	if err != nil {
+		return errors.Wrapf(err, "failed to call kinesis GetShardIterator (%s,%s)", r.kinesis.stream, r.shard)
+	}
+	r.iterator = out.ShardIterator
+	return nil
+}
+
+// Read reads the records by GetRecords. The expired iterator is refreshed from the last record.
+func (r *kinesisReader) Read(limit int) ([]*Record, error) {
+	if r.iterator == nil {
+		return nil, io.EOF
+	}
+	out, err := r.kinesis.svc.GetRecords(&gokinesis.GetRecordsInput{
+		ShardIterator: r.iterator,
+		Limit:         aws.Int64(int64(limit)),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == gokinesis.ErrCodeExpiredIteratorException {
+			if err := r.refreshIterator(); err != nil {
+				return nil, err
+			}
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to call kinesis GetRecords (%s,%s)", r.kinesis.stream, r.shard)
+	}
+	// NextShardIterator is nil if the shard is closed and all the records are read.
+	r.iterator = out.NextShardIterator
+	records := make([]*Record, 0, len(out.Records))
+	for _, rec := range out.Records {
+		records = append(records, &Record{
+			SequenceNumber: aws.StringValue(rec.SequenceNumber),
+			Data:           rec.Data,
+		})
+	}
+	if len(records) > 0 {
+		r.last = records[len(records)-1].SequenceNumber
+	}
+	return records, nil
+}
+
+// Close does nothing because the shard iterator needs no cleanup.
+func (r *kinesisReader) Close() error {
+	return nil
+}
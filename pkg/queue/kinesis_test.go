@@ -0,0 +1,181 @@
+package queue
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	gokinesis "github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestKinesisPublish(t *testing.T) {
+	kinesisRetryInterval = time.Millisecond
+	var calls [][]string
+	fake := &FakeKinesisAPI{
+		FakePutRecords: func(in *gokinesis.PutRecordsInput) (*gokinesis.PutRecordsOutput, error) {
+			var keys []string
+			out := &gokinesis.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+			for _, r := range in.Records {
+				keys = append(keys, aws.StringValue(r.PartitionKey))
+				// The record 'b' is throttled once.
+				if aws.StringValue(r.PartitionKey) == "b" && len(calls) == 0 {
+					out.FailedRecordCount = aws.Int64(1)
+					out.Records = append(out.Records, &gokinesis.PutRecordsResultEntry{
+						ErrorCode:    aws.String(gokinesis.ErrCodeProvisionedThroughputExceededException),
+						ErrorMessage: aws.String("Rate exceeded"),
+					})
+					continue
+				}
+				out.Records = append(out.Records, &gokinesis.PutRecordsResultEntry{
+					SequenceNumber: aws.String("1"),
+					ShardId:        aws.String("shardId-000000000000"),
+				})
+			}
+			calls = append(calls, keys)
+			return out, nil
+		},
+	}
+	k := NewTestKinesis(fake, "diamondb-storage")
+
+	err := k.Publish([]*Message{{Key: "a", Data: []byte("a")}, {Key: "b", Data: []byte("b")}})
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if diff := pretty.Compare(calls, [][]string{{"a", "b"}, {"b"}}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestKinesisPublish_Exhausted(t *testing.T) {
+	kinesisRetryInterval = time.Millisecond
+	fake := &FakeKinesisAPI{
+		FakePutRecords: func(in *gokinesis.PutRecordsInput) (*gokinesis.PutRecordsOutput, error) {
+			return &gokinesis.PutRecordsOutput{
+				FailedRecordCount: aws.Int64(1),
+				Records: []*gokinesis.PutRecordsResultEntry{{
+					ErrorCode:    aws.String(gokinesis.ErrCodeProvisionedThroughputExceededException),
+					ErrorMessage: aws.String("Rate exceeded"),
+				}},
+			}, nil
+		},
+	}
+	k := NewTestKinesis(fake, "diamondb-storage")
+	if err := k.Publish([]*Message{{Key: "a", Data: []byte("a")}}); err == nil {
+		t.Fatalf("should raise err")
+	}
+}
+
+func TestKinesisShards(t *testing.T) {
+	fake := &FakeKinesisAPI{
+		FakeDescribeStream: func(in *gokinesis.DescribeStreamInput) (*gokinesis.DescribeStreamOutput, error) {
+			if in.ExclusiveStartShardId == nil {
+				return &gokinesis.DescribeStreamOutput{StreamDescription: &gokinesis.StreamDescription{
+					Shards:        []*gokinesis.Shard{{ShardId: aws.String("shard-0")}, {ShardId: aws.String("shard-1")}},
+					HasMoreShards: aws.Bool(true),
+				}}, nil
+			}
+			if aws.StringValue(in.ExclusiveStartShardId) != "shard-1" {
+				t.Fatalf("unexpected ExclusiveStartShardId %s", aws.StringValue(in.ExclusiveStartShardId))
+			}
+			return &gokinesis.DescribeStreamOutput{StreamDescription: &gokinesis.StreamDescription{
+				Shards: []*gokinesis.Shard{{
+					ShardId:               aws.String("shard-2"),
+					ParentShardId:         aws.String("shard-0"),
+					AdjacentParentShardId: aws.String("shard-1"),
+				}},
+				HasMoreShards: aws.Bool(false),
+			}}, nil
+		},
+	}
+	shards, err := NewTestKinesis(fake, "diamondb-storage").Shards()
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	expected := []*Shard{
+		{ID: "shard-0"},
+		{ID: "shard-1"},
+		{ID: "shard-2", Parents: []string{"shard-0", "shard-1"}},
+	}
+	if diff := pretty.Compare(shards, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestKinesisReader(t *testing.T) {
+	var iteratorInputs []*gokinesis.GetShardIteratorInput
+	getRecords := 0
+	fake := &FakeKinesisAPI{
+		FakeGetShardIterator: func(in *gokinesis.GetShardIteratorInput) (*gokinesis.GetShardIteratorOutput, error) {
+			iteratorInputs = append(iteratorInputs, in)
+			return &gokinesis.GetShardIteratorOutput{ShardIterator: aws.String("iterator")}, nil
+		},
+		FakeGetRecords: func(in *gokinesis.GetRecordsInput) (*gokinesis.GetRecordsOutput, error) {
+			getRecords++
+			switch getRecords {
+			case 1:
+				return &gokinesis.GetRecordsOutput{
+					Records: []*gokinesis.Record{
+						{SequenceNumber: aws.String("10"), Data: []byte("a")},
+						{SequenceNumber: aws.String("11"), Data: []byte("b")},
+					},
+					NextShardIterator: aws.String("iterator"),
+				}, nil
+			case 2:
+				return nil, awserr.New(gokinesis.ErrCodeExpiredIteratorException, "expired", nil)
+			default:
+				// The shard is closed.
+				return &gokinesis.GetRecordsOutput{
+					Records: []*gokinesis.Record{{SequenceNumber: aws.String("12"), Data: []byte("c")}},
+				}, nil
+			}
+		},
+	}
+	r, err := NewTestKinesis(fake, "diamondb-storage").NewReader("shard-0", "")
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+
+	records, err := r.Read(10)
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	expected := []*Record{{SequenceNumber: "10", Data: []byte("a")}, {SequenceNumber: "11", Data: []byte("b")}}
+	if diff := pretty.Compare(records, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	// The expired iterator is refreshed after the last record.
+	if records, err := r.Read(10); err != nil || len(records) != 0 {
+		t.Fatalf("should read no records, not (%v, %v)", records, err)
+	}
+	records, err = r.Read(10)
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	expected = []*Record{{SequenceNumber: "12", Data: []byte("c")}}
+	if diff := pretty.Compare(records, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	if _, err := r.Read(10); err != io.EOF {
+		t.Fatalf("err should be io.EOF, not %v", err)
+	}
+
+	expectedInputs := []*gokinesis.GetShardIteratorInput{
+		{
+			StreamName:        aws.String("diamondb-storage"),
+			ShardId:           aws.String("shard-0"),
+			ShardIteratorType: aws.String(gokinesis.ShardIteratorTypeTrimHorizon),
+		},
+		{
+			StreamName:             aws.String("diamondb-storage"),
+			ShardId:                aws.String("shard-0"),
+			ShardIteratorType:      aws.String(gokinesis.ShardIteratorTypeAfterSequenceNumber),
+			StartingSequenceNumber: aws.String("11"),
+		},
+	}
+	if diff := pretty.Compare(iteratorInputs, expectedInputs); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
@@ -0,0 +1,110 @@
+// Package queue decouples accepting writes from writing them into the store
+// by the ingestion queue such as Kinesis Data Streams.
+package queue
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/config"
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage"
+)
+
+// Message is a message to be published into the queue.
+type Message struct {
+	// Key decides the shard of the message.
+	Key  string
+	Data []byte
+}
+
+// Record is a message read from a shard.
+type Record struct {
+	SequenceNumber string
+	Data           []byte
+}
+
+// Shard is a shard of the queue. The shards are split and merged into the
+// children, whose records are consumed after all the records of the parents.
+type Shard struct {
+	ID      string
+	Parents []string
+}
+
+// Queue defines the interface for the ingestion queue.
+type Queue interface {
+	// Publish appends the messages into the queue.
+	Publish([]*Message) error
+	// Shards returns the shards.
+	Shards() ([]*Shard, error)
+	// NewReader returns a reader of the shard starting after the sequence number.
+	// It starts from the oldest record if after is empty.
+	NewReader(shard, after string) (Reader, error)
+}
+
+// Reader reads the records of a shard in order.
+type Reader interface {
+	// Read returns at most limit records. It returns no records if no new
+	// record has arrived yet, and io.EOF if the shard is closed.
+	Read(limit int) ([]*Record, error)
+	Close() error
+}
+
+// New creates a new Queue selected by the config. It returns nil if the queue is disabled.
+func New() (Queue, error) {
+	switch config.Config.Queue {
+	case "":
+		return nil, nil
+	case "kinesis":
+		return NewKinesis()
+	case "file":
+		return NewFile(config.Config.QueueFileDir)
+	}
+	return nil, errors.Errorf("unknown queue %q", config.Config.Queue)
+}
+
+// Publisher is a storage.ReadWriter publishing the metrics into the queue instead
+// of writing them into the store. The others are delegated to the store.
+type Publisher struct {
+	storage.ReadWriter
+	queue Queue
+}
+
+var _ storage.ReadWriter = &Publisher{}
+
+// NewPublisher creates a new Publisher.
+func NewPublisher(store storage.ReadWriter, q Queue) *Publisher {
+	return &Publisher{ReadWriter: store, queue: q}
+}
+
+// InsertMetric publishes the metric into the queue.
+func (p *Publisher) InsertMetric(m *model.Metric) error {
+	data, err := encodeMetric(m)
+	if err != nil {
+		return err
+	}
+	if err := p.queue.Publish([]*Message{{Key: m.Name, Data: data}}); err != nil {
+		return errors.Wrapf(err, "failed to publish metric (%s)", m.Name)
+	}
+	return nil
+}
+
+func encodeMetric(m *model.Metric) ([]byte, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode metric (%s)", m.Name)
+	}
+	return data, nil
+}
+
+func decodeMetric(data []byte) (*model.Metric, error) {
+	var m model.Metric
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrap(err, "failed to decode metric")
+	}
+	if m.Name == "" {
+		return nil, errors.New("failed to decode metric: empty name")
+	}
+	return &m, nil
+}
@@ -0,0 +1,51 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage"
+)
+
+func TestPublisherInsertMetric(t *testing.T) {
+	q, cleanup := newTestFile(t)
+	defer cleanup()
+
+	p := NewPublisher(&storage.FakeReadWriter{
+		FakeInsertMetric: func(m *model.Metric) error {
+			t.Fatalf("the store should not be written")
+			return nil
+		},
+	}, q)
+	m := &model.Metric{
+		Name:       "server1.loadavg5",
+		Datapoints: []*model.Datapoint{{Timestamp: 100, Value: 10.0}},
+	}
+	if err := p.InsertMetric(m); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+
+	r, _ := q.NewReader("0", "")
+	defer r.Close()
+	records, err := r.Read(10)
+	if err != nil || len(records) != 1 {
+		t.Fatalf("should read a record, not (%v, %v)", records, err)
+	}
+	got, err := decodeMetric(records[0].Data)
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if diff := pretty.Compare(got, m); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestDecodeMetric_Malformed(t *testing.T) {
+	for _, data := range []string{"", "{", `{"datapoints":[]}`} {
+		if _, err := decodeMetric([]byte(data)); err == nil {
+			t.Fatalf("data: %q, should raise err", data)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package queue
+
+import (
+	gokinesis "github.com/aws/aws-sdk-go/service/kinesis"
+	gokinesisiface "github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+// FakeKinesisAPI is for stub testing
+type FakeKinesisAPI struct {
+	gokinesisiface.KinesisAPI
+	FakePutRecords       func(*gokinesis.PutRecordsInput) (*gokinesis.PutRecordsOutput, error)
+	FakeDescribeStream   func(*gokinesis.DescribeStreamInput) (*gokinesis.DescribeStreamOutput, error)
+	FakeGetShardIterator func(*gokinesis.GetShardIteratorInput) (*gokinesis.GetShardIteratorOutput, error)
+	FakeGetRecords       func(*gokinesis.GetRecordsInput) (*gokinesis.GetRecordsOutput, error)
+}
+
+func (k *FakeKinesisAPI) PutRecords(in *gokinesis.PutRecordsInput) (*gokinesis.PutRecordsOutput, error) {
+	return k.FakePutRecords(in)
+}
+
+func (k *FakeKinesisAPI) DescribeStream(in *gokinesis.DescribeStreamInput) (*gokinesis.DescribeStreamOutput, error) {
+	return k.FakeDescribeStream(in)
+}
+
+func (k *FakeKinesisAPI) GetShardIterator(in *gokinesis.GetShardIteratorInput) (*gokinesis.GetShardIteratorOutput, error) {
+	return k.FakeGetShardIterator(in)
+}
+
+func (k *FakeKinesisAPI) GetRecords(in *gokinesis.GetRecordsInput) (*gokinesis.GetRecordsOutput, error) {
+	return k.FakeGetRecords(in)
+}
+
+// NewTestKinesis creates a Kinesis with the fake client.
+func NewTestKinesis(svc gokinesisiface.KinesisAPI, stream string) *Kinesis {
+	return &Kinesis{svc: svc, stream: stream}
+}
@@ -0,0 +1,212 @@
+package statsd
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuuki/diamondb/pkg/model"
+)
+
+const (
+	counterPrefix = "stats.counters."
+	gaugePrefix   = "stats.gauges."
+	timerPrefix   = "stats.timers."
+	setPrefix     = "stats.sets."
+)
+
+// DefaultPercentiles is the default percentiles calculated for timers.
+var DefaultPercentiles = []float64{90}
+
+// Aggregator aggregates the samples over a flush interval.
+// The series are named by the same namespace as the Etsy's statsd such as
+// 'stats.counters.<name>.count' and 'stats.timers.<name>.upper_90'.
+type Aggregator struct {
+	percentiles  []float64
+	gaugeIdleAge int64
+
+	mu       sync.Mutex
+	counters map[string]float64
+	gauges   map[string]float64
+	timers   map[string]*timer
+	sets     map[string]map[string]struct{}
+	// gaugeUpdated is the gauges updated since the last flush, and gaugeFlushed
+	// is the timestamps of the last flush updating each gauge.
+	gaugeUpdated map[string]struct{}
+	gaugeFlushed map[string]int64
+}
+
+type timer struct {
+	values []float64
+	count  float64 // the count corrected by the sample rates
+}
+
+// NewAggregator creates a new Aggregator calculating the percentiles for timers.
+// The gauges not updated for gaugeIdleAge are deleted, or kept forever if it is 0.
+func NewAggregator(percentiles []float64, gaugeIdleAge time.Duration) *Aggregator {
+	if len(percentiles) == 0 {
+		percentiles = DefaultPercentiles
+	}
+	return &Aggregator{
+		percentiles:  percentiles,
+		gaugeIdleAge: int64(gaugeIdleAge.Seconds()),
+		counters:     make(map[string]float64),
+		gauges:       make(map[string]float64),
+		timers:       make(map[string]*timer),
+		sets:         make(map[string]map[string]struct{}),
+		gaugeUpdated: make(map[string]struct{}),
+		gaugeFlushed: make(map[string]int64),
+	}
+}
+
+// Add aggregates the sample.
+func (a *Aggregator) Add(s *Sample) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch s.Type {
+	case Counter:
+		a.counters[s.Name] += s.Value / s.SampleRate
+	case Gauge:
+		a.gaugeUpdated[s.Name] = struct{}{}
+		if s.Delta {
+			a.gauges[s.Name] += s.Value
+		} else {
+			a.gauges[s.Name] = s.Value
+		}
+	case Timer:
+		t, ok := a.timers[s.Name]
+		if !ok {
+			t = &timer{}
+			a.timers[s.Name] = t
+		}
+		t.values = append(t.values, s.Value)
+		t.count += 1 / s.SampleRate
+	case Set:
+		set, ok := a.sets[s.Name]
+		if !ok {
+			set = make(map[string]struct{})
+			a.sets[s.Name] = set
+		}
+		set[s.SetValue] = struct{}{}
+	}
+}
+
+// Flush returns the aggregated series at the timestamp and resets the aggregation.
+// The interval is the flush interval in seconds to calculate the rates.
+// Gauges keep the last value and are written every flush until they are idle
+// for the gauge idle age.
+func (a *Aggregator) Flush(timestamp int64, interval float64) []*model.Metric {
+	a.mu.Lock()
+	counters, timers, sets := a.counters, a.timers, a.sets
+	a.counters = make(map[string]float64, len(counters))
+	a.timers = make(map[string]*timer, len(timers))
+	a.sets = make(map[string]map[string]struct{}, len(sets))
+	for name := range a.gaugeUpdated {
+		a.gaugeFlushed[name] = timestamp
+	}
+	a.gaugeUpdated = make(map[string]struct{}, len(a.gaugeUpdated))
+	gauges := make(map[string]float64, len(a.gauges))
+	for name, v := range a.gauges {
+		if a.gaugeIdleAge > 0 && timestamp-a.gaugeFlushed[name] > a.gaugeIdleAge {
+			delete(a.gauges, name)
+			delete(a.gaugeFlushed, name)
+			continue
+		}
+		gauges[name] = v
+	}
+	a.mu.Unlock()
+
+	var metrics []*model.Metric
+	add := func(name string, v float64) {
+		metrics = append(metrics, &model.Metric{
+			Name:       name,
+			Datapoints: []*model.Datapoint{{Timestamp: timestamp, Value: v}},
+		})
+	}
+
+	for name, v := range counters {
+		add(counterPrefix+name+".count", v)
+		if interval > 0 {
+			add(counterPrefix+name+".rate", v/interval)
+		}
+	}
+	for name, v := range gauges {
+		add(gaugePrefix+name, v)
+	}
+	for name, t := range timers {
+		for stat, v := range a.timerStats(t, interval) {
+			add(timerPrefix+name+"."+stat, v)
+		}
+	}
+	for name, set := range sets {
+		add(setPrefix+name+".count", float64(len(set)))
+	}
+
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Name < metrics[j].Name })
+	return metrics
+}
+
+// timerStats calculates the statistics of the timer in the same way as the Etsy's statsd.
+func (a *Aggregator) timerStats(t *timer, interval float64) map[string]float64 {
+	values := t.values
+	sort.Float64s(values)
+	n := len(values)
+
+	cumulative := make([]float64, n)
+	sum := 0.0
+	for i, v := range values {
+		sum += v
+		cumulative[i] = sum
+	}
+	mean := sum / float64(n)
+	sqsum := 0.0
+	for _, v := range values {
+		sqsum += (v - mean) * (v - mean)
+	}
+
+	stats := map[string]float64{
+		"count":  t.count,
+		"lower":  values[0],
+		"upper":  values[n-1],
+		"sum":    sum,
+		"mean":   mean,
+		"median": median(values),
+		"std":    math.Sqrt(sqsum / float64(n)),
+	}
+	if interval > 0 {
+		stats["count_ps"] = t.count / interval
+	}
+	for _, pct := range a.percentiles {
+		// The number of values within the percentile threshold.
+		k := int(math.Floor(pct/100*float64(n) + 0.5))
+		if k < 1 {
+			continue
+		}
+		if k > n {
+			k = n
+		}
+		suffix := formatPercentile(pct)
+		stats["upper_"+suffix] = values[k-1]
+		stats["sum_"+suffix] = cumulative[k-1]
+		stats["mean_"+suffix] = cumulative[k-1] / float64(k)
+	}
+	return stats
+}
+
+func median(sorted []float64) float64 {
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// formatPercentile formats the percentile as a node of the series name.
+// ex. 90 => "90", 99.9 => "99_9"
+func formatPercentile(pct float64) string {
+	return strings.Replace(strconv.FormatFloat(pct, 'f', -1, 64), ".", "_", -1)
+}
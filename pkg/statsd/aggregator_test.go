@@ -0,0 +1,102 @@
+package statsd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+)
+
+func flushToMap(metrics []*model.Metric) map[string]float64 {
+	m := make(map[string]float64, len(metrics))
+	for _, metric := range metrics {
+		m[metric.Name] = metric.Datapoints[0].Value
+	}
+	return m
+}
+
+func TestAggregatorFlush(t *testing.T) {
+	a := NewAggregator([]float64{50, 99.9}, 0)
+	samples := []*Sample{
+		{Name: "req", Type: Counter, Value: 1, SampleRate: 1},
+		{Name: "req", Type: Counter, Value: 1, SampleRate: 0.5},
+		{Name: "queue", Type: Gauge, Value: 10, SampleRate: 1},
+		{Name: "queue", Type: Gauge, Value: -3, SampleRate: 1, Delta: true},
+		{Name: "users", Type: Set, SetValue: "alice", SampleRate: 1},
+		{Name: "users", Type: Set, SetValue: "bob", SampleRate: 1},
+		{Name: "users", Type: Set, SetValue: "alice", SampleRate: 1},
+	}
+	for _, v := range []float64{4, 1, 3, 2} {
+		samples = append(samples, &Sample{Name: "latency", Type: Timer, Value: v, SampleRate: 1})
+	}
+	for _, s := range samples {
+		a.Add(s)
+	}
+
+	metrics := a.Flush(100, 10)
+	for _, m := range metrics {
+		if diff := pretty.Compare(m.Datapoints[0].Timestamp, int64(100)); diff != "" {
+			t.Fatalf("name: %s, diff: (-actual +expected)\n%s", m.Name, diff)
+		}
+	}
+	expected := map[string]float64{
+		"stats.counters.req.count":        3,
+		"stats.counters.req.rate":         0.3,
+		"stats.gauges.queue":              7,
+		"stats.sets.users.count":          2,
+		"stats.timers.latency.count":      4,
+		"stats.timers.latency.count_ps":   0.4,
+		"stats.timers.latency.lower":      1,
+		"stats.timers.latency.upper":      4,
+		"stats.timers.latency.sum":        10,
+		"stats.timers.latency.mean":       2.5,
+		"stats.timers.latency.median":     2.5,
+		"stats.timers.latency.std":        1.118033988749895,
+		"stats.timers.latency.upper_50":   2,
+		"stats.timers.latency.sum_50":     3,
+		"stats.timers.latency.mean_50":    1.5,
+		"stats.timers.latency.upper_99_9": 4,
+		"stats.timers.latency.sum_99_9":   10,
+		"stats.timers.latency.mean_99_9":  2.5,
+	}
+	if diff := pretty.Compare(flushToMap(metrics), expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	// Only the gauges are written after the flush.
+	expected = map[string]float64{"stats.gauges.queue": 7}
+	if diff := pretty.Compare(flushToMap(a.Flush(110, 10)), expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestAggregatorFlush_GaugeIdleAge(t *testing.T) {
+	a := NewAggregator(nil, 30*time.Second)
+	a.Add(&Sample{Name: "queue", Type: Gauge, Value: 1, SampleRate: 1})
+	a.Add(&Sample{Name: "conns", Type: Gauge, Value: 2, SampleRate: 1})
+
+	tests := []struct {
+		timestamp int64
+		update    string
+		expected  map[string]float64
+	}{
+		{100, "", map[string]float64{"stats.gauges.queue": 1, "stats.gauges.conns": 2}},
+		{120, "conns", map[string]float64{"stats.gauges.queue": 1, "stats.gauges.conns": 3}},
+		{130, "", map[string]float64{"stats.gauges.queue": 1, "stats.gauges.conns": 3}},
+		// queue is idle for more than 30 seconds since it was flushed at 100.
+		{140, "", map[string]float64{"stats.gauges.conns": 3}},
+		{160, "", map[string]float64{}},
+		// The deleted gauge starts from zero again.
+		{170, "conns", map[string]float64{"stats.gauges.conns": 1}},
+	}
+	for _, tc := range tests {
+		if tc.update != "" {
+			a.Add(&Sample{Name: tc.update, Type: Gauge, Value: 1, SampleRate: 1, Delta: true})
+		}
+		if diff := pretty.Compare(flushToMap(a.Flush(tc.timestamp, 10)), tc.expected); diff != "" {
+			t.Fatalf("timestamp: %d, diff: (-actual +expected)\n%s", tc.timestamp, diff)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Package statsd aggregates the metrics received by the StatsD protocol.
+package statsd
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// MetricType is the type of a StatsD metric.
+type MetricType string
+
+const (
+	// Counter is the type of 'c'.
+	Counter MetricType = "c"
+	// Gauge is the type of 'g'.
+	Gauge MetricType = "g"
+	// Timer is the type of 'ms'. Histograms 'h' are regarded as timers.
+	Timer MetricType = "ms"
+	// Set is the type of 's'.
+	Set MetricType = "s"
+)
+
+// Sample is a parsed StatsD metric such as 'api.requests:1|c|@0.1'.
+type Sample struct {
+	Name       string
+	Type       MetricType
+	Value      float64
+	SetValue   string  // the raw value of the set
+	SampleRate float64 // 1 if not sampled
+	Delta      bool    // true if the gauge value has the sign such as '+1' or '-1'
+}
+
+// ParseError represents an error of parsing a malformed line.
+type ParseError struct {
+	line string
+	msg  string
+}
+
+// Error returns the error message for ParseError.
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("malformed line %q: %s", e.line, e.msg)
+}
+
+// ParseLine parses a line '<name>:<value>|<type>[|@<sample rate>]'. The line
+// may contain multiple values of the same name such as 'a:1|c:2|c'.
+func ParseLine(line string) ([]*Sample, error) {
+	i := strings.IndexByte(line, ':')
+	if i <= 0 {
+		return nil, &ParseError{line: line, msg: "missing name"}
+	}
+	name, rest := line[:i], line[i+1:]
+	// Drop the DogStatsD tags, which may contain ':'.
+	if j := strings.Index(rest, "|#"); j >= 0 {
+		rest = rest[:j]
+	}
+	parts := strings.Split(rest, ":")
+	samples := make([]*Sample, 0, len(parts))
+	for _, part := range parts {
+		s, msg := parseValue(name, part)
+		if msg != "" {
+			return nil, &ParseError{line: line, msg: msg}
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+func parseValue(name, part string) (*Sample, string) {
+	fields := strings.Split(part, "|")
+	if len(fields) < 2 || fields[0] == "" {
+		return nil, "missing value or type"
+	}
+	s := &Sample{Name: name, SampleRate: 1}
+	switch fields[1] {
+	case "c":
+		s.Type = Counter
+	case "g":
+		s.Type = Gauge
+	case "ms", "h":
+		s.Type = Timer
+	case "s":
+		s.Type = Set
+	default:
+		return nil, fmt.Sprintf("unknown type %q", fields[1])
+	}
+	for _, f := range fields[2:] {
+		// Ignore the unsupported extensions.
+		if !strings.HasPrefix(f, "@") {
+			continue
+		}
+		rate, err := strconv.ParseFloat(f[1:], 64)
+		if err != nil || rate <= 0 || rate > 1 {
+			return nil, fmt.Sprintf("invalid sample rate %q", f)
+		}
+		s.SampleRate = rate
+	}
+
+	raw := fields[0]
+	if s.Type == Set {
+		s.SetValue = raw
+		return s, ""
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, fmt.Sprintf("invalid value %q", raw)
+	}
+	s.Value = v
+	if s.Type == Gauge && (raw[0] == '+' || raw[0] == '-') {
+		s.Delta = true
+	}
+	return s, ""
+}
@@ -0,0 +1,85 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		desc     string
+		line     string
+		expected []*Sample
+	}{
+		{
+			"counter",
+			"api.requests:1|c",
+			[]*Sample{{Name: "api.requests", Type: Counter, Value: 1, SampleRate: 1}},
+		},
+		{
+			"sampled counter",
+			"api.requests:2|c|@0.1",
+			[]*Sample{{Name: "api.requests", Type: Counter, Value: 2, SampleRate: 0.1}},
+		},
+		{
+			"gauge",
+			"queue.size:42|g",
+			[]*Sample{{Name: "queue.size", Type: Gauge, Value: 42, SampleRate: 1}},
+		},
+		{
+			"gauge delta",
+			"queue.size:-3|g",
+			[]*Sample{{Name: "queue.size", Type: Gauge, Value: -3, SampleRate: 1, Delta: true}},
+		},
+		{
+			"timer and histogram",
+			"api.latency:12.5|ms:30|h",
+			[]*Sample{
+				{Name: "api.latency", Type: Timer, Value: 12.5, SampleRate: 1},
+				{Name: "api.latency", Type: Timer, Value: 30, SampleRate: 1},
+			},
+		},
+		{
+			"set",
+			"api.users:alice|s",
+			[]*Sample{{Name: "api.users", Type: Set, SetValue: "alice", SampleRate: 1}},
+		},
+		{
+			"dogstatsd tags are ignored",
+			"api.requests:1|c|#env:prod",
+			[]*Sample{{Name: "api.requests", Type: Counter, Value: 1, SampleRate: 1}},
+		},
+	}
+	for _, tc := range tests {
+		got, err := ParseLine(tc.line)
+		if err != nil {
+			t.Fatalf("desc: %s, should not raise err: %s", tc.desc, err)
+		}
+		if diff := pretty.Compare(got, tc.expected); diff != "" {
+			t.Fatalf("desc: %s, diff: (-actual +expected)\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestParseLine_Malformed(t *testing.T) {
+	lines := []string{
+		"api.requests",
+		":1|c",
+		"api.requests:1",
+		"api.requests:|c",
+		"api.requests:1|x",
+		"api.requests:abc|c",
+		"api.requests:1|c|@0",
+		"api.requests:1|c|@abc",
+	}
+	for _, line := range lines {
+		_, err := ParseLine(line)
+		if err == nil {
+			t.Fatalf("line: %q, should raise err", line)
+		}
+		if _, ok := err.(*ParseError); !ok {
+			t.Fatalf("line: %q, err should be ParseError, not %T", line, err)
+		}
+	}
+}
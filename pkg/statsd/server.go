@@ -0,0 +1,127 @@
+package statsd
+
+import (
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/yuuki/diamondb/pkg/storage"
+	"github.com/yuuki/diamondb/pkg/udp"
+)
+
+// Server receives the StatsD metrics over UDP, and writes the aggregated
+// series into the store every flush interval.
+type Server struct {
+	store      storage.ReadWriter
+	interval   time.Duration
+	aggregator *Aggregator
+
+	listener *udp.Listener
+	done     chan struct{}
+
+	received  uint64
+	malformed uint64
+	written   uint64
+	failed    uint64
+}
+
+// Stats represents the counters of the Server.
+type Stats struct {
+	Received  uint64 `json:"received"`
+	Malformed uint64 `json:"malformed"`
+	Written   uint64 `json:"written"`
+	Failed    uint64 `json:"failed"`
+}
+
+// Option for the statsd Server.
+type Option struct {
+	Addr          string
+	Store         storage.ReadWriter
+	FlushInterval time.Duration
+	Percentiles   []float64
+	GaugeIdleAge  time.Duration
+}
+
+// New initializes a new statsd Server.
+func New(o *Option) *Server {
+	s := &Server{
+		store:      o.Store,
+		interval:   o.FlushInterval,
+		aggregator: NewAggregator(o.Percentiles, o.GaugeIdleAge),
+		done:       make(chan struct{}),
+	}
+	s.listener = udp.NewListener("statsd", o.Addr, s.handlePacket)
+	return s
+}
+
+// Run listens on the UDP address and serves until Shutdown is called.
+func (s *Server) Run() error {
+	if err := s.listener.Listen(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.flush(now)
+		case <-s.done:
+			return nil
+		}
+	}
+}
+
+// Shutdown closes the listener and flushes the aggregated series.
+func (s *Server) Shutdown(sig os.Signal) error {
+	log.Printf("Received %s shutdown statsd listener...\n", sig)
+	close(s.done)
+	if err := s.listener.Close(); err != nil {
+		return err
+	}
+	s.flush(time.Now())
+	return nil
+}
+
+// Stats returns the snapshot of the counters. Written and Failed are counted by series.
+func (s *Server) Stats() Stats {
+	return Stats{
+		Received:  atomic.LoadUint64(&s.received),
+		Malformed: atomic.LoadUint64(&s.malformed),
+		Written:   atomic.LoadUint64(&s.written),
+		Failed:    atomic.LoadUint64(&s.failed),
+	}
+}
+
+func (s *Server) handlePacket(packet []byte) {
+	udp.SplitLines(packet, s.handleLine)
+}
+
+func (s *Server) handleLine(line string) {
+	if len(line) == 0 || line == "\r" {
+		return
+	}
+	atomic.AddUint64(&s.received, 1)
+	samples, err := ParseLine(line)
+	if err != nil {
+		atomic.AddUint64(&s.malformed, 1)
+		log.Println(err)
+		return
+	}
+	for _, sample := range samples {
+		s.aggregator.Add(sample)
+	}
+}
+
+func (s *Server) flush(now time.Time) {
+	metrics := s.aggregator.Flush(now.Unix(), s.interval.Seconds())
+	for _, m := range metrics {
+		if err := s.store.InsertMetric(m); err != nil {
+			atomic.AddUint64(&s.failed, 1)
+			log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+			continue
+		}
+		atomic.AddUint64(&s.written, 1)
+	}
+}
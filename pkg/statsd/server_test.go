@@ -0,0 +1,50 @@
+package statsd
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage"
+)
+
+func TestServerHandlePacket(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got = map[string][]*model.Datapoint{}
+	)
+	s := New(&Option{
+		Store: &storage.FakeReadWriter{
+			FakeInsertMetric: func(m *model.Metric) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if m.Name == "stats.gauges.fail" {
+					return errors.New("error")
+				}
+				got[m.Name] = append(got[m.Name], m.Datapoints...)
+				return nil
+			},
+		},
+		FlushInterval: 10 * time.Second,
+	})
+
+	s.handlePacket([]byte("req:1|c\nreq:2|c\nmalformed\n\nqueue:5|g\nfail:1|g"))
+	s.flush(time.Unix(100, 0))
+
+	expected := map[string][]*model.Datapoint{
+		"stats.counters.req.count": {{Timestamp: 100, Value: 3}},
+		"stats.counters.req.rate":  {{Timestamp: 100, Value: 0.3}},
+		"stats.gauges.queue":       {{Timestamp: 100, Value: 5}},
+	}
+	if diff := pretty.Compare(got, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	expectedStats := Stats{Received: 5, Malformed: 1, Written: 3, Failed: 1}
+	if diff := pretty.Compare(s.Stats(), expectedStats); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
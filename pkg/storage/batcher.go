@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yuuki/diamondb/pkg/model"
+)
+
+const (
+	// DefaultBatcherMaxPoints is the number of buffered datapoints to trigger
+	// flushing before the flush interval elapses.
+	DefaultBatcherMaxPoints = 10000
+)
+
+// Batcher buffers datapoints per series and writes them into the store in batches.
+// It is used by the listeners receiving datapoints one by one such as carbon.
+type Batcher struct {
+	store     ReadWriter
+	interval  time.Duration
+	maxPoints int
+
+	mu       sync.Mutex
+	buffer   map[string][]*model.Datapoint
+	buffered int
+	flushc   chan struct{}
+
+	written uint64
+	failed  uint64
+}
+
+// NewBatcher creates a new Batcher flushing every interval.
+func NewBatcher(store ReadWriter, interval time.Duration) *Batcher {
+	return &Batcher{
+		store:     store,
+		interval:  interval,
+		maxPoints: DefaultBatcherMaxPoints,
+		buffer:    make(map[string][]*model.Datapoint),
+		flushc:    make(chan struct{}, 1),
+	}
+}
+
+// Add buffers the datapoint of the series.
+func (b *Batcher) Add(name string, p *model.Datapoint) {
+	b.mu.Lock()
+	b.buffer[name] = append(b.buffer[name], p)
+	b.buffered++
+	full := b.buffered >= b.maxPoints
+	b.mu.Unlock()
+	if full {
+		select {
+		case b.flushc <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run flushes the buffer periodically until done is closed.
+func (b *Batcher) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.Flush()
+		case <-b.flushc:
+			b.Flush()
+		case <-done:
+			return
+		}
+	}
+}
+
+// Flush writes the buffered datapoints into the store per series.
+func (b *Batcher) Flush() {
+	b.mu.Lock()
+	buffer := b.buffer
+	b.buffer = make(map[string][]*model.Datapoint, len(buffer))
+	b.buffered = 0
+	b.mu.Unlock()
+
+	for name, points := range buffer {
+		m := &model.Metric{Name: name, Datapoints: points}
+		if err := b.store.InsertMetric(m); err != nil {
+			atomic.AddUint64(&b.failed, uint64(len(points)))
+			log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+			continue
+		}
+		atomic.AddUint64(&b.written, uint64(len(points)))
+	}
+}
+
+// Written returns the number of datapoints written into the store.
+func (b *Batcher) Written() uint64 {
+	return atomic.LoadUint64(&b.written)
+}
+
+// Failed returns the number of datapoints failed to be written into the store.
+func (b *Batcher) Failed() uint64 {
+	return atomic.LoadUint64(&b.failed)
+}
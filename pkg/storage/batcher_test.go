@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+)
+
+func TestBatcherFlush(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got = map[string][]*model.Datapoint{}
+	)
+	b := NewBatcher(&FakeReadWriter{
+		FakeInsertMetric: func(m *model.Metric) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if m.Name == "server3.loadavg5" {
+				return errors.New("failed to write")
+			}
+			got[m.Name] = append(got[m.Name], m.Datapoints...)
+			return nil
+		},
+	}, time.Second)
+
+	b.Add("server1.loadavg5", &model.Datapoint{Timestamp: 100, Value: 1.0})
+	b.Add("server2.loadavg5", &model.Datapoint{Timestamp: 100, Value: 2.0})
+	b.Add("server1.loadavg5", &model.Datapoint{Timestamp: 160, Value: 1.1})
+	b.Add("server3.loadavg5", &model.Datapoint{Timestamp: 100, Value: 3.0})
+	b.Flush()
+
+	expected := map[string][]*model.Datapoint{
+		"server1.loadavg5": {{Timestamp: 100, Value: 1.0}, {Timestamp: 160, Value: 1.1}},
+		"server2.loadavg5": {{Timestamp: 100, Value: 2.0}},
+	}
+	if diff := pretty.Compare(got, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	if b.Written() != 3 || b.Failed() != 1 {
+		t.Fatalf("written and failed should be (3,1), not (%d,%d)", b.Written(), b.Failed())
+	}
+}
+
+func TestBatcherRun_MaxPoints(t *testing.T) {
+	written := make(chan *model.Metric, 1)
+	b := NewBatcher(&FakeReadWriter{
+		FakeInsertMetric: func(m *model.Metric) error {
+			written <- m
+			return nil
+		},
+	}, time.Hour)
+	b.maxPoints = 2
+
+	done := make(chan struct{})
+	defer close(done)
+	go b.Run(done)
+
+	b.Add("server1.loadavg5", &model.Datapoint{Timestamp: 100, Value: 1.0})
+	b.Add("server1.loadavg5", &model.Datapoint{Timestamp: 160, Value: 1.1})
+	select {
+	case m := <-written:
+		if len(m.Datapoints) != 2 {
+			t.Fatalf("the number of datapoints should be 2, not %d", len(m.Datapoints))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("should flush when the buffer is full")
+	}
+}
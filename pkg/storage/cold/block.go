@@ -0,0 +1,274 @@
+package cold
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
+)
+
+const (
+	dataSuffix  = ".data"
+	indexSuffix = ".index"
+
+	// minPartitionPeriod is the shortest period of the datapoints in a partition.
+	minPartitionPeriod = 60 * 60 * 24
+
+	chunkRaw      byte = 0
+	chunkRolledUp byte = 1
+)
+
+// PartitionPeriod returns the period of the datapoints of the step in a
+// partition of the blocks, which is the period of the DynamoDB items of the
+// step but at least a day.
+func PartitionPeriod(step int64) int64 {
+	period := schema.ItemEpochStep(step)
+	if period < minPartitionPeriod {
+		period = minPartitionPeriod
+	}
+	return period
+}
+
+// Partition returns the start of the partition including the timestamp.
+func Partition(step, timestamp int64) int64 {
+	period := PartitionPeriod(step)
+	return timestamp - timestamp%period
+}
+
+// partitionPrefix returns the prefix of the keys of the blocks in the partition.
+func partitionPrefix(step, partition int64) string {
+	return fmt.Sprintf("%d/%d/", step, partition)
+}
+
+// Index is the index of the series in a block, which is kept in the object next
+// to the data of the block.
+type Index struct {
+	Step    int64 `json:"step"`
+	MinTime int64 `json:"min_time"`
+	MaxTime int64 `json:"max_time"`
+	// Series is ordered by the names.
+	Series []*IndexEntry `json:"series"`
+}
+
+// IndexEntry is the location of the chunk of a series in the data of a block.
+type IndexEntry struct {
+	Name    string `json:"name"`
+	Offset  int64  `json:"offset"`
+	Length  int64  `json:"length"`
+	MinTime int64  `json:"min_time"`
+	MaxTime int64  `json:"max_time"`
+}
+
+// Lookup returns the entry of the series, or nil if not found.
+func (idx *Index) Lookup(name string) *IndexEntry {
+	i := sort.Search(len(idx.Series), func(i int) bool {
+		return idx.Series[i].Name >= name
+	})
+	if i < len(idx.Series) && idx.Series[i].Name == name {
+		return idx.Series[i]
+	}
+	return nil
+}
+
+// encodeBlock encodes the series into the data and the index of a block. The
+// data is the chunks of the series, each of which is compressed by gzip so that
+// a series is read by a range of the data. The index is compressed JSON.
+func encodeBlock(step int64, series map[string]map[int64]*model.Aggregate) ([]byte, []byte, error) {
+	names := make([]string, 0, len(series))
+	for name, tv := range series {
+		if len(tv) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var data bytes.Buffer
+	idx := &Index{Step: step, MinTime: math.MaxInt64, MaxTime: math.MinInt64}
+	for _, name := range names {
+		chunk, minTime, maxTime, err := encodeChunk(series[name])
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to encode chunk of %s", name)
+		}
+		idx.Series = append(idx.Series, &IndexEntry{
+			Name:    name,
+			Offset:  int64(data.Len()),
+			Length:  int64(len(chunk)),
+			MinTime: minTime,
+			MaxTime: maxTime,
+		})
+		data.Write(chunk)
+		if minTime < idx.MinTime {
+			idx.MinTime = minTime
+		}
+		if maxTime > idx.MaxTime {
+			idx.MaxTime = maxTime
+		}
+	}
+	if len(idx.Series) == 0 {
+		return nil, nil, errors.New("block must have a datapoint")
+	}
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to marshal index")
+	}
+	index, err := compress(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data.Bytes(), index, nil
+}
+
+// decodeIndex decodes the index encoded by encodeBlock.
+func decodeIndex(b []byte) (*Index, error) {
+	raw, err := decompress(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decompress index")
+	}
+	var idx Index
+	if err := json.Unmarshal(raw, &idx); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal index")
+	}
+	return &idx, nil
+}
+
+// encodeChunk encodes the datapoints of a series ordered by the timestamps. Each
+// datapoint is the delta of the timestamp, the kind and the value of a raw
+// datapoint, or the min, max, sum, count, last value and delta of the last
+// timestamp of a rolled up one. It returns the first and last timestamps.
+func encodeChunk(tv map[int64]*model.Aggregate) ([]byte, int64, int64, error) {
+	timestamps := make([]int64, 0, len(tv))
+	for t := range tv {
+		timestamps = append(timestamps, t)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	var (
+		raw  bytes.Buffer
+		buf  [binary.MaxVarintLen64]byte
+		prev int64
+	)
+	putUvarint := func(v uint64) { raw.Write(buf[:binary.PutUvarint(buf[:], v)]) }
+	putVarint := func(v int64) { raw.Write(buf[:binary.PutVarint(buf[:], v)]) }
+	putFloat := func(v float64) {
+		binary.BigEndian.PutUint64(buf[:8], math.Float64bits(v))
+		raw.Write(buf[:8])
+	}
+	putUvarint(uint64(len(timestamps)))
+	for _, t := range timestamps {
+		a := tv[t]
+		putVarint(t - prev)
+		prev = t
+		if a.IsRaw() {
+			raw.WriteByte(chunkRaw)
+			putFloat(a.Value)
+			continue
+		}
+		raw.WriteByte(chunkRolledUp)
+		putFloat(a.Min)
+		putFloat(a.Max)
+		putFloat(a.Sum)
+		putUvarint(uint64(a.Count))
+		putFloat(a.Last)
+		putVarint(a.LastTimestamp - t)
+	}
+	chunk, err := compress(raw.Bytes())
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return chunk, timestamps[0], timestamps[len(timestamps)-1], nil
+}
+
+// decodeChunk decodes the datapoints encoded by encodeChunk. The Value of a
+// rolled up aggregate is left to be finalized.
+func decodeChunk(chunk []byte) (map[int64]*model.Aggregate, error) {
+	b, err := decompress(chunk)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decompress chunk")
+	}
+	r := bytes.NewReader(b)
+	float := func() (float64, error) {
+		var v uint64
+		err := binary.Read(r, binary.BigEndian, &v)
+		return math.Float64frombits(v), err
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read chunk")
+	}
+	tv := make(map[int64]*model.Aggregate, n)
+	var t int64
+	for i := uint64(0); i < n; i++ {
+		delta, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read chunk")
+		}
+		t += delta
+		kind, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read chunk")
+		}
+		switch kind {
+		case chunkRaw:
+			v, err := float()
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to read chunk")
+			}
+			tv[t] = model.NewAggregate(t, v)
+		case chunkRolledUp:
+			a := &model.Aggregate{RolledUp: true}
+			var (
+				count     uint64
+				lastDelta int64
+			)
+			if a.Min, err = float(); err == nil {
+				if a.Max, err = float(); err == nil {
+					if a.Sum, err = float(); err == nil {
+						if count, err = binary.ReadUvarint(r); err == nil {
+							if a.Last, err = float(); err == nil {
+								lastDelta, err = binary.ReadVarint(r)
+							}
+						}
+					}
+				}
+			}
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to read chunk")
+			}
+			a.Count, a.LastTimestamp = int64(count), t+lastDelta
+			tv[t] = a
+		default:
+			return nil, errors.Errorf("unknown kind %d of datapoint in chunk", kind)
+		}
+	}
+	return tv, nil
+}
+
+func compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, errors.Wrap(err, "failed to compress")
+	}
+	if err := w.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to compress")
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
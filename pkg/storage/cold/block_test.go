@@ -0,0 +1,98 @@
+package cold
+
+import (
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+)
+
+func TestPartition(t *testing.T) {
+	tests := []struct {
+		desc      string
+		step      int64
+		timestamp int64
+		expected  int64
+	}{
+		{"the partition of a fine step is a day", 60, 100000, 86400},
+		{"the partition of a coarse step is the item", 86400, 100000, 0},
+	}
+	for _, tc := range tests {
+		if got := Partition(tc.step, tc.timestamp); got != tc.expected {
+			t.Fatalf("desc: %s, Partition(%d, %d) = %d; want %d", tc.desc, tc.step, tc.timestamp, got, tc.expected)
+		}
+	}
+}
+
+func TestEncodeChunk(t *testing.T) {
+	tv := map[int64]*model.Aggregate{
+		100: model.NewAggregate(100, 0.1),
+		160: model.NewAggregate(160, -2.5),
+		220: {Min: 1, Max: 3, Sum: 4, Count: 2, Last: 3, LastTimestamp: 250, RolledUp: true},
+	}
+	chunk, minTime, maxTime, err := encodeChunk(tv)
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if minTime != 100 || maxTime != 220 {
+		t.Fatalf("encodeChunk should return (100, 220), not (%d, %d)", minTime, maxTime)
+	}
+	got, err := decodeChunk(chunk)
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if diff := pretty.Compare(got, tv); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestEncodeBlock(t *testing.T) {
+	series := map[string]map[int64]*model.Aggregate{
+		"server1.loadavg5": {
+			100: model.NewAggregate(100, 0.1),
+			160: model.NewAggregate(160, 0.2),
+		},
+		"server2.loadavg5": {
+			40: model.NewAggregate(40, 1.1),
+		},
+		"server3.loadavg5": {},
+	}
+	data, index, err := encodeBlock(60, series)
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	idx, err := decodeIndex(index)
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if idx.Step != 60 || idx.MinTime != 40 || idx.MaxTime != 160 {
+		t.Fatalf("unexpected index (%d,%d,%d)", idx.Step, idx.MinTime, idx.MaxTime)
+	}
+	if len(idx.Series) != 2 {
+		t.Fatalf("index should have 2 series, not %d", len(idx.Series))
+	}
+	if e := idx.Lookup("server3.loadavg5"); e != nil {
+		t.Fatalf("index should not have the empty series: %v", e)
+	}
+	for name, tv := range series {
+		e := idx.Lookup(name)
+		if e == nil {
+			if len(tv) > 0 {
+				t.Fatalf("index should have %s", name)
+			}
+			continue
+		}
+		got, err := decodeChunk(data[e.Offset : e.Offset+e.Length])
+		if err != nil {
+			t.Fatalf("should not raise err: %s", err)
+		}
+		if diff := pretty.Compare(got, tv); diff != "" {
+			t.Fatalf("diff: (-actual +expected)\n%s", diff)
+		}
+	}
+
+	if _, _, err := encodeBlock(60, map[string]map[int64]*model.Aggregate{}); err == nil {
+		t.Fatalf("should raise err for the empty block")
+	}
+}
@@ -0,0 +1,426 @@
+// Package cold provides the cold tier of the datapoints compacted from DynamoDB
+// into the immutable blocks on the object storage.
+//
+// A block is a pair of objects, the data and the index, of the datapoints of
+// the series in a partition, which is a period of the datapoints of a step. The
+// keys of the objects are '<step>/<partition>/<id>.data' and '.index', where
+// the id is the hash of the data, so writing the same block again overwrites
+// it with the same objects. The blocks of a partition are merged on every write,
+// and the partitions are deleted after the history of the retentions.
+package cold
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/yuuki/diamondb/pkg/config"
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/objstore"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
+	"github.com/yuuki/diamondb/pkg/storage/util"
+)
+
+// maxReadRetries is the maximum number of the retries to read a partition
+// whose blocks are merged while they are read.
+const maxReadRetries = 3
+
+// ReadWriter defines the interface for the cold tier reader and writer.
+type ReadWriter interface {
+	Ping() error
+	Fetch(string, time.Time, time.Time) (model.SeriesMap, error)
+	FetchRetention([]string, *schema.Retention, time.Time, time.Time) (model.SeriesMap, error)
+	WriteBlock(step, partition int64, series map[string]map[int64]*model.Aggregate) error
+	Expire(now time.Time) (int, error)
+}
+
+// Cold provides the blocks on the object storage.
+type Cold struct {
+	store objstore.ObjectStore
+}
+
+var _ ReadWriter = &Cold{}
+
+// New creates a new Cold on the object storage.
+func New(store objstore.ObjectStore) *Cold {
+	return &Cold{store: store}
+}
+
+// Ping pings the object storage.
+func (c *Cold) Ping() error {
+	return c.store.Ping()
+}
+
+// WriteBlock merges the datapoints of the series into the blocks of the
+// partition of the step. The blocks of the partition are rewritten into a block
+// per layer of the distinct aggregates of the same timestamps, which is a single
+// block unless a partial aggregate is compacted later, and the old blocks are
+// deleted after the new ones are written. The data is written before the index
+// and deleted after it, so the readers never see the index of the data not
+// written. The blocks are written only by the compactor holding the lock, so a
+// partition is never merged twice at once.
+func (c *Cold) WriteBlock(step, partition int64, series map[string]map[int64]*model.Aggregate) error {
+	blockKeys, orphanKeys, err := c.listBlocks(step, partition)
+	if err != nil {
+		return err
+	}
+	blocks := make([]map[string]map[int64]*model.Aggregate, 0, len(blockKeys)+1)
+	for _, key := range blockKeys {
+		b, err := c.readBlock(key)
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks, b)
+	}
+	blocks = append(blocks, series)
+
+	written := map[string]bool{}
+	for _, layer := range layerBlocks(blocks) {
+		key, err := c.putBlock(step, partition, layer)
+		if err != nil {
+			return err
+		}
+		written[key] = true
+	}
+	for _, key := range blockKeys {
+		if written[key] {
+			continue
+		}
+		if err := c.store.Delete(key + indexSuffix); err != nil {
+			return errors.Wrapf(err, "failed to delete block index (%d,%d)", step, partition)
+		}
+		orphanKeys = append(orphanKeys, key+dataSuffix)
+	}
+	for _, key := range orphanKeys {
+		if written[strings.TrimSuffix(key, dataSuffix)] {
+			continue
+		}
+		if err := c.store.Delete(key); err != nil {
+			return errors.Wrapf(err, "failed to delete block (%d,%d)", step, partition)
+		}
+	}
+	return nil
+}
+
+// putBlock writes the datapoints of the series into a new block of the
+// partition, and returns the key of the block without the suffix.
+func (c *Cold) putBlock(step, partition int64, series map[string]map[int64]*model.Aggregate) (string, error) {
+	data, index, err := encodeBlock(step, series)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(data)
+	key := partitionPrefix(step, partition) + hex.EncodeToString(sum[:8])
+	if err := c.store.Put(key+dataSuffix, data); err != nil {
+		return "", errors.Wrapf(err, "failed to write block (%d,%d)", step, partition)
+	}
+	if err := c.store.Put(key+indexSuffix, index); err != nil {
+		return "", errors.Wrapf(err, "failed to write block index (%d,%d)", step, partition)
+	}
+	return key, nil
+}
+
+// listBlocks returns the keys without the suffix of the blocks of the
+// partition, and the keys of the data without the index, which are left by
+// failing to write the index.
+func (c *Cold) listBlocks(step, partition int64) ([]string, []string, error) {
+	keys, err := c.store.List(partitionPrefix(step, partition))
+	if err != nil {
+		return nil, nil, err
+	}
+	indexed := map[string]bool{}
+	var blockKeys, orphanKeys []string
+	for _, key := range keys {
+		if strings.HasSuffix(key, indexSuffix) {
+			indexed[strings.TrimSuffix(key, indexSuffix)] = true
+			blockKeys = append(blockKeys, strings.TrimSuffix(key, indexSuffix))
+		}
+	}
+	for _, key := range keys {
+		if strings.HasSuffix(key, dataSuffix) && !indexed[strings.TrimSuffix(key, dataSuffix)] {
+			orphanKeys = append(orphanKeys, key)
+		}
+	}
+	return blockKeys, orphanKeys, nil
+}
+
+// readBlock reads all the datapoints of the block of the key without the suffix.
+func (c *Cold) readBlock(key string) (map[string]map[int64]*model.Aggregate, error) {
+	b, err := c.store.Get(key + indexSuffix)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := decodeIndex(b)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read block index %s", key+indexSuffix)
+	}
+	data, err := c.store.Get(key + dataSuffix)
+	if err != nil {
+		return nil, err
+	}
+	series := make(map[string]map[int64]*model.Aggregate, len(idx.Series))
+	for _, e := range idx.Series {
+		if e.Offset < 0 || int64(len(data)) < e.Offset+e.Length {
+			return nil, errors.Errorf("chunk of %s is out of block %s", e.Name, key+dataSuffix)
+		}
+		tv, err := decodeChunk(data[e.Offset : e.Offset+e.Length])
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s in block %s", e.Name, key+dataSuffix)
+		}
+		series[e.Name] = tv
+	}
+	return series, nil
+}
+
+// layerBlocks merges the blocks into the layers read by readPartition as it
+// reads the blocks. The n-th layer has the n-th distinct aggregate of each
+// timestamp, except that a raw datapoint, which is read as it is, is kept alone.
+func layerBlocks(blocks []map[string]map[int64]*model.Aggregate) []map[string]map[int64]*model.Aggregate {
+	distinct := map[string]map[int64][]*model.Aggregate{}
+	for _, series := range blocks {
+		for name, tv := range series {
+			if _, ok := distinct[name]; !ok {
+				distinct[name] = map[int64][]*model.Aggregate{}
+			}
+			for t, a := range tv {
+				as := distinct[name][t]
+				switch {
+				case len(as) > 0 && as[0].IsRaw():
+				case a.IsRaw():
+					distinct[name][t] = []*model.Aggregate{a}
+				case !containsAggregate(as, a):
+					distinct[name][t] = append(as, a)
+				}
+			}
+		}
+	}
+
+	var layers []map[string]map[int64]*model.Aggregate
+	for name, tas := range distinct {
+		for t, as := range tas {
+			for i, a := range as {
+				if i == len(layers) {
+					layers = append(layers, map[string]map[int64]*model.Aggregate{})
+				}
+				if _, ok := layers[i][name]; !ok {
+					layers[i][name] = map[int64]*model.Aggregate{}
+				}
+				layers[i][name][t] = a
+			}
+		}
+	}
+	return layers
+}
+
+// containsAggregate returns whether the same aggregate is in as. The Value is
+// not compared because it is left to be finalized in the blocks.
+func containsAggregate(as []*model.Aggregate, a *model.Aggregate) bool {
+	for _, b := range as {
+		if a.Min == b.Min && a.Max == b.Max && a.Sum == b.Sum && a.Count == b.Count &&
+			a.Last == b.Last && a.LastTimestamp == b.LastTimestamp {
+			return true
+		}
+	}
+	return false
+}
+
+// Expire deletes the partitions older than the longest history of the
+// retentions of the step, as the DynamoDB items expire by the TTL. The
+// partitions of the step no retention has any longer are kept. It returns the
+// number of the partitions deleted.
+func (c *Cold) Expire(now time.Time) (int, error) {
+	histories := map[int64]int64{}
+	for _, sch := range append(append(schema.Schemas{}, config.Config.StorageSchemas...), schema.Default) {
+		for _, r := range sch.Retentions {
+			if r.Period > histories[r.Step] {
+				histories[r.Step] = r.Period
+			}
+		}
+	}
+
+	keys, err := c.store.List("")
+	if err != nil {
+		return 0, err
+	}
+	var (
+		expired []string
+		objects = map[string][]string{}
+	)
+	for _, key := range keys {
+		elems := strings.SplitN(key, "/", 3)
+		if len(elems) != 3 {
+			continue
+		}
+		step, err1 := strconv.ParseInt(elems[0], 10, 64)
+		partition, err2 := strconv.ParseInt(elems[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		history, ok := histories[step]
+		if !ok || now.Unix() < partition+PartitionPeriod(step)+history {
+			continue
+		}
+		prefix := partitionPrefix(step, partition)
+		if _, ok := objects[prefix]; !ok {
+			expired = append(expired, prefix)
+		}
+		objects[prefix] = append(objects[prefix], key)
+	}
+
+	for _, prefix := range expired {
+		// Delete the indexes before the data as WriteBlock does.
+		keys := objects[prefix]
+		sort.SliceStable(keys, func(i, j int) bool {
+			return strings.HasSuffix(keys[i], indexSuffix) && !strings.HasSuffix(keys[j], indexSuffix)
+		})
+		for _, key := range keys {
+			if err := c.store.Delete(key); err != nil {
+				return 0, errors.Wrapf(err, "failed to expire partition %s", prefix)
+			}
+		}
+	}
+	return len(expired), nil
+}
+
+// Fetch fetches datapoints by name from start until end. The step is selected
+// by the schema matching each name as well as DynamoDB.
+func (c *Cold) Fetch(name string, start, end time.Time) (model.SeriesMap, error) {
+	var ps []*partition
+	for sch, names := range config.Config.StorageSchemas.GroupNames(util.SplitName(name)) {
+		ps = append(ps, partitions(names, sch.Select(start, end).Step, start, end)...)
+	}
+	return c.fetchPartitions(ps, start, end)
+}
+
+// FetchRetention fetches datapoints by names from start until end in the
+// blocks of the step of the retention.
+func (c *Cold) FetchRetention(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error) {
+	return c.fetchPartitions(partitions(names, r.Step, start, end), start, end)
+}
+
+type partition struct {
+	names     []string
+	step      int64
+	partition int64
+}
+
+// partitions returns the partitions of the step in the range from start until
+// end.
+func partitions(names []string, step int64, start, end time.Time) []*partition {
+	var ps []*partition
+	for p := Partition(step, start.Unix()); p <= end.Unix(); p += PartitionPeriod(step) {
+		ps = append(ps, &partition{names: names, step: step, partition: p})
+	}
+	return ps
+}
+
+func (c *Cold) fetchPartitions(ps []*partition, start, end time.Time) (model.SeriesMap, error) {
+	results := make([]map[string]map[int64]*model.Aggregate, len(ps))
+	eg := errgroup.Group{}
+	for i, p := range ps {
+		i, p := i, p
+		eg.Go(func() error {
+			tvs, err := c.readPartition(p.step, p.partition, p.names, start.Unix(), end.Unix())
+			results[i] = tvs
+			return err
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	sm := model.SeriesMap{}
+	for i, tvs := range results {
+		step := ps[i].step
+		for name, tv := range tvs {
+			points := make(model.DataPoints, 0, len(tv))
+			for t, a := range tv {
+				util.Finalize(name, step, a)
+				points = append(points, model.NewAggregatedDataPoint(t, a))
+			}
+			sm.MergePointsToMap(model.SeriesMap{
+				name: model.NewSeriesPoint(name, points, int(step)),
+			})
+		}
+	}
+	return sm, nil
+}
+
+// readPartition reads the datapoints of the names from start until end in the
+// blocks of the partition. The same aggregate in the different blocks is the
+// datapoint compacted again after failing to evict it, so it is read once, and
+// the different partial aggregates of the same timestamp are merged. It reads
+// the partition again if the blocks are deleted by being merged while it reads
+// them.
+func (c *Cold) readPartition(step, partition int64, names []string, start, end int64) (map[string]map[int64]*model.Aggregate, error) {
+	for i := 0; ; i++ {
+		tvs, err := c.readBlocks(step, partition, names, start, end)
+		if errors.Cause(err) == objstore.ErrNotFound && i < maxReadRetries {
+			continue
+		}
+		return tvs, err
+	}
+}
+
+func (c *Cold) readBlocks(step, partition int64, names []string, start, end int64) (map[string]map[int64]*model.Aggregate, error) {
+	keys, err := c.store.List(partitionPrefix(step, partition))
+	if err != nil {
+		return nil, err
+	}
+	found := map[string]map[int64][]*model.Aggregate{}
+	for _, key := range keys {
+		if !strings.HasSuffix(key, indexSuffix) {
+			continue
+		}
+		b, err := c.store.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		idx, err := decodeIndex(b)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read block index %s", key)
+		}
+		if idx.MaxTime < start || end < idx.MinTime {
+			continue
+		}
+		dataKey := strings.TrimSuffix(key, indexSuffix) + dataSuffix
+		for _, name := range names {
+			e := idx.Lookup(name)
+			if e == nil || e.MaxTime < start || end < e.MinTime {
+				continue
+			}
+			chunk, err := c.store.GetRange(dataKey, e.Offset, e.Length)
+			if err != nil {
+				return nil, err
+			}
+			tv, err := decodeChunk(chunk)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read %s in block %s", name, dataKey)
+			}
+			if _, ok := found[name]; !ok {
+				found[name] = map[int64][]*model.Aggregate{}
+			}
+			for t, a := range tv {
+				if t < start || end < t {
+					continue
+				}
+				found[name][t] = append(found[name][t], a)
+			}
+		}
+	}
+
+	tvs := make(map[string]map[int64]*model.Aggregate, len(found))
+	for name, tas := range found {
+		tvs[name] = make(map[int64]*model.Aggregate, len(tas))
+		for t, as := range tas {
+			tvs[name][t] = model.MergeDistinct(as)
+		}
+	}
+	return tvs, nil
+}
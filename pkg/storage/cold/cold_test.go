@@ -0,0 +1,232 @@
+package cold
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/objstore"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
+)
+
+func newTestCold(t *testing.T) (*Cold, objstore.ObjectStore, func()) {
+	root, err := ioutil.TempDir("", "diamondb-cold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := objstore.NewDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(store), store, func() { os.RemoveAll(root) }
+}
+
+func TestWriteBlock(t *testing.T) {
+	c, store, cleanup := newTestCold(t)
+	defer cleanup()
+
+	series := map[string]map[int64]*model.Aggregate{
+		"server1.loadavg5": {100: model.NewAggregate(100, 0.1)},
+	}
+	for i := 0; i < 2; i++ {
+		// Writing the same block again is the same objects.
+		if err := c.WriteBlock(60, 0, series); err != nil {
+			t.Fatalf("should not raise err: %s", err)
+		}
+	}
+	keys, err := store.List("60/0/")
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("block should be a pair of data and index: %v", keys)
+	}
+
+	// The blocks of a partition are merged into a block.
+	series = map[string]map[int64]*model.Aggregate{
+		"server2.loadavg5": {100: model.NewAggregate(100, 1.1)},
+	}
+	if err := c.WriteBlock(60, 0, series); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	keys, err = store.List("60/0/")
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("blocks should be merged into a pair of data and index: %v", keys)
+	}
+	sm, err := c.Fetch("server{1,2}.loadavg5", time.Unix(60, 0), time.Unix(120, 0))
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if len(sm) != 2 {
+		t.Fatalf("merged block should have both the series: %v", sm)
+	}
+
+	// A distinct partial aggregate of the same timestamp is kept in another
+	// block not to be merged with the same aggregate written again.
+	for _, a := range []*model.Aggregate{
+		{Min: 1, Max: 1, Sum: 1, Count: 1, Last: 1, LastTimestamp: 200, RolledUp: true},
+		{Min: 2, Max: 2, Sum: 2, Count: 1, Last: 2, LastTimestamp: 210, RolledUp: true},
+		{Min: 2, Max: 2, Sum: 2, Count: 1, Last: 2, LastTimestamp: 210, RolledUp: true},
+	} {
+		series = map[string]map[int64]*model.Aggregate{"server1.loadavg5": {180: a}}
+		if err := c.WriteBlock(60, 0, series); err != nil {
+			t.Fatalf("should not raise err: %s", err)
+		}
+	}
+	keys, err = store.List("60/0/")
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if len(keys) != 4 {
+		t.Fatalf("blocks should be merged into two pairs of data and index: %v", keys)
+	}
+	sm, err = c.Fetch("server1.loadavg5", time.Unix(180, 0), time.Unix(180, 0))
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	expected := model.SeriesMap{
+		"server1.loadavg5": model.NewSeriesPoint("server1.loadavg5", model.DataPoints{
+			model.NewAggregatedDataPoint(180, &model.Aggregate{Value: 1.5, Min: 1, Max: 2, Sum: 3, Count: 2, Last: 2, LastTimestamp: 210, RolledUp: true}),
+		}, 60),
+	}
+	if diff := pretty.Compare(sm, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	c, store, cleanup := newTestCold(t)
+	defer cleanup()
+
+	day := int64(86400)
+	series := map[string]map[int64]*model.Aggregate{
+		"server1.loadavg5": {100: model.NewAggregate(100, 0.1)},
+	}
+	// The history of the step 60 is 1d by the default schema, and no retention
+	// has the step 7.
+	for _, b := range [][2]int64{{60, 0}, {60, 2 * day}, {7, 0}} {
+		if err := c.WriteBlock(b[0], b[1], series); err != nil {
+			t.Fatalf("should not raise err: %s", err)
+		}
+	}
+	n, err := c.Expire(time.Unix(3*day, 0))
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if n != 1 {
+		t.Fatalf("should expire 1 partition, not %d", n)
+	}
+	for _, tc := range []struct {
+		prefix string
+		n      int
+	}{
+		{"60/0/", 0},
+		{"60/172800/", 2},
+		{"7/0/", 2},
+	} {
+		keys, err := store.List(tc.prefix)
+		if err != nil {
+			t.Fatalf("should not raise err: %s", err)
+		}
+		if len(keys) != tc.n {
+			t.Fatalf("%s should have %d objects: %v", tc.prefix, tc.n, keys)
+		}
+	}
+}
+
+func TestFetch(t *testing.T) {
+	c, _, cleanup := newTestCold(t)
+	defer cleanup()
+
+	blocks := []struct {
+		partition int64
+		series    map[string]map[int64]*model.Aggregate
+	}{
+		{
+			0,
+			map[string]map[int64]*model.Aggregate{
+				"server1.loadavg5": {
+					86220: model.NewAggregate(86220, 0.1),
+					86280: {Min: 1, Max: 2, Sum: 3, Count: 2, Last: 2, LastTimestamp: 86290, RolledUp: true},
+				},
+				"server2.loadavg5": {
+					86220: model.NewAggregate(86220, 1.1),
+				},
+			},
+		},
+		{
+			// Compacted again with a partial aggregate compacted later.
+			0,
+			map[string]map[int64]*model.Aggregate{
+				"server1.loadavg5": {
+					86280: {Min: 1, Max: 2, Sum: 3, Count: 2, Last: 2, LastTimestamp: 86290, RolledUp: true},
+					86340: model.NewAggregate(86340, 0.3),
+				},
+			},
+		},
+		{
+			0,
+			map[string]map[int64]*model.Aggregate{
+				"server1.loadavg5": {
+					86280: {Min: 5, Max: 5, Sum: 5, Count: 1, Last: 5, LastTimestamp: 86330, RolledUp: true},
+				},
+			},
+		},
+		{
+			86400,
+			map[string]map[int64]*model.Aggregate{
+				"server1.loadavg5": {
+					86400: model.NewAggregate(86400, 0.4),
+					90000: model.NewAggregate(90000, 0.5),
+				},
+			},
+		},
+	}
+	for _, b := range blocks {
+		if err := c.WriteBlock(60, b.partition, b.series); err != nil {
+			t.Fatalf("should not raise err: %s", err)
+		}
+	}
+
+	sm, err := c.Fetch("server{1,2,3}.loadavg5", time.Unix(86220, 0), time.Unix(86460, 0))
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	rolled := &model.Aggregate{Value: 8.0 / 3, Min: 1, Max: 5, Sum: 8, Count: 3, Last: 5, LastTimestamp: 86330, RolledUp: true}
+	expected := model.SeriesMap{
+		"server1.loadavg5": model.NewSeriesPoint("server1.loadavg5", model.DataPoints{
+			model.NewAggregatedDataPoint(86220, model.NewAggregate(86220, 0.1)),
+			model.NewAggregatedDataPoint(86280, rolled),
+			model.NewAggregatedDataPoint(86340, model.NewAggregate(86340, 0.3)),
+			model.NewAggregatedDataPoint(86400, model.NewAggregate(86400, 0.4)),
+		}, 60),
+		"server2.loadavg5": model.NewSeriesPoint("server2.loadavg5", model.DataPoints{
+			model.NewAggregatedDataPoint(86220, model.NewAggregate(86220, 1.1)),
+		}, 60),
+	}
+	if diff := pretty.Compare(sm, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	// The blocks of the step of the retention are fetched whatever the range is.
+	sm, err = c.FetchRetention([]string{"server1.loadavg5"}, schema.Default.Retentions[0], time.Unix(86400, 0), time.Unix(100000, 0))
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	expected = model.SeriesMap{
+		"server1.loadavg5": model.NewSeriesPoint("server1.loadavg5", model.DataPoints{
+			model.NewAggregatedDataPoint(86400, model.NewAggregate(86400, 0.4)),
+			model.NewAggregatedDataPoint(90000, model.NewAggregate(90000, 0.5)),
+		}, 60),
+	}
+	if diff := pretty.Compare(sm, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
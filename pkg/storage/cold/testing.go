@@ -0,0 +1,33 @@
+package cold
+
+import (
+	"time"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
+)
+
+// FakeReadWriter is for stub testing
+type FakeReadWriter struct {
+	ReadWriter
+	FakeFetch          func(name string, start, end time.Time) (model.SeriesMap, error)
+	FakeFetchRetention func(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error)
+	FakeWriteBlock     func(step, partition int64, series map[string]map[int64]*model.Aggregate) error
+	FakeExpire         func(now time.Time) (int, error)
+}
+
+func (c *FakeReadWriter) Fetch(name string, start, end time.Time) (model.SeriesMap, error) {
+	return c.FakeFetch(name, start, end)
+}
+
+func (c *FakeReadWriter) FetchRetention(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error) {
+	return c.FakeFetchRetention(names, r, start, end)
+}
+
+func (c *FakeReadWriter) WriteBlock(step, partition int64, series map[string]map[int64]*model.Aggregate) error {
+	return c.FakeWriteBlock(step, partition, series)
+}
+
+func (c *FakeReadWriter) Expire(now time.Time) (int, error) {
+	return c.FakeExpire(now)
+}
@@ -8,6 +8,9 @@ import (
 	"log"
 	"math"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -21,6 +24,8 @@ import (
 
 	"github.com/yuuki/diamondb/pkg/config"
 	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/gorilla"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
 	"github.com/yuuki/diamondb/pkg/storage/util"
 	"github.com/yuuki/diamondb/pkg/timeparser"
 )
@@ -33,8 +38,11 @@ type ReadWriter interface {
 	Client() godynamodbiface.DynamoDBAPI
 	CreateTable(*CreateTableParam) error
 	Fetch(string, time.Time, time.Time) (model.SeriesMap, error)
+	FetchRetention([]string, *schema.Retention, time.Time, time.Time) (model.SeriesMap, error)
 	batchGet(q *query) (model.SeriesMap, error)
-	Put(string, string, string, int64, map[int64]float64) error
+	Put(string, string, string, int64, map[int64]*model.Aggregate) error
+	ScanItems(func([]*Item) error) error
+	Evict(*Item) error
 }
 
 // DynamoDB provides a dynamodb client.
@@ -52,7 +60,8 @@ type query struct {
 	start time.Time
 	end   time.Time
 	slot  *timeSlot
-	// context
+	// budget is the retries shared by the queries of a fetch.
+	budget *retryBudget
 }
 
 const (
@@ -60,18 +69,10 @@ const (
 	pingTimeout     = time.Duration(5) * time.Second
 	batchGetTimeout = time.Duration(5) * time.Second
 	updateTimeout   = time.Duration(5) * time.Second
-
-	oneYear time.Duration = time.Duration(24*360) * time.Hour
-	oneWeek time.Duration = time.Duration(24*7) * time.Hour
-	oneDay  time.Duration = time.Duration(24*1) * time.Hour
 )
 
 var (
 	dynamodbBatchLimit = 100
-
-	oneYearSeconds = int(oneYear.Seconds())
-	oneWeekSeconds = int(oneWeek.Seconds())
-	oneDaySeconds  = int(oneDay.Seconds())
 )
 
 var _ ReadWriter = &DynamoDB{}
@@ -84,6 +85,9 @@ func New() (*DynamoDB, error) {
 		awsConf.WithEndpoint(config.Config.DynamoDBEndpoint)
 		awsConf.WithCredentials(credentials.NewStaticCredentials("dummy", "dummy", "dummy"))
 	}
+	// The throttled calls are retried by the retry budget of the request instead
+	// of the SDK, so the request is bounded by the deadline of the budget.
+	awsConf.WithMaxRetries(0)
 	awsConf.WithHTTPClient(&http.Client{
 		Timeout:   HTTPTimeout,
 		Transport: http.DefaultTransport,
@@ -161,7 +165,6 @@ func (d *DynamoDB) CreateTable(param *CreateTableParam) error {
 			ReadCapacityUnits:  aws.Int64(param.RCU),
 			WriteCapacityUnits: aws.Int64(param.WCU),
 		},
-		// TODO StreamSpecification to export to s3
 	})
 	if err != nil {
 		if awsErr, ok := err.(awserr.Error); ok {
@@ -202,39 +205,71 @@ func (d *DynamoDB) CreateTable(param *CreateTableParam) error {
 	return nil
 }
 
-// Fetch fetches datapoints by name from start until end.
+// Fetch fetches datapoints by name from start until end. The slots are selected
+// by the schema matching each name.
 func (d *DynamoDB) Fetch(name string, start, end time.Time) (model.SeriesMap, error) {
-	slots := selectTimeSlots(start, end)
-	nameGroups := util.GroupNames(util.SplitName(name), dynamodbBatchLimit)
-	numQueries := len(slots) * len(nameGroups)
-
-	type result struct {
-		value model.SeriesMap
-		err   error
+	var qs []*query
+	for sch, names := range config.Config.StorageSchemas.GroupNames(util.SplitName(name)) {
+		qs = append(qs, newQueries(names, selectTimeSlots(sch, start, end), start, end)...)
 	}
-	c := make(chan *result, numQueries)
-	for _, slot := range slots {
-		for _, names := range nameGroups {
-			q := &query{
+	return d.fetchQueries(qs)
+}
+
+// FetchRetention fetches datapoints by names from start until end in the items
+// of the retention.
+func (d *DynamoDB) FetchRetention(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error) {
+	return d.fetchQueries(newQueries(names, retentionTimeSlots(r, start, end), start, end))
+}
+
+func newQueries(names []string, slots []*timeSlot, start, end time.Time) []*query {
+	var qs []*query
+	for _, names := range util.GroupNames(names, dynamodbBatchLimit) {
+		for _, slot := range slots {
+			qs = append(qs, &query{
 				names: names,
 				start: start,
 				end:   end,
 				slot:  slot,
-			}
-			go func(q *query) {
-				sm, err := d.batchGet(q)
-				c <- &result{value: sm, err: err}
-			}(q)
+			})
 		}
 	}
-	sm := make(model.SeriesMap, len(nameGroups))
-	for i := 0; i < numQueries; i++ {
+	return qs
+}
+
+// fetchQueries fetches the queries in parallel sharing a retry budget. If some
+// of the items are given up because of throttling, it returns the series
+// fetched with *PartialError.
+func (d *DynamoDB) fetchQueries(qs []*query) (model.SeriesMap, error) {
+	type result struct {
+		value model.SeriesMap
+		err   error
+	}
+	budget := newRetryBudget()
+	c := make(chan *result, len(qs))
+	for _, q := range qs {
+		q.budget = budget
+		go func(q *query) {
+			sm, err := d.batchGet(q)
+			c <- &result{value: sm, err: err}
+		}(q)
+	}
+	sm := make(model.SeriesMap, len(qs))
+	var partial *PartialError
+	for i := 0; i < len(qs); i++ {
 		ret := <-c
-		if ret.err != nil {
+		if perr, ok := ret.err.(*PartialError); ok {
+			if partial == nil {
+				partial = &PartialError{Err: perr.Err}
+			}
+			partial.Unfetched = append(partial.Unfetched, perr.Unfetched...)
+		} else if ret.err != nil {
 			return nil, ret.err
 		}
 		sm.MergePointsToMap(ret.value)
 	}
+	if partial != nil {
+		return sm, partial
+	}
 	return sm, nil
 }
 
@@ -243,15 +278,15 @@ func batchGetResultToMap(resp *godynamodb.BatchGetItemOutput, q *query) model.Se
 	for _, xs := range resp.Responses {
 		for _, x := range xs {
 			name := (*x["Name"].S)
-			points := make(model.DataPoints, 0, len(x["Values"].BS))
-			for _, y := range x["Values"].BS {
-				t := int64(binary.BigEndian.Uint64(y[0:8]))
-				v := math.Float64frombits(binary.BigEndian.Uint64(y[8:]))
+			aggs := decodeValues(x["Values"].BS)
+			points := make(model.DataPoints, 0, len(aggs))
+			for t, a := range aggs {
 				// Trim datapoints out of [start, end]
 				if t < q.start.Unix() || q.end.Unix() < t {
 					continue
 				}
-				points = append(points, model.NewDataPoint(t, v))
+				util.Finalize(name, int64(q.slot.step), a)
+				points = append(points, model.NewAggregatedDataPoint(t, a))
 			}
 			sm[name] = model.NewSeriesPoint(name, points, q.slot.step)
 		}
@@ -259,6 +294,10 @@ func batchGetResultToMap(resp *godynamodb.BatchGetItemOutput, q *query) model.Se
 	return sm
 }
 
+// batchGet gets the items of the query. The unprocessed keys are submitted
+// again, and the throttled calls are retried, with backoff while the budget of
+// the query remains until its deadline. It returns the series fetched with *PartialError if it
+// gives up some of the items.
 func (d *DynamoDB) batchGet(q *query) (model.SeriesMap, error) {
 	var keys []map[string]*godynamodb.AttributeValue
 	for _, name := range q.names {
@@ -267,40 +306,248 @@ func (d *DynamoDB) batchGet(q *query) (model.SeriesMap, error) {
 			"Timestamp": {S: aws.String(fmt.Sprintf("%d:%d", q.slot.itemEpoch, q.slot.step))},
 		})
 	}
+	sm := model.SeriesMap{}
+	for attempt := 0; ; attempt++ {
+		resp, err := d.batchGetItem(q.budget, keys)
+		if err != nil {
+			if isThrottled(err) && q.budget.wait(attempt) {
+				continue
+			}
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
+				// If the SDK can determine the request or retry delay was canceled
+				// by a context the CanceledErrorCode error code will be returned.
+				return nil, errors.Wrap(err, "failed to batchGet dynamodb due to timeout")
+			}
+			if awsErr, ok := err.(awserr.Error); ok {
+				if awsErr.Code() == "ResourceNotFoundException" {
+					// Don't handle ResourceNotFoundException as error
+					// bacause diamondb web return length 0 series as 200.
+					return model.SeriesMap{}, nil
+				}
+			}
+			werr := errors.Wrapf(err,
+				"failed to call dynamodb API batchGetItem (%s,%d,%d)",
+				config.Config.DynamoDBTableName, q.slot.itemEpoch, q.slot.step,
+			)
+			if isThrottled(err) {
+				return sm, &PartialError{Err: werr, Unfetched: q.items(keys)}
+			}
+			return nil, werr
+		}
+		sm.MergePointsToMap(batchGetResultToMap(resp, q))
+
+		unprocessed := resp.UnprocessedKeys[config.Config.DynamoDBTableName]
+		if unprocessed == nil || len(unprocessed.Keys) == 0 {
+			return sm, nil
+		}
+		keys = unprocessed.Keys
+		if !q.budget.wait(attempt) {
+			return sm, &PartialError{
+				Err: errors.Errorf("unprocessed keys of dynamodb API batchGetItem left (%s,%d,%d)",
+					config.Config.DynamoDBTableName, q.slot.itemEpoch, q.slot.step),
+				Unfetched: q.items(keys),
+			}
+		}
+	}
+}
+
+func (d *DynamoDB) batchGetItem(budget *retryBudget, keys []map[string]*godynamodb.AttributeValue) (*godynamodb.BatchGetItemOutput, error) {
 	items := make(map[string]*godynamodb.KeysAndAttributes)
 	items[config.Config.DynamoDBTableName] = &godynamodb.KeysAndAttributes{Keys: keys}
 	params := &godynamodb.BatchGetItemInput{
 		RequestItems:           items,
 		ReturnConsumedCapacity: aws.String("NONE"),
 	}
-	ctx, cancel := context.WithTimeout(context.TODO(), batchGetTimeout)
+	ctx, cancel := budget.context(batchGetTimeout)
 	defer cancel()
 	var opt request.Option = func(r *request.Request) {}
-	resp, err := d.svc.BatchGetItemWithContext(ctx, params, opt)
+	return d.svc.BatchGetItemWithContext(ctx, params, opt)
+}
+
+// items returns the items of the keys of the query without the datapoints.
+func (q *query) items(keys []map[string]*godynamodb.AttributeValue) []*Item {
+	items := make([]*Item, 0, len(keys))
+	for _, key := range keys {
+		items = append(items, &Item{
+			Name:      aws.StringValue(key["Name"].S),
+			ItemEpoch: q.slot.itemEpoch,
+			Step:      int64(q.slot.step),
+		})
+	}
+	return items
+}
+
+const (
+	// plainRawSize and plainRolledUpSize are the lengths of the elements of the
+	// binary set of a datapoint encoded by encodeValue.
+	plainRawSize      = 16
+	plainRolledUpSize = 56
+
+	// gorillaFormat is the first byte of the element of the datapoints
+	// compressed by gorilla, which is followed by the kind of the datapoints.
+	gorillaFormat   byte = 1
+	gorillaRaw      byte = 0
+	gorillaRolledUp byte = 1
+)
+
+// encodeValues encodes the datapoints into the elements of the binary set by
+// the encoding of the config. The 'plain' encoding is an element per datapoint
+// encoded by encodeValue. The 'gorilla' encoding is an element of the raw
+// datapoints and an element of the rolled up ones compressed by gorilla, which
+// are read by the nodes of this version, while the nodes of the older ones skip
+// them. The elements of the same datapoints are the same bytes, so the
+// datapoints flushed again are the same elements of the binary set.
+func encodeValues(tv map[int64]*model.Aggregate) [][]byte {
+	if config.Config.DynamoDBValueEncoding != "gorilla" {
+		vals := make([][]byte, 0, len(tv))
+		for timestamp, a := range tv {
+			vals = append(vals, encodeValue(timestamp, a))
+		}
+		return vals
+	}
+
+	timestamps := make([]int64, 0, len(tv))
+	for t := range tv {
+		timestamps = append(timestamps, t)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	raw, rolled := gorilla.NewEncoder(1), gorilla.NewEncoder(6)
+	for _, t := range timestamps {
+		a := tv[t]
+		if a.IsRaw() {
+			raw.Append(t, a.Value)
+			continue
+		}
+		rolled.Append(t, a.Min, a.Max, a.Sum, float64(a.Count), a.Last, float64(a.LastTimestamp-t))
+	}
+	var vals [][]byte
+	for _, c := range []struct {
+		kind byte
+		e    *gorilla.Encoder
+	}{{gorillaRaw, raw}, {gorillaRolledUp, rolled}} {
+		if c.e.Len() == 0 {
+			continue
+		}
+		b := append([]byte{gorillaFormat, c.kind}, c.e.Bytes()...)
+		// Pad the element not to be taken as a plain one by the older versions.
+		if len(b) == plainRawSize || len(b) == plainRolledUpSize {
+			b = append(b, 0)
+		}
+		vals = append(vals, b)
+	}
+	return vals
+}
+
+// encodeValue encodes the datapoint into an element of the binary set. The
+// element of a raw datapoint is the timestamp and the value. The element of a
+// rolled up one is the timestamp, the min, the max, the sum, the count, the last
+// value and the last timestamp. The partial aggregates of the same timestamp
+// are rolled up from the different raw datapoints, so they are distinct
+// elements by the last timestamps to be merged on reading, while the same
+// aggregate flushed again is the same element.
+func encodeValue(timestamp int64, a *model.Aggregate) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, timestamp)
+	if a.IsRaw() {
+		binary.Write(buf, binary.BigEndian, math.Float64bits(a.Value))
+		return buf.Bytes()
+	}
+	binary.Write(buf, binary.BigEndian, math.Float64bits(a.Min))
+	binary.Write(buf, binary.BigEndian, math.Float64bits(a.Max))
+	binary.Write(buf, binary.BigEndian, math.Float64bits(a.Sum))
+	binary.Write(buf, binary.BigEndian, a.Count)
+	binary.Write(buf, binary.BigEndian, math.Float64bits(a.Last))
+	binary.Write(buf, binary.BigEndian, a.LastTimestamp)
+	return buf.Bytes()
+}
+
+// decodeValue decodes the element of the binary set encoded by encodeValue. It
+// returns false if the length of the element is unknown. The Value of a rolled
+// up aggregate is left to finalize.
+func decodeValue(b []byte) (int64, *model.Aggregate, bool) {
+	float := func(i int) float64 {
+		return math.Float64frombits(binary.BigEndian.Uint64(b[i : i+8]))
+	}
+	integer := func(i int) int64 {
+		return int64(binary.BigEndian.Uint64(b[i : i+8]))
+	}
+	switch len(b) {
+	case plainRawSize:
+		return integer(0), model.NewAggregate(integer(0), float(8)), true
+	case plainRolledUpSize:
+		return integer(0), &model.Aggregate{
+			Min:           float(8),
+			Max:           float(16),
+			Sum:           float(24),
+			Count:         integer(32),
+			Last:          float(40),
+			LastTimestamp: integer(48),
+			RolledUp:      true,
+		}, true
+	}
+	return 0, nil, false
+}
+
+// decodeGorilla decodes the element of the binary set compressed by gorilla.
+// The Values of the rolled up aggregates are left to finalize.
+func decodeGorilla(b []byte, fn func(int64, *model.Aggregate)) error {
+	if len(b) < 2 || b[0] != gorillaFormat {
+		return errors.New("unknown format of dynamodb value")
+	}
+	kind := b[1]
+	d, err := gorilla.NewDecoder(b[2:])
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
-			// If the SDK can determine the request or retry delay was canceled
-			// by a context the CanceledErrorCode error code will be returned.
-			return nil, errors.Wrap(err, "failed to batchGet dynamodb due to timeout")
+		return err
+	}
+	for d.Next() {
+		t, vals := d.At()
+		switch {
+		case kind == gorillaRaw && len(vals) == 1:
+			fn(t, model.NewAggregate(t, vals[0]))
+		case kind == gorillaRolledUp && len(vals) == 6:
+			fn(t, &model.Aggregate{
+				Min:           vals[0],
+				Max:           vals[1],
+				Sum:           vals[2],
+				Count:         int64(vals[3]),
+				Last:          vals[4],
+				LastTimestamp: t + int64(vals[5]),
+				RolledUp:      true,
+			})
+		default:
+			return errors.Errorf("unknown kind %d of dynamodb value with %d fields", kind, len(vals))
 		}
-		if awsErr, ok := err.(awserr.Error); ok {
-			if awsErr.Code() == "ResourceNotFoundException" {
-				// Don't handle ResourceNotFoundException as error
-				// bacause diamondb web return length 0 series as 200.
-				return model.SeriesMap{}, nil
-			}
+	}
+	return d.Err()
+}
+
+// decodeValues decodes the elements of the binary set in either encoding. The
+// partial aggregates of the same timestamp flushed separately are merged.
+func decodeValues(bs [][]byte) map[int64]*model.Aggregate {
+	found := make(map[int64][]*model.Aggregate, len(bs))
+	add := func(t int64, a *model.Aggregate) {
+		found[t] = append(found[t], a)
+	}
+	for _, b := range bs {
+		if t, a, ok := decodeValue(b); ok {
+			add(t, a)
+			continue
+		}
+		if err := decodeGorilla(b, add); err != nil {
+			log.Printf("%+v\n", err) // Print stack trace by pkg/errors
 		}
-		return nil, errors.Wrapf(err,
-			"failed to call dynamodb API batchGetItem (%s,%d,%d)",
-			config.Config.DynamoDBTableName, q.slot.itemEpoch, q.slot.step,
-		)
 	}
-	return batchGetResultToMap(resp, q), nil
+	aggs := make(map[int64]*model.Aggregate, len(found))
+	for t, as := range found {
+		aggs[t] = model.MergeDistinct(as)
+	}
+	return aggs
 }
 
 // Put writes the datapoints into DynamoDB. It creates item
-// if item doesn't exist and updates item if it exists.
-func (d *DynamoDB) Put(name, slot, history string, itemEpoch int64, tv map[int64]float64) error {
+// if item doesn't exist and updates item if it exists. The throttled update is
+// retried, which adds the same elements into the binary set again.
+func (d *DynamoDB) Put(name, slot, history string, itemEpoch int64, tv map[int64]*model.Aggregate) error {
 	stepDuration, err := timeparser.ParseTimeOffset(slot)
 	if err != nil {
 		return err
@@ -311,13 +558,7 @@ func (d *DynamoDB) Put(name, slot, history string, itemEpoch int64, tv map[int64
 	}
 	ttl := itemEpoch + int64(historyDuration.Seconds())
 
-	vals := make([][]byte, 0, len(tv))
-	for timestamp, value := range tv {
-		buf := new(bytes.Buffer)
-		binary.Write(buf, binary.BigEndian, timestamp)
-		binary.Write(buf, binary.BigEndian, math.Float64bits(value))
-		vals = append(vals, buf.Bytes())
-	}
+	vals := encodeValues(tv)
 
 	params := &godynamodb.UpdateItemInput{
 		TableName: aws.String(config.Config.DynamoDBTableName),
@@ -340,10 +581,7 @@ func (d *DynamoDB) Put(name, slot, history string, itemEpoch int64, tv map[int64
 		ReturnValues: aws.String("NONE"),
 	}
 
-	ctx, cancel := context.WithTimeout(context.TODO(), updateTimeout)
-	defer cancel()
-	var opt request.Option = func(r *request.Request) {}
-	if _, err := d.svc.UpdateItemWithContext(ctx, params, opt); err != nil {
+	if err := d.updateItem(params); err != nil {
 		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
 			// If the SDK can determine the request or retry delay was canceled
 			// by a context the CanceledErrorCode error code will be returned.
@@ -355,33 +593,147 @@ func (d *DynamoDB) Put(name, slot, history string, itemEpoch int64, tv map[int64
 	return nil
 }
 
-func selectTimeSlots(startTime, endTime time.Time) []*timeSlot {
-	var (
-		step          int
-		itemEpochStep int
-	)
-	diff := endTime.Sub(startTime)
-	switch {
-	case oneYear <= diff:
-		itemEpochStep = oneYearSeconds
-		step = 60 * 60 * 24
-	case oneWeek <= diff:
-		itemEpochStep = oneWeekSeconds
-		step = 60 * 60
-	case oneDay <= diff:
-		itemEpochStep = oneDaySeconds
-		step = 5 * 60
-	default:
-		itemEpochStep = 60 * 60
-		step = 60
+// updateItem updates the item. The throttled calls are retried with backoff
+// while the budget remains until its deadline.
+func (d *DynamoDB) updateItem(params *godynamodb.UpdateItemInput) error {
+	budget := newRetryBudget()
+	for attempt := 0; ; attempt++ {
+		err := d.updateItemOnce(budget, params)
+		if err != nil && isThrottled(err) && budget.wait(attempt) {
+			continue
+		}
+		return err
 	}
+}
+
+func (d *DynamoDB) updateItemOnce(budget *retryBudget, params *godynamodb.UpdateItemInput) error {
+	ctx, cancel := budget.context(updateTimeout)
+	defer cancel()
+	var opt request.Option = func(r *request.Request) {}
+	_, err := d.svc.UpdateItemWithContext(ctx, params, opt)
+	return err
+}
+
+// selectTimeSlots returns the items of the retention of the schema selected for
+// the range from startTime until endTime.
+func selectTimeSlots(sch *schema.Schema, startTime, endTime time.Time) []*timeSlot {
+	return retentionTimeSlots(sch.Select(startTime, endTime), startTime, endTime)
+}
 
+// retentionTimeSlots returns the items of the retention in the range from
+// startTime until endTime.
+func retentionTimeSlots(r *schema.Retention, startTime, endTime time.Time) []*timeSlot {
 	var slots []*timeSlot
-	startItemEpoch := startTime.Unix() - startTime.Unix()%int64(itemEpochStep)
+	startItemEpoch := r.ItemEpoch(startTime.Unix())
 	endItemEpoch := endTime.Unix()
-	for epoch := startItemEpoch; epoch < endItemEpoch; epoch += int64(itemEpochStep) {
-		slots = append(slots, &timeSlot{itemEpoch: epoch, step: step})
+	for epoch := startItemEpoch; epoch < endItemEpoch; epoch += r.ItemEpochStep {
+		slots = append(slots, &timeSlot{itemEpoch: epoch, step: int(r.Step)})
 	}
 
 	return slots
 }
+
+// Item is a DynamoDB item of the datapoints of a series in the period from
+// ItemEpoch of the step.
+type Item struct {
+	Name      string
+	ItemEpoch int64
+	Step      int64
+	Points    map[int64]*model.Aggregate
+	// values is the elements of the binary set read, which are deleted by Evict.
+	values [][]byte
+}
+
+// ScanItems scans the items having the datapoints, and calls fn with the items
+// of each page. It stops scanning if fn returns an error.
+func (d *DynamoDB) ScanItems(fn func([]*Item) error) error {
+	var ferr error
+	err := d.svc.ScanPages(&godynamodb.ScanInput{
+		TableName:        aws.String(config.Config.DynamoDBTableName),
+		FilterExpression: aws.String("attribute_exists(#values_set)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#values_set": aws.String("Values"),
+		},
+		ReturnConsumedCapacity: aws.String("NONE"),
+	}, func(out *godynamodb.ScanOutput, last bool) bool {
+		items := make([]*Item, 0, len(out.Items))
+		for _, x := range out.Items {
+			item, err := scanResultToItem(x)
+			if err != nil {
+				log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+				continue
+			}
+			items = append(items, item)
+		}
+		ferr = fn(items)
+		return ferr == nil
+	})
+	if ferr != nil {
+		return ferr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to call dynamodb API scan (%s)",
+			config.Config.DynamoDBTableName)
+	}
+	return nil
+}
+
+func scanResultToItem(x map[string]*godynamodb.AttributeValue) (*Item, error) {
+	if x["Name"] == nil || x["Timestamp"] == nil || x["Values"] == nil {
+		return nil, errors.New("dynamodb item lacks Name, Timestamp or Values")
+	}
+	name, ts := aws.StringValue(x["Name"].S), aws.StringValue(x["Timestamp"].S)
+	parts := strings.SplitN(ts, ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.Errorf("invalid timestamp of dynamodb item (%s,%s)", name, ts)
+	}
+	itemEpoch, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid timestamp of dynamodb item (%s,%s)", name, ts)
+	}
+	step, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid timestamp of dynamodb item (%s,%s)", name, ts)
+	}
+	return &Item{
+		Name:      name,
+		ItemEpoch: itemEpoch,
+		Step:      step,
+		Points:    decodeValues(x["Values"].BS),
+		values:    x["Values"].BS,
+	}, nil
+}
+
+// Evict deletes the datapoints of the item scanned by ScanItems from DynamoDB.
+// The datapoints put into the item after scanning are kept.
+func (d *DynamoDB) Evict(item *Item) error {
+	if len(item.values) == 0 {
+		return nil
+	}
+	params := &godynamodb.UpdateItemInput{
+		TableName: aws.String(config.Config.DynamoDBTableName),
+		Key: map[string]*godynamodb.AttributeValue{
+			"Name":      {S: aws.String(item.Name)},
+			"Timestamp": {S: aws.String(fmt.Sprintf("%d:%d", item.ItemEpoch, item.Step))},
+		},
+		UpdateExpression: aws.String("DELETE #values_set :old_values"),
+		ExpressionAttributeNames: map[string]*string{
+			"#values_set": aws.String("Values"),
+		},
+		ExpressionAttributeValues: map[string]*godynamodb.AttributeValue{
+			":old_values": {BS: item.values},
+		},
+		ReturnValues: aws.String("NONE"),
+	}
+
+	if err := d.updateItem(params); err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
+			// If the SDK can determine the request or retry delay was canceled
+			// by a context the CanceledErrorCode error code will be returned.
+			return errors.Wrap(err, "failed to updateItem dynamodb due to timeout")
+		}
+		return errors.Wrapf(err, "failed to call dynamodb API updateItem (%s,%s,%d)",
+			config.Config.DynamoDBTableName, item.Name, item.ItemEpoch)
+	}
+	return nil
+}
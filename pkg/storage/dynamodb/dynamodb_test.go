@@ -1,15 +1,23 @@
 package dynamodb
 
 import (
+	"bytes"
 	"errors"
+	"math"
+	"math/rand"
+	"sort"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	godynamodb "github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/golang/mock/gomock"
 	"github.com/kylelemons/godebug/pretty"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/yuuki/diamondb/pkg/config"
 	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
 )
 
 func TestPing(t *testing.T) {
@@ -271,52 +279,491 @@ func TestBatchGet(t *testing.T) {
 	}
 }
 
+// setRetry sets the retry budget and the backoff short for the test, and
+// returns the function to restore them.
+func setRetry(budget int) func() {
+	oldBudget, oldDelay := config.Config.DynamoDBRetryBudget, retryBaseDelay
+	config.Config.DynamoDBRetryBudget, retryBaseDelay = budget, time.Millisecond
+	return func() {
+		config.Config.DynamoDBRetryBudget, retryBaseDelay = oldBudget, oldDelay
+	}
+}
+
+func TestBatchGet_Retry(t *testing.T) {
+	slot := &timeSlot{itemEpoch: 1000, step: 60}
+	server1 := &mockDynamoDBParam{Slot: slot, SeriesMap: model.SeriesMap{
+		"server1.loadavg5": model.NewSeriesPoint("server1.loadavg5", model.DataPoints{model.NewDataPoint(1100, 10.0)}, 60),
+	}}
+	server2 := &mockDynamoDBParam{Slot: slot, SeriesMap: model.SeriesMap{
+		"server2.loadavg5": model.NewSeriesPoint("server2.loadavg5", model.DataPoints{model.NewDataPoint(1100, 15.0)}, 60),
+	}}
+	both := &mockDynamoDBParam{Slot: slot, SeriesMap: model.SeriesMap{
+		"server1.loadavg5": server1.SeriesMap["server1.loadavg5"],
+		"server2.loadavg5": server2.SeriesMap["server2.loadavg5"],
+	}}
+	throttled := awserr.New(godynamodb.ErrCodeProvisionedThroughputExceededException, "exceeded", nil)
+	// The partial response leaves the key of server2 unprocessed.
+	partial := mockBatchGetItemOutput(server1)
+	partial.UnprocessedKeys = map[string]*godynamodb.KeysAndAttributes{
+		mockTableName: {Keys: mockBatchGetItemKeys(server2)},
+	}
+
+	tests := []struct {
+		desc      string
+		budget    int
+		expect    func(mock *MockDynamoDBAPI)
+		expected  model.SeriesMap
+		unfetched []*Item
+	}{
+		{
+			"unprocessed keys submitted again", 2,
+			func(mock *MockDynamoDBAPI) {
+				gomock.InOrder(
+					mockExpectBatchGetItem(mock, both).Return(nil, throttled),
+					mockExpectBatchGetItem(mock, both).Return(partial, nil),
+					mockReturnBatchGetItem(mockExpectBatchGetItem(mock, server2), server2),
+				)
+			},
+			both.SeriesMap, nil,
+		},
+		{
+			"budget exhausted by unprocessed keys", 1,
+			func(mock *MockDynamoDBAPI) {
+				gomock.InOrder(
+					mockExpectBatchGetItem(mock, both).Return(nil, throttled),
+					mockExpectBatchGetItem(mock, both).Return(partial, nil),
+				)
+			},
+			server1.SeriesMap, []*Item{{Name: "server2.loadavg5", ItemEpoch: 1000, Step: 60}},
+		},
+		{
+			"budget exhausted by throttling", 1,
+			func(mock *MockDynamoDBAPI) {
+				mockExpectBatchGetItem(mock, both).Return(nil, throttled).Times(2)
+			},
+			model.SeriesMap{}, []*Item{
+				{Name: "server1.loadavg5", ItemEpoch: 1000, Step: 60},
+				{Name: "server2.loadavg5", ItemEpoch: 1000, Step: 60},
+			},
+		},
+	}
+	for _, tc := range tests {
+		restore := setRetry(tc.budget)
+		ctrl := gomock.NewController(t)
+		mock := NewMockDynamoDBAPI(ctrl)
+		tc.expect(mock)
+
+		sm, err := NewTestDynamoDB(mock).fetchQueries([]*query{{
+			names: []string{"server1.loadavg5", "server2.loadavg5"},
+			start: time.Unix(1000, 0),
+			end:   time.Unix(2000, 0),
+			slot:  slot,
+		}})
+		if tc.unfetched == nil && err != nil {
+			t.Fatalf("%s: should not raise err: %s", tc.desc, err)
+		}
+		if tc.unfetched != nil {
+			perr, ok := err.(*PartialError)
+			if !ok {
+				t.Fatalf("%s: err should be *PartialError: %#v", tc.desc, err)
+			}
+			if diff := pretty.Compare(perr.Unfetched, tc.unfetched); diff != "" {
+				t.Fatalf("%s: diff: (-actual +expected)\n%s", tc.desc, diff)
+			}
+		}
+		// The series fetched are returned even if some of the items are not.
+		if diff := pretty.Compare(sm, tc.expected); diff != "" {
+			t.Fatalf("%s: diff: (-actual +expected)\n%s", tc.desc, diff)
+		}
+		ctrl.Finish()
+		restore()
+	}
+
+	// The errors other than throttling are not retried.
+	defer setRetry(2)()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock := NewMockDynamoDBAPI(ctrl)
+	mockExpectBatchGetItem(mock, both).Return(nil, awserr.New("ValidationException", "invalid", nil))
+	_, err := NewTestDynamoDB(mock).fetchQueries([]*query{{
+		names: []string{"server1.loadavg5", "server2.loadavg5"},
+		start: time.Unix(1000, 0),
+		end:   time.Unix(2000, 0),
+		slot:  slot,
+	}})
+	if err == nil {
+		t.Fatal("should raise err")
+	}
+	if _, ok := err.(*PartialError); ok {
+		t.Fatalf("err should not be *PartialError: %s", err)
+	}
+}
+
+func TestPut_Retry(t *testing.T) {
+	throttled := awserr.New(godynamodb.ErrCodeProvisionedThroughputExceededException, "exceeded", nil)
+	tv := map[int64]*model.Aggregate{1100: model.NewAggregate(1100, 10.0)}
+	tests := []struct {
+		desc   string
+		budget int
+		fails  int
+		ok     bool
+	}{
+		{"retried", 2, 2, true},
+		{"budget exhausted", 1, 2, false},
+	}
+	for _, tc := range tests {
+		restore := setRetry(tc.budget)
+		config.Config.DynamoDBTableName = mockTableName
+		ctrl := gomock.NewController(t)
+		mock := NewMockDynamoDBAPI(ctrl)
+		calls := []*gomock.Call{
+			mock.EXPECT().UpdateItemWithContext(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, throttled).Times(tc.fails),
+		}
+		if tc.ok {
+			calls = append(calls, mock.EXPECT().UpdateItemWithContext(gomock.Any(), gomock.Any(), gomock.Any()).Return(&godynamodb.UpdateItemOutput{}, nil))
+		} else {
+			calls[0].Times(tc.budget + 1)
+		}
+		gomock.InOrder(calls...)
+
+		err := NewTestDynamoDB(mock).Put("server1.loadavg5", "1m", "1d", 0, tv)
+		if tc.ok && err != nil {
+			t.Fatalf("%s: should not raise err: %s", tc.desc, err)
+		}
+		if !tc.ok && pkgerrors.Cause(err) != throttled {
+			t.Fatalf("%s: cause should be the throttling: %v", tc.desc, err)
+		}
+		ctrl.Finish()
+		restore()
+	}
+}
+
 func TestSelectTimeSlots(t *testing.T) {
+	business, err := schema.New("business", `^business\.`, false, "10s:6h,1m:7d,10m:5y")
+	if err != nil {
+		t.Fatal(err)
+	}
 	tests := []struct {
+		schema    *schema.Schema
 		start     time.Time
 		end       time.Time
 		timeSlots []*timeSlot
 	}{
 		{
-			time.Unix(100, 0), time.Unix(6000, 0),
+			schema.Default, time.Unix(100, 0), time.Unix(6000, 0),
 			[]*timeSlot{{itemEpoch: 0, step: 60}, {itemEpoch: 3600, step: 60}},
 		},
 		{
-			time.Unix(10000, 0), time.Unix(100000, 0),
+			schema.Default, time.Unix(10000, 0), time.Unix(100000, 0),
 			[]*timeSlot{{itemEpoch: 0, step: 300}, {itemEpoch: 86400, step: 300}},
 		},
 		{
-			time.Unix(100000, 0), time.Unix(1000000, 0),
+			schema.Default, time.Unix(100000, 0), time.Unix(1000000, 0),
 			[]*timeSlot{{itemEpoch: 0, step: 3600}, {itemEpoch: 604800, step: 3600}},
 		},
 		{
-			time.Unix(1000000, 0), time.Unix(100000000, 0),
+			schema.Default, time.Unix(1000000, 0), time.Unix(100000000, 0),
 			[]*timeSlot{
 				{
 					itemEpoch: 0,
 					step:      86400,
 				},
 				{
-					itemEpoch: 31104000,
+					itemEpoch: 31536000,
 					step:      86400,
 				},
 				{
-					itemEpoch: 62208000,
+					itemEpoch: 63072000,
 					step:      86400,
 				},
 				{
-					itemEpoch: 93312000,
+					itemEpoch: 94608000,
 					step:      86400,
 				},
 			},
 		},
+		{
+			business, time.Unix(100, 0), time.Unix(6000, 0),
+			[]*timeSlot{{itemEpoch: 0, step: 10}, {itemEpoch: 3600, step: 10}},
+		},
+		{
+			business, time.Unix(3600, 0), time.Unix(28800, 0),
+			[]*timeSlot{
+				{itemEpoch: 3600, step: 60}, {itemEpoch: 7200, step: 60}, {itemEpoch: 10800, step: 60},
+				{itemEpoch: 14400, step: 60}, {itemEpoch: 18000, step: 60}, {itemEpoch: 21600, step: 60},
+				{itemEpoch: 25200, step: 60},
+			},
+		},
 	}
 
 	for _, lc := range tests {
-		got := selectTimeSlots(lc.start, lc.end)
+		got := selectTimeSlots(lc.schema, lc.start, lc.end)
 
 		if diff := pretty.Compare(lc.timeSlots, got); diff != "" {
 			t.Fatalf("diff: (-actual +expected)\n%s", diff)
 		}
 	}
 }
+
+func TestRetentionTimeSlots(t *testing.T) {
+	// The items of the retention are selected whatever the range is.
+	got := retentionTimeSlots(schema.Default.Retentions[2], time.Unix(100, 0), time.Unix(6000, 0))
+	expected := []*timeSlot{{itemEpoch: 0, step: 3600}}
+	if diff := pretty.Compare(got, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestEncodeValue(t *testing.T) {
+	tests := []struct {
+		aggregate *model.Aggregate
+		size      int
+	}{
+		{model.NewAggregate(100, 0.5), 16},
+		{&model.Aggregate{Min: 1, Max: 4, Sum: 7.5, Count: 3, Last: 2.5, LastTimestamp: 160, RolledUp: true}, 56},
+	}
+	for _, tc := range tests {
+		b := encodeValue(100, tc.aggregate)
+		if len(b) != tc.size {
+			t.Fatalf("encodeValue(%v) should be %d bytes, not %d", tc.aggregate, tc.size, len(b))
+		}
+		ts, a, ok := decodeValue(b)
+		if !ok || ts != 100 {
+			t.Fatalf("failed to decode %v: %d, %v", b, ts, ok)
+		}
+		if diff := pretty.Compare(a, tc.aggregate); diff != "" {
+			t.Fatalf("diff: (-actual +expected)\n%s", diff)
+		}
+	}
+	if _, _, ok := decodeValue(make([]byte, 20)); ok {
+		t.Fatal("decodeValue should fail with the unknown length")
+	}
+	// The partial aggregates of the different raw datapoints are distinct
+	// elements of the binary set.
+	a := &model.Aggregate{Min: 1, Max: 1, Sum: 1, Count: 1, Last: 1, LastTimestamp: 60, RolledUp: true}
+	b := &model.Aggregate{Min: 1, Max: 1, Sum: 1, Count: 1, Last: 1, LastTimestamp: 120, RolledUp: true}
+	if bytes.Equal(encodeValue(0, a), encodeValue(0, b)) {
+		t.Fatal("encodeValue should encode the partial aggregates into the different elements")
+	}
+}
+
+func TestBatchGetResultToMap_Merge(t *testing.T) {
+	partial1 := &model.Aggregate{Min: 1, Max: 3, Sum: 4, Count: 2, Last: 3, LastTimestamp: 60, RolledUp: true}
+	partial2 := &model.Aggregate{Min: 2, Max: 6, Sum: 8, Count: 2, Last: 2, LastTimestamp: 240, RolledUp: true}
+	resp := &godynamodb.BatchGetItemOutput{
+		Responses: map[string][]map[string]*godynamodb.AttributeValue{
+			"SeriesTestRange": {
+				{
+					"Name": {S: aws.String("server1.loadavg5")},
+					"Values": {BS: [][]byte{
+						encodeValue(0, partial1),
+						encodeValue(0, partial2),
+						encodeValue(300, partial1),
+					}},
+				},
+			},
+		},
+	}
+	sm := batchGetResultToMap(resp, &query{
+		names: []string{"server1.loadavg5"},
+		start: time.Unix(0, 0),
+		end:   time.Unix(300, 0),
+		slot:  &timeSlot{itemEpoch: 0, step: 300},
+	})
+	// The partial aggregates are averaged over the raw datapoints of both.
+	expected := model.NewSeriesPoint("server1.loadavg5", model.DataPoints{
+		model.NewAggregatedDataPoint(0, &model.Aggregate{
+			Value: 3.0, Min: 1, Max: 6, Sum: 12, Count: 4, Last: 2, LastTimestamp: 240, RolledUp: true,
+		}),
+		model.NewAggregatedDataPoint(300, &model.Aggregate{
+			Value: 2.0, Min: 1, Max: 3, Sum: 4, Count: 2, Last: 3, LastTimestamp: 60, RolledUp: true,
+		}),
+	}, 300)
+	if diff := pretty.Compare(sm["server1.loadavg5"], expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestScanItems(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mock := NewMockDynamoDBAPI(ctrl)
+
+	raw := encodeValue(120, model.NewAggregate(120, 0.5))
+	pages := []*godynamodb.ScanOutput{
+		{Items: []map[string]*godynamodb.AttributeValue{
+			{
+				"Name":      {S: aws.String("server1.loadavg5")},
+				"Timestamp": {S: aws.String("0:60")},
+				"Values":    {BS: [][]byte{raw}},
+			},
+			{
+				"Name":      {S: aws.String("server2.loadavg5")},
+				"Timestamp": {S: aws.String("invalid")},
+				"Values":    {BS: [][]byte{raw}},
+			},
+		}},
+		{Items: []map[string]*godynamodb.AttributeValue{
+			{
+				"Name":      {S: aws.String("server3.loadavg5")},
+				"Timestamp": {S: aws.String("86400:300")},
+				"Values":    {BS: [][]byte{raw}},
+			},
+		}},
+	}
+	mock.EXPECT().ScanPages(gomock.Any(), gomock.Any()).Do(
+		func(in *godynamodb.ScanInput, fn func(*godynamodb.ScanOutput, bool) bool) {
+			for i, page := range pages {
+				if !fn(page, i == len(pages)-1) {
+					return
+				}
+			}
+		},
+	).Return(nil)
+	mock.EXPECT().UpdateItemWithContext(gomock.Any(), &godynamodb.UpdateItemInput{
+		TableName: aws.String(mockTableName),
+		Key: map[string]*godynamodb.AttributeValue{
+			"Name":      {S: aws.String("server1.loadavg5")},
+			"Timestamp": {S: aws.String("0:60")},
+		},
+		UpdateExpression: aws.String("DELETE #values_set :old_values"),
+		ExpressionAttributeNames: map[string]*string{
+			"#values_set": aws.String("Values"),
+		},
+		ExpressionAttributeValues: map[string]*godynamodb.AttributeValue{
+			":old_values": {BS: [][]byte{raw}},
+		},
+		ReturnValues: aws.String("NONE"),
+	}, gomock.Any()).Return(&godynamodb.UpdateItemOutput{}, nil)
+
+	config.Config.DynamoDBTableName = mockTableName
+	d := NewTestDynamoDB(mock)
+	var items []*Item
+	err := d.ScanItems(func(page []*Item) error {
+		items = append(items, page...)
+		if len(items) >= 1 {
+			// Stop scanning after the first page.
+			return errors.New("stop")
+		}
+		return nil
+	})
+	if err == nil || err.Error() != "stop" {
+		t.Fatalf("ScanItems should return the error of fn, not %v", err)
+	}
+	expected := []*Item{
+		{
+			Name:      "server1.loadavg5",
+			ItemEpoch: 0,
+			Step:      60,
+			Points:    map[int64]*model.Aggregate{120: model.NewAggregate(120, 0.5)},
+			values:    [][]byte{raw},
+		},
+	}
+	if diff := pretty.Compare(items, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	if err := d.Evict(items[0]); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+}
+
+func testValues(n int) map[int64]*model.Aggregate {
+	r := rand.New(rand.NewSource(1))
+	tv := make(map[int64]*model.Aggregate, n)
+	v := 50.0
+	for i := 0; i < n; i++ {
+		t := int64(1500000000 + 60*i)
+		v += math.Floor(r.NormFloat64()*100) / 100
+		tv[t] = model.NewAggregate(t, v)
+	}
+	return tv
+}
+
+// sortedValues sorts the elements of the binary set.
+func sortedValues(vals [][]byte) [][]byte {
+	sort.Slice(vals, func(i, j int) bool { return bytes.Compare(vals[i], vals[j]) < 0 })
+	return vals
+}
+
+func TestEncodeValues(t *testing.T) {
+	defer func(enc string) { config.Config.DynamoDBValueEncoding = enc }(config.Config.DynamoDBValueEncoding)
+
+	tv := testValues(100)
+	for t := int64(0); t < 600; t += 300 {
+		tv[t] = &model.Aggregate{Min: 1, Max: 4, Sum: 7.5, Count: 3, Last: 2.5, LastTimestamp: t + 160, RolledUp: true}
+	}
+	for _, enc := range []string{"plain", "gorilla"} {
+		config.Config.DynamoDBValueEncoding = enc
+		vals := encodeValues(tv)
+		if diff := pretty.Compare(decodeValues(vals), tv); diff != "" {
+			t.Fatalf("encoding: %s, diff: (-actual +expected)\n%s", enc, diff)
+		}
+		if diff := pretty.Compare(sortedValues(encodeValues(tv)), sortedValues(vals)); diff != "" {
+			t.Fatalf("encoding: %s, the same datapoints should be the same elements\n%s", enc, diff)
+		}
+	}
+	if n := len(encodeValues(tv)); n != 2 {
+		t.Fatalf("gorilla should encode the raw and rolled up datapoints into 2 elements, not %d", n)
+	}
+	// The elements are never taken as the plain ones by the older versions.
+	for n := 1; n < 100; n++ {
+		for _, b := range encodeValues(testValues(n)) {
+			if len(b) == plainRawSize || len(b) == plainRolledUpSize {
+				t.Fatalf("gorilla element of %d datapoints should not be %d bytes", n, len(b))
+			}
+		}
+	}
+}
+
+func TestDecodeValues_Mixed(t *testing.T) {
+	defer func(enc string) { config.Config.DynamoDBValueEncoding = enc }(config.Config.DynamoDBValueEncoding)
+
+	// The datapoints written by both versions during the migration
+	partial1 := &model.Aggregate{Min: 1, Max: 3, Sum: 4, Count: 2, Last: 3, LastTimestamp: 60, RolledUp: true}
+	partial2 := &model.Aggregate{Min: 2, Max: 6, Sum: 8, Count: 2, Last: 2, LastTimestamp: 240, RolledUp: true}
+	config.Config.DynamoDBValueEncoding = "plain"
+	vals := encodeValues(map[int64]*model.Aggregate{0: partial1, 300: partial2})
+	config.Config.DynamoDBValueEncoding = "gorilla"
+	vals = append(vals, encodeValues(map[int64]*model.Aggregate{0: partial2, 300: partial2})...)
+	vals = append(vals, []byte{gorillaFormat, 9, 1, 1}, []byte{0xff})
+
+	expected := map[int64]*model.Aggregate{
+		0:   {Min: 1, Max: 6, Sum: 12, Count: 4, Last: 2, LastTimestamp: 240, RolledUp: true},
+		300: partial2,
+	}
+	if diff := pretty.Compare(decodeValues(vals), expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func benchmarkEncodeValues(b *testing.B, enc string) {
+	defer func(enc string) { config.Config.DynamoDBValueEncoding = enc }(config.Config.DynamoDBValueEncoding)
+	config.Config.DynamoDBValueEncoding = enc
+
+	tv := testValues(360)
+	size := 0
+	for _, v := range encodeValues(tv) {
+		size += len(v)
+	}
+	b.Logf("%s: %.2f bytes/point", enc, float64(size)/float64(len(tv)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		encodeValues(tv)
+	}
+}
+
+func benchmarkDecodeValues(b *testing.B, enc string) {
+	defer func(enc string) { config.Config.DynamoDBValueEncoding = enc }(config.Config.DynamoDBValueEncoding)
+	config.Config.DynamoDBValueEncoding = enc
+
+	vals := encodeValues(testValues(360))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		decodeValues(vals)
+	}
+}
+
+func BenchmarkEncodeValues_Plain(b *testing.B)   { benchmarkEncodeValues(b, "plain") }
+func BenchmarkEncodeValues_Gorilla(b *testing.B) { benchmarkEncodeValues(b, "gorilla") }
+func BenchmarkDecodeValues_Plain(b *testing.B)   { benchmarkDecodeValues(b, "plain") }
+func BenchmarkDecodeValues_Gorilla(b *testing.B) { benchmarkDecodeValues(b, "gorilla") }
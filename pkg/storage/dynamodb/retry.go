@@ -0,0 +1,113 @@
+package dynamodb
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	godynamodb "github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"github.com/yuuki/diamondb/pkg/config"
+)
+
+var (
+	// retryBaseDelay and retryMaxDelay bound the backoff before retrying the
+	// throttled calls.
+	retryBaseDelay = 50 * time.Millisecond
+	retryMaxDelay  = 5 * time.Second
+)
+
+// retryBudget is the retries shared by the calls to DynamoDB of a request, such
+// as the batchGets of a fetch, so a throttled request gives up instead of
+// retrying each of the calls. The calls of a request are bounded by the deadline
+// of the budget, since the SDK never retries them. The nil budget never retries.
+type retryBudget struct {
+	remaining int64
+	// deadline is the time to give up the calls, or zero to be unbounded.
+	deadline time.Time
+}
+
+func newRetryBudget() *retryBudget {
+	b := &retryBudget{remaining: int64(config.Config.DynamoDBRetryBudget)}
+	if timeout := config.Config.DynamoDBRequestTimeout; timeout > 0 {
+		b.deadline = time.Now().Add(timeout)
+	}
+	return b
+}
+
+// wait takes a retry out of the budget and sleeps for the backoff of the
+// attempt counted from 0. It returns false without sleeping if the budget is
+// exhausted or the backoff passes the deadline.
+func (b *retryBudget) wait(attempt int) bool {
+	if b == nil {
+		return false
+	}
+	d := backoff(attempt)
+	if !b.deadline.IsZero() && time.Now().Add(d).After(b.deadline) {
+		return false
+	}
+	if atomic.AddInt64(&b.remaining, -1) < 0 {
+		return false
+	}
+	time.Sleep(d)
+	return true
+}
+
+// context returns the context of a call, which is canceled after the timeout or
+// at the deadline of the budget.
+func (b *retryBudget) context(timeout time.Duration) (context.Context, context.CancelFunc) {
+	deadline := time.Now().Add(timeout)
+	if b != nil && !b.deadline.IsZero() && b.deadline.Before(deadline) {
+		deadline = b.deadline
+	}
+	return context.WithDeadline(context.TODO(), deadline)
+}
+
+// backoff returns the delay before retrying the attempt, which is exponential
+// with full jitter so the throttled callers don't retry at the same time.
+func backoff(attempt int) time.Duration {
+	d := retryMaxDelay
+	if attempt < 32 {
+		if e := retryBaseDelay << uint(attempt); e > 0 && e < d {
+			d = e
+		}
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
+
+// isThrottled returns whether the error is the throttling of DynamoDB, which is
+// retried.
+func isThrottled(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch aerr.Code() {
+	case godynamodb.ErrCodeProvisionedThroughputExceededException, "ThrottlingException", "RequestLimitExceeded":
+		return true
+	}
+	return false
+}
+
+// PartialError is the error of the fetch which gives up fetching some of the
+// items because of throttling. The series fetched are returned with it.
+type PartialError struct {
+	Err error
+	// Unfetched is the items not fetched, which have no datapoints.
+	Unfetched []*Item
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%d dynamodb items not fetched: %s", len(e.Unfetched), e.Err)
+}
+
+// Cause returns the underlying error for errors.Cause.
+func (e *PartialError) Cause() error {
+	return e.Err
+}
@@ -0,0 +1,71 @@
+package dynamodb
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	godynamodb "github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"github.com/yuuki/diamondb/pkg/config"
+)
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 40; attempt++ {
+		max := retryMaxDelay
+		if e := retryBaseDelay << uint(attempt); attempt < 6 && e < max {
+			max = e
+		}
+		if d := backoff(attempt); d <= 0 || max < d {
+			t.Fatalf("backoff(%d) should be in (0, %s]: %s", attempt, max, d)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	defer func(base time.Duration, budget int) {
+		retryBaseDelay, config.Config.DynamoDBRetryBudget = base, budget
+	}(retryBaseDelay, config.Config.DynamoDBRetryBudget)
+	retryBaseDelay = time.Millisecond
+	config.Config.DynamoDBRetryBudget = 2
+
+	b := newRetryBudget()
+	for i, expected := range []bool{true, true, false, false} {
+		if got := b.wait(i); got != expected {
+			t.Fatalf("wait(%d) should be %v", i, expected)
+		}
+	}
+	var nilBudget *retryBudget
+	if nilBudget.wait(0) {
+		t.Fatal("nil budget should never retry")
+	}
+
+	// The calls are bounded by the deadline even if the retries remain.
+	b = &retryBudget{remaining: 2, deadline: time.Now()}
+	if b.wait(0) {
+		t.Fatal("wait should not sleep past the deadline")
+	}
+	ctx, cancel := b.context(time.Hour)
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || !deadline.Equal(b.deadline) {
+		t.Fatalf("context should be canceled at the deadline: %s", deadline)
+	}
+}
+
+func TestIsThrottled(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{awserr.New(godynamodb.ErrCodeProvisionedThroughputExceededException, "exceeded", nil), true},
+		{awserr.New("ThrottlingException", "throttled", nil), true},
+		{awserr.New("ResourceNotFoundException", "not found", nil), false},
+		{errors.New("ProvisionedThroughputExceededException"), false},
+	}
+	for _, tc := range tests {
+		if got := isThrottled(tc.err); got != tc.expected {
+			t.Fatalf("isThrottled(%v) should be %v", tc.err, tc.expected)
+		}
+	}
+}
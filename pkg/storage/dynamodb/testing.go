@@ -12,18 +12,49 @@ import (
 	"github.com/golang/mock/gomock"
 	"github.com/yuuki/diamondb/pkg/config"
 	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
 )
 
 // FakeReadWriter is for stub testing
 type FakeReadWriter struct {
 	ReadWriter
-	FakeFetch func(name string, start, end time.Time) (model.SeriesMap, error)
+	FakeFetch          func(name string, start, end time.Time) (model.SeriesMap, error)
+	FakeFetchRetention func(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error)
+	FakePut            func(name, slot, history string, itemEpoch int64, tv map[int64]*model.Aggregate) error
+
+	FakeScanItems func(fn func([]*Item) error) error
+	FakeEvict     func(item *Item) error
 }
 
 func (s *FakeReadWriter) Fetch(name string, start, end time.Time) (model.SeriesMap, error) {
 	return s.FakeFetch(name, start, end)
 }
 
+func (s *FakeReadWriter) FetchRetention(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error) {
+	return s.FakeFetchRetention(names, r, start, end)
+}
+
+func (s *FakeReadWriter) Put(name, slot, history string, itemEpoch int64, tv map[int64]*model.Aggregate) error {
+	return s.FakePut(name, slot, history, itemEpoch, tv)
+}
+
+func (s *FakeReadWriter) ScanItems(fn func([]*Item) error) error {
+	return s.FakeScanItems(fn)
+}
+
+func (s *FakeReadWriter) Evict(item *Item) error {
+	return s.FakeEvict(item)
+}
+
+// NewTestItem creates an Item as scanned by ScanItems.
+func NewTestItem(name string, itemEpoch, step int64, tv map[int64]*model.Aggregate) *Item {
+	item := &Item{Name: name, ItemEpoch: itemEpoch, Step: step, Points: tv}
+	for t, a := range tv {
+		item.values = append(item.values, encodeValue(t, a))
+	}
+	return item
+}
+
 type mockDynamoDBParam struct {
 	Slot      *timeSlot
 	SeriesMap model.SeriesMap
@@ -38,6 +69,16 @@ func NewTestDynamoDB(mock *MockDynamoDBAPI) *DynamoDB {
 func mockExpectBatchGetItem(mock *MockDynamoDBAPI, m *mockDynamoDBParam) *gomock.Call {
 	config.Config.DynamoDBTableName = mockTableName
 
+	items := make(map[string]*godynamodb.KeysAndAttributes)
+	items[mockTableName] = &godynamodb.KeysAndAttributes{Keys: mockBatchGetItemKeys(m)}
+	params := &godynamodb.BatchGetItemInput{
+		RequestItems:           items,
+		ReturnConsumedCapacity: aws.String("NONE"),
+	}
+	return mock.EXPECT().BatchGetItemWithContext(gomock.Any(), params, gomock.Any())
+}
+
+func mockBatchGetItemKeys(m *mockDynamoDBParam) []map[string]*godynamodb.AttributeValue {
 	var keys []map[string]*godynamodb.AttributeValue
 	for _, name := range m.SeriesMap.SortedNames() {
 		keys = append(keys, map[string]*godynamodb.AttributeValue{
@@ -45,16 +86,15 @@ func mockExpectBatchGetItem(mock *MockDynamoDBAPI, m *mockDynamoDBParam) *gomock
 			"Timestamp": {S: aws.String(fmt.Sprintf("%d:%d", m.Slot.itemEpoch, m.Slot.step))},
 		})
 	}
-	items := make(map[string]*godynamodb.KeysAndAttributes)
-	items[mockTableName] = &godynamodb.KeysAndAttributes{Keys: keys}
-	params := &godynamodb.BatchGetItemInput{
-		RequestItems:           items,
-		ReturnConsumedCapacity: aws.String("NONE"),
-	}
-	return mock.EXPECT().BatchGetItemWithContext(gomock.Any(), params, gomock.Any())
+	return keys
 }
 
 func mockReturnBatchGetItem(expect *gomock.Call, m *mockDynamoDBParam) *gomock.Call {
+	expect.Return(mockBatchGetItemOutput(m), nil)
+	return expect
+}
+
+func mockBatchGetItemOutput(m *mockDynamoDBParam) *godynamodb.BatchGetItemOutput {
 	responses := make(map[string][]map[string]*godynamodb.AttributeValue)
 	for name, sp := range m.SeriesMap {
 		var vals [][]byte
@@ -71,9 +111,7 @@ func mockReturnBatchGetItem(expect *gomock.Call, m *mockDynamoDBParam) *gomock.C
 		}
 		responses[mockTableName] = append(responses[mockTableName], attribute)
 	}
-
-	expect.Return(&godynamodb.BatchGetItemOutput{
+	return &godynamodb.BatchGetItemOutput{
 		Responses: responses,
-	}, nil)
-	return expect
+	}
 }
@@ -0,0 +1,481 @@
+// Package embedded provides the storage backend on the local disk of a single
+// node, which needs neither Redis nor DynamoDB. It is a log-structured merge
+// store: the metrics are appended into the write-ahead log and buffered in the
+// memtable, which is flushed into an immutable segment file when it is full or
+// periodically. The segments are merged into one when there are too many of
+// them, and the datapoints older than the history of their retentions are
+// dropped by the merge.
+//
+// The memtable holds the raw datapoints, which overwrite the ones of the same
+// timestamps as they do in Redis. They are rolled up into the coarser retentions
+// of the schema when the memtable is flushed, as the datapoints flushed from
+// Redis are, so the retentions and the rollups are the same as the store on
+// Redis and DynamoDB. The memtable is also rolled up on reading it, so the
+// coarser retentions include the datapoints not flushed yet.
+package embedded
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/config"
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
+	"github.com/yuuki/diamondb/pkg/storage/util"
+	"github.com/yuuki/diamondb/pkg/storage/wal"
+)
+
+const (
+	// DefaultFlushInterval is the default interval to flush the memtable.
+	DefaultFlushInterval = 1 * time.Minute
+	// DefaultMemtablePoints is the default number of the datapoints in the memtable to flush it.
+	DefaultMemtablePoints = 100000
+	// DefaultMaxSegments is the default number of the segments to merge them.
+	DefaultMaxSegments = 8
+
+	walDir = "wal"
+)
+
+// Option for the DB.
+type Option struct {
+	Dir            string
+	FlushInterval  time.Duration
+	MemtablePoints int
+	MaxSegments    int
+	// Sync is the policy to fsync the write-ahead log.
+	Sync wal.SyncPolicy
+}
+
+// DB is the embedded store, which implements storage.ReadWriter.
+type DB struct {
+	dir            string
+	flushInterval  time.Duration
+	memtablePoints int
+	maxSegments    int
+	wal            *wal.WAL
+
+	mu sync.RWMutex
+	// memtable is the raw datapoints by name not flushed yet.
+	memtable  map[string]map[int64]*model.Aggregate
+	memPoints int
+	// segments is ordered by the sequence numbers of the memtables.
+	segments []*segment
+	nextSeq  uint64
+	closed   bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Open opens the store in the directory. The metrics left in the write-ahead log
+// are replayed into the memtable by Init.
+func Open(o *Option) (*DB, error) {
+	db := &DB{
+		dir:            o.Dir,
+		flushInterval:  o.FlushInterval,
+		memtablePoints: o.MemtablePoints,
+		maxSegments:    o.MaxSegments,
+		memtable:       map[string]map[int64]*model.Aggregate{},
+		nextSeq:        1,
+		done:           make(chan struct{}),
+	}
+	if db.flushInterval <= 0 {
+		db.flushInterval = DefaultFlushInterval
+	}
+	if db.memtablePoints <= 0 {
+		db.memtablePoints = DefaultMemtablePoints
+	}
+	if db.maxSegments <= 0 {
+		db.maxSegments = DefaultMaxSegments
+	}
+	if err := os.MkdirAll(db.dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create directory (%s)", db.dir)
+	}
+	segments, err := loadSegments(db.dir)
+	if err != nil {
+		return nil, err
+	}
+	db.segments = segments
+	for _, seg := range segments {
+		if seg.last >= db.nextSeq {
+			db.nextSeq = seg.last + 1
+		}
+	}
+	w, err := wal.Open(&wal.Option{Dir: filepath.Join(db.dir, walDir), Sync: o.Sync})
+	if err != nil {
+		db.closeSegments()
+		return nil, err
+	}
+	db.wal = w
+	// The metrics flushed into the segment are not replayed if the store crashed
+	// before removing the write-ahead log of them, not to roll them up twice.
+	for _, seg := range segments {
+		if err := w.SetCheckpoint(seg.walEnd); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// Ping checks whether the store is open.
+func (db *DB) Ping() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return errors.New("embedded store is closed")
+	}
+	if _, err := os.Stat(db.dir); err != nil {
+		return errors.Wrapf(err, "failed to stat directory (%s)", db.dir)
+	}
+	return nil
+}
+
+// Init replays the metrics left in the write-ahead log into the memtable and
+// starts flushing it periodically.
+func (db *DB) Init() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	r := db.wal.NewReader(db.wal.Checkpoint())
+	defer r.Close()
+	n := 0
+	for {
+		data, _, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var m model.Metric
+		if err := json.Unmarshal(data, &m); err != nil {
+			return errors.Wrap(err, "failed to decode metric in write-ahead log")
+		}
+		db.insert(&m)
+		n++
+	}
+	if n > 0 {
+		log.Printf("Replayed %d metrics from the write-ahead log\n", n)
+	}
+	db.wg.Add(1)
+	go db.flushLoop()
+	return nil
+}
+
+// InsertMetric appends the metric into the write-ahead log and puts the
+// datapoints into the memtable, which is flushed if it is full.
+func (db *DB) InsertMetric(m *model.Metric) error {
+	if len(m.Datapoints) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode metric (%s)", m.Name)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return errors.New("embedded store is closed")
+	}
+	if _, err := db.wal.Append(data); err != nil {
+		return err
+	}
+	db.insert(m)
+	if db.memPoints >= db.memtablePoints {
+		// The metric is in the write-ahead log, so the memtable is flushed again later.
+		if err := db.flush(time.Now()); err != nil {
+			log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+		}
+	}
+	return nil
+}
+
+func (db *DB) insert(m *model.Metric) {
+	tv, ok := db.memtable[m.Name]
+	if !ok {
+		tv = map[int64]*model.Aggregate{}
+		db.memtable[m.Name] = tv
+	}
+	for _, p := range m.Datapoints {
+		if _, ok := tv[p.Timestamp]; !ok {
+			db.memPoints++
+		}
+		tv[p.Timestamp] = model.NewAggregate(p.Timestamp, p.Value)
+	}
+}
+
+// Fetch fetches the series by name from start until end. Each part of the
+// range is read from the finest retention of the schema matching each name
+// keeping it, and consolidated into the step of the coarsest one.
+func (db *DB) Fetch(name string, start, end time.Time) (model.SeriesSlice, error) {
+	return db.fetch(name, start, end, time.Now())
+}
+
+func (db *DB) fetch(name string, start, end, now time.Time) (model.SeriesSlice, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	sm := model.SeriesMap{}
+	for sch, names := range config.Config.StorageSchemas.GroupNames(util.SplitName(name)) {
+		archives := sch.Archives(start, end, now)
+		if len(archives) == 0 {
+			continue
+		}
+		step := archives[len(archives)-1].Retention.Step
+		for _, archive := range archives {
+			r := archive.Retention
+			i := sch.Index(r.Slot)
+			smA := model.SeriesMap{}
+			for _, name := range names {
+				tv, err := db.get(sch.Retentions[:i+1], name, archive.Start.Unix(), archive.End.Unix())
+				if err != nil {
+					return nil, err
+				}
+				if len(tv) == 0 {
+					continue
+				}
+				points := make(model.DataPoints, 0, len(tv))
+				for t, a := range tv {
+					util.Finalize(name, r.Step, a)
+					points = append(points, model.NewAggregatedDataPoint(t, a))
+				}
+				smA[name] = util.Consolidate(model.NewSeriesPoint(name, points, int(r.Step)), step)
+			}
+			sm = sm.MergePointsToMap(smA)
+		}
+	}
+	return sm.MergePointsToSlice(model.SeriesMap{}), nil
+}
+
+// get gets the datapoints of the series from start until end in the last of
+// the retentions, which are the ones of the schema up to it.
+func (db *DB) get(retentions []*schema.Retention, name string, start, end int64) (map[int64]*model.Aggregate, error) {
+	tv := map[int64]*model.Aggregate{}
+	key := seriesKey{slot: retentions[len(retentions)-1].Slot, name: name}
+	for _, seg := range db.segments {
+		e := seg.lookup(key)
+		if e == nil || e.MaxTime < start || end < e.MinTime {
+			continue
+		}
+		err := seg.read(e, func(t int64, a *model.Aggregate) {
+			if start <= t && t <= end {
+				putAggregate(tv, t, a)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if raw, ok := db.memtable[name]; ok {
+		for t, a := range rollupRetentions(retentions, raw) {
+			if start <= t && t <= end {
+				c := *a
+				putAggregate(tv, t, &c)
+			}
+		}
+	}
+	return tv, nil
+}
+
+// putAggregate puts the aggregate written later than the one of the same
+// timestamp. The rolled up aggregates are merged, and the others overwrite it.
+func putAggregate(tv map[int64]*model.Aggregate, t int64, a *model.Aggregate) {
+	if old, ok := tv[t]; ok && !old.IsRaw() && !a.IsRaw() {
+		old.Merge(a)
+		return
+	}
+	tv[t] = a
+}
+
+// rollupRetentions rolls up the raw datapoints through the retentions, and
+// returns the datapoints of the last one.
+func rollupRetentions(retentions []*schema.Retention, raw map[int64]*model.Aggregate) map[int64]*model.Aggregate {
+	tv := raw
+	for _, r := range retentions[1:] {
+		tv = rollup(r, tv)
+	}
+	return tv
+}
+
+// rollup merges the datapoints into the aggregates of the timestamps aligned by
+// the coarser retention.
+func rollup(coarser *schema.Retention, tv map[int64]*model.Aggregate) map[int64]*model.Aggregate {
+	rolled := map[int64]*model.Aggregate{}
+	for t, a := range tv {
+		aligned := coarser.AlignTimestamp(t)
+		if _, ok := rolled[aligned]; !ok {
+			rolled[aligned] = &model.Aggregate{RolledUp: true}
+		}
+		rolled[aligned].Merge(a)
+	}
+	return rolled
+}
+
+func (db *DB) flushLoop() {
+	defer db.wg.Done()
+	ticker := time.NewTicker(db.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			db.mu.Lock()
+			if err := db.flush(time.Now()); err != nil {
+				log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+			}
+			db.mu.Unlock()
+		case <-db.done:
+			return
+		}
+	}
+}
+
+// flush writes the memtable rolled up into all the retentions into a new
+// segment, and removes the write-ahead log of it. The segments are merged if
+// there are too many of them. It must be called with the lock held.
+func (db *DB) flush(now time.Time) error {
+	if len(db.memtable) == 0 {
+		return nil
+	}
+	end := db.wal.End()
+
+	series := map[seriesKey]map[int64]*model.Aggregate{}
+	for name, raw := range db.memtable {
+		retentions := config.Config.StorageSchemas.Match(name).Retentions
+		tv := raw
+		for i, r := range retentions {
+			if i > 0 {
+				tv = rollup(r, tv)
+			}
+			series[seriesKey{slot: r.Slot, name: name}] = tv
+		}
+	}
+	keys := make([]seriesKey, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+
+	w, err := newSegmentWriter(db.dir, db.nextSeq, db.nextSeq, end)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := w.add(key, series[key]); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	seg, err := w.close()
+	if err != nil {
+		return err
+	}
+	db.segments = append(db.segments, seg)
+	db.nextSeq++
+	db.memtable = map[string]map[int64]*model.Aggregate{}
+	db.memPoints = 0
+	if err := db.wal.SetCheckpoint(end); err != nil {
+		return err
+	}
+
+	if len(db.segments) > db.maxSegments {
+		return db.compact(now)
+	}
+	return nil
+}
+
+// compact merges all the segments into one series by series, and drops the
+// datapoints older than the history of the retentions and the series of the
+// slots no longer in their schemas. The merged segment has the range of all the
+// segments, so the segments are removed on opening the store if it crashes
+// before removing them. It must be called with the lock held.
+func (db *DB) compact(now time.Time) error {
+	if len(db.segments) == 0 {
+		return nil
+	}
+	keySet := map[seriesKey]bool{}
+	for _, seg := range db.segments {
+		for _, e := range seg.entries {
+			keySet[e.key()] = true
+		}
+	}
+	keys := make([]seriesKey, 0, len(keySet))
+	for key := range keySet {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+
+	first, last := db.segments[0].first, db.segments[len(db.segments)-1].last
+	walEnd := db.segments[len(db.segments)-1].walEnd
+	w, err := newSegmentWriter(db.dir, first, last, walEnd)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		sch := config.Config.StorageSchemas.Match(key.name)
+		i := sch.Index(key.slot)
+		if i < 0 {
+			continue
+		}
+		cutoff := now.Unix() - sch.Retentions[i].Period
+		tv := map[int64]*model.Aggregate{}
+		for _, seg := range db.segments {
+			e := seg.lookup(key)
+			if e == nil || e.MaxTime < cutoff {
+				continue
+			}
+			err := seg.read(e, func(t int64, a *model.Aggregate) {
+				if t >= cutoff {
+					putAggregate(tv, t, a)
+				}
+			})
+			if err != nil {
+				w.abort()
+				return err
+			}
+		}
+		if err := w.add(key, tv); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	seg, err := w.close()
+	if err != nil {
+		return err
+	}
+	old := db.segments
+	db.segments = []*segment{seg}
+	for _, s := range old {
+		s.close()
+		if err := os.Remove(s.path); err != nil {
+			return errors.Wrapf(err, "failed to remove compacted segment (%s)", s.path)
+		}
+	}
+	return nil
+}
+
+// Close flushes the memtable and closes the store.
+func (db *DB) Close() error {
+	close(db.done)
+	db.wg.Wait()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.flush(time.Now()); err != nil {
+		log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+	}
+	db.closed = true
+	db.closeSegments()
+	return db.wal.Close()
+}
+
+func (db *DB) closeSegments() {
+	for _, seg := range db.segments {
+		seg.close()
+	}
+}
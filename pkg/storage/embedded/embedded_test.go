@@ -0,0 +1,188 @@
+package embedded
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
+	"github.com/yuuki/diamondb/pkg/storage/wal"
+)
+
+func openTestDB(t *testing.T, dir string, o *Option) *DB {
+	if o == nil {
+		o = &Option{}
+	}
+	o.Dir = dir
+	o.FlushInterval = time.Hour
+	o.Sync = wal.SyncNever
+	db, err := Open(o)
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if err := db.Init(); err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	return db
+}
+
+// fetchValues fetches the values of the series at the end of the range.
+func fetchValues(t *testing.T, db *DB, name string, start, end int64) map[int64]float64 {
+	ss, err := db.fetch(name, time.Unix(start, 0), time.Unix(end, 0), time.Unix(end, 0))
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if len(ss) != 1 {
+		t.Fatalf("should fetch a series, not %d", len(ss))
+	}
+	vals := map[int64]float64{}
+	for i, v := range ss[0].Values() {
+		vals[ss[0].Start()+int64(i*ss[0].Step())] = v
+	}
+	return vals
+}
+
+func TestDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diamondb-embedded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := openTestDB(t, dir, nil)
+	if err := db.Ping(); err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	m := &model.Metric{Name: "server1.loadavg5"}
+	for i := int64(0); i < 10; i++ {
+		m.Datapoints = append(m.Datapoints, &model.Datapoint{Timestamp: i * 60, Value: float64(i + 1)})
+	}
+	if err := db.InsertMetric(m); err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+
+	raw := map[int64]float64{}
+	for i := int64(0); i < 10; i++ {
+		raw[i*60] = float64(i + 1)
+	}
+	// The 5m retention is selected for the part older than the 1m retention.
+	rolled := map[int64]float64{0: 3, 300: 8}
+	check := func(desc string) {
+		if diff := pretty.Compare(fetchValues(t, db, "server1.loadavg5", 0, 540), raw); diff != "" {
+			t.Fatalf("%s: diff: (-actual +expected)\n%s", desc, diff)
+		}
+		got := fetchValues(t, db, "server1.loadavg5", 0, 2*86400)
+		for ts, v := range rolled {
+			if got[ts] != v {
+				t.Fatalf("%s: the value at %d should be %f, not %f", desc, ts, v, got[ts])
+			}
+		}
+	}
+	check("memtable")
+
+	db.mu.Lock()
+	if err := db.flush(time.Unix(600, 0)); err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	db.mu.Unlock()
+	if len(db.segments) != 1 {
+		t.Fatalf("the memtable should be flushed into a segment, not %d", len(db.segments))
+	}
+	check("segment")
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if err := db.Ping(); err == nil {
+		t.Fatal("should raise error after closed")
+	}
+	db = openTestDB(t, dir, nil)
+	defer db.Close()
+	check("reopened")
+}
+
+func TestDBInit_Replay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diamondb-embedded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The store crashes without flushing the memtable.
+	db := openTestDB(t, dir, nil)
+	err = db.InsertMetric(&model.Metric{
+		Name:       "server1.loadavg5",
+		Datapoints: []*model.Datapoint{{Timestamp: 60, Value: 1.5}},
+	})
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if err := db.wal.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	db2 := openTestDB(t, dir, nil)
+	defer db2.Close()
+	if diff := pretty.Compare(fetchValues(t, db2, "server1.loadavg5", 60, 60), map[int64]float64{60: 1.5}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestDBCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diamondb-embedded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := openTestDB(t, dir, &Option{MaxSegments: 2})
+	defer db.Close()
+
+	// The raw datapoint at 60 is overwritten, and the rolled up datapoints at 0
+	// are merged including the one overwritten after flushed as in Redis.
+	for i, p := range []*model.Datapoint{{Timestamp: 60, Value: 1}, {Timestamp: 120, Value: 2}, {Timestamp: 60, Value: 3}} {
+		if err := db.InsertMetric(&model.Metric{Name: "server1.loadavg5", Datapoints: []*model.Datapoint{p}}); err != nil {
+			t.Fatalf("should not raise error: %s", err)
+		}
+		db.mu.Lock()
+		err := db.flush(time.Unix(600, 0))
+		db.mu.Unlock()
+		if err != nil {
+			t.Fatalf("should not raise error: %s", err)
+		}
+		if i < 2 && len(db.segments) != i+1 {
+			t.Fatalf("the segments should not be merged yet: %d", len(db.segments))
+		}
+	}
+	if len(db.segments) != 1 || db.segments[0].first != 1 || db.segments[0].last != 3 {
+		t.Fatalf("the segments should be merged into 1-3: %+v", db.segments)
+	}
+	if diff := pretty.Compare(fetchValues(t, db, "server1.loadavg5", 60, 120), map[int64]float64{60: 3, 120: 2}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	if got := fetchValues(t, db, "server1.loadavg5", 0, 2*86400)[0]; got != 2 {
+		t.Fatalf("the rolled up value should be the average of 1, 2 and 3, not %f", got)
+	}
+
+	// The datapoints of the 1m retention kept for 1d are dropped.
+	db.mu.Lock()
+	err = db.compact(time.Unix(2*86400, 0))
+	db.mu.Unlock()
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	tv, err := db.get(schema.Default.Retentions[:1], "server1.loadavg5", 60, 120)
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if len(tv) != 0 {
+		t.Fatalf("the expired datapoints should be dropped: %v", tv)
+	}
+	if got := fetchValues(t, db, "server1.loadavg5", 0, 2*86400)[0]; got != 2 {
+		t.Fatalf("the rolled up value should be kept, not %f", got)
+	}
+}
@@ -0,0 +1,414 @@
+package embedded
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/gorilla"
+	"github.com/yuuki/diamondb/pkg/storage/wal"
+)
+
+const (
+	segmentSuffix = ".seg"
+	segmentMagic  = "DIAMONDB"
+	// footerSize is the size of the offset and the CRC-32 of the index followed by the magic.
+	footerSize = 8 + 4 + len(segmentMagic)
+
+	chunkRaw      byte = 0
+	chunkRolledUp byte = 1
+)
+
+// seriesKey is the key of the datapoints of a series in the slot of a retention.
+type seriesKey struct {
+	slot string
+	name string
+}
+
+func (k seriesKey) less(l seriesKey) bool {
+	if k.slot != l.slot {
+		return k.slot < l.slot
+	}
+	return k.name < l.name
+}
+
+// indexEntry is the location of the chunk of a series in the segment.
+type indexEntry struct {
+	Slot    string `json:"slot"`
+	Name    string `json:"name"`
+	Offset  int64  `json:"offset"`
+	Length  int64  `json:"length"`
+	CRC     uint32 `json:"crc"`
+	MinTime int64  `json:"min_time"`
+	MaxTime int64  `json:"max_time"`
+}
+
+// segmentIndex is the index of the chunks in the segment, and the end of the
+// write-ahead log flushed into it.
+type segmentIndex struct {
+	WALEnd wal.Position  `json:"wal_end"`
+	Series []*indexEntry `json:"series"`
+}
+
+func (e *indexEntry) key() seriesKey {
+	return seriesKey{slot: e.Slot, name: e.Name}
+}
+
+// segment is an immutable file of the chunks of the series sorted by the key,
+// which is followed by the gzipped JSON index and the footer. A segment holds the
+// memtables from first until last, which are the sequence numbers in the file
+// name, and the compaction of the segments holds the range of all of them.
+type segment struct {
+	path    string
+	first   uint64
+	last    uint64
+	walEnd  wal.Position
+	f       *os.File
+	entries []*indexEntry
+}
+
+func segmentName(first, last uint64) string {
+	return fmt.Sprintf("%020d-%020d%s", first, last, segmentSuffix)
+}
+
+func parseSegmentName(name string) (uint64, uint64, bool) {
+	seqs := strings.Split(strings.TrimSuffix(name, segmentSuffix), "-")
+	if len(seqs) != 2 {
+		return 0, 0, false
+	}
+	first, err := strconv.ParseUint(seqs[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	last, err := strconv.ParseUint(seqs[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return first, last, first <= last && name == segmentName(first, last)
+}
+
+// openSegment opens the segment and reads the index.
+func openSegment(path string) (*segment, error) {
+	first, last, ok := parseSegmentName(filepath.Base(path))
+	if !ok {
+		return nil, errors.Errorf("invalid segment name (%s)", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open segment (%s)", path)
+	}
+	index, err := readIndex(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "failed to read index of segment (%s)", path)
+	}
+	return &segment{
+		path:    path,
+		first:   first,
+		last:    last,
+		walEnd:  index.WALEnd,
+		f:       f,
+		entries: index.Series,
+	}, nil
+}
+
+func readIndex(f *os.File) (*segmentIndex, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < int64(footerSize) {
+		return nil, errors.New("too short")
+	}
+	footer := make([]byte, footerSize)
+	if _, err := f.ReadAt(footer, fi.Size()-int64(footerSize)); err != nil {
+		return nil, err
+	}
+	if string(footer[12:]) != segmentMagic {
+		return nil, errors.New("invalid magic")
+	}
+	offset := int64(binary.BigEndian.Uint64(footer[0:8]))
+	if offset < 0 || offset > fi.Size()-int64(footerSize) {
+		return nil, errors.Errorf("invalid index offset %d", offset)
+	}
+	b := make([]byte, fi.Size()-int64(footerSize)-offset)
+	if _, err := f.ReadAt(b, offset); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(b) != binary.BigEndian.Uint32(footer[8:12]) {
+		return nil, errors.New("checksum mismatch of index")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	var index segmentIndex
+	if err := json.NewDecoder(zr).Decode(&index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// lookup returns the index entry of the key, or nil if the segment has no chunk
+// of the key.
+func (s *segment) lookup(key seriesKey) *indexEntry {
+	i := sort.Search(len(s.entries), func(i int) bool {
+		return !s.entries[i].key().less(key)
+	})
+	if i < len(s.entries) && s.entries[i].key() == key {
+		return s.entries[i]
+	}
+	return nil
+}
+
+// read reads the datapoints of the chunk.
+func (s *segment) read(e *indexEntry, fn func(int64, *model.Aggregate)) error {
+	b := make([]byte, e.Length)
+	if _, err := s.f.ReadAt(b, e.Offset); err != nil {
+		return errors.Wrapf(err, "failed to read chunk (%s:%s) of segment (%s)", e.Slot, e.Name, s.path)
+	}
+	if crc32.ChecksumIEEE(b) != e.CRC {
+		return errors.Errorf("checksum mismatch of chunk (%s:%s) of segment (%s)", e.Slot, e.Name, s.path)
+	}
+	if err := decodeChunk(b, fn); err != nil {
+		return errors.Wrapf(err, "failed to decode chunk (%s:%s) of segment (%s)", e.Slot, e.Name, s.path)
+	}
+	return nil
+}
+
+func (s *segment) close() error {
+	return s.f.Close()
+}
+
+// segmentWriter writes the chunks of a segment in the order of the keys into the
+// temporary file, which is renamed to the segment by close.
+type segmentWriter struct {
+	path   string
+	f      *os.File
+	offset int64
+	index  segmentIndex
+}
+
+func newSegmentWriter(dir string, first, last uint64, walEnd wal.Position) (*segmentWriter, error) {
+	path := filepath.Join(dir, segmentName(first, last))
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create segment (%s)", path)
+	}
+	return &segmentWriter{
+		path:  path,
+		f:     f,
+		index: segmentIndex{WALEnd: walEnd, Series: []*indexEntry{}},
+	}, nil
+}
+
+// add writes the chunk of the datapoints of the key, which must be after the keys
+// added before.
+func (w *segmentWriter) add(key seriesKey, tv map[int64]*model.Aggregate) error {
+	if len(tv) == 0 {
+		return nil
+	}
+	chunk, minTime, maxTime := encodeChunk(tv)
+	if _, err := w.f.Write(chunk); err != nil {
+		return errors.Wrapf(err, "failed to write segment (%s)", w.path)
+	}
+	w.index.Series = append(w.index.Series, &indexEntry{
+		Slot:    key.slot,
+		Name:    key.name,
+		Offset:  w.offset,
+		Length:  int64(len(chunk)),
+		CRC:     crc32.ChecksumIEEE(chunk),
+		MinTime: minTime,
+		MaxTime: maxTime,
+	})
+	w.offset += int64(len(chunk))
+	return nil
+}
+
+// close writes the index and the footer, and opens the segment renamed from the
+// temporary file.
+func (w *segmentWriter) close() (*segment, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(&w.index); err != nil {
+		w.abort()
+		return nil, errors.Wrapf(err, "failed to encode index of segment (%s)", w.path)
+	}
+	if err := zw.Close(); err != nil {
+		w.abort()
+		return nil, errors.Wrapf(err, "failed to compress index of segment (%s)", w.path)
+	}
+	footer := make([]byte, footerSize)
+	binary.BigEndian.PutUint64(footer[0:8], uint64(w.offset))
+	binary.BigEndian.PutUint32(footer[8:12], crc32.ChecksumIEEE(buf.Bytes()))
+	copy(footer[12:], segmentMagic)
+	if _, err := w.f.Write(append(buf.Bytes(), footer...)); err != nil {
+		w.abort()
+		return nil, errors.Wrapf(err, "failed to write segment (%s)", w.path)
+	}
+	if err := w.f.Sync(); err != nil {
+		w.abort()
+		return nil, errors.Wrapf(err, "failed to sync segment (%s)", w.path)
+	}
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return nil, errors.Wrapf(err, "failed to close segment (%s)", w.path)
+	}
+	if err := os.Rename(w.f.Name(), w.path); err != nil {
+		os.Remove(w.f.Name())
+		return nil, errors.Wrapf(err, "failed to rename segment (%s)", w.path)
+	}
+	return openSegment(w.path)
+}
+
+// abort removes the temporary file.
+func (w *segmentWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// encodeChunk encodes the datapoints into the parts of the raw and the rolled up
+// datapoints, each of which is the kind, the length and the datapoints encoded by
+// gorilla. The rolled up datapoints have the min, max, sum, count, last value and
+// the last timestamp relative to the timestamp.
+func encodeChunk(tv map[int64]*model.Aggregate) ([]byte, int64, int64) {
+	ts := make([]int64, 0, len(tv))
+	for t := range tv {
+		ts = append(ts, t)
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i] < ts[j] })
+
+	raw, rolled := gorilla.NewEncoder(1), gorilla.NewEncoder(6)
+	for _, t := range ts {
+		a := tv[t]
+		if a.IsRaw() {
+			raw.Append(t, a.Value)
+			continue
+		}
+		rolled.Append(t, a.Min, a.Max, a.Sum, float64(a.Count), a.Last, float64(a.LastTimestamp-t))
+	}
+	var chunk []byte
+	for _, part := range []struct {
+		kind byte
+		e    *gorilla.Encoder
+	}{{chunkRaw, raw}, {chunkRolledUp, rolled}} {
+		if part.e.Len() == 0 {
+			continue
+		}
+		data := part.e.Bytes()
+		var n [binary.MaxVarintLen64]byte
+		chunk = append(chunk, part.kind)
+		chunk = append(chunk, n[:binary.PutUvarint(n[:], uint64(len(data)))]...)
+		chunk = append(chunk, data...)
+	}
+	return chunk, ts[0], ts[len(ts)-1]
+}
+
+func decodeChunk(b []byte, fn func(int64, *model.Aggregate)) error {
+	for len(b) > 0 {
+		kind := b[0]
+		n, i := binary.Uvarint(b[1:])
+		if i <= 0 || uint64(len(b)-1-i) < n {
+			return errors.New("invalid length of part")
+		}
+		data := b[1+i : 1+i+int(n)]
+		b = b[1+i+int(n):]
+
+		d, err := gorilla.NewDecoder(data)
+		if err != nil {
+			return err
+		}
+		for d.Next() {
+			t, vals := d.At()
+			switch {
+			case kind == chunkRaw && len(vals) == 1:
+				fn(t, model.NewAggregate(t, vals[0]))
+			case kind == chunkRolledUp && len(vals) == 6:
+				fn(t, &model.Aggregate{
+					Min:           vals[0],
+					Max:           vals[1],
+					Sum:           vals[2],
+					Count:         int64(vals[3]),
+					Last:          vals[4],
+					LastTimestamp: t + int64(vals[5]),
+					RolledUp:      true,
+				})
+			default:
+				return errors.Errorf("unknown part of kind %d with %d fields", kind, len(vals))
+			}
+		}
+		if err := d.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadSegments opens the segments in the directory in the order of the sequence
+// numbers. The segments whose ranges are included by another one are the inputs
+// of the compaction interrupted after the output is written, so they are
+// removed, as are the temporary files.
+func loadSegments(dir string) ([]*segment, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read directory (%s)", dir)
+	}
+	type seq struct {
+		name        string
+		first, last uint64
+	}
+	var seqs []seq
+	for _, fi := range files {
+		path := filepath.Join(dir, fi.Name())
+		if filepath.Ext(fi.Name()) == ".tmp" {
+			if err := os.Remove(path); err != nil {
+				return nil, errors.Wrapf(err, "failed to remove temporary file (%s)", path)
+			}
+			continue
+		}
+		if first, last, ok := parseSegmentName(fi.Name()); ok {
+			seqs = append(seqs, seq{name: fi.Name(), first: first, last: last})
+		}
+	}
+
+	var segments []*segment
+	for i, s := range seqs {
+		covered := false
+		for j, t := range seqs {
+			if i != j && t.first <= s.first && s.last <= t.last && (t.first != s.first || t.last != s.last) {
+				covered = true
+				break
+			}
+		}
+		path := filepath.Join(dir, s.name)
+		if covered {
+			if err := os.Remove(path); err != nil {
+				return nil, errors.Wrapf(err, "failed to remove compacted segment (%s)", path)
+			}
+			continue
+		}
+		seg, err := openSegment(path)
+		if err != nil {
+			for _, seg := range segments {
+				seg.close()
+			}
+			return nil, err
+		}
+		segments = append(segments, seg)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].first < segments[j].first })
+	return segments, nil
+}
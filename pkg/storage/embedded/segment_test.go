@@ -0,0 +1,144 @@
+package embedded
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/wal"
+)
+
+func TestEncodeChunk(t *testing.T) {
+	tv := map[int64]*model.Aggregate{
+		120: model.NewAggregate(120, 0.5),
+		0:   {Min: 1, Max: 5, Sum: 12, Count: 4, Last: 2, LastTimestamp: 50, RolledUp: true},
+		60:  model.NewAggregate(60, -1.25),
+	}
+	chunk, minTime, maxTime := encodeChunk(tv)
+	if minTime != 0 || maxTime != 120 {
+		t.Fatalf("the range should be [0, 120], not [%d, %d]", minTime, maxTime)
+	}
+	got := map[int64]*model.Aggregate{}
+	if err := decodeChunk(chunk, func(t int64, a *model.Aggregate) { got[t] = a }); err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if diff := pretty.Compare(got, tv); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	if err := decodeChunk(chunk[:len(chunk)-1], func(int64, *model.Aggregate) {}); err == nil {
+		t.Fatal("should raise error for the truncated chunk")
+	}
+}
+
+func TestSegmentWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diamondb-embedded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	series := map[seriesKey]map[int64]*model.Aggregate{
+		{slot: "1m", name: "server1.loadavg5"}: {60: model.NewAggregate(60, 1.0)},
+		{slot: "1m", name: "server2.loadavg5"}: {120: model.NewAggregate(120, 2.0)},
+		{slot: "5m", name: "server1.loadavg5"}: {
+			0: {Min: 1, Max: 1, Sum: 1, Count: 1, Last: 1, LastTimestamp: 60, RolledUp: true},
+		},
+	}
+	keys := []seriesKey{}
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+
+	walEnd := wal.Position{Segment: 1, Offset: 100}
+	w, err := newSegmentWriter(dir, 1, 3, walEnd)
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	for _, key := range keys {
+		if err := w.add(key, series[key]); err != nil {
+			t.Fatalf("should not raise error: %s", err)
+		}
+	}
+	seg, err := w.close()
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	defer seg.close()
+
+	if seg.first != 1 || seg.last != 3 || seg.walEnd != walEnd {
+		t.Fatalf("unexpected segment: %+v", seg)
+	}
+	for key, expected := range series {
+		e := seg.lookup(key)
+		if e == nil {
+			t.Fatalf("should find %v", key)
+		}
+		got := map[int64]*model.Aggregate{}
+		if err := seg.read(e, func(t int64, a *model.Aggregate) { got[t] = a }); err != nil {
+			t.Fatalf("should not raise error: %s", err)
+		}
+		if diff := pretty.Compare(got, expected); diff != "" {
+			t.Fatalf("diff: (-actual +expected)\n%s", diff)
+		}
+	}
+	if e := seg.lookup(seriesKey{slot: "1h", name: "server1.loadavg5"}); e != nil {
+		t.Fatalf("should not find the key, but found %+v", e)
+	}
+
+	// The broken segment
+	path := filepath.Join(dir, segmentName(4, 4))
+	if err := ioutil.WriteFile(path, []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openSegment(path); err == nil {
+		t.Fatal("should raise error for the broken segment")
+	}
+}
+
+func TestLoadSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diamondb-embedded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The segments 1 and 2 are left by the compaction interrupted after writing
+	// the segment of 1-2.
+	for _, r := range [][2]uint64{{3, 3}, {1, 1}, {2, 2}, {1, 2}} {
+		w, err := newSegmentWriter(dir, r[0], r[1], wal.Position{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seg, err := w.close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seg.close()
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, segmentName(4, 4)+".tmp"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := loadSegments(dir)
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	var got [][2]uint64
+	for _, seg := range segments {
+		got = append(got, [2]uint64{seg.first, seg.last})
+		seg.close()
+	}
+	if diff := pretty.Compare(got, [][2]uint64{{1, 2}, {3, 3}}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 2 {
+		t.Fatalf("the segments included by another and the temporary file should be removed: %v", files)
+	}
+}
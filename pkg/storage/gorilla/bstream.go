@@ -0,0 +1,109 @@
+package gorilla
+
+import (
+	"io"
+)
+
+// bstream is the stream of bits written and read from the most significant bit
+// of each byte.
+type bstream struct {
+	stream []byte
+	// count is the number of the bits left to write in the last byte, or to
+	// read in the first byte.
+	count uint8
+}
+
+func (b *bstream) writeBit(bit bool) {
+	if b.count == 0 {
+		b.stream = append(b.stream, 0)
+		b.count = 8
+	}
+	b.count--
+	if bit {
+		b.stream[len(b.stream)-1] |= 1 << b.count
+	}
+}
+
+func (b *bstream) writeByte(byt byte) {
+	if b.count == 0 {
+		b.stream = append(b.stream, byt)
+		return
+	}
+	// Fill the bits left in the last byte and the rest of the bits in a new one.
+	b.stream[len(b.stream)-1] |= byt >> (8 - b.count)
+	b.stream = append(b.stream, byt<<b.count)
+}
+
+// writeBits writes the nbits least significant bits of u.
+func (b *bstream) writeBits(u uint64, nbits int) {
+	u <<= uint(64 - nbits)
+	for ; nbits >= 8; nbits -= 8 {
+		b.writeByte(byte(u >> 56))
+		u <<= 8
+	}
+	for ; nbits > 0; nbits-- {
+		b.writeBit(u>>63 == 1)
+		u <<= 1
+	}
+}
+
+func (b *bstream) readBit() (bool, error) {
+	if len(b.stream) == 0 {
+		return false, io.ErrUnexpectedEOF
+	}
+	if b.count == 0 {
+		b.stream = b.stream[1:]
+		b.count = 8
+		if len(b.stream) == 0 {
+			return false, io.ErrUnexpectedEOF
+		}
+	}
+	b.count--
+	return (b.stream[0]>>b.count)&1 == 1, nil
+}
+
+func (b *bstream) readByte() (byte, error) {
+	if b.count == 0 {
+		if len(b.stream) > 0 {
+			b.stream = b.stream[1:]
+		}
+		b.count = 8
+	}
+	if len(b.stream) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if b.count == 8 {
+		b.count = 0
+		return b.stream[0], nil
+	}
+	// Take the bits left in the first byte and the rest of the bits in the next one.
+	byt := b.stream[0] << (8 - b.count)
+	b.stream = b.stream[1:]
+	if len(b.stream) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return byt | b.stream[0]>>b.count, nil
+}
+
+// readBits reads nbits bits into the least significant bits.
+func (b *bstream) readBits(nbits int) (uint64, error) {
+	var u uint64
+	for ; nbits >= 8; nbits -= 8 {
+		byt, err := b.readByte()
+		if err != nil {
+			return 0, err
+		}
+		u = u<<8 | uint64(byt)
+	}
+	for i := 0; i < nbits; i++ {
+		bit, err := b.readBit()
+		if err != nil {
+			return 0, err
+		}
+		u <<= 1
+		if bit {
+			u |= 1
+		}
+	}
+	return u, nil
+}
@@ -0,0 +1,285 @@
+// Package gorilla provides the compression of the datapoints described in
+// "Gorilla: A Fast, Scalable, In-Memory Time Series Database". The timestamps
+// are encoded by the delta of the deltas and the values by the XOR with the
+// previous value, so the datapoints at the regular interval with the values
+// slowly changing take a few bits each.
+//
+// A datapoint has one or more values, which are compressed separately as the
+// fields, such as the min, max and sum of a datapoint rolled up.
+package gorilla
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Encoder encodes the datapoints appended in the order of the timestamps.
+type Encoder struct {
+	b      bstream
+	n      int
+	fields []xorState
+	t      int64
+	delta  int64
+}
+
+// xorState is the previous value of a field and the window of its meaningful
+// bits.
+type xorState struct {
+	v        uint64
+	leading  uint8
+	trailing uint8
+}
+
+// NewEncoder creates a new Encoder of the datapoints having the number of the
+// fields.
+func NewEncoder(fields int) *Encoder {
+	return &Encoder{fields: make([]xorState, fields)}
+}
+
+// Len returns the number of the datapoints appended.
+func (e *Encoder) Len() int {
+	return e.n
+}
+
+// Append appends the datapoint. The number of the values must be the number of
+// the fields, and the timestamp must not be older than the previous one.
+func (e *Encoder) Append(t int64, vals ...float64) {
+	if len(vals) != len(e.fields) {
+		panic("gorilla: the number of the values must be the number of the fields")
+	}
+	if e.n == 0 {
+		e.b.writeBits(uint64(t), 64)
+	} else {
+		delta := t - e.t
+		writeDoD(&e.b, delta-e.delta)
+		e.delta = delta
+	}
+	e.t = t
+	for i, v := range vals {
+		writeXOR(&e.b, &e.fields[i], math.Float64bits(v))
+	}
+	e.n++
+}
+
+// Bytes returns the encoded datapoints, which are the number of the datapoints
+// and the fields followed by the stream of the bits.
+func (e *Encoder) Bytes() []byte {
+	buf := make([]byte, 2*binary.MaxVarintLen64, 2*binary.MaxVarintLen64+len(e.b.stream))
+	n := binary.PutUvarint(buf, uint64(e.n))
+	n += binary.PutUvarint(buf[n:], uint64(len(e.fields)))
+	return append(buf[:n], e.b.stream...)
+}
+
+// writeDoD writes the delta of the deltas of the timestamps in the buckets of
+// the paper except the widest one extended to 64 bits.
+func writeDoD(b *bstream, dod int64) {
+	switch {
+	case dod == 0:
+		b.writeBit(false)
+	case -63 <= dod && dod <= 64:
+		b.writeBits(0x02, 2)
+		b.writeBits(uint64(dod), 7)
+	case -255 <= dod && dod <= 256:
+		b.writeBits(0x06, 3)
+		b.writeBits(uint64(dod), 9)
+	case -2047 <= dod && dod <= 2048:
+		b.writeBits(0x0e, 4)
+		b.writeBits(uint64(dod), 12)
+	default:
+		b.writeBits(0x0f, 4)
+		b.writeBits(uint64(dod), 64)
+	}
+}
+
+// writeXOR writes the XOR of the value with the previous one. The meaningful
+// bits are written in the window of the previous value if they fit in it. No
+// window is written yet if both the leading and trailing zeros are 0.
+func writeXOR(b *bstream, s *xorState, v uint64) {
+	xor := v ^ s.v
+	s.v = v
+	if xor == 0 {
+		b.writeBit(false)
+		return
+	}
+	b.writeBit(true)
+	leading, trailing := zeros(xor)
+	// The leading zeros are written in 5 bits.
+	if leading > 31 {
+		leading = 31
+	}
+	if (s.leading != 0 || s.trailing != 0) && leading >= s.leading && trailing >= s.trailing {
+		b.writeBit(false)
+		b.writeBits(xor>>s.trailing, int(64-s.leading-s.trailing))
+		return
+	}
+	s.leading, s.trailing = leading, trailing
+	sigbits := 64 - leading - trailing
+	b.writeBit(true)
+	b.writeBits(uint64(leading), 5)
+	// 64 meaningful bits are written as 0, which is never written otherwise.
+	b.writeBits(uint64(sigbits), 6)
+	b.writeBits(xor>>trailing, int(sigbits))
+}
+
+// zeros returns the number of the leading and trailing zero bits of x, which
+// must not be 0.
+func zeros(x uint64) (uint8, uint8) {
+	var leading, trailing uint8
+	for y := x; y&(1<<63) == 0; y <<= 1 {
+		leading++
+	}
+	for y := x; y&1 == 0; y >>= 1 {
+		trailing++
+	}
+	return leading, trailing
+}
+
+// Decoder decodes the datapoints encoded by Encoder.
+type Decoder struct {
+	b      bstream
+	n      int
+	i      int
+	fields []xorState
+	t      int64
+	delta  int64
+	vals   []float64
+	err    error
+}
+
+// NewDecoder creates a new Decoder of the encoded datapoints.
+func NewDecoder(b []byte) (*Decoder, error) {
+	n, i := binary.Uvarint(b)
+	if i <= 0 {
+		return nil, errors.New("gorilla: invalid number of datapoints")
+	}
+	fields, j := binary.Uvarint(b[i:])
+	if j <= 0 || fields == 0 || fields > 64 {
+		return nil, errors.New("gorilla: invalid number of fields")
+	}
+	return &Decoder{
+		b:      bstream{stream: b[i+j:], count: 8},
+		n:      int(n),
+		fields: make([]xorState, fields),
+		vals:   make([]float64, fields),
+	}, nil
+}
+
+// Len returns the number of the datapoints.
+func (d *Decoder) Len() int {
+	return d.n
+}
+
+// Next decodes the next datapoint. It returns false at the end of the datapoints
+// or on an error.
+func (d *Decoder) Next() bool {
+	if d.err != nil || d.i >= d.n {
+		return false
+	}
+	if d.i == 0 {
+		t, err := d.b.readBits(64)
+		if err != nil {
+			d.err = errors.Wrap(err, "gorilla: failed to read timestamp")
+			return false
+		}
+		d.t = int64(t)
+	} else {
+		dod, err := readDoD(&d.b)
+		if err != nil {
+			d.err = errors.Wrap(err, "gorilla: failed to read timestamp")
+			return false
+		}
+		d.delta += dod
+		d.t += d.delta
+	}
+	for i := range d.fields {
+		v, err := readXOR(&d.b, &d.fields[i])
+		if err != nil {
+			d.err = errors.Wrap(err, "gorilla: failed to read value")
+			return false
+		}
+		d.vals[i] = math.Float64frombits(v)
+	}
+	d.i++
+	return true
+}
+
+// At returns the datapoint decoded by Next. The values are overwritten by the
+// next call of Next.
+func (d *Decoder) At() (int64, []float64) {
+	return d.t, d.vals
+}
+
+// Err returns the error occurred in Next.
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// dodBits are the bits of the delta of the deltas by the number of the leading
+// 1 of the control bits.
+var dodBits = []int{0, 7, 9, 12, 64}
+
+func readDoD(b *bstream) (int64, error) {
+	ones := 0
+	for ones < len(dodBits)-1 {
+		bit, err := b.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			break
+		}
+		ones++
+	}
+	nbits := dodBits[ones]
+	if nbits == 0 {
+		return 0, nil
+	}
+	u, err := b.readBits(nbits)
+	if err != nil {
+		return 0, err
+	}
+	// The buckets are [-(2^(n-1)-1), 2^(n-1)] rather than the two's complement.
+	if nbits < 64 && u > 1<<uint(nbits-1) {
+		return int64(u) - 1<<uint(nbits), nil
+	}
+	return int64(u), nil
+}
+
+func readXOR(b *bstream, s *xorState) (uint64, error) {
+	bit, err := b.readBit()
+	if err != nil {
+		return 0, err
+	}
+	if !bit {
+		return s.v, nil
+	}
+	bit, err = b.readBit()
+	if err != nil {
+		return 0, err
+	}
+	if bit {
+		leading, err := b.readBits(5)
+		if err != nil {
+			return 0, err
+		}
+		sigbits, err := b.readBits(6)
+		if err != nil {
+			return 0, err
+		}
+		if sigbits == 0 {
+			sigbits = 64
+		}
+		if leading+sigbits > 64 {
+			return 0, errors.Errorf("invalid meaningful bits %d with %d leading zeros", sigbits, leading)
+		}
+		s.leading, s.trailing = uint8(leading), uint8(64-leading-sigbits)
+	}
+	u, err := b.readBits(int(64 - s.leading - s.trailing))
+	if err != nil {
+		return 0, err
+	}
+	s.v ^= u << s.trailing
+	return s.v, nil
+}
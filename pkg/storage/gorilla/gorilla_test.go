@@ -0,0 +1,145 @@
+package gorilla
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"testing/quick"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+type point struct {
+	T    int64
+	Vals []float64
+}
+
+func roundTrip(t *testing.T, fields int, points []point) []point {
+	e := NewEncoder(fields)
+	for _, p := range points {
+		e.Append(p.T, p.Vals...)
+	}
+	if e.Len() != len(points) {
+		t.Fatalf("Len should be %d, not %d", len(points), e.Len())
+	}
+	d, err := NewDecoder(e.Bytes())
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	var got []point
+	for d.Next() {
+		ts, vals := d.At()
+		got = append(got, point{T: ts, Vals: append([]float64{}, vals...)})
+	}
+	if err := d.Err(); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	return got
+}
+
+func TestEncoder(t *testing.T) {
+	tests := []struct {
+		desc   string
+		fields int
+		points []point
+	}{
+		{"empty", 1, nil},
+		{"a datapoint", 1, []point{{1500000000, []float64{0.5}}}},
+		{
+			"regular interval", 1,
+			[]point{{60, []float64{1.0}}, {120, []float64{1.0}}, {180, []float64{1.5}}, {240, []float64{-2.25}}},
+		},
+		{
+			"every bucket of the delta of the deltas", 1,
+			[]point{
+				{0, []float64{0}}, {60, []float64{0}}, {124, []float64{0}}, {125, []float64{0}},
+				{381, []float64{0}}, {382, []float64{0}}, {2430, []float64{0}}, {2431, []float64{0}},
+				{1 << 40, []float64{0}}, {1<<40 + 1, []float64{0}}, {-1 << 40, []float64{0}},
+			},
+		},
+		{
+			"the special values", 1,
+			[]point{{0, []float64{math.Inf(1)}}, {1, []float64{math.Inf(-1)}}, {2, []float64{math.MaxFloat64}}, {3, []float64{math.SmallestNonzeroFloat64}}, {4, []float64{0}}},
+		},
+		{
+			"multiple fields", 3,
+			[]point{{60, []float64{1, 3, 4}}, {120, []float64{1, 3, 4}}, {180, []float64{0.5, 10, 100}}},
+		},
+	}
+	for _, tc := range tests {
+		got := roundTrip(t, tc.fields, tc.points)
+		if diff := pretty.Compare(got, tc.points); diff != "" {
+			t.Fatalf("desc: %s, diff: (-actual +expected)\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestEncoder_NaN(t *testing.T) {
+	got := roundTrip(t, 1, []point{{0, []float64{math.NaN()}}, {60, []float64{1}}})
+	if len(got) != 2 || !math.IsNaN(got[0].Vals[0]) || got[1].Vals[0] != 1 {
+		t.Fatalf("failed to round trip NaN: %v", got)
+	}
+}
+
+func TestEncoder_Quick(t *testing.T) {
+	f := func(seed int64) bool {
+		r := rand.New(rand.NewSource(seed))
+		points := make([]point, r.Intn(200))
+		var ts int64 = r.Int63n(1 << 32)
+		for i := range points {
+			// Mostly regular intervals with some jitter and gaps
+			switch r.Intn(4) {
+			case 0:
+				ts += r.Int63n(1 << 20)
+			default:
+				ts += 60
+			}
+			vals := make([]float64, 2)
+			for j := range vals {
+				switch r.Intn(3) {
+				case 0:
+					vals[j] = r.NormFloat64() * 1e6
+				case 1:
+					vals[j] = float64(r.Intn(10))
+				default:
+					vals[j] = math.Float64frombits(r.Uint64())
+				}
+				if math.IsNaN(vals[j]) {
+					vals[j] = 0
+				}
+			}
+			points[i] = point{T: ts, Vals: vals}
+		}
+		got := roundTrip(t, 2, points)
+		if len(points) == 0 {
+			return len(got) == 0
+		}
+		return pretty.Compare(got, points) == ""
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 300}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecoder_Truncated(t *testing.T) {
+	e := NewEncoder(1)
+	for i := int64(0); i < 10; i++ {
+		e.Append(i*60, float64(i)*1.5)
+	}
+	b := e.Bytes()
+	d, err := NewDecoder(b[:len(b)-3])
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	for d.Next() {
+	}
+	if d.Err() == nil {
+		t.Fatal("should raise err for the truncated datapoints")
+	}
+	if _, err := NewDecoder([]byte{}); err == nil {
+		t.Fatal("should raise err for the empty bytes")
+	}
+	if _, err := NewDecoder([]byte{1, 0}); err == nil {
+		t.Fatal("should raise err for no field")
+	}
+}
@@ -0,0 +1,165 @@
+package objstore
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// tmpPrefix is the prefix of the temporary files written before renamed.
+const tmpPrefix = ".tmp-"
+
+// Dir is an ObjectStore on a local directory, which keeps each object in the
+// file of the key under the root.
+type Dir struct {
+	root string
+}
+
+var _ ObjectStore = &Dir{}
+
+// NewDir creates a new Dir, creating the root directory if it doesn't exist.
+func NewDir(root string) (*Dir, error) {
+	if root == "" {
+		return nil, errors.New("root directory of object storage must not be empty")
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create directory %s", root)
+	}
+	return &Dir{root: root}, nil
+}
+
+func (d *Dir) path(key string) string {
+	return filepath.Join(d.root, filepath.FromSlash(key))
+}
+
+// Ping checks the root directory exists.
+func (d *Dir) Ping() error {
+	if _, err := os.Stat(d.root); err != nil {
+		return errors.Wrapf(err, "failed to stat %s", d.root)
+	}
+	return nil
+}
+
+// Put writes the object into a temporary file and renames it, so the readers
+// never see the object partially written.
+func (d *Dir) Put(key string, body []byte) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	p := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return errors.Wrapf(err, "failed to create directory of %s", key)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), tmpPrefix)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create temporary file of %s", key)
+	}
+	if _, err := f.Write(body); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.Wrapf(err, "failed to write %s", key)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.Wrapf(err, "failed to sync %s", key)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrapf(err, "failed to close %s", key)
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrapf(err, "failed to rename %s", key)
+	}
+	return nil
+}
+
+// Get reads the whole object.
+func (d *Dir) Get(key string) ([]byte, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadFile(d.path(key))
+	if os.IsNotExist(err) {
+		return nil, errors.Wrapf(ErrNotFound, "failed to get %s", key)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %s", key)
+	}
+	return body, nil
+}
+
+// GetRange reads the length bytes of the object from the offset.
+func (d *Dir) GetRange(key string, offset, length int64) ([]byte, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(d.path(key))
+	if os.IsNotExist(err) {
+		return nil, errors.Wrapf(ErrNotFound, "failed to get %s", key)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %s", key)
+	}
+	defer f.Close()
+	body := make([]byte, length)
+	if _, err := f.ReadAt(body, offset); err != nil {
+		if err == io.EOF {
+			return nil, errors.Errorf("range %d-%d is out of %s", offset, offset+length, key)
+		}
+		return nil, errors.Wrapf(err, "failed to get range %d-%d of %s", offset, offset+length, key)
+	}
+	return body, nil
+}
+
+// List returns the keys starting with the prefix in the lexical order.
+func (d *Dir) List(prefix string) ([]string, error) {
+	// Walk only the directory including the prefix.
+	dir := d.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = d.path(prefix[:i])
+	}
+	var keys []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), tmpPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(d.root, p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, path.Clean(key))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list %s", prefix)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Delete removes the object. Deleting the missing object succeeds.
+func (d *Dir) Delete(key string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	if err := os.Remove(d.path(key)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to delete %s", key)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package objstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/pkg/errors"
+)
+
+func newTestDir(t *testing.T) (*Dir, func()) {
+	root, err := ioutil.TempDir("", "diamondb-objstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDir(filepath.Join(root, "blocks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, func() { os.RemoveAll(root) }
+}
+
+func TestDir(t *testing.T) {
+	d, cleanup := newTestDir(t)
+	defer cleanup()
+
+	if err := d.Ping(); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	objects := map[string]string{
+		"60/0/a.data":     "0123456789",
+		"60/0/a.index":    "index",
+		"60/86400/b.data": "abc",
+		"600/0/c.data":    "xyz",
+	}
+	for key, body := range objects {
+		if err := d.Put(key, []byte(body)); err != nil {
+			t.Fatalf("should not raise err: %s", err)
+		}
+	}
+	// Put again overwrites the object.
+	if err := d.Put("60/0/a.index", []byte("index2")); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+
+	body, err := d.Get("60/0/a.index")
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if string(body) != "index2" {
+		t.Fatalf("Get should return index2, not %s", body)
+	}
+	body, err = d.GetRange("60/0/a.data", 3, 4)
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if string(body) != "3456" {
+		t.Fatalf("GetRange should return 3456, not %s", body)
+	}
+	if _, err := d.GetRange("60/0/a.data", 8, 4); err == nil {
+		t.Fatal("GetRange out of the object should raise err")
+	}
+	if _, err := d.Get("60/0/z.data"); errors.Cause(err) != ErrNotFound {
+		t.Fatalf("Get of the missing object should raise ErrNotFound, not %v", err)
+	}
+
+	tests := []struct {
+		prefix   string
+		expected []string
+	}{
+		{"60/", []string{"60/0/a.data", "60/0/a.index", "60/86400/b.data"}},
+		{"60/0/", []string{"60/0/a.data", "60/0/a.index"}},
+		{"6", []string{"60/0/a.data", "60/0/a.index", "60/86400/b.data", "600/0/c.data"}},
+		{"3600/", nil},
+	}
+	for _, tc := range tests {
+		keys, err := d.List(tc.prefix)
+		if err != nil {
+			t.Fatalf("should not raise err: %s", err)
+		}
+		if diff := pretty.Compare(keys, tc.expected); diff != "" {
+			t.Fatalf("List(%q); diff: (-actual +expected)\n%s", tc.prefix, diff)
+		}
+	}
+
+	// Delete the object twice.
+	for i := 0; i < 2; i++ {
+		if err := d.Delete("60/0/a.data"); err != nil {
+			t.Fatalf("should not raise err: %s", err)
+		}
+	}
+	if _, err := d.Get("60/0/a.data"); errors.Cause(err) != ErrNotFound {
+		t.Fatalf("Get of the deleted object should raise ErrNotFound, not %v", err)
+	}
+}
+
+func TestDir_InvalidKey(t *testing.T) {
+	d, cleanup := newTestDir(t)
+	defer cleanup()
+
+	for _, key := range []string{"", "/a", "a/", "a//b", "../a", "a/./b"} {
+		if err := d.Put(key, []byte("a")); err == nil {
+			t.Fatalf("Put(%q) should raise err", key)
+		}
+		if _, err := d.Get(key); err == nil {
+			t.Fatalf("Get(%q) should raise err", key)
+		}
+	}
+}
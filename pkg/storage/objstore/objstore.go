@@ -0,0 +1,59 @@
+// Package objstore provides the object storage of the cold tier on S3 or a
+// local directory.
+package objstore
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned when the object of the key doesn't exist.
+var ErrNotFound = errors.New("object not found")
+
+// ObjectStore defines the interface for the object storage. The keys are the
+// slash-separated paths such as 'blocks/60/86400/0123abcd.index'. The objects
+// are immutable, so an object put is never changed except being put again
+// with the same body or deleted.
+type ObjectStore interface {
+	Ping() error
+	Put(key string, body []byte) error
+	Get(key string) ([]byte, error)
+	GetRange(key string, offset, length int64) ([]byte, error)
+	List(prefix string) ([]string, error)
+	Delete(key string) error
+}
+
+// New creates the ObjectStore of the location, which is either the S3 URL such
+// as 's3://bucket/prefix' or the local directory such as 'file:///var/lib/diamondb'
+// or '/var/lib/diamondb'.
+func New(location string) (ObjectStore, error) {
+	if !strings.Contains(location, "://") {
+		return NewDir(location)
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid location of object storage %s", location)
+	}
+	switch u.Scheme {
+	case "s3":
+		return NewS3(u.Host, strings.Trim(u.Path, "/"))
+	case "file":
+		return NewDir(u.Path)
+	}
+	return nil, errors.Errorf("unknown scheme of object storage %s", location)
+}
+
+// validKey returns an error if the key is not a relative slash-separated path.
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") {
+		return errors.Errorf("invalid key %q", key)
+	}
+	for _, elem := range strings.Split(key, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return errors.Errorf("invalid key %q", key)
+		}
+	}
+	return nil
+}
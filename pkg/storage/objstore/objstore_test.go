@@ -0,0 +1,43 @@
+package objstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	root, err := ioutil.TempDir("", "diamondb-objstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	tests := []struct {
+		location string
+		expected string
+	}{
+		{filepath.Join(root, "a"), "*objstore.Dir"},
+		{"file://" + filepath.Join(root, "b"), "*objstore.Dir"},
+		{"s3://bucket/prefix", "*objstore.S3"},
+	}
+	for _, tc := range tests {
+		s, err := New(tc.location)
+		if err != nil {
+			t.Fatalf("New(%q) should not raise err: %s", tc.location, err)
+		}
+		if got := fmt.Sprintf("%T", s); got != tc.expected {
+			t.Fatalf("New(%q) should be %s, not %s", tc.location, tc.expected, got)
+		}
+	}
+	if s, _ := New("s3://bucket/prefix"); s.(*S3).prefix != "prefix" {
+		t.Fatalf("prefix should be 'prefix', not %q", s.(*S3).prefix)
+	}
+	for _, location := range []string{"", "gs://bucket", "s3:///prefix"} {
+		if _, err := New(location); err == nil {
+			t.Fatalf("New(%q) should raise err", location)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package objstore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	gos3 "github.com/aws/aws-sdk-go/service/s3"
+	gos3iface "github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/config"
+)
+
+const s3HTTPTimeout = 30 * time.Second
+
+// S3 is an ObjectStore on a S3 bucket, which keeps each object in the key
+// under the prefix.
+type S3 struct {
+	svc    gos3iface.S3API
+	bucket string
+	prefix string
+}
+
+var _ ObjectStore = &S3{}
+
+// NewS3 creates a new S3.
+func NewS3(bucket, prefix string) (*S3, error) {
+	if bucket == "" {
+		return nil, errors.New("bucket of object storage must not be empty")
+	}
+	awsConf := aws.NewConfig().WithRegion(config.Config.S3Region)
+	if config.Config.S3Endpoint != "" {
+		// For the S3 compatible storage such as minio
+		awsConf.WithEndpoint(config.Config.S3Endpoint)
+		awsConf.WithS3ForcePathStyle(true)
+		awsConf.WithCredentials(credentials.NewStaticCredentials("dummy", "dummy", "dummy"))
+	}
+	awsConf.WithHTTPClient(&http.Client{
+		Timeout:   s3HTTPTimeout,
+		Transport: http.DefaultTransport,
+	})
+	sess, err := session.NewSession(awsConf)
+	if err != nil {
+		return nil, errors.Wrapf(err,
+			"failed to create session for s3 (%s,%s)",
+			config.Config.S3Region,
+			config.Config.S3Endpoint,
+		)
+	}
+	return &S3{svc: gos3.New(sess), bucket: bucket, prefix: prefix}, nil
+}
+
+func (s *S3) key(key string) string {
+	return path.Join(s.prefix, key)
+}
+
+// Ping checks the bucket exists.
+func (s *S3) Ping() error {
+	_, err := s.svc.HeadBucket(&gos3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	if err != nil {
+		return errors.Wrapf(err, "failed to ping s3 bucket %s", s.bucket)
+	}
+	return nil
+}
+
+// Put puts the object.
+func (s *S3) Put(key string, body []byte) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	_, err := s.svc.PutObject(&gos3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+		Body:   bytes.NewReader(body),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to put s3 object %s", key)
+	}
+	return nil
+}
+
+// Get gets the whole object.
+func (s *S3) Get(key string) ([]byte, error) {
+	return s.get(key, nil)
+}
+
+// GetRange gets the length bytes of the object from the offset.
+func (s *S3) GetRange(key string, offset, length int64) ([]byte, error) {
+	body, err := s.get(key, aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) != length {
+		return nil, errors.Errorf("range %d-%d is out of %s", offset, offset+length, key)
+	}
+	return body, nil
+}
+
+func (s *S3) get(key string, rng *string) ([]byte, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+	resp, err := s.svc.GetObject(&gos3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+		Range:  rng,
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == gos3.ErrCodeNoSuchKey {
+			return nil, errors.Wrapf(ErrNotFound, "failed to get s3 object %s", key)
+		}
+		return nil, errors.Wrapf(err, "failed to get s3 object %s", key)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read s3 object %s", key)
+	}
+	return body, nil
+}
+
+// List returns the keys starting with the prefix in the lexical order.
+func (s *S3) List(prefix string) ([]string, error) {
+	// Not joined by path.Join, which drops the trailing slash of the prefix.
+	full := prefix
+	if s.prefix != "" {
+		full = s.prefix + "/" + prefix
+	}
+	var keys []string
+	err := s.svc.ListObjectsV2Pages(&gos3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(full),
+	}, func(out *gos3.ListObjectsV2Output, last bool) bool {
+		for _, obj := range out.Contents {
+			key := aws.StringValue(obj.Key)
+			if s.prefix != "" {
+				key = key[len(s.prefix)+1:]
+			}
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list s3 objects %s", prefix)
+	}
+	return keys, nil
+}
+
+// Delete deletes the object. Deleting the missing object succeeds as S3 does.
+func (s *S3) Delete(key string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	_, err := s.svc.DeleteObject(&gos3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete s3 object %s", key)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package objstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	gos3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/pkg/errors"
+)
+
+func TestS3(t *testing.T) {
+	objects := map[string][]byte{}
+	var ranges []string
+	fake := &FakeS3API{
+		FakePutObject: func(in *gos3.PutObjectInput) (*gos3.PutObjectOutput, error) {
+			body, _ := ioutil.ReadAll(in.Body)
+			objects[aws.StringValue(in.Bucket)+"/"+aws.StringValue(in.Key)] = body
+			return &gos3.PutObjectOutput{}, nil
+		},
+		FakeGetObject: func(in *gos3.GetObjectInput) (*gos3.GetObjectOutput, error) {
+			body, ok := objects[aws.StringValue(in.Bucket)+"/"+aws.StringValue(in.Key)]
+			if !ok {
+				return nil, awserr.New(gos3.ErrCodeNoSuchKey, "not found", nil)
+			}
+			if in.Range != nil {
+				ranges = append(ranges, aws.StringValue(in.Range))
+				body = body[3:7]
+			}
+			return &gos3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+		},
+		FakeListObjectsV2Pages: func(in *gos3.ListObjectsV2Input, fn func(*gos3.ListObjectsV2Output, bool) bool) error {
+			if aws.StringValue(in.Prefix) != "diamondb/60/" {
+				t.Fatalf("prefix should be diamondb/60/, not %s", aws.StringValue(in.Prefix))
+			}
+			fn(&gos3.ListObjectsV2Output{Contents: []*gos3.Object{{Key: aws.String("diamondb/60/0/a.data")}}}, false)
+			fn(&gos3.ListObjectsV2Output{Contents: []*gos3.Object{{Key: aws.String("diamondb/60/0/a.index")}}}, true)
+			return nil
+		},
+		FakeDeleteObject: func(in *gos3.DeleteObjectInput) (*gos3.DeleteObjectOutput, error) {
+			delete(objects, aws.StringValue(in.Bucket)+"/"+aws.StringValue(in.Key))
+			return &gos3.DeleteObjectOutput{}, nil
+		},
+	}
+	s := NewTestS3(fake, "bucket", "diamondb")
+
+	if err := s.Put("60/0/a.data", []byte("0123456789")); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if _, ok := objects["bucket/diamondb/60/0/a.data"]; !ok {
+		t.Fatalf("the object should be put under the prefix: %v", objects)
+	}
+	body, err := s.Get("60/0/a.data")
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if string(body) != "0123456789" {
+		t.Fatalf("Get should return 0123456789, not %s", body)
+	}
+	body, err = s.GetRange("60/0/a.data", 3, 4)
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if string(body) != "3456" || ranges[0] != "bytes=3-6" {
+		t.Fatalf("GetRange should return 3456 by bytes=3-6, not %s by %s", body, ranges[0])
+	}
+	if _, err := s.Get("60/0/z.data"); errors.Cause(err) != ErrNotFound {
+		t.Fatalf("Get of the missing object should raise ErrNotFound, not %v", err)
+	}
+	keys, err := s.List("60/")
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if diff := pretty.Compare(keys, []string{"60/0/a.data", "60/0/a.index"}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	if err := s.Delete("60/0/a.data"); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if _, ok := objects["bucket/diamondb/60/0/a.data"]; ok {
+		t.Fatalf("the object should be deleted: %v", objects)
+	}
+}
@@ -0,0 +1,36 @@
+package objstore
+
+import (
+	gos3 "github.com/aws/aws-sdk-go/service/s3"
+	gos3iface "github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// FakeS3API is for stub testing
+type FakeS3API struct {
+	gos3iface.S3API
+	FakePutObject          func(*gos3.PutObjectInput) (*gos3.PutObjectOutput, error)
+	FakeGetObject          func(*gos3.GetObjectInput) (*gos3.GetObjectOutput, error)
+	FakeListObjectsV2Pages func(*gos3.ListObjectsV2Input, func(*gos3.ListObjectsV2Output, bool) bool) error
+	FakeDeleteObject       func(*gos3.DeleteObjectInput) (*gos3.DeleteObjectOutput, error)
+}
+
+func (s *FakeS3API) PutObject(in *gos3.PutObjectInput) (*gos3.PutObjectOutput, error) {
+	return s.FakePutObject(in)
+}
+
+func (s *FakeS3API) GetObject(in *gos3.GetObjectInput) (*gos3.GetObjectOutput, error) {
+	return s.FakeGetObject(in)
+}
+
+func (s *FakeS3API) ListObjectsV2Pages(in *gos3.ListObjectsV2Input, fn func(*gos3.ListObjectsV2Output, bool) bool) error {
+	return s.FakeListObjectsV2Pages(in, fn)
+}
+
+func (s *FakeS3API) DeleteObject(in *gos3.DeleteObjectInput) (*gos3.DeleteObjectOutput, error) {
+	return s.FakeDeleteObject(in)
+}
+
+// NewTestS3 creates a S3 with the fake client.
+func NewTestS3(svc gos3iface.S3API, bucket, prefix string) *S3 {
+	return &S3{svc: svc, bucket: bucket, prefix: prefix}
+}
@@ -0,0 +1,334 @@
+package redis
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/config"
+	"github.com/yuuki/diamondb/pkg/model"
+)
+
+// The blob encoding buffers a series into a string appended with the records
+// of the datapoints instead of a hash field per datapoint. A record is the kind
+// byte followed by the timestamp and the values as big-endian float64, which
+// keep the bits of the values as they are and take 17 bytes of a raw datapoint
+// and 57 bytes of a rolled up one. The timestamp and the count are float64 to
+// be read by the Lua scripts, whose numbers are float64.
+//
+// The records of the same timestamp are resolved in the order of the blob as
+// the hash fields are: the rolled up records are merged into the rolled up
+// record before them and the others overwrite it.
+const (
+	blobRaw      byte = 0
+	blobRolledUp byte = 1
+
+	blobRawSize      = 17
+	blobRolledUpSize = 57
+)
+
+// blobEnabled returns whether the datapoints are written in the blob encoding.
+func blobEnabled() bool {
+	return config.Config.RedisBufferEncoding == "blob"
+}
+
+// isWrongType returns whether err is the reply to the command against the key
+// buffered in the other encoding.
+func isWrongType(err error) bool {
+	return err != nil && strings.HasPrefix(errors.Cause(err).Error(), "WRONGTYPE")
+}
+
+// encodeBlob encodes the datapoints into the records in the order of the
+// timestamps.
+func encodeBlob(tv map[int64]*model.Aggregate) []byte {
+	ts := make([]int64, 0, len(tv))
+	for t := range tv {
+		ts = append(ts, t)
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i] < ts[j] })
+	b := make([]byte, 0, len(tv)*blobRawSize)
+	for _, t := range ts {
+		b = appendRecord(b, t, tv[t])
+	}
+	return b
+}
+
+func appendRecord(b []byte, t int64, a *model.Aggregate) []byte {
+	if a.IsRaw() {
+		b = append(b, blobRaw)
+		b = appendFloat(b, float64(t))
+		return appendFloat(b, a.Value)
+	}
+	b = append(b, blobRolledUp)
+	for _, f := range []float64{
+		float64(t), a.Min, a.Max, a.Sum, float64(a.Count), a.Last, float64(a.LastTimestamp),
+	} {
+		b = appendFloat(b, f)
+	}
+	return b
+}
+
+func appendFloat(b []byte, f float64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], math.Float64bits(f))
+	return append(b, buf[:]...)
+}
+
+func readFloat(b []byte) float64 {
+	return math.Float64frombits(binary.BigEndian.Uint64(b))
+}
+
+// decodeBlob decodes the records into the datapoints. The Value of a rolled up
+// aggregate is left to finalize.
+func decodeBlob(b []byte) (map[int64]*model.Aggregate, error) {
+	tv := map[int64]*model.Aggregate{}
+	for len(b) > 0 {
+		var size int
+		switch b[0] {
+		case blobRaw:
+			size = blobRawSize
+		case blobRolledUp:
+			size = blobRolledUpSize
+		default:
+			return nil, errors.Errorf("unknown kind of record %d", b[0])
+		}
+		if len(b) < size {
+			return nil, errors.Errorf("truncated record of %d bytes", len(b))
+		}
+		t := int64(readFloat(b[1:]))
+		var a *model.Aggregate
+		if b[0] == blobRaw {
+			a = model.NewAggregate(t, readFloat(b[9:]))
+		} else {
+			a = &model.Aggregate{
+				Min:           readFloat(b[9:]),
+				Max:           readFloat(b[17:]),
+				Sum:           readFloat(b[25:]),
+				Count:         int64(readFloat(b[33:])),
+				Last:          readFloat(b[41:]),
+				LastTimestamp: int64(readFloat(b[49:])),
+				RolledUp:      true,
+			}
+		}
+		if old, ok := tv[t]; ok && !old.IsRaw() && !a.IsRaw() {
+			old.Merge(a)
+		} else {
+			tv[t] = a
+		}
+		b = b[size:]
+	}
+	return tv, nil
+}
+
+// bufferLua defines the functions to read and write the records of the key in
+// the hash and the blob encodings. The key is converted into the encoding of
+// the writer before being written, so the keys written by the nodes of the
+// other encoding are migrated on the next write. It requires putAggregateLua.
+const bufferLua = `
+local rawFormat, rolledUpFormat = '>Bdd', '>Bddddddd'
+local minRecordSize = 17
+local compactSize = 4096
+
+local function eachRecord(blob, fn)
+  local pos = 1
+  while pos <= #blob do
+    local kind, t = struct.unpack('>Bd', blob, pos)
+    local size = 17
+    if kind ~= 0 then
+      size = 57
+    end
+    fn(t, string.sub(blob, pos, pos + size - 1))
+    pos = pos + size
+  end
+end
+
+local function mergeRecords(a, b)
+  if string.byte(a, 1) == 0 or string.byte(b, 1) == 0 then
+    return b
+  end
+  local _, t, min1, max1, sum1, count1, last1, lastTimestamp1 = struct.unpack(rolledUpFormat, a)
+  local _, _, min2, max2, sum2, count2, last2, lastTimestamp2 = struct.unpack(rolledUpFormat, b)
+  local last, lastTimestamp = last1, lastTimestamp1
+  if lastTimestamp2 >= lastTimestamp1 then
+    last, lastTimestamp = last2, lastTimestamp2
+  end
+  return struct.pack(rolledUpFormat, 1, t,
+    math.min(min1, min2), math.max(max1, max2), sum1 + sum2, count1 + count2, last, lastTimestamp)
+end
+
+-- compactBlob merges the records of the same timestamp, and returns the blob of
+-- a record per timestamp and the number of the timestamps.
+local function compactBlob(blob)
+  local order, records = {}, {}
+  eachRecord(blob, function(t, record)
+    if records[t] then
+      records[t] = mergeRecords(records[t], record)
+    else
+      order[#order+1] = t
+      records[t] = record
+    end
+  end)
+  local out = {}
+  for i, t in ipairs(order) do
+    out[i] = records[t]
+  end
+  return table.concat(out), #order
+end
+
+-- rollupRecords rolls up the records of distinct timestamps into the rolled up
+-- records of the timestamps aligned by step. The records are merged in the
+-- order of the timestamps as Store did before rolling up in the scripts.
+local function rollupRecords(blob, step)
+  local ts, records = {}, {}
+  eachRecord(blob, function(t, record)
+    ts[#ts+1] = t
+    records[t] = record
+  end)
+  table.sort(ts)
+  local order, rolled = {}, {}
+  for _, t in ipairs(ts) do
+    local aligned = t - t % step
+    local record = records[t]
+    if string.byte(record, 1) == 0 then
+      local _, _, v = struct.unpack(rawFormat, record)
+      record = struct.pack(rolledUpFormat, 1, aligned, v, v, v, 1, v, t)
+    else
+      record = struct.pack('>Bd', 1, aligned) .. string.sub(record, 10)
+    end
+    if rolled[aligned] then
+      rolled[aligned] = mergeRecords(rolled[aligned], record)
+    else
+      order[#order+1] = aligned
+      rolled[aligned] = record
+    end
+  end
+  local out = {}
+  for i, t in ipairs(order) do
+    out[i] = rolled[t]
+  end
+  return table.concat(out)
+end
+
+local function hashValueToRecord(field, value)
+  local t = tonumber(field)
+  if not string.find(value, ':', 1, true) then
+    return struct.pack(rawFormat, 0, t, tonumber(value))
+  end
+  local x = {}
+  for f in string.gmatch(value, '[^:]+') do x[#x+1] = tonumber(f) end
+  return struct.pack(rolledUpFormat, 1, t, x[1], x[2], x[3], x[4], x[5], x[6])
+end
+
+local function recordToHashValue(record)
+  if string.byte(record, 1) == 0 then
+    local _, _, v = struct.unpack(rawFormat, record)
+    return string.format('%.17g', v)
+  end
+  local _, _, min, max, sum, count, last, lastTimestamp = struct.unpack(rolledUpFormat, record)
+  return string.format('%.17g:%.17g:%.17g:%d:%.17g:%d', min, max, sum, count, last, lastTimestamp)
+end
+
+-- readRecords returns the records of the key in either encoding.
+local function readRecords(key)
+  if redis.call('TYPE', key).ok ~= 'hash' then
+    return redis.call('GET', key) or ''
+  end
+  local points = redis.call('HGETALL', key)
+  local records = {}
+  for i = 1, #points, 2 do
+    records[#records+1] = hashValueToRecord(points[i], points[i+1])
+  end
+  return table.concat(records)
+end
+
+local function toBlob(key)
+  if redis.call('TYPE', key).ok ~= 'hash' then
+    return
+  end
+  local blob = readRecords(key)
+  redis.call('DEL', key)
+  redis.call('SET', key, blob)
+end
+
+local function toHash(key)
+  if redis.call('TYPE', key).ok ~= 'string' then
+    return
+  end
+  local blob = redis.call('GET', key)
+  redis.call('DEL', key)
+  eachRecord(blob, function(t, record)
+    putAggregate(key, string.format('%d', t), recordToHashValue(record), false)
+  end)
+end
+
+-- putHash puts the records into the hash, and takes all the records out of it
+-- if the number of them reaches the threshold, which is negative not to take
+-- them out.
+local function putHash(key, records, threshold)
+  toHash(key)
+  eachRecord(records, function(t, record)
+    putAggregate(key, string.format('%d', t), recordToHashValue(record), false)
+  end)
+  if threshold < 0 or redis.call('HLEN', key) < threshold then
+    return nil
+  end
+  local blob = readRecords(key)
+  redis.call('DEL', key)
+  return blob
+end
+
+-- putBlob is putHash of the blob encoding. The blob is compacted to count the
+-- timestamps only if it is large enough to reach the threshold. The blob never
+-- taken out is compacted every compactSize bytes appended instead, so the
+-- records of the same timestamps don't pile up.
+local function putBlob(key, records, threshold)
+  toBlob(key)
+  local size
+  if #records > 0 then
+    size = redis.call('APPEND', key, records)
+  else
+    size = redis.call('STRLEN', key)
+  end
+  if size == 0 then
+    return nil
+  end
+  if threshold < 0 then
+    if math.floor((size - #records) / compactSize) < math.floor(size / compactSize) then
+      redis.call('SET', key, (compactBlob(redis.call('GET', key))))
+    end
+    return nil
+  end
+  if size < threshold * minRecordSize then
+    return nil
+  end
+  local blob, n = compactBlob(redis.call('GET', key))
+  if n < threshold then
+    redis.call('SET', key, blob)
+    return nil
+  end
+  redis.call('DEL', key)
+  return blob
+end
+
+-- readIdle returns the records of the key compacted if it has no record at or
+-- after the cutoff, or nil.
+local function readIdle(key, cutoff)
+  local blob = readRecords(key)
+  if #blob == 0 then
+    return nil
+  end
+  local idle = true
+  eachRecord(blob, function(t)
+    if t >= cutoff then
+      idle = false
+    end
+  end)
+  if not idle then
+    return nil
+  end
+  return (compactBlob(blob))
+end
+`
@@ -0,0 +1,94 @@
+package redis
+
+import (
+	"math"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
+)
+
+func TestEncodeBlob(t *testing.T) {
+	tv := map[int64]*model.Aggregate{
+		120: model.NewAggregate(120, 1.2345678901234567e-300),
+		60:  model.NewAggregate(60, math.Inf(-1)),
+		0: {
+			Min: -0.5, Max: math.MaxFloat64, Sum: 1e20, Count: 3, Last: 0.1, LastTimestamp: 50, RolledUp: true,
+		},
+	}
+	b := encodeBlob(tv)
+	if len(b) != 2*blobRawSize+blobRolledUpSize {
+		t.Fatalf("the blob should be %d bytes, not %d", 2*blobRawSize+blobRolledUpSize, len(b))
+	}
+	got, err := decodeBlob(b)
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if diff := pretty.Compare(got, tv); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestDecodeBlob_Appended(t *testing.T) {
+	var b []byte
+	b = append(b, encodeBlob(map[int64]*model.Aggregate{
+		0:  {Min: 1, Max: 2, Sum: 3, Count: 2, Last: 2, LastTimestamp: 30, RolledUp: true},
+		60: model.NewAggregate(60, 1.0),
+	})...)
+	b = append(b, encodeBlob(map[int64]*model.Aggregate{
+		0:  {Min: 0.5, Max: 1, Sum: 1.5, Count: 2, Last: 1, LastTimestamp: 20, RolledUp: true},
+		60: model.NewAggregate(60, 2.0),
+	})...)
+	got, err := decodeBlob(b)
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	// The rolled up records are merged and the raw record is overwritten.
+	expected := map[int64]*model.Aggregate{
+		0:  {Min: 0.5, Max: 2, Sum: 4.5, Count: 4, Last: 2, LastTimestamp: 30, RolledUp: true},
+		60: model.NewAggregate(60, 2.0),
+	}
+	if diff := pretty.Compare(got, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestDecodeBlob_Invalid(t *testing.T) {
+	b := encodeBlob(map[int64]*model.Aggregate{60: model.NewAggregate(60, 1.0)})
+	for _, blob := range [][]byte{b[:len(b)-1], append([]byte{2}, b[1:]...)} {
+		if _, err := decodeBlob(blob); err == nil {
+			t.Fatalf("decodeBlob(%v) should raise error", blob)
+		}
+	}
+}
+
+func TestDecodeClaims(t *testing.T) {
+	rs := schema.Default.Retentions
+	fine := map[int64]*model.Aggregate{
+		60:  model.NewAggregate(60, 0.1),
+		120: model.NewAggregate(120, 0.2),
+	}
+	coarse := map[int64]*model.Aggregate{
+		0: {Min: 0.1, Max: 0.2, Sum: 0.3, Count: 2, Last: 0.2, LastTimestamp: 120, RolledUp: true},
+	}
+	ret := []interface{}{string(encodeBlob(fine)), string(encodeBlob(coarse))}
+	got, err := decodeClaims(rs, "100:1", ret)
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	expected := []*Claim{
+		{Slot: rs[0].Slot, ID: "100:1", Points: fine},
+		{Slot: rs[1].Slot, ID: "100:1", Points: coarse},
+	}
+	if diff := pretty.Compare(got, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	if got, err := decodeClaims(rs, "100:1", []interface{}{}); err != nil || len(got) != 0 {
+		t.Fatalf("decodeClaims of the empty reply should be empty, not %v, %v", got, err)
+	}
+	if _, err := decodeClaims(rs[:1], "100:1", ret); err == nil {
+		t.Fatalf("decodeClaims of more claims than the slots should raise error")
+	}
+}
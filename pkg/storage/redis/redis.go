@@ -2,8 +2,11 @@ package redis
 
 import (
 	"fmt"
+	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -11,15 +14,17 @@ import (
 
 	"github.com/yuuki/diamondb/pkg/config"
 	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
 	"github.com/yuuki/diamondb/pkg/storage/util"
+	"github.com/yuuki/diamondb/pkg/timeparser"
 )
 
 const (
-	oneYear time.Duration = time.Duration(24*360) * time.Hour
-	oneWeek time.Duration = time.Duration(24*7) * time.Hour
-	oneDay  time.Duration = time.Duration(24*1) * time.Hour
-
 	redisBatchLimit = 50 // TODO need to tweak
+	redisScanCount  = 1000
+
+	pendingPrefix = "diamondb:pending:"
+	rolledPrefix  = "diamondb:rolled:"
 )
 
 // ReadWriter defines the interface for Redis reader and writer.
@@ -27,23 +32,184 @@ type ReadWriter interface {
 	api() redisAPI
 	Ping() error
 	Fetch(string, time.Time, time.Time) (model.SeriesMap, error)
+	FetchRetention([]string, *schema.Retention, time.Time, time.Time) (model.SeriesMap, error)
 	batchGet(q *query) (model.SeriesMap, error)
 	Get(string, string) (map[int64]float64, error)
 	Len(string, string) (int64, error)
 	Put(string, string, *model.Datapoint) error
 	MPut(string, string, map[int64]float64) error
+	PutAndRollup([]*schema.Retention, string, map[int64]*model.Aggregate, time.Time) ([]*Claim, error)
+	ClaimIdle([]*schema.Retention, string, int64, time.Time) ([]*Claim, error)
+	ClaimPending(string, string, time.Time) ([]*Claim, error)
+	Ack(string, string, string) error
+	Names(string) ([]string, error)
+	MarkFlushed(string, string, int64, time.Duration) error
+	Flushed(string, []string) (map[string]int64, error)
+	AcquireLock(string, string, time.Duration) (bool, error)
+	ReleaseLock(string, string) error
 	Delete(string, string) error
 }
 
 type redisAPI interface {
 	Ping() *goredis.StatusCmd
 	Del(key ...string) *goredis.IntCmd
+	Get(key string) *goredis.StringCmd
+	Append(key, value string) *goredis.IntCmd
 	HGetAll(key string) *goredis.StringStringMapCmd
+	HDel(key string, fields ...string) *goredis.IntCmd
 	HSet(key, field string, value interface{}) *goredis.BoolCmd
+	HMGet(key string, fields ...string) *goredis.SliceCmd
 	HMSet(key string, fields map[string]string) *goredis.StatusCmd
 	HLen(key string) *goredis.IntCmd
+	Scan(cursor uint64, match string, count int64) *goredis.ScanCmd
+	SetNX(key string, value interface{}, expiration time.Duration) *goredis.BoolCmd
+	Eval(script string, keys []string, args ...interface{}) *goredis.Cmd
+	EvalSha(sha1 string, keys []string, args ...interface{}) *goredis.Cmd
+	ScriptExists(scripts ...string) *goredis.BoolSliceCmd
+	ScriptLoad(script string) *goredis.StringCmd
+	Pipelined(fn func(*goredis.Pipeline) error) ([]goredis.Cmder, error)
+	TxPipeline() *goredis.Pipeline
 }
 
+// putAggregateLua defines putAggregate, which puts the value encoded by
+// encodeAggregate into the field of the hash. The rolled up values containing
+// ':' are merged into the rolled up value of the same field, and the other
+// values overwrite it unless nx is true. The floats are formatted with 17
+// significant digits not to lose their precision.
+const putAggregateLua = `
+local function mergeAggregates(a, b)
+  local x, y = {}, {}
+  for f in string.gmatch(a, '[^:]+') do x[#x+1] = tonumber(f) end
+  for f in string.gmatch(b, '[^:]+') do y[#y+1] = tonumber(f) end
+  local last, lastTimestamp = x[5], x[6]
+  if y[6] >= x[6] then
+    last, lastTimestamp = y[5], y[6]
+  end
+  return string.format('%.17g:%.17g:%.17g:%d:%.17g:%d',
+    math.min(x[1], y[1]), math.max(x[2], y[2]), x[3] + y[3], x[4] + y[4], last, lastTimestamp)
+end
+
+local function putAggregate(key, field, value, nx)
+  local old = redis.call('HGET', key, field)
+  if old and string.find(old, ':', 1, true) and string.find(value, ':', 1, true) then
+    value = mergeAggregates(old, value)
+  elseif old and nx then
+    return
+  end
+  redis.call('HSET', key, field, value)
+end
+`
+
+// newBufferScript creates the script writing the buffer of a series with the
+// functions of putAggregateLua and bufferLua.
+func newBufferScript(body string) *goredis.Script {
+	return goredis.NewScript(putAggregateLua + bufferLua + body)
+}
+
+// putAndRollupScript puts the records of the datapoints into the buffer of a
+// series in the first slot, and rolls up the records taken out of each slot
+// into the next one until a slot keeps them. The records taken out of a slot
+// are kept in the field ARGV[1] of its pending hash until they are acknowledged
+// to be flushed, so they are never lost even if the flush fails or the writer
+// crashes. KEYS are the triples of the buffer key, the pending key and the
+// rolled key of the slots, which have the name of the series as the hash tag,
+// so the script runs on the node of the series on Redis Cluster.
+//
+// The rolled key is the set of the digests of the records rolled up into the
+// slot, which expires in ARGV[6] seconds if it is positive. The same records
+// taken out again, such as the batch delivered again or the legacy key adopted
+// again after a crash, are not rolled up twice, while the distinct records are
+// rolled up even if their aggregates look alike.
+//
+// ARGV[2] is the mode of the first slot: 'put' puts the records ARGV[5] into
+// it, 'idle' takes out its records only if they are older than the cutoff
+// ARGV[3], and 'adopt' takes ARGV[5] as the records taken out of it. ARGV[4] is
+// the encoding of the buffers, and ARGV[7:] are the pairs of the threshold and
+// the step of the slots. The threshold is negative not to take out the records.
+// It replies the records taken out of the slots in the order of the slots.
+var putAndRollupScript = newBufferScript(`
+local id, mode, cutoff, blobEncoding, records = ARGV[1], ARGV[2], tonumber(ARGV[3]), ARGV[4] == 'blob', ARGV[5]
+local rolledTTL = tonumber(ARGV[6])
+local claims = {}
+for j = 1, #KEYS / 3 do
+  local key, pending, rolled = KEYS[3*j-2], KEYS[3*j-1], KEYS[3*j]
+  local threshold, step = tonumber(ARGV[5+2*j]), tonumber(ARGV[6+2*j])
+  local claimed
+  if j == 1 and mode == 'adopt' then
+    claimed = records
+  elseif j == 1 and mode == 'idle' then
+    claimed = readIdle(key, cutoff)
+    if claimed then
+      redis.call('DEL', key)
+    end
+  else
+    if j > 1 then
+      records = rollupRecords(records, step)
+      if redis.call('SADD', rolled, redis.sha1hex(records)) == 0 then
+        break
+      end
+      if rolledTTL > 0 then
+        redis.call('EXPIRE', rolled, rolledTTL)
+      end
+    end
+    if blobEncoding then
+      claimed = putBlob(key, records, threshold)
+    else
+      claimed = putHash(key, records, threshold)
+    end
+  end
+  if not claimed or #claimed == 0 then
+    break
+  end
+  redis.call('HSET', pending, id, claimed)
+  claims[#claims+1] = claimed
+  records = claimed
+end
+return claims
+`)
+
+// readIdleScript replies the records of the key compacted if they are older than
+// ARGV[1], or the empty string.
+var readIdleScript = newBufferScript(`
+return readIdle(KEYS[1], tonumber(ARGV[1])) or ''
+`)
+
+// deleteUnchangedScript deletes the key if its records compacted are still ARGV[1].
+var deleteUnchangedScript = newBufferScript(`
+if (compactBlob(readRecords(KEYS[1]))) ~= ARGV[1] then
+  return 0
+end
+return redis.call('DEL', KEYS[1])
+`)
+
+// markFlushedScript sets the key to the timestamp ARGV[1] unless it is already
+// newer, and expires it after ARGV[2] seconds.
+var markFlushedScript = goredis.NewScript(`
+local old = redis.call('GET', KEYS[1])
+if old and tonumber(old) >= tonumber(ARGV[1]) then
+  redis.call('EXPIRE', KEYS[1], ARGV[2])
+  return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'EX', ARGV[2])
+return 1
+`)
+
+// renewLockScript extends the expiration of the lock if it is held by ARGV[1].
+var renewLockScript = goredis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseLockScript deletes the lock if it is held by ARGV[1].
+var releaseLockScript = goredis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
 // Redis provides a redis client.
 type Redis struct {
 	client redisAPI
@@ -100,31 +266,51 @@ func (r *Redis) Ping() error {
 	return nil
 }
 
-// Fetch fetches datapoints by name from start until end.
+// Fetch fetches datapoints by name from start until end. The slot is selected
+// by the schema matching each name.
 func (r *Redis) Fetch(name string, start, end time.Time) (model.SeriesMap, error) {
-	slot, step := selectTimeSlot(start, end)
-	nameGroups := util.GroupNames(util.SplitName(name), redisBatchLimit)
-
-	type result struct {
-		value model.SeriesMap
-		err   error
+	var qs []*query
+	for sch, names := range config.Config.StorageSchemas.GroupNames(util.SplitName(name)) {
+		slot, step := selectTimeSlot(sch, start, end)
+		qs = append(qs, newQueries(names, slot, step, start, end)...)
 	}
-	c := make(chan *result, len(nameGroups))
-	for _, names := range nameGroups {
-		q := &query{
+	return r.fetchQueries(qs)
+}
+
+// FetchRetention fetches datapoints by names from start until end in the slot
+// of the retention.
+func (r *Redis) FetchRetention(names []string, rt *schema.Retention, start, end time.Time) (model.SeriesMap, error) {
+	return r.fetchQueries(newQueries(names, rt.Slot, int(rt.Step), start, end))
+}
+
+func newQueries(names []string, slot string, step int, start, end time.Time) []*query {
+	var qs []*query
+	for _, names := range util.GroupNames(names, redisBatchLimit) {
+		qs = append(qs, &query{
 			names: names,
 			slot:  slot,
 			start: start,
 			end:   end,
 			step:  step,
-		}
+		})
+	}
+	return qs
+}
+
+func (r *Redis) fetchQueries(qs []*query) (model.SeriesMap, error) {
+	type result struct {
+		value model.SeriesMap
+		err   error
+	}
+	c := make(chan *result, len(qs))
+	for _, q := range qs {
 		go func(q *query) {
 			sm, err := r.batchGet(q)
 			c <- &result{value: sm, err: err}
 		}(q)
 	}
-	sm := make(model.SeriesMap, len(nameGroups))
-	for i := 0; i < len(nameGroups); i++ {
+	sm := make(model.SeriesMap, len(qs))
+	for i := 0; i < len(qs); i++ {
 		ret := <-c
 		if ret.err != nil {
 			return nil, errors.WithStack(ret.err)
@@ -134,130 +320,623 @@ func (r *Redis) Fetch(name string, start, end time.Time) (model.SeriesMap, error
 	return sm, nil
 }
 
-func hGetAllToMap(name string, tsval map[string]string, q *query) (*model.SeriesPoint, error) {
-	points := make(model.DataPoints, 0, len(tsval))
-	for ts, val := range tsval {
-		t, err := strconv.ParseInt(ts, 10, 64)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to parse timestamp %s", ts)
-		}
-		v, err := strconv.ParseFloat(val, 64)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to parse float value %s", val)
-		}
+// toSeriesPoint converts the datapoints buffered into the series within the
+// range of the query.
+func toSeriesPoint(name string, tv map[int64]*model.Aggregate, q *query) *model.SeriesPoint {
+	points := make(model.DataPoints, 0, len(tv))
+	for t, a := range tv {
 		// Trim datapoints out of [start, end]
 		if t < q.start.Unix() || q.end.Unix() < t {
 			continue
 		}
-		points = append(points, model.NewDataPoint(t, v))
+		util.Finalize(name, int64(q.step), a)
+		points = append(points, model.NewAggregatedDataPoint(t, a))
 	}
-	return model.NewSeriesPoint(name, points, q.step), nil
+	return model.NewSeriesPoint(name, points, q.step)
 }
 
 func (r *Redis) batchGet(q *query) (model.SeriesMap, error) {
+	buffers, err := r.getBuffers(q.slot, q.names)
+	if err != nil {
+		return nil, errors.Wrapf(err,
+			"failed to get api %s", strings.Join(q.names, ","),
+		)
+	}
 	sm := make(model.SeriesMap, len(q.names))
-	for _, name := range q.names {
-		key := fmt.Sprintf("%s:%s", q.slot, name)
-		tsval, err := r.client.HGetAll(key).Result()
-		if err != nil {
-			return nil, errors.Wrapf(err,
-				"failed to hgetall api %s", strings.Join(q.names, ","),
-			)
-		}
-		if len(tsval) < 1 {
+	for name, tv := range buffers {
+		if len(tv) < 1 {
 			continue
 		}
-		sp, err := hGetAllToMap(name, tsval, q)
-		if err != nil {
-			return nil, errors.WithStack(err)
-		}
-		sm[name] = sp
+		sm[name] = toSeriesPoint(name, tv, q)
 	}
 	return sm, nil
 }
 
-// Get gets datapoints from redis by slot and series name.
-func (r *Redis) Get(slot string, name string) (map[int64]float64, error) {
-	key := slot + ":" + name
-	tsval, err := r.client.HGetAll(key).Result()
+// bufferKey returns the key buffering the datapoints of the series in the slot.
+// The name is the hash tag of the keys of a series, so they are in the same
+// hash slot of Redis Cluster to be written by a script.
+func bufferKey(slot string, name string) string {
+	return slot + ":{" + name + "}"
+}
+
+// pendingKey returns the key of the hash of the datapoints taken out of the
+// buffer of the series in the slot, which are not acknowledged to be flushed.
+func pendingKey(slot string, name string) string {
+	return pendingPrefix + slot + ":{" + name + "}"
+}
+
+// rolledKey returns the key of the set of the digests of the records rolled up
+// into the buffer of the series in the slot.
+func rolledKey(slot string, name string) string {
+	return rolledPrefix + slot + ":{" + name + "}"
+}
+
+// legacyKey returns the key buffering the datapoints of the series written
+// before the keys have the hash tag. It is read until the idle sweep adopts it.
+func legacyKey(slot string, name string) string {
+	return slot + ":" + name
+}
+
+// nameOfKey returns the name of the series of the key with the prefix in either
+// the hash tagged or the legacy form.
+func nameOfKey(key string, prefix string) string {
+	name := strings.TrimPrefix(key, prefix)
+	if strings.HasPrefix(name, "{") && strings.HasSuffix(name, "}") {
+		return name[1 : len(name)-1]
+	}
+	return name
+}
+
+// bufferCmds is the commands reading the buffers of a series. Both the hash and
+// the blob of a key are read, and the one of the other encoding fails.
+type bufferCmds struct {
+	hashes  []*goredis.StringStringMapCmd
+	blobs   []*goredis.StringCmd
+	pending *goredis.StringStringMapCmd
+}
+
+// getBuffers gets the datapoints of the series buffered in the slot in either
+// the hash or the blob encoding, and merges them in the order they are written.
+// The buffer key and the pending hash of a series share the hash tag, so they
+// are read in a transaction, and the datapoints taken out of the buffer into the
+// pending hash are never missed. The legacy key is in another hash slot on Redis
+// Cluster, which is read in another transaction, so the datapoints of the legacy
+// key may be missed while the idle sweep adopts it into the pending hash.
+func (r *Redis) getBuffers(slot string, names []string) (map[string]map[int64]*model.Aggregate, error) {
+	pipe := r.client.TxPipeline()
+	defer pipe.Close()
+	cmds := make([]*bufferCmds, len(names))
+	for i, name := range names {
+		c := &bufferCmds{}
+		for _, key := range []string{legacyKey(slot, name), bufferKey(slot, name)} {
+			c.hashes = append(c.hashes, pipe.HGetAll(key))
+			c.blobs = append(c.blobs, pipe.Get(key))
+		}
+		c.pending = pipe.HGetAll(pendingKey(slot, name))
+		cmds[i] = c
+	}
+	if _, err := pipe.Exec(); err != nil && err != goredis.Nil && !isWrongType(err) {
+		return nil, errors.Wrapf(err, "failed to get buffers (%s) from redis", slot)
+	}
+
+	buffers := make(map[string]map[int64]*model.Aggregate, len(names))
+	for i, c := range cmds {
+		tv := map[int64]*model.Aggregate{}
+		for k := range c.hashes {
+			if k == 1 {
+				if err := mergePending(tv, c.pending); err != nil {
+					return nil, err
+				}
+			}
+			buffered, err := decodeBuffer(c.hashes[k], c.blobs[k])
+			if err != nil {
+				return nil, err
+			}
+			mergeBuffer(tv, buffered)
+		}
+		buffers[names[i]] = tv
+	}
+	return buffers, nil
+}
+
+// decodeBuffer decodes the datapoints of the key read by either of the commands.
+func decodeBuffer(hash *goredis.StringStringMapCmd, blob *goredis.StringCmd) (map[int64]*model.Aggregate, error) {
+	tsval, err := hash.Result()
+	if err == nil {
+		return decodeHash(tsval)
+	}
+	if !isWrongType(err) {
+		return nil, errors.Wrapf(err, "failed to hgetall from redis")
+	}
+	b, err := blob.Bytes()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get from redis")
+	}
+	tv, err := decodeBlob(b)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to write (%s) from redis", key)
+		return nil, errors.Wrapf(err, "failed to decode blob from redis")
+	}
+	return tv, nil
+}
+
+// mergePending merges the datapoints of the pending claims in the order they
+// are taken out.
+func mergePending(tv map[int64]*model.Aggregate, cmd *goredis.StringStringMapCmd) error {
+	claims, err := cmd.Result()
+	if err != nil {
+		return errors.Wrapf(err, "failed to hgetall pending from redis")
+	}
+	ids := make([]string, 0, len(claims))
+	for id := range claims {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		claimed, err := decodeBlob([]byte(claims[id]))
+		if err != nil {
+			return errors.Wrapf(err, "failed to decode pending %s from redis", id)
+		}
+		mergeBuffer(tv, claimed)
+	}
+	return nil
+}
+
+// mergeBuffer merges the datapoints written later into tv. The raw datapoints
+// overwrite the older ones, and the rolled up ones are merged into the older
+// ones unless they are the same, which are the datapoints read from both the
+// legacy key and the pending hash while the legacy key is adopted.
+func mergeBuffer(tv map[int64]*model.Aggregate, later map[int64]*model.Aggregate) {
+	for t, a := range later {
+		old, ok := tv[t]
+		switch {
+		case !ok || old.IsRaw() || a.IsRaw():
+			tv[t] = a
+		case *old != *a:
+			merged := *old
+			merged.Merge(a)
+			tv[t] = &merged
+		}
 	}
-	tv := make(map[int64]float64, len(tsval))
+}
+
+// decodeHash decodes the fields of the hash of a series.
+func decodeHash(tsval map[string]string) (map[int64]*model.Aggregate, error) {
+	tv := make(map[int64]*model.Aggregate, len(tsval))
 	for ts, val := range tsval {
 		t, err := strconv.ParseInt(ts, 10, 64)
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to parse timestamp %s", ts)
 		}
-		v, err := strconv.ParseFloat(val, 64)
+		a, err := decodeAggregate(t, val)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to parse float value %s", val)
+			return nil, err
 		}
-		tv[t] = v
+		tv[t] = a
+	}
+	return tv, nil
+}
+
+// Get gets datapoints from redis by slot and series name.
+func (r *Redis) Get(slot string, name string) (map[int64]float64, error) {
+	step, err := timeparser.ParseTimeOffset(slot)
+	if err != nil {
+		return nil, err
+	}
+	buffers, err := r.getBuffers(slot, []string{name})
+	if err != nil {
+		return nil, err
+	}
+	tv := make(map[int64]float64, len(buffers[name]))
+	for t, a := range buffers[name] {
+		util.Finalize(name, int64(step.Seconds()), a)
+		tv[t] = a.Value
 	}
 	return tv, nil
 }
 
 // Len returns the length of datapoints by slot and name.
 func (r *Redis) Len(slot string, name string) (int64, error) {
-	key := slot + ":" + name
-	n, err := r.client.HLen(key).Result()
+	buffers, err := r.getBuffers(slot, []string{name})
 	if err != nil {
-		return -1, errors.Wrapf(err, "failed to get length (%s) from redis", key)
+		return -1, err
 	}
-	return n, nil
+	return int64(len(buffers[name])), nil
 }
 
 // Put puts the datapoint into redis.
 func (r *Redis) Put(slot string, name string, p *model.Datapoint) error {
-	key := slot + ":" + name
-	err := r.client.HSet(key, fmt.Sprintf("%d", p.Timestamp), p.Value).Err()
-	if err != nil {
-		return errors.Wrapf(err, "failed to write (%s) from redis", key)
-	}
-	return nil
+	return r.put(slot, name, map[int64]*model.Aggregate{
+		p.Timestamp: model.NewAggregate(p.Timestamp, p.Value),
+	})
 }
 
 // MPut puts datapoints into redis.
 func (r *Redis) MPut(slot string, name string, tv map[int64]float64) error {
-	key := slot + ":" + name
-	tsval := make(map[string]string, len(tv))
+	aggs := make(map[int64]*model.Aggregate, len(tv))
 	for t, v := range tv {
-		tsval[fmt.Sprintf("%d", t)] = fmt.Sprintf("%f", v)
+		aggs[t] = model.NewAggregate(t, v)
+	}
+	return r.put(slot, name, aggs)
+}
+
+// put overwrites the datapoints of the series in the slot. The key buffered in
+// the other encoding is written by putAndRollup, which converts it.
+func (r *Redis) put(slot string, name string, tv map[int64]*model.Aggregate) error {
+	if len(tv) == 0 {
+		return nil
 	}
-	if err := r.client.HMSet(key, tsval).Err(); err != nil {
+	key := bufferKey(slot, name)
+	var err error
+	if blobEnabled() {
+		err = r.client.Append(key, string(encodeBlob(tv))).Err()
+	} else {
+		tsval := make(map[string]string, len(tv))
+		for t, a := range tv {
+			tsval[strconv.FormatInt(t, 10)] = encodeAggregate(a)
+		}
+		err = r.client.HMSet(key, tsval).Err()
+	}
+	if isWrongType(err) {
+		rs := []*schema.Retention{{Slot: slot, Last: true}}
+		_, err = r.putAndRollup(rs, name, "put", 0, encodeBlob(tv), time.Now())
+	}
+	if err != nil {
 		return errors.Wrapf(err, "failed to write (%s) from redis", key)
 	}
 	return nil
 }
 
-// Delete datapoints from redis.
-func (r *Redis) Delete(slot string, name string) error {
-	key := slot + ":" + name
-	if err := r.client.Del(key).Err(); err != nil {
-		return errors.Wrapf(err, "failed to write (%s) from redis", key)
+// Claim is the datapoints taken out of the buffer of a series in a slot, which
+// are kept in the pending hash of the slot until Ack.
+type Claim struct {
+	Slot   string
+	ID     string
+	Points map[int64]*model.Aggregate
+}
+
+// PutAndRollup puts the datapoints into the buffer of the series in the slot of
+// the first retention, and atomically takes all the datapoints out of it if the
+// number of them reaches the flushPoints of the retention. The datapoints taken
+// out are rolled up into the slot of the next retention, and taken out of it in
+// the same way until the last retention, which never takes them out. It returns
+// the claims of the datapoints taken out, which are kept pending until Ack. Only
+// one of the writers of the same series takes the datapoints out, so they are
+// rolled up exactly once.
+func (r *Redis) PutAndRollup(rs []*schema.Retention, name string, tv map[int64]*model.Aggregate, now time.Time) ([]*Claim, error) {
+	claims, err := r.putAndRollup(rs, name, "put", 0, encodeBlob(tv), now)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to put and roll up (%s) into redis", bufferKey(rs[0].Slot, name))
+	}
+	return claims, nil
+}
+
+// threshold returns the number of the datapoints taken out of the slot of the
+// retention, which is negative for the last retention.
+func threshold(r *schema.Retention) int {
+	if r.Last {
+		return -1
+	}
+	return r.FlushPoints
+}
+
+// claimID returns the identifier of the claim taken out at now. It starts with
+// the time to be claimed again by ClaimPending after it is left pending.
+func claimID(now time.Time) string {
+	return fmt.Sprintf("%d:%d", now.Unix(), rand.Int63())
+}
+
+// rolledTTL returns the seconds to keep the digests of the records rolled up,
+// which is long enough for the datapoints delivered again to be idle and swept.
+func rolledTTL() int64 {
+	return int64((config.Config.FlusherIdleAge + config.Config.FlusherInterval) / time.Second)
+}
+
+func (r *Redis) putAndRollup(rs []*schema.Retention, name string, mode string, cutoff int64, records []byte, now time.Time) ([]*Claim, error) {
+	id := claimID(now)
+	keys := make([]string, 0, len(rs)*3)
+	args := make([]interface{}, 0, 6+len(rs)*2)
+	args = append(args, id, mode, cutoff, config.Config.RedisBufferEncoding, records, rolledTTL())
+	for _, rt := range rs {
+		keys = append(keys, bufferKey(rt.Slot, name), pendingKey(rt.Slot, name), rolledKey(rt.Slot, name))
+		args = append(args, threshold(rt), rt.Step)
+	}
+	ret, err := putAndRollupScript.Run(r.client, keys, args...).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeClaims(rs, id, ret)
+}
+
+// encodeAggregate encodes the aggregate into the value of a hash field. The value
+// of a raw datapoint is the float, and the others are the min, max, sum, count,
+// last value and last timestamp joined with ':', which putAggregateLua merges.
+func encodeAggregate(a *model.Aggregate) string {
+	if a.IsRaw() {
+		return strconv.FormatFloat(a.Value, 'f', -1, 64)
+	}
+	return strings.Join([]string{
+		strconv.FormatFloat(a.Min, 'f', -1, 64),
+		strconv.FormatFloat(a.Max, 'f', -1, 64),
+		strconv.FormatFloat(a.Sum, 'f', -1, 64),
+		strconv.FormatInt(a.Count, 10),
+		strconv.FormatFloat(a.Last, 'f', -1, 64),
+		strconv.FormatInt(a.LastTimestamp, 10),
+	}, ":")
+}
+
+// decodeAggregate decodes the value of the hash field of the timestamp encoded
+// by encodeAggregate. The Value of a rolled up aggregate is left to finalize.
+func decodeAggregate(t int64, val string) (*model.Aggregate, error) {
+	fields := strings.Split(val, ":")
+	if len(fields) == 1 {
+		v, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse float value %s", val)
+		}
+		return model.NewAggregate(t, v), nil
+	}
+	if len(fields) != 6 {
+		return nil, errors.Errorf("failed to parse aggregate value %s", val)
+	}
+	var (
+		floats [6]float64
+		ints   [6]int64
+	)
+	for i, f := range fields {
+		var err error
+		switch i {
+		case 3, 5: // the count and the last timestamp
+			ints[i], err = strconv.ParseInt(f, 10, 64)
+		default:
+			floats[i], err = strconv.ParseFloat(f, 64)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse aggregate value %s", val)
+		}
+	}
+	return &model.Aggregate{
+		Min:           floats[0],
+		Max:           floats[1],
+		Sum:           floats[2],
+		Count:         ints[3],
+		Last:          floats[4],
+		LastTimestamp: ints[5],
+		RolledUp:      true,
+	}, nil
+}
+
+// decodeClaims decodes the array of the blobs of the records taken out of the
+// slots of the retentions replied by putAndRollupScript.
+func decodeClaims(rs []*schema.Retention, id string, ret interface{}) ([]*Claim, error) {
+	blobs, ok := ret.([]interface{})
+	if !ok || len(blobs) > len(rs) {
+		return nil, errors.Errorf("unexpected reply of claims (%s) from redis: %v", id, ret)
+	}
+	claims := make([]*Claim, 0, len(blobs))
+	for i, b := range blobs {
+		blob, _ := b.(string)
+		tv, err := decodeBlob([]byte(blob))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode claim (%s,%s) from redis", rs[i].Slot, id)
+		}
+		claims = append(claims, &Claim{Slot: rs[i].Slot, ID: id, Points: tv})
+	}
+	return claims, nil
+}
+
+// ClaimIdle atomically takes all the datapoints of the series out of the slot
+// of the first retention if the latest timestamp of them is before the cutoff,
+// and rolls them up as PutAndRollup does. The legacy key of the series is
+// adopted in the same way, but it is deleted after its datapoints are taken out,
+// but the same records are not rolled up twice if the node crashes in between
+// and they are adopted again. It returns nil if
+// the series has a datapoint at or after the cutoff.
+func (r *Redis) ClaimIdle(rs []*schema.Retention, name string, cutoff int64, now time.Time) ([]*Claim, error) {
+	key := bufferKey(rs[0].Slot, name)
+	claims, err := r.putAndRollup(rs, name, "idle", cutoff, nil, now)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to claim idle (%s) from redis", key)
+	}
+
+	legacy := legacyKey(rs[0].Slot, name)
+	ret, err := readIdleScript.Run(r.client, []string{legacy}, cutoff).Result()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read idle (%s) from redis", legacy)
+	}
+	blob, _ := ret.(string)
+	if blob == "" {
+		return claims, nil
+	}
+	adopted, err := r.putAndRollup(rs, name, "adopt", 0, []byte(blob), now)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to adopt (%s) into redis", legacy)
+	}
+	if err := deleteUnchangedScript.Run(r.client, []string{legacy}, blob).Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to delete (%s) from redis", legacy)
+	}
+	return append(claims, adopted...), nil
+}
+
+// ClaimPending returns the claims of the series in the slot which have been
+// pending since before the time, because their flush failed or the writer
+// crashed.
+func (r *Redis) ClaimPending(slot string, name string, before time.Time) ([]*Claim, error) {
+	key := pendingKey(slot, name)
+	pending, err := r.client.HGetAll(key).Result()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to hgetall (%s) from redis", key)
+	}
+	var claims []*Claim
+	for id, blob := range pending {
+		t, err := strconv.ParseInt(strings.SplitN(id, ":", 2)[0], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid pending (%s,%s) in redis", key, id)
+		}
+		if t >= before.Unix() {
+			continue
+		}
+		tv, err := decodeBlob([]byte(blob))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode pending (%s,%s) from redis", key, id)
+		}
+		claims = append(claims, &Claim{Slot: slot, ID: id, Points: tv})
+	}
+	sort.Slice(claims, func(i, j int) bool { return claims[i].ID < claims[j].ID })
+	return claims, nil
+}
+
+// Ack deletes the claim of the series in the slot, which is flushed.
+func (r *Redis) Ack(slot string, name string, id string) error {
+	key := pendingKey(slot, name)
+	if err := r.client.HDel(key, id).Err(); err != nil {
+		return errors.Wrapf(err, "failed to ack (%s,%s) into redis", key, id)
 	}
 	return nil
 }
 
-func selectTimeSlot(startTime, endTime time.Time) (string, int) {
+type scanner interface {
+	Scan(cursor uint64, match string, count int64) *goredis.ScanCmd
+}
+
+// Names returns the names of the series buffered or pending in the slot. It
+// scans all the master nodes on Redis Cluster.
+func (r *Redis) Names(slot string) ([]string, error) {
 	var (
-		step int
-		slot string
+		mu    sync.Mutex
+		seen  = map[string]bool{}
+		names []string
 	)
-	diffTime := endTime.Sub(startTime)
-	if oneYear <= diffTime {
-		slot = "1d"
-		step = 60 * 60 * 24
-	} else if oneWeek <= diffTime {
-		slot = "1h"
-		step = 60 * 60
-	} else if oneDay <= diffTime {
-		slot = "5m"
-		step = 5 * 60
-	} else {
-		slot = "1m"
-		step = 60
+	scan := func(c scanner, prefix string) error {
+		var cursor uint64
+		for {
+			keys, next, err := c.Scan(cursor, prefix+"*", redisScanCount).Result()
+			if err != nil {
+				return errors.Wrapf(err, "failed to scan (%s*) from redis", prefix)
+			}
+			mu.Lock()
+			for _, key := range keys {
+				name := nameOfKey(key, prefix)
+				if !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+			mu.Unlock()
+			if next == 0 {
+				return nil
+			}
+			cursor = next
+		}
+	}
+	for _, prefix := range []string{slot + ":", pendingPrefix + slot + ":"} {
+		if cluster, ok := r.client.(*goredis.ClusterClient); ok {
+			err := cluster.ForEachMaster(func(c *goredis.Client) error {
+				return scan(c, prefix)
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := scan(r.client, prefix); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// flushedKey returns the key of the newest timestamp of the datapoints of the
+// series taken out of the slot. The timestamps are kept in a key per series not
+// to concentrate the writes of all the series on a key.
+func flushedKey(slot string, name string) string {
+	return "diamondb:flushed:" + slot + ":" + name
+}
+
+// MarkFlushed records that the datapoints of the series until t are taken out
+// of the slot to be flushed. The timestamp recorded never goes back, and is
+// forgotten after ttl unless it is recorded again.
+func (r *Redis) MarkFlushed(slot string, name string, t int64, ttl time.Duration) error {
+	key := flushedKey(slot, name)
+	if err := markFlushedScript.Run(r.client, []string{key}, t, int64(ttl/time.Second)).Err(); err != nil {
+		return errors.Wrapf(err, "failed to mark flushed (%s) into redis", key)
 	}
-	return slot, step
+	return nil
+}
+
+// Flushed returns the newest timestamps of the datapoints of the series taken
+// out of the slot. The series never marked or forgotten are absent.
+func (r *Redis) Flushed(slot string, names []string) (map[string]int64, error) {
+	cmds := make([]*goredis.StringCmd, len(names))
+	_, err := r.client.Pipelined(func(pipe *goredis.Pipeline) error {
+		for i, name := range names {
+			cmds[i] = pipe.Get(flushedKey(slot, name))
+		}
+		return nil
+	})
+	if err != nil && err != goredis.Nil {
+		return nil, errors.Wrapf(err, "failed to get flushed (%s) from redis", slot)
+	}
+	flushed := make(map[string]int64, len(names))
+	for i, cmd := range cmds {
+		s, err := cmd.Result()
+		if err == goredis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get flushed (%s,%s) from redis", slot, names[i])
+		}
+		t, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid flushed (%s,%s) in redis", slot, names[i])
+		}
+		flushed[names[i]] = t
+	}
+	return flushed, nil
+}
+
+// AcquireLock acquires the lock of the key for the owner, or extends it if the
+// owner already holds it. It returns false if another owner holds it.
+func (r *Redis) AcquireLock(key string, owner string, ttl time.Duration) (bool, error) {
+	ok, err := r.client.SetNX(key, owner, ttl).Result()
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to acquire lock (%s) from redis", key)
+	}
+	if ok {
+		return true, nil
+	}
+	ret, err := renewLockScript.Run(r.client, []string{key}, owner, int64(ttl/time.Millisecond)).Result()
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to renew lock (%s) from redis", key)
+	}
+	n, _ := ret.(int64)
+	return n == 1, nil
+}
+
+// ReleaseLock releases the lock of the key if the owner holds it.
+func (r *Redis) ReleaseLock(key string, owner string) error {
+	if err := releaseLockScript.Run(r.client, []string{key}, owner).Err(); err != nil {
+		return errors.Wrapf(err, "failed to release lock (%s) from redis", key)
+	}
+	return nil
+}
+
+// Delete datapoints from redis.
+func (r *Redis) Delete(slot string, name string) error {
+	key := bufferKey(slot, name)
+	// The legacy key is in another hash slot on Redis Cluster, so it is deleted
+	// by another command.
+	if err := r.client.Del(legacyKey(slot, name)).Err(); err != nil {
+		return errors.Wrapf(err, "failed to write (%s) from redis", legacyKey(slot, name))
+	}
+	if err := r.client.Del(key, pendingKey(slot, name), rolledKey(slot, name)).Err(); err != nil {
+		return errors.Wrapf(err, "failed to write (%s) from redis", key)
+	}
+	return nil
+}
+
+// selectTimeSlot returns the slot and the step of the retention of the schema
+// selected for the range from startTime until endTime.
+func selectTimeSlot(sch *schema.Schema, startTime, endTime time.Time) (string, int) {
+	r := sch.Select(startTime, endTime)
+	return r.Slot, int(r.Step)
 }
@@ -1,7 +1,9 @@
 package redis
 
 import (
+	"math"
 	"reflect"
+	"sort"
 	"testing"
 	"time"
 
@@ -11,6 +13,7 @@ import (
 
 	"github.com/yuuki/diamondb/pkg/config"
 	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
 )
 
 func TestNewRedis(t *testing.T) {
@@ -196,7 +199,7 @@ func TestBatchGet_Empty(t *testing.T) {
 	}
 }
 
-var testHGetAllToMapTests = []struct {
+var testToSeriesPointTests = []struct {
 	desc     string
 	name     string
 	tsval    map[string]string
@@ -241,14 +244,37 @@ var testHGetAllToMapTests = []struct {
 			}, 60,
 		),
 	},
+	{
+		"rolled up datapoints averaged over the raw datapoints",
+		"server1.loadavg5",
+		map[string]string{"0": "1:5:12:4:2:240", "300": "3:3:3:1:3:300"},
+		&query{
+			names: []string{"server1.loadavg5"},
+			start: time.Unix(0, 0),
+			end:   time.Unix(300, 0),
+			slot:  "5m",
+			step:  300,
+		},
+		model.NewSeriesPoint(
+			"server1.loadavg5", model.DataPoints{
+				model.NewAggregatedDataPoint(0, &model.Aggregate{
+					Value: 3.0, Min: 1.0, Max: 5.0, Sum: 12.0, Count: 4, Last: 2.0, LastTimestamp: 240, RolledUp: true,
+				}),
+				model.NewAggregatedDataPoint(300, &model.Aggregate{
+					Value: 3.0, Min: 3.0, Max: 3.0, Sum: 3.0, Count: 1, Last: 3.0, LastTimestamp: 300, RolledUp: true,
+				}),
+			}, 300,
+		),
+	},
 }
 
-func TestHGetAllToMap(t *testing.T) {
-	for _, tc := range testHGetAllToMapTests {
-		got, err := hGetAllToMap(tc.name, tc.tsval, tc.query)
+func TestToSeriesPoint(t *testing.T) {
+	for _, tc := range testToSeriesPointTests {
+		tv, err := decodeHash(tc.tsval)
 		if err != nil {
 			t.Fatalf("err: %s", err)
 		}
+		got := toSeriesPoint(tc.name, tv, tc.query)
 		if diff := pretty.Compare(got, tc.expected); diff != "" {
 			t.Fatalf("diff: (-actual +expected)\n%s", diff)
 		}
@@ -326,23 +352,110 @@ func TestMPut(t *testing.T) {
 	config.Config.RedisAddrs = []string{s.Addr()}
 	r := New()
 
-	expected := map[int64]float64{
-		100: 10.0,
-		160: 10.2,
-		220: 11.0,
+	defer func(enc string) { config.Config.RedisBufferEncoding = enc }(config.Config.RedisBufferEncoding)
+	for _, enc := range []string{"hash", "blob"} {
+		config.Config.RedisBufferEncoding = enc
+		name := "server1.loadavg5." + enc
+
+		expected := map[int64]float64{
+			100: 10.0,
+			160: 10.2,
+			220: 11.0,
+			// The values which lose their precision by %f
+			280: 1.2345678901234567e-10,
+			340: math.MaxFloat64,
+			400: -math.SmallestNonzeroFloat64,
+		}
+		err = r.MPut("1m", name, expected)
+		if err != nil {
+			t.Fatalf("should not raise error: %s", err)
+		}
+
+		got, err := r.Get("1m", name)
+		if err != nil {
+			panic(err)
+		}
+
+		if diff := pretty.Compare(got, expected); diff != "" {
+			t.Fatalf("redis.Get(1m, %s); diff (-actual +expected)\n%s", name, diff)
+		}
 	}
-	err = r.MPut("1m", "server1.loadavg5", expected)
+}
+
+func TestBufferEncoding(t *testing.T) {
+	s, err := miniredis.Run()
 	if err != nil {
-		t.Fatalf("should not raise error: %s", err)
+		panic(err)
 	}
+	defer s.Close()
 
-	got, err := r.Get("1m", "server1.loadavg5")
+	// Set mock
+	config.Config.RedisAddrs = []string{s.Addr()}
+	r := New()
+
+	defer func(enc string) { config.Config.RedisBufferEncoding = enc }(config.Config.RedisBufferEncoding)
+
+	// The keys written by the nodes of the other encoding
+	_, err = r.api().HMSet("1m:server1.loadavg5", map[string]string{
+		"100": "10.0", "160": "10.2",
+	}).Result()
 	if err != nil {
 		panic(err)
 	}
+	config.Config.RedisBufferEncoding = "blob"
+	err = r.Put("1m", "server2.loadavg5", &model.Datapoint{Timestamp: 100, Value: 8.0})
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	err = r.MPut("1m", "server2.loadavg5", map[int64]float64{100: 9.0, 160: 5.0})
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if n := len(s.Keys()); n != 2 {
+		t.Fatalf("the number of the keys should be 2, not %d", n)
+	}
+	if v, _ := s.Get("1m:{server2.loadavg5}"); len(v) != 3*blobRawSize {
+		t.Fatalf("the blob should be %d bytes, not %d", 3*blobRawSize, len(v))
+	}
 
-	if diff := pretty.Compare(got, expected); diff != "" {
-		t.Fatalf("redis.Get(1m, server1.loadavg5); diff (-actual +expected)\n%s", diff)
+	expected := model.SeriesMap{
+		"server1.loadavg5": model.NewSeriesPoint("server1.loadavg5", model.DataPoints{
+			model.NewDataPoint(100, 10.0),
+			model.NewDataPoint(160, 10.2),
+		}, 60),
+		"server2.loadavg5": model.NewSeriesPoint("server2.loadavg5", model.DataPoints{
+			model.NewDataPoint(100, 9.0),
+			model.NewDataPoint(160, 5.0),
+		}, 60),
+	}
+	for _, enc := range []string{"hash", "blob"} {
+		config.Config.RedisBufferEncoding = enc
+
+		sm, err := r.Fetch("server{1,2}.loadavg5", time.Unix(100, 0), time.Unix(1000, 0))
+		if err != nil {
+			t.Fatalf("should not raise error: %s", err)
+		}
+		if diff := pretty.Compare(sm, expected); diff != "" {
+			t.Fatalf("encoding: %s, diff: (-actual +expected)\n%s", enc, diff)
+		}
+		for _, name := range []string{"server1.loadavg5", "server2.loadavg5"} {
+			n, err := r.Len("1m", name)
+			if err != nil {
+				t.Fatalf("should not raise error: %s", err)
+			}
+			if n != 2 {
+				t.Fatalf("encoding: %s, redis.Len(1m, %s) = %d; want 2", enc, name, n)
+			}
+		}
+	}
+
+	for _, name := range []string{"server1.loadavg5", "server2.loadavg5"} {
+		if err := r.Delete("1m", name); err != nil {
+			t.Fatalf("should not raise error: %s", err)
+		}
+	}
+	if n := len(s.Keys()); n != 0 {
+		t.Fatalf("the number of the keys should be 0, not %d", n)
 	}
 }
 
@@ -378,21 +491,227 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestNames(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	// Set mock
+	config.Config.RedisAddrs = []string{s.Addr()}
+	r := New()
+
+	// The legacy keys, the hash tagged keys and the pending hashes
+	for _, key := range []string{
+		"1m:server1.loadavg5", "1m:server2.loadavg5", "5m:server1.loadavg5",
+		"1m:{server1.loadavg5}", "1m:{server3.loadavg5}", "diamondb:pending:1m:{server4.loadavg5}",
+	} {
+		if err := r.api().HSet(key, "100", "10.0").Err(); err != nil {
+			panic(err)
+		}
+	}
+
+	got, err := r.Names("1m")
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	sort.Strings(got)
+	expected := []string{"server1.loadavg5", "server2.loadavg5", "server3.loadavg5", "server4.loadavg5"}
+	if diff := pretty.Compare(got, expected); diff != "" {
+		t.Fatalf("redis.Names(1m); diff (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestGetBuffers_Pending(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	// Set mock
+	config.Config.RedisAddrs = []string{s.Addr()}
+	r := New()
+
+	// The legacy key, the claims pending in the order of the ids and the buffer
+	// key are merged in the order.
+	if err := r.api().HMSet("5m:server1.loadavg5", map[string]string{
+		"0": "1:1:1:1:1:0", "300": "1",
+	}).Err(); err != nil {
+		panic(err)
+	}
+	claim := func(tv map[int64]*model.Aggregate) string { return string(encodeBlob(tv)) }
+	if err := r.api().HMSet("diamondb:pending:5m:{server1.loadavg5}", map[string]string{
+		"100:1": claim(map[int64]*model.Aggregate{
+			// adopted from the legacy key
+			0:   {Min: 1, Max: 1, Sum: 1, Count: 1, Last: 1, LastTimestamp: 0, RolledUp: true},
+			300: model.NewAggregate(300, 2),
+		}),
+		"200:1": claim(map[int64]*model.Aggregate{
+			0: {Min: 2, Max: 2, Sum: 2, Count: 1, Last: 2, LastTimestamp: 60, RolledUp: true},
+		}),
+	}).Err(); err != nil {
+		panic(err)
+	}
+	if err := r.api().Append("5m:{server1.loadavg5}", claim(map[int64]*model.Aggregate{
+		0:   {Min: 3, Max: 3, Sum: 3, Count: 1, Last: 3, LastTimestamp: 120, RolledUp: true},
+		600: model.NewAggregate(600, 4),
+	})).Err(); err != nil {
+		panic(err)
+	}
+
+	got, err := r.getBuffers("5m", []string{"server1.loadavg5", "server2.loadavg5"})
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	expected := map[string]map[int64]*model.Aggregate{
+		"server1.loadavg5": {
+			0:   {Min: 1, Max: 3, Sum: 6, Count: 3, Last: 3, LastTimestamp: 120, RolledUp: true},
+			300: model.NewAggregate(300, 2),
+			600: model.NewAggregate(600, 4),
+		},
+		"server2.loadavg5": {},
+	}
+	if diff := pretty.Compare(got, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestClaimPending(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	// Set mock
+	config.Config.RedisAddrs = []string{s.Addr()}
+	r := New()
+
+	tv := map[int64]*model.Aggregate{60: model.NewAggregate(60, 1)}
+	for _, id := range []string{"100:1", "200:1", "300:1"} {
+		if err := r.api().HSet("diamondb:pending:1m:{server1.loadavg5}", id, string(encodeBlob(tv))).Err(); err != nil {
+			panic(err)
+		}
+	}
+
+	// The claims pending since before the time are claimed until they are acked.
+	got, err := r.ClaimPending("1m", "server1.loadavg5", time.Unix(300, 0))
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	expected := []*Claim{
+		{Slot: "1m", ID: "100:1", Points: tv},
+		{Slot: "1m", ID: "200:1", Points: tv},
+	}
+	if diff := pretty.Compare(got, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	for _, c := range got {
+		if err := r.Ack("1m", "server1.loadavg5", c.ID); err != nil {
+			t.Fatalf("should not raise error: %s", err)
+		}
+	}
+	got, err = r.ClaimPending("1m", "server1.loadavg5", time.Unix(400, 0))
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if len(got) != 1 || got[0].ID != "300:1" {
+		t.Fatalf("only the claim not acked should be pending: %v", got)
+	}
+}
+
+func TestFetchRetention(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	// Set mock
+	config.Config.RedisAddrs = []string{s.Addr()}
+	r := New()
+
+	for key, tv := range map[string]map[string]string{
+		"1m:server1.loadavg5": {"100": "10.0", "160": "10.2"},
+		"5m:server1.loadavg5": {"0": "9.0", "300": "9.5"},
+	} {
+		if err := r.api().HMSet(key, tv).Err(); err != nil {
+			panic(err)
+		}
+	}
+
+	// The slot of the retention is fetched whatever the range is.
+	sm, err := r.FetchRetention([]string{"server1.loadavg5"}, schema.Default.Retentions[1], time.Unix(0, 0), time.Unix(200, 0))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := model.SeriesMap{
+		"server1.loadavg5": model.NewSeriesPoint("server1.loadavg5", model.DataPoints{
+			model.NewDataPoint(0, 9.0),
+		}, 300),
+	}
+	if diff := pretty.Compare(sm, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestFlushed(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	// Set mock
+	config.Config.RedisAddrs = []string{s.Addr()}
+	r := New()
+
+	if err := s.Set(flushedKey("1m", "server1.loadavg5"), "240"); err != nil {
+		panic(err)
+	}
+	got, err := r.Flushed("1m", []string{"server1.loadavg5", "server2.loadavg5"})
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	// The series never flushed are absent.
+	expected := map[string]int64{"server1.loadavg5": 240}
+	if diff := pretty.Compare(got, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	if err := s.Set(flushedKey("1m", "server1.loadavg5"), "invalid"); err != nil {
+		panic(err)
+	}
+	if _, err := r.Flushed("1m", []string{"server1.loadavg5"}); err == nil {
+		t.Fatalf("should raise error")
+	}
+}
+
 func TestSelectTimeSlot(t *testing.T) {
+	business, err := schema.New("business", `^business\.`, false, "10s:6h,1m:7d,10m:5y")
+	if err != nil {
+		t.Fatal(err)
+	}
 	tests := []struct {
-		start time.Time
-		end   time.Time
-		slot  string
-		step  int
+		schema *schema.Schema
+		start  time.Time
+		end    time.Time
+		slot   string
+		step   int
 	}{
-		{time.Unix(100, 0), time.Unix(6000, 0), "1m", 60},
-		{time.Unix(10000, 0), time.Unix(100000, 0), "5m", 300},
-		{time.Unix(100000, 0), time.Unix(1000000, 0), "1h", 3600},
-		{time.Unix(1000000, 0), time.Unix(100000000, 0), "1d", 86400},
+		{schema.Default, time.Unix(100, 0), time.Unix(6000, 0), "1m", 60},
+		{schema.Default, time.Unix(10000, 0), time.Unix(100000, 0), "5m", 300},
+		{schema.Default, time.Unix(100000, 0), time.Unix(1000000, 0), "1h", 3600},
+		{schema.Default, time.Unix(1000000, 0), time.Unix(100000000, 0), "1d", 86400},
+		{business, time.Unix(100, 0), time.Unix(6000, 0), "10s", 10},
+		{business, time.Unix(10000, 0), time.Unix(100000, 0), "1m", 60},
+		{business, time.Unix(1000000, 0), time.Unix(100000000, 0), "10m", 600},
 	}
 
 	for i, lc := range tests {
-		slot, step := selectTimeSlot(lc.start, lc.end)
+		slot, step := selectTimeSlot(lc.schema, lc.start, lc.end)
 		if slot != lc.slot {
 			t.Fatalf("\nExpected: %+v\nActual:   %+v (#%d)", lc.slot, slot, i)
 		}
@@ -401,3 +720,34 @@ func TestSelectTimeSlot(t *testing.T) {
 		}
 	}
 }
+
+func TestEncodeAggregate(t *testing.T) {
+	tests := []struct {
+		aggregate *model.Aggregate
+		encoded   string
+	}{
+		{model.NewAggregate(120, 0.5), "0.5"},
+		{
+			&model.Aggregate{Min: 1, Max: 4, Sum: 7.5, Count: 3, Last: 2.5, LastTimestamp: 240, RolledUp: true},
+			"1:4:7.5:3:2.5:240",
+		},
+	}
+	for _, tc := range tests {
+		encoded := encodeAggregate(tc.aggregate)
+		if encoded != tc.encoded {
+			t.Fatalf("encodeAggregate(%v) should be %s, not %s", tc.aggregate, tc.encoded, encoded)
+		}
+		decoded, err := decodeAggregate(120, encoded)
+		if err != nil {
+			t.Fatalf("should not raise error: %s", err)
+		}
+		if diff := pretty.Compare(decoded, tc.aggregate); diff != "" {
+			t.Fatalf("diff: (-actual +expected)\n%s", diff)
+		}
+	}
+	for _, val := range []string{"foo", "1:2", "2.5:1:4:7.5:3", "1:4:7.5:3.5:2.5:240", "1:4:7.5:3:x:240"} {
+		if _, err := decodeAggregate(120, val); err == nil {
+			t.Fatalf("decodeAggregate(%s) should raise error", val)
+		}
+	}
+}
@@ -4,21 +4,35 @@ import (
 	"time"
 
 	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
 )
 
 // FakeReadWriter is for stub testing
 type FakeReadWriter struct {
 	ReadWriter
-	FakeFetch func(name string, start, end time.Time) (model.SeriesMap, error)
-	FakeGet   func(slot string, name string) (map[int64]float64, error)
-	FakeLen   func(slot string, name string) (int64, error)
-	FakePut   func(slot string, name string, p *model.Datapoint) error
+	FakeFetch          func(name string, start, end time.Time) (model.SeriesMap, error)
+	FakeFetchRetention func(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error)
+	FakeGet            func(slot string, name string) (map[int64]float64, error)
+	FakeLen            func(slot string, name string) (int64, error)
+	FakePut            func(slot string, name string, p *model.Datapoint) error
+
+	FakePutAndRollup func(rs []*schema.Retention, name string, tv map[int64]*model.Aggregate, now time.Time) ([]*Claim, error)
+	FakeClaimIdle    func(rs []*schema.Retention, name string, cutoff int64, now time.Time) ([]*Claim, error)
+	FakeClaimPending func(slot string, name string, before time.Time) ([]*Claim, error)
+	FakeAck          func(slot string, name string, id string) error
+	FakeNames        func(slot string) ([]string, error)
+	FakeMarkFlushed  func(slot string, name string, t int64, ttl time.Duration) error
+	FakeFlushed      func(slot string, names []string) (map[string]int64, error)
 }
 
 func (s *FakeReadWriter) Fetch(name string, start, end time.Time) (model.SeriesMap, error) {
 	return s.FakeFetch(name, start, end)
 }
 
+func (r *FakeReadWriter) FetchRetention(names []string, rt *schema.Retention, start, end time.Time) (model.SeriesMap, error) {
+	return r.FakeFetchRetention(names, rt, start, end)
+}
+
 func (r *FakeReadWriter) Get(slot string, name string) (map[int64]float64, error) {
 	return r.FakeGet(slot, name)
 }
@@ -30,3 +44,31 @@ func (r *FakeReadWriter) Len(slot string, name string) (int64, error) {
 func (r *FakeReadWriter) Put(slot string, name string, p *model.Datapoint) error {
 	return r.FakePut(slot, name, p)
 }
+
+func (r *FakeReadWriter) PutAndRollup(rs []*schema.Retention, name string, tv map[int64]*model.Aggregate, now time.Time) ([]*Claim, error) {
+	return r.FakePutAndRollup(rs, name, tv, now)
+}
+
+func (r *FakeReadWriter) ClaimIdle(rs []*schema.Retention, name string, cutoff int64, now time.Time) ([]*Claim, error) {
+	return r.FakeClaimIdle(rs, name, cutoff, now)
+}
+
+func (r *FakeReadWriter) ClaimPending(slot string, name string, before time.Time) ([]*Claim, error) {
+	return r.FakeClaimPending(slot, name, before)
+}
+
+func (r *FakeReadWriter) Ack(slot string, name string, id string) error {
+	return r.FakeAck(slot, name, id)
+}
+
+func (r *FakeReadWriter) Names(slot string) ([]string, error) {
+	return r.FakeNames(slot)
+}
+
+func (r *FakeReadWriter) MarkFlushed(slot string, name string, t int64, ttl time.Duration) error {
+	return r.FakeMarkFlushed(slot, name, t, ttl)
+}
+
+func (r *FakeReadWriter) Flushed(slot string, names []string) (map[string]int64, error) {
+	return r.FakeFlushed(slot, names)
+}
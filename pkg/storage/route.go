@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/yuuki/diamondb/pkg/config"
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
+)
+
+// TierStats represents the fetch counters of a tier.
+type TierStats struct {
+	Name    string `json:"name"`
+	Fetched uint64 `json:"fetched"`
+	Skipped uint64 `json:"skipped"`
+	Failed  uint64 `json:"failed"`
+	Series  uint64 `json:"series"`
+	Points  uint64 `json:"points"`
+}
+
+type tierCounters struct {
+	fetched uint64
+	skipped uint64
+	failed  uint64
+	series  uint64
+	points  uint64
+}
+
+// tierFetch is the fetch of the names in the retention from a tier.
+type tierFetch struct {
+	tier  int
+	names []string
+	r     *schema.Retention
+	start time.Time
+	end   time.Time
+}
+
+// route returns the fetches of the names in the retention from start until end
+// from the tiers which may hold them. The range of each fetch is narrowed to the
+// ages of the datapoints the tier holds, but not to after the oldest timestamp
+// flushed of the names out of a Watermarker, since the datapoints newer than it
+// may be written late or backfilled. The fetch from the tier next to a
+// Watermarker is narrowed to the series flushed at or after start, and until the
+// newest timestamp flushed of them if all of them have been flushed.
+func (s *Store) route(names []string, r *schema.Retention, start, end, now time.Time) ([]*tierFetch, error) {
+	var (
+		fetches []*tierFetch
+		flushed map[string]int64
+	)
+	for k, tier := range s.Tiers {
+		f := &tierFetch{tier: k, names: names, r: r, start: start, end: end}
+		w, isWatermarker := tier.(Watermarker)
+		var marks map[string]int64
+		min, max := tier.Retention(r)
+		if t := now.Add(-min); min > 0 && t.Before(f.end) {
+			f.end = t
+		}
+		if t := now.Add(-max); max > 0 && t.After(f.start) {
+			if isWatermarker {
+				var err error
+				if marks, err = w.Flushed(names, r); err != nil {
+					return nil, err
+				}
+				t = oldestFlushed(names, marks, t)
+			}
+			if t.After(f.start) {
+				f.start = t
+			}
+		}
+		if flushed != nil {
+			f.narrow(flushed)
+		}
+
+		flushed = nil
+		if isWatermarker && config.Config.RouteByFlushed && k+1 < len(s.Tiers) {
+			if marks == nil {
+				var err error
+				if marks, err = w.Flushed(names, r); err != nil {
+					return nil, err
+				}
+			}
+			flushed = marks
+		}
+
+		if len(f.names) == 0 || f.start.After(f.end) {
+			if k < len(s.stats) {
+				atomic.AddUint64(&s.stats[k].skipped, 1)
+			}
+			continue
+		}
+		fetches = append(fetches, f)
+	}
+	return fetches, nil
+}
+
+// oldestFlushed returns the oldest timestamp flushed of the names if it is
+// before t, or t otherwise. It returns the zero time if any of the names has
+// never been flushed.
+func oldestFlushed(names []string, flushed map[string]int64, t time.Time) time.Time {
+	for _, name := range names {
+		ts, ok := flushed[name]
+		if !ok {
+			return time.Time{}
+		}
+		if ts < t.Unix() {
+			t = time.Unix(ts, 0)
+		}
+	}
+	return t
+}
+
+// narrow narrows the fetch to the series flushed at or after the start. The
+// series never flushed are kept because the datapoints flushed before the
+// timestamps are recorded are unknown.
+func (f *tierFetch) narrow(flushed map[string]int64) {
+	var (
+		names   []string
+		newest  int64
+		unknown bool
+	)
+	for _, name := range f.names {
+		t, ok := flushed[name]
+		if !ok {
+			unknown = true
+		} else if t < f.start.Unix() {
+			continue
+		} else if t > newest {
+			newest = t
+		}
+		names = append(names, name)
+	}
+	f.names = names
+	if !unknown && len(names) > 0 && newest < f.end.Unix() {
+		f.end = time.Unix(newest, 0)
+	}
+}
+
+// fetchTier fetches the datapoints of the fetch from the tier, and counts them.
+func (s *Store) fetchTier(f *tierFetch) (model.SeriesMap, error) {
+	tier := s.Tiers[f.tier]
+	begin := time.Now()
+	sm, err := tier.Fetch(f.names, f.r, f.start, f.end)
+	var points int
+	for _, sp := range sm {
+		points += len(sp.Points())
+	}
+	if f.tier < len(s.stats) {
+		c := &s.stats[f.tier]
+		atomic.AddUint64(&c.fetched, 1)
+		if err != nil {
+			atomic.AddUint64(&c.failed, 1)
+		}
+		atomic.AddUint64(&c.series, uint64(len(sm)))
+		atomic.AddUint64(&c.points, uint64(points))
+	}
+	if config.Config.Debug {
+		log.Printf("Fetched %d series and %d points of %d names in %s from %s (%d-%d) in %s\n",
+			len(sm), points, len(f.names), f.r.Slot, tier.Name(), f.start.Unix(), f.end.Unix(), time.Since(begin))
+	}
+	return sm, err
+}
+
+// Stats returns the snapshot of the fetch counters of each tier.
+func (s *Store) Stats() []TierStats {
+	stats := make([]TierStats, 0, len(s.stats))
+	for k := range s.stats {
+		c := &s.stats[k]
+		stats = append(stats, TierStats{
+			Name:    s.Tiers[k].Name(),
+			Fetched: atomic.LoadUint64(&c.fetched),
+			Skipped: atomic.LoadUint64(&c.skipped),
+			Failed:  atomic.LoadUint64(&c.failed),
+			Series:  atomic.LoadUint64(&c.series),
+			Points:  atomic.LoadUint64(&c.points),
+		})
+	}
+	return stats
+}
@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/config"
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/dynamodb"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
+)
+
+// fakeWatermarkTier is the fake tier recording the flushed timestamps.
+type fakeWatermarkTier struct {
+	fakeTier
+	flushed map[string]int64
+}
+
+func (t *fakeWatermarkTier) MarkFlushed(name string, r *schema.Retention, ts int64) error {
+	t.flushed[name] = ts
+	return nil
+}
+
+func (t *fakeWatermarkTier) Flushed(names []string, r *schema.Retention) (map[string]int64, error) {
+	return t.flushed, nil
+}
+
+func TestStoreRoute(t *testing.T) {
+	defer func(b bool) { config.Config.RouteByFlushed = b }(config.Config.RouteByFlushed)
+
+	now := time.Unix(1000000, 0)
+	r := schema.Default.Retentions[0]
+	hot := &fakeWatermarkTier{fakeTier: fakeTier{name: "hot", max: 1 * time.Hour}}
+	s := NewStore(hot, &fakeTier{name: "warm"}, &fakeTier{name: "cold", min: 24 * time.Hour})
+
+	type fetch struct {
+		tier       int
+		names      []string
+		start, end int64
+	}
+	tests := []struct {
+		desc       string
+		byFlushed  bool
+		flushed    map[string]int64
+		start, end int64
+		expected   []fetch
+	}{
+		{
+			"recent range narrowed to the flushed timestamps",
+			true, map[string]int64{"a": 999000, "b": 998000},
+			997000, 1000000,
+			[]fetch{
+				{0, []string{"a", "b"}, 997000, 1000000},
+				{1, []string{"a", "b"}, 997000, 999000},
+			},
+		},
+		{
+			"series flushed before the range skipped",
+			true, map[string]int64{"a": 999000, "b": 990000},
+			997000, 1000000,
+			[]fetch{
+				{0, []string{"a", "b"}, 997000, 1000000},
+				{1, []string{"a"}, 997000, 999000},
+			},
+		},
+		{
+			"series never flushed kept",
+			true, map[string]int64{"a": 999000},
+			997000, 1000000,
+			[]fetch{
+				{0, []string{"a", "b"}, 997000, 1000000},
+				{1, []string{"a", "b"}, 997000, 1000000},
+			},
+		},
+		{
+			"no series flushed in the range",
+			true, map[string]int64{"a": 990000, "b": 990000},
+			997000, 1000000,
+			[]fetch{
+				{0, []string{"a", "b"}, 997000, 1000000},
+			},
+		},
+		{
+			"not narrowed by the flushed timestamps",
+			false, map[string]int64{"a": 990000, "b": 990000},
+			997000, 1000000,
+			[]fetch{
+				{0, []string{"a", "b"}, 997000, 1000000},
+				{1, []string{"a", "b"}, 997000, 1000000},
+			},
+		},
+		{
+			"range split across the tiers",
+			true, map[string]int64{"a": 999000, "b": 999000},
+			900000, 1000000,
+			[]fetch{
+				{0, []string{"a", "b"}, 996400, 1000000},
+				{1, []string{"a", "b"}, 900000, 999000},
+				{2, []string{"a", "b"}, 900000, 913600},
+			},
+		},
+		{
+			"old range",
+			true, map[string]int64{"a": 999000, "b": 999000},
+			800000, 900000,
+			[]fetch{
+				{1, []string{"a", "b"}, 800000, 900000},
+				{2, []string{"a", "b"}, 800000, 900000},
+			},
+		},
+		{
+			"old range of the series not flushed since the range",
+			true, map[string]int64{"a": 850000, "b": 999000},
+			800000, 900000,
+			[]fetch{
+				{0, []string{"a", "b"}, 850000, 900000},
+				{1, []string{"a", "b"}, 800000, 900000},
+				{2, []string{"a", "b"}, 800000, 900000},
+			},
+		},
+		{
+			"old range of the series never flushed",
+			false, map[string]int64{"a": 999000},
+			800000, 900000,
+			[]fetch{
+				{0, []string{"a", "b"}, 800000, 900000},
+				{1, []string{"a", "b"}, 800000, 900000},
+				{2, []string{"a", "b"}, 800000, 900000},
+			},
+		},
+	}
+	for _, tc := range tests {
+		config.Config.RouteByFlushed = tc.byFlushed
+		hot.flushed = tc.flushed
+		fs, err := s.route([]string{"a", "b"}, r, time.Unix(tc.start, 0), time.Unix(tc.end, 0), now)
+		if err != nil {
+			t.Fatalf("%s: should not raise err: %s", tc.desc, err)
+		}
+		got := make([]fetch, 0, len(fs))
+		for _, f := range fs {
+			if f.r != r {
+				t.Fatalf("%s: retention should be %s: %s", tc.desc, r.Slot, f.r.Slot)
+			}
+			got = append(got, fetch{f.tier, f.names, f.start.Unix(), f.end.Unix()})
+		}
+		if diff := pretty.Compare(got, tc.expected); diff != "" {
+			t.Fatalf("%s: diff: (-actual +expected)\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestStoreStats(t *testing.T) {
+	fetch := func(err error) func([]string, *schema.Retention, time.Time, time.Time) (model.SeriesMap, error) {
+		return func(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error) {
+			if err != nil {
+				return nil, err
+			}
+			return model.SeriesMap{
+				"server1.loadavg5": model.NewSeriesPoint("server1.loadavg5", model.DataPoints{
+					model.NewDataPoint(120, 1.0), model.NewDataPoint(180, 2.0),
+				}, 60),
+			}, nil
+		}
+	}
+	s := NewStore(
+		&fakeTier{name: "hot", fakeFetch: fetch(nil)},
+		&fakeTier{name: "warm", fakeFetch: fetch(errors.New("unavailable"))},
+		&fakeTier{name: "cold", min: 24 * time.Hour, fakeFetch: fetch(nil)},
+	)
+	if _, err := s.Fetch("server1.loadavg5", time.Now().Add(-1*time.Hour), time.Now()); err == nil {
+		t.Fatalf("should raise err")
+	}
+	expected := []TierStats{
+		{Name: "hot", Fetched: 1, Series: 1, Points: 2},
+		{Name: "warm", Fetched: 1, Failed: 1},
+		{Name: "cold", Skipped: 1},
+	}
+	if diff := pretty.Compare(s.Stats(), expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestStoreInsertMetric_MarkFlushed(t *testing.T) {
+	hashes := newFakeRedisHashes(map[string]map[int64]float64{
+		"1m:server1.loadavg5": {0: 0.1, 60: 0.2, 120: 0.3, 180: 0.4},
+	})
+	var events []string
+	rw := hashes.ReadWriter()
+	rw.FakeMarkFlushed = func(slot string, name string, t int64, ttl time.Duration) error {
+		events = append(events, "mark")
+		if slot != "1m" || name != "server1.loadavg5" || t != 240 {
+			return errors.New("unexpected mark")
+		}
+		return nil
+	}
+	s := NewStore(
+		&RedisTier{Redis: rw},
+		&DynamoDBTier{DynamoDB: &dynamodb.FakeReadWriter{
+			FakePut: func(name, slot, history string, itemEpoch int64, tv map[int64]*model.Aggregate) error {
+				events = append(events, "put")
+				return nil
+			},
+		}},
+	)
+	err := s.InsertMetric(&model.Metric{
+		Name:       "server1.loadavg5",
+		Datapoints: []*model.Datapoint{{Timestamp: 240, Value: 0.5}},
+	})
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	// The flushed timestamp is recorded before the datapoints are flushed.
+	if diff := pretty.Compare(events, []string{"mark", "put"}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	// The datapoints are left pending if the flushed timestamp fails to be recorded.
+	hashes["1m:server1.loadavg5"] = map[int64]*model.Aggregate{
+		0: model.NewAggregate(0, 0.1), 60: model.NewAggregate(60, 0.2), 120: model.NewAggregate(120, 0.3),
+		180: model.NewAggregate(180, 0.4),
+	}
+	delete(hashes, "5m:server1.loadavg5")
+	rw.FakeMarkFlushed = func(slot string, name string, t int64, ttl time.Duration) error {
+		return errors.New("unavailable")
+	}
+	err = s.InsertMetric(&model.Metric{
+		Name:       "server1.loadavg5",
+		Datapoints: []*model.Datapoint{{Timestamp: 240, Value: 0.5}},
+	})
+	if err != nil {
+		t.Fatalf("should not raise err of the datapoints left pending: %s", err)
+	}
+	expected := map[string]map[int64]float64{
+		"pending:1m:server1.loadavg5": {0: 0.1, 60: 0.2, 120: 0.3, 180: 0.4, 240: 0.5},
+		"5m:server1.loadavg5":         {0: 0.3},
+	}
+	if diff := pretty.Compare(hashes.Values(), expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
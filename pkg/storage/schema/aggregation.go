@@ -0,0 +1,175 @@
+package schema
+
+import (
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/model"
+)
+
+// Method is the method to aggregate the finer datapoints into a coarser one.
+type Method string
+
+// The aggregation methods of storage-aggregation.conf of Graphite.
+const (
+	MethodAverage Method = "average"
+	MethodSum     Method = "sum"
+	MethodMin     Method = "min"
+	MethodMax     Method = "max"
+	MethodLast    Method = "last"
+)
+
+// ParseMethod parses the name of the aggregation method.
+func ParseMethod(s string) (Method, error) {
+	switch Method(s) {
+	case MethodAverage, MethodSum, MethodMin, MethodMax, MethodLast:
+		return Method(s), nil
+	case "avg":
+		return MethodAverage, nil
+	case "total":
+		return MethodSum, nil
+	}
+	return "", errors.Errorf("unknown aggregation method %q", s)
+}
+
+// DefaultAggregation is the aggregation of the series matching no aggregation.
+var DefaultAggregation = &Aggregation{
+	Name:    "default",
+	Pattern: ".*",
+	Method:  MethodAverage,
+	re:      regexp.MustCompile(".*"),
+}
+
+// Aggregation is the method to roll up the series whose names match the pattern.
+type Aggregation struct {
+	Name    string
+	Pattern string
+	Method  Method
+	// XFilesFactor is the ratio of the raw datapoints which must be present in
+	// a rolled up datapoint. It is null (NaN) if fewer are present.
+	XFilesFactor float64
+	re           *regexp.Regexp
+}
+
+// NewAggregation creates a new Aggregation. The pattern is a glob such as
+// 'servers.*.requests' if glob is true, or a regular expression.
+func NewAggregation(name, pattern string, glob bool, method Method, xFilesFactor float64) (*Aggregation, error) {
+	expr := pattern
+	if glob {
+		expr = globToRegexp(pattern)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid pattern of aggregation %s", name)
+	}
+	if xFilesFactor < 0 || 1 < xFilesFactor {
+		return nil, errors.Errorf("xFilesFactor of aggregation %s must be between 0 and 1", name)
+	}
+	return &Aggregation{Name: name, Pattern: pattern, Method: method, XFilesFactor: xFilesFactor, re: re}, nil
+}
+
+// Match returns whether the name matches the pattern.
+func (a *Aggregation) Match(name string) bool {
+	return a.re.MatchString(name)
+}
+
+// Value returns the value of the aggregate rolled up from the raw datapoints by
+// the method. expected is the number of the raw datapoints in the step of the
+// aggregate. It returns NaN if the ratio of the raw datapoints present is less
+// than XFilesFactor.
+func (a *Aggregation) Value(agg *model.Aggregate, expected int64) float64 {
+	if agg.Count == 0 || (expected > 0 && float64(agg.Count)/float64(expected) < a.XFilesFactor) {
+		return math.NaN()
+	}
+	switch a.Method {
+	case MethodSum:
+		return agg.Sum
+	case MethodMin:
+		return agg.Min
+	case MethodMax:
+		return agg.Max
+	case MethodLast:
+		return agg.Last
+	}
+	return agg.Sum / float64(agg.Count)
+}
+
+// Aggregations is the list of the aggregations matched in order.
+type Aggregations []*Aggregation
+
+// Match returns the first aggregation matching the name, or DefaultAggregation
+// if none matches.
+func (as Aggregations) Match(name string) *Aggregation {
+	for _, a := range as {
+		if a.Match(name) {
+			return a
+		}
+	}
+	return DefaultAggregation
+}
+
+// ParseAggregations parses the aggregations in the format of
+// storage-aggregation.conf of Graphite. Each section has either 'pattern' of a
+// regular expression or 'glob', and 'aggregationMethod' and 'xFilesFactor'
+// which are 'average' and 0 by default. The aggregations are matched in the
+// order of the sections.
+//
+//	[count]
+//	pattern = \.count$
+//	aggregationMethod = sum
+//	xFilesFactor = 0
+//
+//	[errors]
+//	glob = servers.*.errors.max
+//	aggregationMethod = max
+//	xFilesFactor = 0.1
+func ParseAggregations(r io.Reader) (Aggregations, error) {
+	sections, err := parseSections(r, "pattern", "glob", "aggregationMethod", "xFilesFactor")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse aggregations")
+	}
+	as := make(Aggregations, 0, len(sections))
+	for _, sec := range sections {
+		pattern, glob, err := sec.pattern()
+		if err != nil {
+			return nil, err
+		}
+		method := MethodAverage
+		if v := sec.values["aggregationMethod"]; v != "" {
+			if method, err = ParseMethod(v); err != nil {
+				return nil, errors.Wrapf(err, "line %d", sec.line)
+			}
+		}
+		var xff float64
+		if v := sec.values["xFilesFactor"]; v != "" {
+			if xff, err = strconv.ParseFloat(v, 64); err != nil {
+				return nil, errors.Wrapf(err, "line %d: invalid xFilesFactor", sec.line)
+			}
+		}
+		a, err := NewAggregation(sec.name, pattern, glob, method, xff)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", sec.line)
+		}
+		as = append(as, a)
+	}
+	return as, nil
+}
+
+// LoadAggregations loads the aggregations from the file.
+func LoadAggregations(path string) (Aggregations, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s", path)
+	}
+	defer f.Close()
+	as, err := ParseAggregations(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", path)
+	}
+	return as, nil
+}
@@ -0,0 +1,91 @@
+package schema
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+)
+
+func TestAggregationValue(t *testing.T) {
+	nan := math.NaN()
+	// 3 of 5 raw datapoints are present.
+	agg := &model.Aggregate{Min: 1.0, Max: 6.0, Sum: 9.0, Count: 3, Last: 2.0, LastTimestamp: 240, RolledUp: true}
+	tests := []struct {
+		method       Method
+		xFilesFactor float64
+		agg          *model.Aggregate
+		expected     float64
+	}{
+		{MethodAverage, 0, agg, 3.0},
+		{MethodSum, 0, agg, 9.0},
+		{MethodMin, 0, agg, 1.0},
+		{MethodMax, 0, agg, 6.0},
+		{MethodLast, 0, agg, 2.0},
+		{MethodAverage, 0, &model.Aggregate{RolledUp: true}, nan},
+		{MethodSum, 0.8, agg, nan},
+		{MethodSum, 0.6, agg, 9.0},
+	}
+	for _, tc := range tests {
+		a, err := NewAggregation("test", ".*", false, tc.method, tc.xFilesFactor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := a.Value(tc.agg, 5)
+		if diff := pretty.Compare(got, tc.expected); diff != "" {
+			t.Fatalf("Value(%s, %v, %+v); diff (-actual +expected)\n%s", tc.method, tc.xFilesFactor, tc.agg, diff)
+		}
+	}
+}
+
+func TestParseAggregations(t *testing.T) {
+	conf := `
+[count]
+pattern = \.count$
+aggregationMethod = sum
+
+[errors]
+glob = servers.*.errors.max
+aggregationMethod = max
+xFilesFactor = 0.1
+
+[default]
+pattern = .*
+`
+	as, err := ParseAggregations(strings.NewReader(conf))
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	tests := []struct {
+		name         string
+		method       Method
+		xFilesFactor float64
+	}{
+		{"servers.web1.requests.count", MethodSum, 0},
+		{"servers.web1.errors.max", MethodMax, 0.1},
+		{"servers.web1.loadavg5", MethodAverage, 0},
+	}
+	for _, tc := range tests {
+		a := as.Match(tc.name)
+		if a.Method != tc.method || a.XFilesFactor != tc.xFilesFactor {
+			t.Fatalf("Match(%q) should be (%s, %v), not (%s, %v)", tc.name, tc.method, tc.xFilesFactor, a.Method, a.XFilesFactor)
+		}
+	}
+	if a := Aggregations(nil).Match("servers.web1.loadavg5"); a != DefaultAggregation {
+		t.Fatalf("Match should return DefaultAggregation, not %s", a.Name)
+	}
+
+	for _, conf := range []string{
+		"[a]\naggregationMethod = sum",
+		"[a]\npattern = .*\naggregationMethod = median",
+		"[a]\npattern = .*\nxFilesFactor = 2",
+		"[a]\npattern = .*\nretentions = 1m:1d",
+	} {
+		if _, err := ParseAggregations(strings.NewReader(conf)); err == nil {
+			t.Fatalf("ParseAggregations(%q) should raise err", conf)
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package schema
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/timeparser"
+)
+
+const (
+	// DefaultRetentions is the retentions of the series matching no schema.
+	DefaultRetentions = "1m:1d,5m:7d,1h:30d,1d:1y"
+
+	// maxItemPoints is the maximum number of the datapoints in a DynamoDB item.
+	maxItemPoints = 500
+)
+
+var (
+	// itemEpochSteps are the candidates of the period of a DynamoDB item.
+	itemEpochSteps = []int64{60 * 60, 60 * 60 * 24, 60 * 60 * 24 * 7, 60 * 60 * 24 * 365}
+
+	// Default is the schema of the series matching no schema.
+	Default = mustNew("default", ".*", false, DefaultRetentions)
+)
+
+// Retention is a resolution of the datapoints and how long they are kept.
+type Retention struct {
+	// Slot is the step formatted such as '1m', which is the prefix of the Redis keys.
+	Slot string
+	// History is the period to keep formatted such as '7d'.
+	History string
+	// Step and Period are the seconds of Slot and History.
+	Step   int64
+	Period int64
+	// ItemEpochStep is the period of the datapoints in a DynamoDB item.
+	ItemEpochStep int64
+	// FlushPoints is the number of the datapoints buffered in Redis before they are
+	// flushed and rolled up into the next retention.
+	FlushPoints int
+	// Last is whether it is the last retention of the schema, which is never
+	// rolled up.
+	Last bool
+}
+
+// AlignTimestamp returns the timestamp aligned by the step.
+func (r *Retention) AlignTimestamp(timestamp int64) int64 {
+	return timestamp - timestamp%r.Step
+}
+
+// ItemEpoch returns the start of the DynamoDB item including the timestamp.
+func (r *Retention) ItemEpoch(timestamp int64) int64 {
+	return timestamp - timestamp%r.ItemEpochStep
+}
+
+// Schema is the retentions of the series whose names match the pattern.
+type Schema struct {
+	Name       string
+	Pattern    string
+	Retentions []*Retention
+	re         *regexp.Regexp
+}
+
+// New creates a new Schema. The pattern is a glob such as 'servers.*.cpu.*' if
+// glob is true, or a regular expression.
+func New(name, pattern string, glob bool, retentions string) (*Schema, error) {
+	expr := pattern
+	if glob {
+		expr = globToRegexp(pattern)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid pattern of schema %s", name)
+	}
+	rs, err := ParseRetentions(retentions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid retentions of schema %s", name)
+	}
+	return &Schema{Name: name, Pattern: pattern, Retentions: rs, re: re}, nil
+}
+
+func mustNew(name, pattern string, glob bool, retentions string) *Schema {
+	s, err := New(name, pattern, glob, retentions)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Match returns whether the name matches the pattern.
+func (s *Schema) Match(name string) bool {
+	return s.re.MatchString(name)
+}
+
+// Index returns the index of the retention of the slot, or -1 if not found.
+func (s *Schema) Index(slot string) int {
+	for i, r := range s.Retentions {
+		if r.Slot == slot {
+			return i
+		}
+	}
+	return -1
+}
+
+// Select returns the finest retention which keeps the range from start until
+// end, or the coarsest retention if none keeps it.
+func (s *Schema) Select(start, end time.Time) *Retention {
+	diff := int64(end.Sub(start).Seconds())
+	for _, r := range s.Retentions {
+		if diff < r.Period {
+			return r
+		}
+	}
+	return s.Retentions[len(s.Retentions)-1]
+}
+
+// Archive is the part of a range read from a retention.
+type Archive struct {
+	Retention *Retention
+	Start     time.Time
+	End       time.Time
+}
+
+// Archives returns the parts of the range from start until end, each of which
+// is read from the finest retention keeping it at now, from the newest part.
+// The part older than all the retentions is read from the coarsest one. The
+// step of the last archive is the coarsest, and the boundaries of the parts are
+// aligned by it, so the datapoints consolidated into the step are read from
+// only one of the parts.
+func (s *Schema) Archives(start, end, now time.Time) []*Archive {
+	if start.After(end) {
+		return nil
+	}
+	// The oldest timestamp kept by each retention but the coarsest one, until
+	// the one keeping start.
+	var (
+		retentions = []*Retention{}
+		bounds     = []int64{}
+	)
+	for i, r := range s.Retentions {
+		oldest := now.Unix() - r.Period
+		if i == len(s.Retentions)-1 || oldest <= start.Unix() {
+			retentions = append(retentions, r)
+			break
+		}
+		if oldest <= end.Unix() {
+			retentions = append(retentions, r)
+			bounds = append(bounds, oldest)
+		}
+	}
+	step := retentions[len(retentions)-1].Step
+	archives := make([]*Archive, 0, len(retentions))
+	last := end.Unix()
+	for i, r := range retentions {
+		first := start.Unix()
+		if i < len(bounds) {
+			// The first step wholly kept by the finer retention.
+			first = (bounds[i] + step - 1) / step * step
+		}
+		if first <= last {
+			archives = append(archives, &Archive{Retention: r, Start: time.Unix(first, 0), End: time.Unix(last, 0)})
+			last = first - 1
+		}
+	}
+	return archives
+}
+
+// RawPoints returns the number of the raw datapoints in the step, which are
+// the datapoints of the finest retention.
+func (s *Schema) RawPoints(step int64) int64 {
+	return step / s.Retentions[0].Step
+}
+
+// Schemas is the list of the schemas matched in order.
+type Schemas []*Schema
+
+// Match returns the first schema matching the name, or Default if none matches.
+func (ss Schemas) Match(name string) *Schema {
+	for _, s := range ss {
+		if s.Match(name) {
+			return s
+		}
+	}
+	return Default
+}
+
+// GroupNames groups the names by the matching schema.
+func (ss Schemas) GroupNames(names []string) map[*Schema][]string {
+	groups := map[*Schema][]string{}
+	for _, name := range names {
+		s := ss.Match(name)
+		groups[s] = append(groups[s], name)
+	}
+	return groups
+}
+
+// Slots returns the slots of all the schemas including Default ordered by the step.
+func (ss Schemas) Slots() []*Retention {
+	var slots []*Retention
+	seen := map[string]bool{}
+	for _, s := range append(append(Schemas{}, ss...), Default) {
+		for _, r := range s.Retentions {
+			if seen[r.Slot] {
+				continue
+			}
+			seen[r.Slot] = true
+			i := len(slots)
+			for i > 0 && slots[i-1].Step > r.Step {
+				i--
+			}
+			slots = append(slots, nil)
+			copy(slots[i+1:], slots[i:])
+			slots[i] = r
+		}
+	}
+	return slots
+}
+
+// ParseRetentions parses the comma-separated retentions such as '1m:1d,5m:7d'.
+// Each retention is the step and the history in the units such as '10s' and '1y',
+// or the step in seconds and the number of the datapoints such as '60:1440'.
+// The step of each retention must be a multiple of the previous one.
+func ParseRetentions(s string) ([]*Retention, error) {
+	var rs []*Retention
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		kv := strings.SplitN(part, ":", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("retention %q must be 'step:history'", part)
+		}
+		step, err := parseSeconds(kv[0], 1)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid step of retention %q", part)
+		}
+		period, err := parseSeconds(kv[1], step)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid history of retention %q", part)
+		}
+		if step <= 0 || period < step {
+			return nil, errors.Errorf("retention %q must have a positive step and a longer history", part)
+		}
+		if n := len(rs); n > 0 {
+			prev := rs[n-1]
+			if step <= prev.Step || step%prev.Step != 0 {
+				return nil, errors.Errorf("step of retention %q must be a multiple of %s", part, prev.Slot)
+			}
+			if period < prev.Period {
+				return nil, errors.Errorf("history of retention %q must not be shorter than %s", part, prev.History)
+			}
+			prev.FlushPoints = int(step / prev.Step)
+		}
+		rs = append(rs, &Retention{
+			Slot:          formatSeconds(step),
+			History:       formatSeconds(period),
+			Step:          step,
+			Period:        period,
+			ItemEpochStep: ItemEpochStep(step),
+			FlushPoints:   1,
+		})
+	}
+	rs[len(rs)-1].Last = true
+	return rs, nil
+}
+
+// parseSeconds parses the duration such as '10s' or the number multiplied by unit.
+func parseSeconds(s string, unit int64) (int64, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n * unit, nil
+	}
+	if s == "" || s[0] < '0' || s[0] > '9' {
+		return 0, errors.Errorf("%q is not a duration", s)
+	}
+	d, err := timeparser.ParseTimeOffset(s)
+	if err != nil {
+		return 0, err
+	}
+	return int64(d.Seconds()), nil
+}
+
+// formatSeconds formats the seconds in the largest unit dividing them.
+func formatSeconds(sec int64) string {
+	switch {
+	case sec%(60*60*24) == 0:
+		return fmt.Sprintf("%dd", sec/(60*60*24))
+	case sec%(60*60) == 0:
+		return fmt.Sprintf("%dh", sec/(60*60))
+	case sec%60 == 0:
+		return fmt.Sprintf("%dm", sec/60)
+	}
+	return fmt.Sprintf("%ds", sec)
+}
+
+// ItemEpochStep returns the longest candidate period of a DynamoDB item holding
+// at most maxItemPoints datapoints of the step, or the step itself if none.
+func ItemEpochStep(step int64) int64 {
+	selected := step
+	for _, s := range itemEpochSteps {
+		if s%step == 0 && s/step <= maxItemPoints {
+			selected = s
+		}
+	}
+	return selected
+}
+
+// globToRegexp converts the glob such as 'servers.*.cpu.{user,system}' into the
+// regular expression matching the whole name. '*' and '?' don't match '.'.
+func globToRegexp(glob string) string {
+	var b bytes.Buffer
+	b.WriteString("^")
+	inBrace := false
+	for _, r := range glob {
+		switch {
+		case r == '*':
+			b.WriteString(`[^.]*`)
+		case r == '?':
+			b.WriteString(`[^.]`)
+		case r == '{':
+			inBrace = true
+			b.WriteString("(?:")
+		case r == '}' && inBrace:
+			inBrace = false
+			b.WriteString(")")
+		case r == ',' && inBrace:
+			b.WriteString("|")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// Parse parses the schemas in the format of storage-schemas.conf of Graphite.
+// Each section has 'retentions' and either 'pattern' of a regular expression or
+// 'glob'. The schemas are matched in the order of the sections.
+//
+//	[business]
+//	pattern = ^business\.
+//	retentions = 10s:6h,1m:7d,10m:5y
+//
+//	[hosts]
+//	glob = servers.*.cpu.*
+//	retentions = 1m:1d,1h:30d,1d:2y
+func Parse(r io.Reader) (Schemas, error) {
+	sections, err := parseSections(r, "pattern", "glob", "retentions")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse schemas")
+	}
+	ss := make(Schemas, 0, len(sections))
+	for _, sec := range sections {
+		pattern, glob, err := sec.pattern()
+		if err != nil {
+			return nil, err
+		}
+		if sec.values["retentions"] == "" {
+			return nil, errors.Errorf("line %d: schema %s must have 'retentions'", sec.line, sec.name)
+		}
+		s, err := New(sec.name, pattern, glob, sec.values["retentions"])
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", sec.line)
+		}
+		ss = append(ss, s)
+	}
+	return ss, nil
+}
+
+// section is a section of the configuration file in the INI format.
+type section struct {
+	name   string
+	line   int
+	values map[string]string
+}
+
+// pattern returns the value of either 'pattern' or 'glob' of the section.
+func (sec *section) pattern() (string, bool, error) {
+	pattern, glob := sec.values["pattern"], sec.values["glob"]
+	switch {
+	case pattern != "" && glob != "":
+		return "", false, errors.Errorf("line %d: %s must not have both 'pattern' and 'glob'", sec.line, sec.name)
+	case pattern != "":
+		return pattern, false, nil
+	case glob != "":
+		return glob, true, nil
+	}
+	return "", false, errors.Errorf("line %d: %s must have 'pattern' or 'glob'", sec.line, sec.name)
+}
+
+// parseSections parses the sections having only the keys. The lines starting
+// with '#' or ';' are comments.
+func parseSections(r io.Reader, keys ...string) ([]*section, error) {
+	known := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		known[key] = true
+	}
+	var (
+		sections []*section
+		cur      *section
+	)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			cur = &section{name: strings.TrimSpace(line[1 : len(line)-1]), line: n, values: map[string]string{}}
+			sections = append(sections, cur)
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if cur == nil || len(kv) != 2 {
+			return nil, errors.Errorf("line %d: must be '[name]' or 'key = value'", n)
+		}
+		key := strings.TrimSpace(kv[0])
+		if !known[key] {
+			return nil, errors.Errorf("line %d: unknown key %q", n, key)
+		}
+		cur.values[key] = strings.TrimSpace(kv[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return sections, nil
+}
+
+// Load loads the schemas from the file.
+func Load(path string) (Schemas, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s", path)
+	}
+	defer f.Close()
+	ss, err := Parse(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", path)
+	}
+	return ss, nil
+}
@@ -0,0 +1,232 @@
+package schema
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestParseRetentions(t *testing.T) {
+	tests := []struct {
+		desc     string
+		in       string
+		expected []*Retention
+	}{
+		{
+			"default",
+			DefaultRetentions,
+			[]*Retention{
+				{Slot: "1m", History: "1d", Step: 60, Period: 86400, ItemEpochStep: 3600, FlushPoints: 5},
+				{Slot: "5m", History: "7d", Step: 300, Period: 604800, ItemEpochStep: 86400, FlushPoints: 12},
+				{Slot: "1h", History: "30d", Step: 3600, Period: 2592000, ItemEpochStep: 604800, FlushPoints: 24},
+				{Slot: "1d", History: "365d", Step: 86400, Period: 31536000, ItemEpochStep: 31536000, FlushPoints: 1, Last: true},
+			},
+		},
+		{
+			"high resolution",
+			"10s:6h, 1min:7d, 10m:5y",
+			[]*Retention{
+				{Slot: "10s", History: "6h", Step: 10, Period: 21600, ItemEpochStep: 3600, FlushPoints: 6},
+				{Slot: "1m", History: "7d", Step: 60, Period: 604800, ItemEpochStep: 3600, FlushPoints: 10},
+				{Slot: "10m", History: "1825d", Step: 600, Period: 157680000, ItemEpochStep: 86400, FlushPoints: 1, Last: true},
+			},
+		},
+		{
+			"seconds and points",
+			"60:1440,3600:720",
+			[]*Retention{
+				{Slot: "1m", History: "1d", Step: 60, Period: 86400, ItemEpochStep: 3600, FlushPoints: 60},
+				{Slot: "1h", History: "30d", Step: 3600, Period: 2592000, ItemEpochStep: 604800, FlushPoints: 1, Last: true},
+			},
+		},
+	}
+	for _, tc := range tests {
+		got, err := ParseRetentions(tc.in)
+		if err != nil {
+			t.Fatalf("desc: %s, should not raise err: %s", tc.desc, err)
+		}
+		if diff := pretty.Compare(got, tc.expected); diff != "" {
+			t.Fatalf("desc: %s, diff: (-actual +expected)\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestParseRetentions_Error(t *testing.T) {
+	tests := []string{
+		"",
+		"1m",
+		"1m:foo",
+		"xx:1d",
+		"1m:30s",
+		"5m:1d,1m:7d",
+		"2m:1d,3m:7d",
+		"1m:7d,5m:1d",
+	}
+	for _, in := range tests {
+		if _, err := ParseRetentions(in); err == nil {
+			t.Fatalf("ParseRetentions(%q) should raise err", in)
+		}
+	}
+}
+
+func TestSchemasMatch(t *testing.T) {
+	business, err := New("business", `^business\.`, false, "10s:6h,1m:7d,10m:5y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := New("hosts", "servers.*.cpu.{user,system}", true, "1m:1d,1h:30d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := Schemas{business, hosts}
+	tests := []struct {
+		name     string
+		expected *Schema
+	}{
+		{"business.sales", business},
+		{"servers.web1.cpu.user", hosts},
+		{"servers.web1.cpu.idle", Default},
+		{"servers.web1.web2.cpu.user", Default},
+		{"server1.loadavg5", Default},
+	}
+	for _, tc := range tests {
+		if got := ss.Match(tc.name); got != tc.expected {
+			t.Fatalf("Match(%q) should be %s, not %s", tc.name, tc.expected.Name, got.Name)
+		}
+	}
+
+	var slots []string
+	for _, r := range ss.Slots() {
+		slots = append(slots, r.Slot)
+	}
+	if diff := pretty.Compare(slots, []string{"10s", "1m", "5m", "10m", "1h", "1d"}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestSchemaSelect(t *testing.T) {
+	tests := []struct {
+		start time.Time
+		end   time.Time
+		slot  string
+	}{
+		{time.Unix(100, 0), time.Unix(6000, 0), "1m"},
+		{time.Unix(10000, 0), time.Unix(100000, 0), "5m"},
+		{time.Unix(100000, 0), time.Unix(1000000, 0), "1h"},
+		{time.Unix(1000000, 0), time.Unix(10000000, 0), "1d"},
+		{time.Unix(1000000, 0), time.Unix(100000000, 0), "1d"},
+	}
+	for _, tc := range tests {
+		if got := Default.Select(tc.start, tc.end); got.Slot != tc.slot {
+			t.Fatalf("Select(%d, %d) should be %s, not %s", tc.start.Unix(), tc.end.Unix(), tc.slot, got.Slot)
+		}
+	}
+}
+
+func TestSchemaArchives(t *testing.T) {
+	type archive struct {
+		slot       string
+		start, end int64
+	}
+	tests := []struct {
+		desc       string
+		start, end int64
+		now        int64
+		expected   []archive
+	}{
+		{
+			"recent range kept by the finest retention",
+			992800, 1000000, 1000000,
+			[]archive{{"1m", 992800, 1000000}},
+		},
+		{
+			"range split at the step of the coarser retention",
+			827200, 1000000, 1000000,
+			[]archive{{"1m", 913800, 1000000}, {"5m", 827200, 913799}},
+		},
+		{
+			"finer part empty after aligned",
+			900000, 913700, 1000000,
+			[]archive{{"5m", 900000, 913700}},
+		},
+		{
+			"old range kept by a coarser retention",
+			0, 1000, 1000000,
+			[]archive{{"1h", 0, 1000}},
+		},
+		{
+			"range older than all the retentions",
+			0, 1000, 100000000,
+			[]archive{{"1d", 0, 1000}},
+		},
+		{
+			"empty range",
+			1000, 0, 1000000,
+			[]archive{},
+		},
+	}
+	for _, tc := range tests {
+		got := []archive{}
+		for _, a := range Default.Archives(time.Unix(tc.start, 0), time.Unix(tc.end, 0), time.Unix(tc.now, 0)) {
+			got = append(got, archive{a.Retention.Slot, a.Start.Unix(), a.End.Unix()})
+		}
+		if diff := pretty.Compare(got, tc.expected); diff != "" {
+			t.Fatalf("%s: diff: (-actual +expected)\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestSchemaRawPoints(t *testing.T) {
+	business, err := New("business", `^business\.`, false, "10s:6h,1m:7d,10m:5y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := business.RawPoints(600); got != 60 {
+		t.Fatalf("RawPoints(600) should be 60, not %d", got)
+	}
+	if got := Default.RawPoints(86400); got != 1440 {
+		t.Fatalf("RawPoints(86400) should be 1440, not %d", got)
+	}
+}
+
+func TestParse(t *testing.T) {
+	conf := `
+# high resolution business metrics
+[business]
+pattern = ^business\.
+retentions = 10s:6h,1m:7d,10m:5y
+
+; cheap host metrics
+[hosts]
+glob = servers.*
+retentions = 1m:1d,1h:30d
+`
+	ss, err := Parse(strings.NewReader(conf))
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	var got [][]string
+	for _, s := range ss {
+		got = append(got, []string{s.Name, s.Pattern, s.Retentions[0].Slot})
+	}
+	expected := [][]string{
+		{"business", `^business\.`, "10s"},
+		{"hosts", "servers.*", "1m"},
+	}
+	if diff := pretty.Compare(got, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	for _, conf := range []string{
+		"pattern = .*",
+		"[a]\nretentions = 1m:1d",
+		"[a]\npattern = .*\nretentions = 1m:1d\nfoo = bar",
+		"[a]\npattern = (\nretentions = 1m:1d",
+	} {
+		if _, err := Parse(strings.NewReader(conf)); err == nil {
+			t.Fatalf("Parse(%q) should raise err", conf)
+		}
+	}
+}
@@ -1,16 +1,20 @@
 package storage
 
 import (
-	"strings"
+	"log"
 	"time"
 
+	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/yuuki/diamondb/pkg/config"
-	"github.com/yuuki/diamondb/pkg/mathutil"
 	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/cold"
 	"github.com/yuuki/diamondb/pkg/storage/dynamodb"
+	"github.com/yuuki/diamondb/pkg/storage/objstore"
 	"github.com/yuuki/diamondb/pkg/storage/redis"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
+	"github.com/yuuki/diamondb/pkg/storage/util"
 )
 
 // ReadWriter defines the interface for data store reader and writer.
@@ -21,48 +25,95 @@ type ReadWriter interface {
 	InsertMetric(*model.Metric) error
 }
 
-// Store provides each data store client.
+// Store is the ordered chain of the tiers from the hottest one. The datapoints
+// are written into the slots of the first tier, and the datapoints taken out of
+// a slot are written into the next tiers and rolled up into the next slot.
 type Store struct {
-	Redis    redis.ReadWriter
-	DynamoDB dynamodb.ReadWriter
-	// s3 client
+	Tiers []Tier
+	// stats is the fetch counters of each tier.
+	stats []tierCounters
 }
 
 var _ ReadWriter = &Store{}
 
-// New create a new Store wrapped by ReadWriter.
-func New() (*Store, error) {
+// NewStore creates a new Store of the chain of the tiers.
+func NewStore(tiers ...Tier) *Store {
+	return &Store{
+		Tiers: tiers,
+		stats: make([]tierCounters, len(tiers)),
+	}
+}
+
+// Clients provides each data store client of the default tiers, which are
+// shared with the flusher and the compactor.
+type Clients struct {
+	Redis    redis.ReadWriter
+	DynamoDB dynamodb.ReadWriter
+	// Cold is the cold tier, or nil if no cold storage is configured.
+	Cold cold.ReadWriter
+}
+
+// NewClients creates the clients of the default tiers.
+func NewClients() (*Clients, error) {
 	d, err := dynamodb.New()
 	if err != nil {
 		return nil, err
 	}
-	return &Store{
+	c := &Clients{
 		Redis:    redis.New(),
 		DynamoDB: d,
-	}, nil
+	}
+	if config.Config.ColdStorage != "" {
+		store, err := objstore.New(config.Config.ColdStorage)
+		if err != nil {
+			return nil, err
+		}
+		c.Cold = cold.New(store)
+	}
+	return c, nil
+}
+
+// Tiers returns the default chain of Redis, DynamoDB and the cold tier if any.
+func (c *Clients) Tiers() []Tier {
+	tiers := []Tier{&RedisTier{Redis: c.Redis}, &DynamoDBTier{DynamoDB: c.DynamoDB}}
+	if c.Cold != nil {
+		tiers = append(tiers, &ColdTier{Cold: c.Cold})
+	}
+	return tiers
+}
+
+// New create a new Store of the default tiers wrapped by ReadWriter.
+func New() (*Store, error) {
+	c, err := NewClients()
+	if err != nil {
+		return nil, err
+	}
+	return NewStore(c.Tiers()...), nil
 }
 
-// Ping pings each storage.
+// Ping pings each tier.
 func (s *Store) Ping() error {
 	eg := errgroup.Group{}
-	eg.Go(func() error {
-		return s.Redis.Ping()
-	})
-	eg.Go(func() error {
-		return s.DynamoDB.Ping()
-	})
+	for _, tier := range s.Tiers {
+		tier := tier
+		eg.Go(func() error {
+			return tier.Ping()
+		})
+	}
 	return eg.Wait()
 }
 
-// Init initializes the store object.
+// Init initializes the tiers. It returns an error if the store has no tiers.
 func (s *Store) Init() error {
-	err := s.DynamoDB.CreateTable(&dynamodb.CreateTableParam{
-		Name: config.Config.DynamoDBTableName,
-		RCU:  config.Config.DynamoDBTableReadCapacityUnits,
-		WCU:  config.Config.DynamoDBTableWriteCapacityUnits,
-	})
-	if err != nil {
-		return err
+	if len(s.Tiers) == 0 {
+		return errors.New("store has no tiers")
+	}
+	for _, tier := range s.Tiers {
+		if i, ok := tier.(Initializer); ok {
+			if err := i.Init(); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
@@ -84,167 +135,270 @@ func (f *futureSeriesMap) Get() (model.SeriesMap, error) {
 	return f.result, f.err
 }
 
-// Fetch fetches series from Redis, DynamoDB and S3.
-// TODO S3
+// Fetch fetches series from the tiers in parallel. The names are grouped by the
+// schema, and each part of the range is fetched from the finest retention
+// keeping it, which is fetched from the tiers routed by the range. The series of
+// a retention are merged in the order of the chain, so the datapoints of the
+// colder tiers take precedence over the hotter ones of the same timestamps. The
+// series of the finer retentions are consolidated into the step of the coarsest
+// one, so each series has the uniform step. If some of the items of DynamoDB are
+// given up, it returns the series fetched with *PartialError.
 func (s *Store) Fetch(name string, start, end time.Time) (model.SeriesSlice, error) {
-	fredis := newFutureSeriesMap()
-	fdynamodb := newFutureSeriesMap()
-
-	// Redis task
-	go func(name string, start, end time.Time) {
-		fredis.result, fredis.err = s.Redis.Fetch(name, start, end)
-		fredis.done <- struct{}{}
-	}(name, start, end)
-
-	// DynamoDB task
-	go func(name string, start, end time.Time) {
-		fdynamodb.result, fdynamodb.err = s.DynamoDB.Fetch(name, start, end)
-		fdynamodb.done <- struct{}{}
-	}(name, start, end)
-
-	smR, err := fredis.Get()
-	if err != nil {
-		return nil, err
-	}
-	smD, err := fdynamodb.Get()
-	if err != nil {
-		return nil, err
-	}
+	return s.fetch(name, start, end, time.Now())
+}
+
+// archiveFetch is the fetches of a part of the range from a retention, which
+// are consolidated into the step.
+type archiveFetch struct {
+	step    int64
+	fetches []*tierFetch
+	futures []*futureSeriesMap
+}
 
-	ss := smR.MergePointsToSlice(smD)
-	return ss, nil
-}
-
-var (
-	retentions  = []string{"1m:1d", "5m:7d", "1h:30d", "1d:1y"}
-	timeSlotMap = map[string]map[string]int{
-		"1m": {
-			"timestampStep":  60,
-			"itemEpochStep":  60 * 60,
-			"numberOfPoints": 5,
-			"flushPoints":    5,
-		},
-		"5m": {
-			"timestampStep":  60 * 5,
-			"itemEpochStep":  60 * 60 * 24,
-			"numberOfPoints": 12,
-			"flushPoints":    12,
-		},
-		"1h": {
-			"timestampStep":  60 * 60,
-			"itemEpochStep":  60 * 60 * 24 * 7,
-			"numberOfPoints": 24,
-			"flushPoints":    24,
-		},
-		"1d": {
-			"timestampStep":  60 * 60 * 24,
-			"itemEpochStep":  60 * 60 * 24 * 365,
-			"numberOfPoints": -1,
-			"flushPoints":    1,
-		},
+func (s *Store) fetch(name string, start, end, now time.Time) (model.SeriesSlice, error) {
+	var archives []*archiveFetch
+	for sch, names := range config.Config.StorageSchemas.GroupNames(util.SplitName(name)) {
+		as := sch.Archives(start, end, now)
+		if len(as) == 0 {
+			continue
+		}
+		step := as[len(as)-1].Retention.Step
+		for _, a := range as {
+			fs, err := s.route(names, a.Retention, a.Start, a.End, now)
+			if err != nil {
+				return nil, err
+			}
+			archives = append(archives, &archiveFetch{step: step, fetches: fs})
+		}
 	}
-)
 
-func itemEpochFromTimestamp(slot string, timestamp int64) int64 {
-	itemEpochStep := timeSlotMap[slot]["itemEpochStep"]
-	return timestamp - timestamp%int64(itemEpochStep)
-}
+	for _, a := range archives {
+		for _, f := range a.fetches {
+			future := newFutureSeriesMap()
+			go func(f *tierFetch) {
+				future.result, future.err = s.fetchTier(f)
+				future.done <- struct{}{}
+			}(f)
+			a.futures = append(a.futures, future)
+		}
+	}
 
-func alignedTimestamp(slot string, timestamp int64) int64 {
-	timestampStep := timeSlotMap[slot]["timestampStep"]
-	return timestamp - timestamp%int64(timestampStep)
+	sm := model.SeriesMap{}
+	var partial error
+	for _, a := range archives {
+		smA := model.SeriesMap{}
+		for _, f := range a.futures {
+			smT, err := f.Get()
+			if perr, ok := err.(*dynamodb.PartialError); ok {
+				if partial == nil {
+					partial = perr
+				}
+			} else if err != nil {
+				return nil, err
+			}
+			smA = smA.MergePointsToMap(smT)
+		}
+		for name, sp := range smA {
+			smA[name] = util.Consolidate(sp, a.step)
+		}
+		// The parts of the range of the retentions don't overlap.
+		sm = sm.MergePointsToMap(smA)
+	}
+	if partial != nil {
+		return sm.MergePointsToSlice(model.SeriesMap{}), &PartialError{Err: partial}
+	}
+	return sm.MergePointsToSlice(model.SeriesMap{}), nil
 }
 
-// InsertMetric inserts datapoints to Redis with rollup aggregation
-// to DynamoDB if needed.
+// InsertMetric inserts datapoints into the first tier with rollup aggregation
+// to the next tiers if needed. The datapoints are put into the first slot, and
+// taken out of each slot and rolled up into the next one atomically by a Redis
+// script per series once they reach flushPoints, so the writers of the same
+// series never roll up the same datapoints twice. The datapoints taken out are
+// kept pending until they are flushed to the next tiers. The error of the
+// datapoints failed to be flushed is logged instead of returned, since they are
+// flushed again by SweepIdle and writing them again is not needed.
 func (s *Store) InsertMetric(m *model.Metric) error {
+	if len(m.Datapoints) == 0 {
+		return nil
+	}
+	if len(s.Tiers) == 0 {
+		return errors.New("store has no tiers")
+	}
+	roller, ok := s.Tiers[0].(Roller)
+	if !ok {
+		return errors.Errorf("%s tier doesn't roll up datapoints", s.Tiers[0].Name())
+	}
+	tv := make(map[int64]*model.Aggregate, len(m.Datapoints))
 	for _, p := range m.Datapoints {
-		slot := strings.SplitN(retentions[0], ":", 2)[0]
-		if err := s.Redis.Put(slot, m.Name, p); err != nil {
+		tv[p.Timestamp] = model.NewAggregate(p.Timestamp, p.Value)
+	}
+	retentions := config.Config.StorageSchemas.Match(m.Name).Retentions
+	claims, err := roller.WriteRollup(m.Name, retentions, tv, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := s.flushClaims(roller, m.Name, claims); err != nil {
+		if !isFlushError(err) {
 			return err
 		}
+		log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+	}
+	return nil
+}
 
-		for i, retention := range retentions {
-			if i == (len(retentions) - 1) {
-				break
+// flushClaims flushes the datapoints of the claims taken out of the first tier
+// into the next tiers, and acknowledges the claims written into the next tier.
+// The claims failed to be written are left pending to be flushed again by
+// SweepIdle, which writes the same datapoints again, so the next tier must
+// write them idempotently as DynamoDB does. It continues flushing the other
+// claims if some of them fail, and returns the first error of the datapoints
+// lost if any, or *FlushError.
+func (s *Store) flushClaims(roller Roller, name string, claims []*Claim) error {
+	var firstErr error
+	for _, c := range claims {
+		err := s.markFlushed(c.Retention, name, c.Points)
+		if err != nil {
+			err = &FlushError{Err: err}
+		} else {
+			var flushed map[int64]*model.Aggregate
+			flushed, err = s.flushOrRestore(1, c.Retention, name, c.Points)
+			if len(flushed) == len(c.Points) {
+				if aerr := roller.Ack(name, c); aerr != nil && err == nil {
+					err = &FlushError{Err: aerr}
+				}
 			}
+		}
+		if err != nil && (firstErr == nil || isFlushError(firstErr) && !isFlushError(err)) {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
 
-			parts := strings.SplitN(retention, ":", 2)
-			slot, history := parts[0], parts[1]
+// SweepIdle flushes the datapoints of the series which are left in the first
+// tier because they stop being written before reaching flushPoints. A series is
+// idle in a slot if no datapoint is newer than age plus the step of the slot.
+// The datapoints of the idle series are flushed and rolled up into the coarser
+// slots, which are swept next. The claims pending for age because they failed
+// to be flushed are flushed again. The slots of all the schemas are swept in
+// the order of the step, and the series whose schema has no slot swept are
+// skipped. It returns the number of the flushed buffers, and continues sweeping
+// the other series if some of them fail. Nothing is swept unless the first tier
+// is an IdleClaimer.
+func (s *Store) SweepIdle(now time.Time, age time.Duration) (int, error) {
+	var (
+		flushed  int
+		firstErr error
+	)
+	if len(s.Tiers) == 0 {
+		return 0, nil
+	}
+	ic, ok := s.Tiers[0].(IdleClaimer)
+	if !ok {
+		return 0, nil
+	}
+	for _, slot := range config.Config.StorageSchemas.Slots() {
+		cutoff := now.Add(-age).Unix() - slot.Step
 
-			n, err := s.Redis.Len(slot, m.Name)
-			if err != nil {
-				return err
+		names, err := ic.Names(slot.Slot)
+		if err != nil {
+			return flushed, err
+		}
+		for _, name := range names {
+			sch := config.Config.StorageSchemas.Match(name)
+			i := sch.Index(slot.Slot)
+			if i < 0 {
+				continue
 			}
-			if n >= int64(timeSlotMap[slot]["numberOfPoints"]) {
-				tv, err := s.Redis.Get(slot, m.Name)
-				if err != nil {
-					return err
-				}
-				nextSlot := strings.SplitN(retentions[i+1], ":", 2)[0]
-				if err := s.rollup(nextSlot, m.Name, tv); err != nil {
-					return err
-				}
+			claims, err := ic.ClaimPending(name, sch.Retentions[i], now.Add(-age))
+			if err == nil {
+				var idle []*Claim
+				idle, err = ic.ClaimIdle(name, sch.Retentions[i:], cutoff, now)
+				claims = append(claims, idle...)
 			}
-			if n >= int64(timeSlotMap[slot]["flushPoints"]) {
-				if err := s.flush(slot, history, m.Name); err != nil {
-					return err
+			if err == nil && len(claims) > 0 {
+				if err = s.flushClaims(ic, name, claims); err == nil {
+					flushed++
 				}
 			}
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
 		}
 	}
-	return nil
+	return flushed, firstErr
 }
 
-func (s *Store) rollup(slot string, name string, tvmap map[int64]float64) error {
-	for _, tv := range groupByItemEpoch(slot, tvmap) {
-		for t, vals := range groupByAlignedTimestamp(slot, tv) {
-			p := &model.Datapoint{
-				Timestamp: t,
-				Value:     mathutil.AvgFloat64(vals),
-			}
-			if err := s.Redis.Put(slot, name, p); err != nil {
-				return err
+// flushOrRestore writes the datapoints taken out of the tier at k-1 into the
+// tier at k, and the datapoints taken out of it into the next tiers. If it
+// fails, the datapoints not written are put back into the tier at k-1 to be
+// written again later. It returns the datapoints written into the tier at k.
+func (s *Store) flushOrRestore(k int, r *schema.Retention, name string, tv map[int64]*model.Aggregate) (map[int64]*model.Aggregate, error) {
+	if k >= len(s.Tiers) {
+		err := errors.Errorf("no tier next to %s", s.Tiers[k-1].Name())
+		return nil, s.restore(k-1, r, name, tv, err)
+	}
+	claimed, err := s.Tiers[k].WriteBatch(name, r, tv)
+	if err != nil {
+		unwritten := unwrittenBy(err, tv)
+		flushed := make(map[int64]*model.Aggregate, len(tv)-len(unwritten))
+		for t, a := range tv {
+			if _, ok := unwritten[t]; !ok {
+				flushed[t] = a
 			}
 		}
+		return flushed, s.restore(k-1, r, name, unwritten, err)
 	}
-	return nil
+	if len(claimed) > 0 {
+		if _, err := s.flushOrRestore(k+1, r, name, claimed); err != nil {
+			return tv, err
+		}
+	}
+	return tv, nil
 }
 
-func (s *Store) flush(slot, history, name string) error {
-	tv1, err := s.Redis.Get(slot, name)
-	if err != nil {
-		return err
+// markFlushed records the newest timestamp of the datapoints taken out of the
+// first tier if it is a Watermarker. It is recorded before they are flushed, so
+// the readers never miss them in the next tier.
+func (s *Store) markFlushed(r *schema.Retention, name string, tv map[int64]*model.Aggregate) error {
+	w, ok := s.Tiers[0].(Watermarker)
+	if !ok {
+		return nil
 	}
-	for itemEpoch, tv2 := range groupByItemEpoch(slot, tv1) {
-		if err := s.DynamoDB.Put(name, slot, history, itemEpoch, tv2); err != nil {
-			return err
+	var newest int64
+	first := true
+	for t := range tv {
+		if first || t > newest {
+			newest, first = t, false
 		}
 	}
-	if err := s.Redis.Delete(slot, name); err != nil {
-		return err
-	}
-	return nil
+	return w.MarkFlushed(name, r, newest)
 }
 
-func groupByAlignedTimestamp(slot string, tv map[int64]float64) map[int64][]float64 {
-	groups := map[int64][]float64{}
-	for t, v := range tv {
-		aligned := alignedTimestamp(slot, t)
-		if _, ok := groups[aligned]; !ok {
-			groups[aligned] = []float64{}
-		}
-		groups[aligned] = append(groups[aligned], v)
+// restore puts back the datapoints into the tier at k because of err, and
+// returns *FlushError of err if they are kept in the tier. The datapoints of the
+// first tier are not put back since they are kept pending in it.
+func (s *Store) restore(k int, r *schema.Retention, name string, tv map[int64]*model.Aggregate, err error) error {
+	if len(tv) == 0 || k == 0 {
+		return &FlushError{Err: err}
 	}
-	return groups
+	restorer, ok := s.Tiers[k].(Restorer)
+	if !ok {
+		return errors.Wrapf(err, "failed to restore datapoints: %s is not restorable", s.Tiers[k].Name())
+	}
+	if rerr := restorer.Restore(name, r, tv); rerr != nil {
+		return errors.Wrapf(err, "failed to restore datapoints: %s", rerr)
+	}
+	return &FlushError{Err: err}
 }
 
-func groupByItemEpoch(slot string, tv map[int64]float64) map[int64]map[int64]float64 {
-	groups := map[int64]map[int64]float64{}
+func groupByItemEpoch(r *schema.Retention, tv map[int64]*model.Aggregate) map[int64]map[int64]*model.Aggregate {
+	groups := map[int64]map[int64]*model.Aggregate{}
 	for t, v := range tv {
-		itemEpoch := itemEpochFromTimestamp(slot, t)
+		itemEpoch := r.ItemEpoch(t)
 		if _, ok := groups[itemEpoch]; !ok {
-			groups[itemEpoch] = map[int64]float64{}
+			groups[itemEpoch] = map[int64]*model.Aggregate{}
 		}
 		groups[itemEpoch][t] = v
 	}
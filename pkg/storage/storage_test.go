@@ -1,7 +1,15 @@
 package storage
 
 import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/quick"
 	"time"
 
 	"github.com/alicebob/miniredis"
@@ -11,8 +19,10 @@ import (
 
 	"github.com/yuuki/diamondb/pkg/config"
 	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/cold"
 	"github.com/yuuki/diamondb/pkg/storage/dynamodb"
 	"github.com/yuuki/diamondb/pkg/storage/redis"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
 )
 
 func TestStorePing(t *testing.T) {
@@ -34,10 +44,10 @@ func TestStorePing(t *testing.T) {
 	)
 	d := dynamodb.NewTestDynamoDB(mock)
 
-	store := &Store{
-		Redis:    r,
-		DynamoDB: d,
-	}
+	store := NewStore(
+		&RedisTier{Redis: r},
+		&DynamoDBTier{DynamoDB: d},
+	)
 	err = store.Ping()
 	if err != nil {
 		t.Fatalf("should not raise err: %s", err)
@@ -46,7 +56,7 @@ func TestStorePing(t *testing.T) {
 
 func TestStoreFetch(t *testing.T) {
 	redisff := &redis.FakeReadWriter{
-		FakeFetch: func(name string, start, end time.Time) (model.SeriesMap, error) {
+		FakeFetchRetention: func(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error) {
 			return model.SeriesMap{
 				"server1.loadavg5": model.NewSeriesPoint(
 					"server1.loadavg5", model.DataPoints{
@@ -58,7 +68,7 @@ func TestStoreFetch(t *testing.T) {
 		},
 	}
 	dynamodbff := &dynamodb.FakeReadWriter{
-		FakeFetch: func(name string, start, end time.Time) (model.SeriesMap, error) {
+		FakeFetchRetention: func(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error) {
 			return model.SeriesMap{
 				"server1.loadavg5": model.NewSeriesPoint(
 					"server1.loadavg5", model.DataPoints{
@@ -70,64 +80,716 @@ func TestStoreFetch(t *testing.T) {
 		},
 	}
 
-	store := &Store{
-		Redis:    redisff,
-		DynamoDB: dynamodbff,
-	}
+	store := NewStore(
+		&RedisTier{Redis: redisff},
+		&DynamoDBTier{DynamoDB: dynamodbff},
+	)
 	_, err := store.Fetch("server1.loadavg5", time.Unix(100, 0), time.Unix(1000, 0))
 	if err != nil {
 		t.Fatalf("should not raise err: %s", err)
 	}
 }
 
-func TestStoreInsertMetric(t *testing.T) {
-	s := &Store{
-		Redis: &redis.FakeReadWriter{
-			FakeGet: func(slot string, name string) (map[int64]float64, error) {
-				return nil, nil
+func TestStoreFetch_Partial(t *testing.T) {
+	fetch := func(points ...*model.DataPoint) func([]string, *schema.Retention, time.Time, time.Time) (model.SeriesMap, error) {
+		return func(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error) {
+			return model.SeriesMap{
+				"server1.loadavg5": model.NewSeriesPoint("server1.loadavg5", points, int(r.Step)),
+			}, nil
+		}
+	}
+	store := NewStore(
+		&RedisTier{Redis: &redis.FakeReadWriter{FakeFetchRetention: fetch(model.NewDataPoint(60, 11.0))}},
+		&DynamoDBTier{DynamoDB: &dynamodb.FakeReadWriter{
+			FakeFetchRetention: func(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error) {
+				sm, _ := fetch(model.NewDataPoint(0, 10.0))(names, r, start, end)
+				return sm, &dynamodb.PartialError{Err: errors.New("throttled")}
 			},
-			FakeLen: func(slot string, name string) (int64, error) {
-				return 0, nil
+		}},
+	)
+
+	// The series fetched are returned with the error of the items given up.
+	ss, err := store.fetch("server1.loadavg5", time.Unix(0, 0), time.Unix(60, 0), time.Unix(120, 0))
+	if _, ok := err.(*PartialError); !ok {
+		t.Fatalf("err should be *PartialError: %v", err)
+	}
+	expected := model.SeriesSlice{model.NewSeries("server1.loadavg5", []float64{10.0, 11.0}, 0, 60)}
+	if diff := pretty.Compare(ss, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestStoreFetch_Cold(t *testing.T) {
+	defer func(age time.Duration) { config.Config.CompactorAge = age }(config.Config.CompactorAge)
+	config.Config.CompactorAge = 24 * time.Hour
+
+	fetch := func(points ...*model.DataPoint) func([]string, *schema.Retention, time.Time, time.Time) (model.SeriesMap, error) {
+		return func(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error) {
+			return model.SeriesMap{
+				"server1.loadavg5": model.NewSeriesPoint("server1.loadavg5", points, int(r.Step)),
+			}, nil
+		}
+	}
+	var coldFetched bool
+	store := NewStore(
+		&RedisTier{Redis: &redis.FakeReadWriter{FakeFetchRetention: fetch()}},
+		&DynamoDBTier{DynamoDB: &dynamodb.FakeReadWriter{FakeFetchRetention: fetch(model.NewDataPoint(300, 11.0))}},
+		&ColdTier{Cold: &cold.FakeReadWriter{
+			FakeFetchRetention: func(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error) {
+				coldFetched = true
+				return fetch(model.NewDataPoint(0, 10.0))(names, r, start, end)
 			},
-			FakePut: func(slot string, name string, p *model.Datapoint) error {
+		}},
+	)
+
+	// The range older than the 1m retention is fetched from the 5m one.
+	ss, err := store.fetch("server1.loadavg5", time.Unix(0, 0), time.Unix(300, 0), time.Unix(2*86400, 0))
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	expected := model.SeriesSlice{model.NewSeries("server1.loadavg5", []float64{10.0, 11.0}, 0, 300)}
+	if diff := pretty.Compare(ss, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	// The recent range is never compacted into the cold tier.
+	coldFetched = false
+	now := time.Now()
+	if _, err := store.Fetch("server1.loadavg5", now.Add(-1*time.Hour), now); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if coldFetched {
+		t.Fatal("Fetch should not fetch the cold tier for the recent range")
+	}
+}
+
+// fakeRedisHashes is the in-memory hashes of the fake Redis.
+type fakeRedisHashes map[string]map[int64]*model.Aggregate
+
+func newFakeRedisHashes(init map[string]map[int64]float64) fakeRedisHashes {
+	hashes := fakeRedisHashes{}
+	for key, tv := range init {
+		hashes[key] = map[int64]*model.Aggregate{}
+		for t, v := range tv {
+			hashes[key][t] = model.NewAggregate(t, v)
+		}
+	}
+	return hashes
+}
+
+// values returns the values of the aggregates by the default aggregation, which
+// is the average of the raw datapoints.
+func values(tv map[int64]*model.Aggregate) map[int64]float64 {
+	vals := make(map[int64]float64, len(tv))
+	for t, a := range tv {
+		vals[t] = schema.DefaultAggregation.Value(a, 0)
+	}
+	return vals
+}
+
+// putAggregate puts the aggregate into the hash as the Redis scripts do. It
+// doesn't overwrite the datapoint if nx is true unless both are rolled up.
+func putAggregate(hash map[int64]*model.Aggregate, t int64, a *model.Aggregate, nx bool) {
+	old, ok := hash[t]
+	switch {
+	case ok && !old.IsRaw() && !a.IsRaw():
+		merged := *old
+		merged.Merge(a)
+		hash[t] = &merged
+	case !ok || !nx:
+		hash[t] = a
+	}
+}
+
+// Values returns the values of the hashes. The claims pending are keyed by
+// "pending:<slot>:<name>".
+func (hashes fakeRedisHashes) Values() map[string]map[int64]float64 {
+	vals := make(map[string]map[int64]float64, len(hashes))
+	for key, tv := range hashes {
+		key = strings.SplitN(key, "#", 2)[0]
+		if vals[key] == nil {
+			vals[key] = map[int64]float64{}
+		}
+		for t, v := range values(tv) {
+			vals[key][t] = v
+		}
+	}
+	return vals
+}
+
+// fakePendingKey returns the key of the claim pending in the fake Redis.
+func fakePendingKey(slot string, name string, id string) string {
+	return "pending:" + slot + ":" + name + "#" + id
+}
+
+// rollup merges the datapoints of the finer retention into the aggregates of
+// the aligned timestamps of the coarser retention as the Redis script does.
+func rollup(coarser *schema.Retention, tvmap map[int64]*model.Aggregate) map[int64]*model.Aggregate {
+	rolled := map[int64]*model.Aggregate{}
+	for t, as := range groupByAlignedTimestamp(coarser, tvmap) {
+		rolled[t] = &model.Aggregate{RolledUp: true}
+		for _, a := range as {
+			rolled[t].Merge(a)
+		}
+	}
+	return rolled
+}
+
+// groupByAlignedTimestamp groups the values by the aligned timestamps. The values
+// of each group are ordered by the timestamps.
+func groupByAlignedTimestamp(r *schema.Retention, tv map[int64]*model.Aggregate) map[int64][]*model.Aggregate {
+	timestamps := make([]int64, 0, len(tv))
+	for t := range tv {
+		timestamps = append(timestamps, t)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	groups := map[int64][]*model.Aggregate{}
+	for _, t := range timestamps {
+		aligned := r.AlignTimestamp(t)
+		groups[aligned] = append(groups[aligned], tv[t])
+	}
+	return groups
+}
+
+// ReadWriter returns the fake Redis which puts, rolls up and claims the
+// datapoints on the hashes as the Redis scripts do.
+func (hashes fakeRedisHashes) ReadWriter() *redis.FakeReadWriter {
+	var n int
+	// putAndRollup puts the datapoints into the first slot, and rolls up the
+	// datapoints taken out of each slot into the next one.
+	putAndRollup := func(rs []*schema.Retention, name string, tv map[int64]*model.Aggregate, id string) []*redis.Claim {
+		var claims []*redis.Claim
+		for _, r := range rs {
+			if len(claims) > 0 {
+				tv = rollup(r, tv)
+			}
+			key := r.Slot + ":" + name
+			if hashes[key] == nil {
+				hashes[key] = map[int64]*model.Aggregate{}
+			}
+			for t, a := range tv {
+				putAggregate(hashes[key], t, a, false)
+			}
+			if r.Last || len(hashes[key]) < r.FlushPoints {
+				break
+			}
+			tv = hashes[key]
+			delete(hashes, key)
+			hashes[fakePendingKey(r.Slot, name, id)] = tv
+			claims = append(claims, &redis.Claim{Slot: r.Slot, ID: id, Points: tv})
+		}
+		return claims
+	}
+	newID := func(now time.Time) string {
+		n++
+		return fmt.Sprintf("%d:%d", now.Unix(), n)
+	}
+	return &redis.FakeReadWriter{
+		FakePutAndRollup: func(rs []*schema.Retention, name string, tv map[int64]*model.Aggregate, now time.Time) ([]*redis.Claim, error) {
+			return putAndRollup(rs, name, tv, newID(now)), nil
+		},
+		FakeNames: func(slot string) ([]string, error) {
+			var names []string
+			seen := map[string]bool{}
+			for key := range hashes {
+				var name string
+				switch {
+				case strings.HasPrefix(key, slot+":"):
+					name = strings.TrimPrefix(key, slot+":")
+				case strings.HasPrefix(key, "pending:"+slot+":"):
+					name = strings.SplitN(strings.TrimPrefix(key, "pending:"+slot+":"), "#", 2)[0]
+				default:
+					continue
+				}
+				if !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+			return names, nil
+		},
+		FakeClaimIdle: func(rs []*schema.Retention, name string, cutoff int64, now time.Time) ([]*redis.Claim, error) {
+			key := rs[0].Slot + ":" + name
+			if len(hashes[key]) == 0 {
+				return nil, nil
+			}
+			for t := range hashes[key] {
+				if t >= cutoff {
+					return nil, nil
+				}
+			}
+			id := newID(now)
+			claimed := hashes[key]
+			delete(hashes, key)
+			hashes[fakePendingKey(rs[0].Slot, name, id)] = claimed
+			claims := []*redis.Claim{{Slot: rs[0].Slot, ID: id, Points: claimed}}
+			if len(rs) > 1 {
+				claims = append(claims, putAndRollup(rs[1:], name, rollup(rs[1], claimed), id)...)
+			}
+			return claims, nil
+		},
+		FakeClaimPending: func(slot string, name string, before time.Time) ([]*redis.Claim, error) {
+			var claims []*redis.Claim
+			prefix := fakePendingKey(slot, name, "")
+			for key, tv := range hashes {
+				if !strings.HasPrefix(key, prefix) {
+					continue
+				}
+				id := strings.TrimPrefix(key, prefix)
+				t, err := strconv.ParseInt(strings.SplitN(id, ":", 2)[0], 10, 64)
+				if err != nil {
+					return nil, err
+				}
+				if t < before.Unix() {
+					claims = append(claims, &redis.Claim{Slot: slot, ID: id, Points: tv})
+				}
+			}
+			sort.Slice(claims, func(i, j int) bool { return claims[i].ID < claims[j].ID })
+			return claims, nil
+		},
+		FakeAck: func(slot string, name string, id string) error {
+			delete(hashes, fakePendingKey(slot, name, id))
+			return nil
+		},
+		FakeMarkFlushed: func(slot string, name string, t int64, ttl time.Duration) error {
+			return nil
+		},
+	}
+}
+
+func TestStoreInsertMetric(t *testing.T) {
+	hashes := newFakeRedisHashes(nil)
+	flushed := map[string]map[int64]float64{}
+	s := NewStore(
+		&RedisTier{Redis: hashes.ReadWriter()},
+		&DynamoDBTier{DynamoDB: &dynamodb.FakeReadWriter{
+			FakePut: func(name, slot, history string, itemEpoch int64, tv map[int64]*model.Aggregate) error {
+				flushed[slot+":"+name] = values(tv)
 				return nil
 			},
+		}},
+	)
+	err := s.InsertMetric(&model.Metric{
+		Name: "server1.loadavg5",
+		Datapoints: []*model.Datapoint{
+			{Timestamp: 0, Value: 1.0},
+			{Timestamp: 60, Value: 2.0},
+			{Timestamp: 120, Value: 3.0},
+			{Timestamp: 180, Value: 4.0},
 		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	err := s.InsertMetric(&model.Metric{
+	if len(flushed) != 0 {
+		t.Fatalf("datapoints should not be flushed: %v", flushed)
+	}
+
+	err = s.InsertMetric(&model.Metric{
 		Name:       "server1.loadavg5",
-		Datapoints: []*model.Datapoint{{Timestamp: 100, Value: 0.1}},
+		Datapoints: []*model.Datapoint{{Timestamp: 240, Value: 5.0}},
 	})
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
+	expectedFlushed := map[string]map[int64]float64{
+		"1m:server1.loadavg5": {0: 1.0, 60: 2.0, 120: 3.0, 180: 4.0, 240: 5.0},
+	}
+	if diff := pretty.Compare(flushed, expectedFlushed); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	expectedHashes := map[string]map[int64]float64{
+		"5m:server1.loadavg5": {0: 3.0},
+	}
+	if diff := pretty.Compare(hashes.Values(), expectedHashes); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
 }
 
-func TestStoreRollup(t *testing.T) {
-	s, err := miniredis.Run()
+func TestStore_NoTiers(t *testing.T) {
+	s := NewStore()
+	if err := s.Init(); err == nil {
+		t.Fatalf("Init should raise error")
+	}
+	err := s.InsertMetric(&model.Metric{
+		Name:       "server1.loadavg5",
+		Datapoints: []*model.Datapoint{{Timestamp: 0, Value: 1.0}},
+	})
+	if err == nil {
+		t.Fatalf("InsertMetric should raise error")
+	}
+	if n, err := s.SweepIdle(time.Unix(3600, 0), 10*time.Minute); err != nil || n != 0 {
+		t.Fatalf("nothing should be swept: %d, %v", n, err)
+	}
+}
+
+func TestStoreInsertMetric_Schema(t *testing.T) {
+	business, err := schema.New("business", `^business\.`, false, "10s:6h,1m:7d,10m:5y")
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
-	defer s.Close()
+	defer func(ss schema.Schemas) { config.Config.StorageSchemas = ss }(config.Config.StorageSchemas)
+	config.Config.StorageSchemas = schema.Schemas{business}
 
-	// Set mock
-	config.Config.RedisAddrs = []string{s.Addr()}
-	r := redis.New()
+	hashes := newFakeRedisHashes(nil)
+	type put struct {
+		history   string
+		itemEpoch int64
+		tv        map[int64]float64
+	}
+	flushed := map[string]put{}
+	s := NewStore(
+		&RedisTier{Redis: hashes.ReadWriter()},
+		&DynamoDBTier{DynamoDB: &dynamodb.FakeReadWriter{
+			FakePut: func(name, slot, history string, itemEpoch int64, tv map[int64]*model.Aggregate) error {
+				flushed[slot+":"+name] = put{history: history, itemEpoch: itemEpoch, tv: values(tv)}
+				return nil
+			},
+		}},
+	)
+	for _, name := range []string{"business.sales", "server1.loadavg5"} {
+		m := &model.Metric{Name: name}
+		for i := int64(0); i < 6; i++ {
+			m.Datapoints = append(m.Datapoints, &model.Datapoint{Timestamp: 3600 + i*10, Value: float64(i + 1)})
+		}
+		if err := s.InsertMetric(m); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// The same datapoints are flushed and rolled up by the retentions of each schema.
+	expectedFlushed := map[string]put{
+		"10s:business.sales": {
+			history:   "6h",
+			itemEpoch: 3600,
+			tv:        map[int64]float64{3600: 1.0, 3610: 2.0, 3620: 3.0, 3630: 4.0, 3640: 5.0, 3650: 6.0},
+		},
+		"1m:server1.loadavg5": {
+			history:   "1d",
+			itemEpoch: 3600,
+			tv:        map[int64]float64{3600: 1.0, 3610: 2.0, 3620: 3.0, 3630: 4.0, 3640: 5.0, 3650: 6.0},
+		},
+	}
+	if diff := pretty.Compare(flushed, expectedFlushed); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	expectedHashes := map[string]map[int64]float64{
+		"1m:business.sales":   {3600: 3.5},
+		"5m:server1.loadavg5": {3600: 3.5},
+	}
+	if diff := pretty.Compare(hashes.Values(), expectedHashes); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
 
-	store := &Store{Redis: r}
-	err = store.rollup("5m", "server1.loadavg5", map[int64]float64{
-		0: 0.1, 60: 0.2, 120: 0.3, 180: 0.4, 240: 0.5,
+func TestStoreInsertMetric_FlushError(t *testing.T) {
+	hashes := newFakeRedisHashes(map[string]map[int64]float64{
+		"1m:server1.loadavg5": {0: 0.1, 60: 0.2, 120: 0.3, 180: 0.4},
+	})
+	flushed := map[string]map[int64]float64{}
+	failing := true
+	s := NewStore(
+		&RedisTier{Redis: hashes.ReadWriter()},
+		&DynamoDBTier{DynamoDB: &dynamodb.FakeReadWriter{
+			FakePut: func(name, slot, history string, itemEpoch int64, tv map[int64]*model.Aggregate) error {
+				if failing {
+					return errors.New("throttled")
+				}
+				flushed[slot+":"+name] = values(tv)
+				return nil
+			},
+		}},
+	)
+	err := s.InsertMetric(&model.Metric{
+		Name:       "server1.loadavg5",
+		Datapoints: []*model.Datapoint{{Timestamp: 240, Value: 0.5}},
 	})
 	if err != nil {
+		t.Fatalf("should not raise err of the datapoints left pending: %s", err)
+	}
+	// The datapoints are rolled up, and left pending.
+	expected := map[string]map[int64]float64{
+		"pending:1m:server1.loadavg5": {0: 0.1, 60: 0.2, 120: 0.3, 180: 0.4, 240: 0.5},
+		"5m:server1.loadavg5":         {0: 0.3},
+	}
+	if diff := pretty.Compare(hashes.Values(), expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	// The datapoints pending for the age are flushed again by the sweep, which
+	// sweeps the idle slots too.
+	failing = false
+	if _, err := s.SweepIdle(time.Now().Add(2*time.Hour), time.Hour); err != nil {
 		t.Fatalf("should not raise err: %s", err)
 	}
-	got, err := r.Get("5m", "server1.loadavg5")
+	expectedFlushed := map[string]map[int64]float64{
+		"1m:server1.loadavg5": {0: 0.1, 60: 0.2, 120: 0.3, 180: 0.4, 240: 0.5},
+		"5m:server1.loadavg5": {0: 0.3},
+		"1h:server1.loadavg5": {0: 0.3},
+		"1d:server1.loadavg5": {0: 0.3},
+	}
+	if diff := pretty.Compare(flushed, expectedFlushed); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	if len(hashes) != 0 {
+		t.Fatalf("datapoints should not be left in Redis: %v", hashes.Values())
+	}
+}
+
+func TestStoreSweepIdle(t *testing.T) {
+	hashes := newFakeRedisHashes(map[string]map[int64]float64{
+		// idle
+		"1m:server1.loadavg5": {0: 1.0, 60: 2.0, 120: 3.0},
+		// active
+		"1m:server2.loadavg5": {3480: 0.1, 3540: 0.2},
+	})
+	flushed := map[string]map[int64]float64{}
+	s := NewStore(
+		&RedisTier{Redis: hashes.ReadWriter()},
+		&DynamoDBTier{DynamoDB: &dynamodb.FakeReadWriter{
+			FakePut: func(name, slot, history string, itemEpoch int64, tv map[int64]*model.Aggregate) error {
+				for t, v := range values(tv) {
+					if flushed[slot+":"+name] == nil {
+						flushed[slot+":"+name] = map[int64]float64{}
+					}
+					flushed[slot+":"+name][t] = v
+				}
+				return nil
+			},
+		}},
+	)
+
+	n, err := s.SweepIdle(time.Unix(3600, 0), 10*time.Minute)
 	if err != nil {
-		panic(err)
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if n != 2 {
+		t.Fatalf("the number of flushed buffers should be 2, not %d", n)
+	}
+	expectedFlushed := map[string]map[int64]float64{
+		"1m:server1.loadavg5": {0: 1.0, 60: 2.0, 120: 3.0},
+		"5m:server1.loadavg5": {0: 2.0},
+	}
+	if diff := pretty.Compare(flushed, expectedFlushed); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	// The rolled up datapoint is swept again in the 5m slot, but not in the 1h slot.
+	expectedHashes := map[string]map[int64]float64{
+		"1m:server2.loadavg5": {3480: 0.1, 3540: 0.2},
+		"1h:server1.loadavg5": {0: 2.0},
 	}
+	if diff := pretty.Compare(hashes.Values(), expectedHashes); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
 
-	expected := map[int64]float64{0: 0.3}
+func TestRollup(t *testing.T) {
+	// The datapoints rolled up into 5m are rolled up again into 1h.
+	tvmap := map[int64]*model.Aggregate{
+		0:    {Min: 1.0, Max: 5.0, Sum: 15.0, Count: 5, Last: 2.0, LastTimestamp: 240, RolledUp: true},
+		300:  {Min: 6.0, Max: 10.0, Sum: 24.0, Count: 3, Last: 6.0, LastTimestamp: 480, RolledUp: true},
+		600:  model.NewAggregate(600, 20.0),
+		3600: model.NewAggregate(3600, 1.0),
+	}
+	got := rollup(schema.Default.Retentions[2], tvmap)
+	expected := map[int64]*model.Aggregate{
+		0:    {Min: 1.0, Max: 20.0, Sum: 59.0, Count: 9, Last: 20.0, LastTimestamp: 600, RolledUp: true},
+		3600: {Min: 1.0, Max: 1.0, Sum: 1.0, Count: 1, Last: 1.0, LastTimestamp: 3600, RolledUp: true},
+	}
 	if diff := pretty.Compare(got, expected); diff != "" {
-		t.Fatalf("storage.rollup(5m, server1.loadavg5, ); diff (-actual +expected)\n%s", diff)
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+// flushedElement is an element of the binary set of a DynamoDB item.
+type flushedElement struct {
+	timestamp int64
+	aggregate model.Aggregate
+}
+
+// TestStoreRollup_Batch checks the property that the datapoints finally rolled
+// up and flushed are the same as the ones rolled up from all the raw datapoints
+// at once, however the raw datapoints are written in batches out of order,
+// delivered again, swept partially, and failed to be flushed or acknowledged.
+func TestStoreRollup_Batch(t *testing.T) {
+	const name = "server1.loadavg5"
+	retentions := schema.Default.Retentions
+
+	f := func(seed int64) bool {
+		rnd := rand.New(rand.NewSource(seed))
+
+		// The raw datapoints in 3 days of integer values, which are summed exactly
+		// in any order.
+		raw := map[int64]float64{}
+		for n := 1 + rnd.Intn(500); len(raw) < n; {
+			raw[int64(rnd.Intn(3*1440))*60] = float64(rnd.Intn(201) - 100)
+		}
+		timestamps := make([]int64, 0, len(raw))
+		for ts := range raw {
+			timestamps = append(timestamps, ts)
+		}
+		sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+		// Shuffle the timestamps locally to write them slightly out of order.
+		for i := range timestamps {
+			j := i + rnd.Intn(10)
+			if j < len(timestamps) {
+				timestamps[i], timestamps[j] = timestamps[j], timestamps[i]
+			}
+		}
+
+		hashes := newFakeRedisHashes(nil)
+		flushed := map[string]map[flushedElement]bool{}
+		failing := true
+		rw := hashes.ReadWriter()
+		putAndRollup, ack := rw.FakePutAndRollup, rw.FakeAck
+		var claimed bool
+		rw.FakePutAndRollup = func(rs []*schema.Retention, name string, tv map[int64]*model.Aggregate, now time.Time) ([]*redis.Claim, error) {
+			claims, err := putAndRollup(rs, name, tv, now)
+			claimed = len(claims) > 0
+			return claims, err
+		}
+		// The claims failed to be acknowledged are flushed again by the sweep.
+		rw.FakeAck = func(slot string, name string, id string) error {
+			if failing && rnd.Intn(10) == 0 {
+				return errors.New("unavailable")
+			}
+			return ack(slot, name, id)
+		}
+		s := NewStore(
+			&RedisTier{Redis: rw},
+			&DynamoDBTier{DynamoDB: &dynamodb.FakeReadWriter{
+				FakePut: func(name, slot, history string, itemEpoch int64, tv map[int64]*model.Aggregate) error {
+					if failing && rnd.Intn(10) == 0 {
+						return errors.New("throttled")
+					}
+					if flushed[slot] == nil {
+						flushed[slot] = map[flushedElement]bool{}
+					}
+					for ts, a := range tv {
+						flushed[slot][flushedElement{timestamp: ts, aggregate: *a}] = true
+					}
+					return nil
+				},
+			}},
+		)
+		for len(timestamps) > 0 {
+			n := 1 + rnd.Intn(10)
+			if n > len(timestamps) {
+				n = len(timestamps)
+			}
+			m := &model.Metric{Name: name}
+			for _, ts := range timestamps[:n] {
+				m.Datapoints = append(m.Datapoints, &model.Datapoint{Timestamp: ts, Value: raw[ts]})
+			}
+			timestamps = timestamps[n:]
+			// The datapoints failed to be flushed are left pending in Redis, so
+			// the writer need not write them again.
+			if err := s.InsertMetric(m); err != nil {
+				t.Logf("seed %d: should not raise err: %s", seed, err)
+				return false
+			}
+			// The metric is delivered again unless its datapoints are taken out,
+			// as the queue redelivers the metric not acknowledged.
+			if !claimed && rnd.Intn(5) == 0 {
+				if err := s.InsertMetric(m); err != nil {
+					t.Logf("seed %d: should not raise err: %s", seed, err)
+					return false
+				}
+			}
+			if rnd.Intn(20) == 0 {
+				s.SweepIdle(time.Unix(m.Datapoints[0].Timestamp, 0), time.Duration(rnd.Intn(3600))*time.Second)
+			}
+		}
+		failing = false
+		if _, err := s.SweepIdle(time.Unix(1<<32, 0), 0); err != nil {
+			t.Logf("seed %d: should not raise err: %s", seed, err)
+			return false
+		}
+		if len(hashes) != 0 {
+			t.Logf("seed %d: datapoints should not be left in Redis: %v", seed, hashes.Values())
+			return false
+		}
+
+		for _, r := range retentions {
+			got := map[int64]*model.Aggregate{}
+			for e := range flushed[r.Slot] {
+				a := e.aggregate
+				if prev, ok := got[e.timestamp]; ok {
+					prev.Merge(&a)
+				} else {
+					got[e.timestamp] = &a
+				}
+			}
+			expected := map[int64]*model.Aggregate{}
+			for ts, v := range raw {
+				if r == retentions[0] {
+					expected[ts] = model.NewAggregate(ts, v)
+					continue
+				}
+				aligned := r.AlignTimestamp(ts)
+				if expected[aligned] == nil {
+					expected[aligned] = &model.Aggregate{RolledUp: true}
+				}
+				expected[aligned].Merge(model.NewAggregate(ts, v))
+			}
+			if diff := pretty.Compare(got, expected); diff != "" {
+				t.Logf("seed %d, slot %s: diff: (-actual +expected)\n%s", seed, r.Slot, diff)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 200}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreFetch_Archives(t *testing.T) {
+	type fetch struct {
+		slot       string
+		start, end int64
+	}
+	var (
+		mu      sync.Mutex
+		fetches []fetch
+	)
+	tier := &fakeTier{
+		name: "hot",
+		fakeFetch: func(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error) {
+			mu.Lock()
+			fetches = append(fetches, fetch{r.Slot, start.Unix(), end.Unix()})
+			mu.Unlock()
+			points := model.DataPoints{model.NewDataPoint(913500, 7.0)}
+			if r.Slot == "1m" {
+				points = model.DataPoints{model.NewDataPoint(913800, 1.0), model.NewDataPoint(913860, 3.0)}
+			}
+			return model.SeriesMap{
+				"server1.loadavg5": model.NewSeriesPoint("server1.loadavg5", points, int(r.Step)),
+			}, nil
+		},
+	}
+	store := NewStore(tier)
+
+	// The recent part of the 2 days is fetched from the 1m retention, and the
+	// older part from the 5m one.
+	ss, err := store.fetch("server1.loadavg5", time.Unix(827200, 0), time.Unix(1000000, 0), time.Unix(1000000, 0))
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	sort.Slice(fetches, func(i, j int) bool { return fetches[i].start > fetches[j].start })
+	expectedFetches := []fetch{{"1m", 913800, 1000000}, {"5m", 827200, 913799}}
+	if diff := pretty.Compare(fetches, expectedFetches); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	if len(ss) != 1 {
+		t.Fatalf("should fetch a series, not %d", len(ss))
+	}
+	// The datapoints of the 1m retention are consolidated into 5m without gaps.
+	if ss[0].Start() != 913500 || ss[0].Step() != 300 {
+		t.Fatalf("series should start at 913500 with step 300: start %d, step %d", ss[0].Start(), ss[0].Step())
+	}
+	if diff := pretty.Compare(ss[0].Values(), []float64{7.0, 2.0}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
 	}
 }
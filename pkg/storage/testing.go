@@ -9,10 +9,20 @@ import (
 // FakeReadWriter is for stub testing
 type FakeReadWriter struct {
 	ReadWriter
+	FakePing         func() error
+	FakeInit         func() error
 	FakeFetch        func(name string, start, end time.Time) (model.SeriesSlice, error)
 	FakeInsertMetric func(*model.Metric) error
 }
 
+func (s *FakeReadWriter) Ping() error {
+	return s.FakePing()
+}
+
+func (s *FakeReadWriter) Init() error {
+	return s.FakeInit()
+}
+
 func (s *FakeReadWriter) Fetch(name string, start, end time.Time) (model.SeriesSlice, error) {
 	return s.FakeFetch(name, start, end)
 }
@@ -0,0 +1,363 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/config"
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/cold"
+	"github.com/yuuki/diamondb/pkg/storage/dynamodb"
+	"github.com/yuuki/diamondb/pkg/storage/redis"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
+)
+
+// Tier defines the interface for a layer of the Store holding the datapoints
+// of a range of ages. The tiers of a Store are chained from the hottest one.
+// The datapoints are written into the first tier, and the datapoints taken out
+// of a tier are written into the next one.
+type Tier interface {
+	// Name returns the name of the tier to be reported.
+	Name() string
+	Ping() error
+	// Fetch fetches the datapoints of the names in the retention from start
+	// until end.
+	Fetch(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error)
+	// WriteBatch writes the datapoints of the series in the retention. A tier
+	// buffering the datapoints returns the ones taken out of it to be written
+	// into the next tier, and a tier persisting them returns nothing. It
+	// returns *WriteError if some of the datapoints are written before failing.
+	WriteBatch(name string, r *schema.Retention, tv map[int64]*model.Aggregate) (map[int64]*model.Aggregate, error)
+	// Retention returns the range of the ages of the datapoints of the
+	// retention the tier holds. The zero max is unbounded.
+	Retention(r *schema.Retention) (min, max time.Duration)
+}
+
+// Restorer is the tier which puts back the datapoints taken out of it if the
+// next tier fails to write them.
+type Restorer interface {
+	Restore(name string, r *schema.Retention, tv map[int64]*model.Aggregate) error
+}
+
+// Claim is the datapoints taken out of the slot of the retention by a Roller,
+// which are kept pending in it until Ack.
+type Claim struct {
+	Retention *schema.Retention
+	ID        string
+	Points    map[int64]*model.Aggregate
+}
+
+// Roller is the first tier which rolls up the datapoints taken out of a slot
+// into the next slot in the same atomic write as taking them out, so the
+// writers of the same series never roll up the same datapoints twice. The
+// datapoints taken out are kept pending in it until Ack, so they are never lost
+// if the next tiers fail to write them.
+type Roller interface {
+	// WriteRollup puts the datapoints into the slot of the first retention, and
+	// returns the claims of the datapoints taken out of the slots.
+	WriteRollup(name string, rs []*schema.Retention, tv map[int64]*model.Aggregate, now time.Time) ([]*Claim, error)
+	Ack(name string, c *Claim) error
+}
+
+// IdleClaimer is the Roller which takes out the datapoints of the series which
+// stop being written, and the claims left pending because the next tiers fail
+// to write them or the writer crashes, to be swept by Store.SweepIdle.
+type IdleClaimer interface {
+	Roller
+	Names(slot string) ([]string, error)
+	ClaimIdle(name string, rs []*schema.Retention, cutoff int64, now time.Time) ([]*Claim, error)
+	ClaimPending(name string, r *schema.Retention, before time.Time) ([]*Claim, error)
+}
+
+// Watermarker is the tier which records the newest timestamps of the datapoints
+// taken out of it, so the next tier is fetched only for the series and the
+// range which the datapoints are written into. The series never marked may
+// have the datapoints written into the next tier before they are recorded. The
+// datapoints newer than the timestamp are read from the tier even if they are
+// older than its Retention, since they may be written late or backfilled.
+type Watermarker interface {
+	MarkFlushed(name string, r *schema.Retention, t int64) error
+	Flushed(names []string, r *schema.Retention) (map[string]int64, error)
+}
+
+// Initializer is the tier which is initialized by Store.Init.
+type Initializer interface {
+	Init() error
+}
+
+// WriteError is the error of WriteBatch which writes some of the datapoints
+// before failing.
+type WriteError struct {
+	Err error
+	// Unwritten is the datapoints not written.
+	Unwritten map[int64]*model.Aggregate
+}
+
+func (e *WriteError) Error() string {
+	return e.Err.Error()
+}
+
+// Cause returns the underlying error for errors.Cause.
+func (e *WriteError) Cause() error {
+	return e.Err
+}
+
+// FlushError is the error of the datapoints failed to be flushed into the next
+// tiers, which are kept in the tier they are taken out of to be flushed again.
+// The writer need not write them again.
+type FlushError struct {
+	Err error
+}
+
+func (e *FlushError) Error() string {
+	return e.Err.Error()
+}
+
+// Cause returns the underlying error for errors.Cause.
+func (e *FlushError) Cause() error {
+	return e.Err
+}
+
+func isFlushError(err error) bool {
+	_, ok := err.(*FlushError)
+	return ok
+}
+
+// PartialError is the error of Fetch which gives up fetching some of the
+// datapoints from a tier. The series fetched are returned with it, so they are
+// rendered with the warning.
+type PartialError struct {
+	Err error
+}
+
+func (e *PartialError) Error() string {
+	return e.Err.Error()
+}
+
+// Cause returns the underlying error for errors.Cause.
+func (e *PartialError) Cause() error {
+	return e.Err
+}
+
+// unwrittenBy returns the datapoints which WriteBatch failing with err leaves
+// unwritten.
+func unwrittenBy(err error, tv map[int64]*model.Aggregate) map[int64]*model.Aggregate {
+	if werr, ok := err.(*WriteError); ok {
+		return werr.Unwritten
+	}
+	return tv
+}
+
+// RedisTier is the tier buffering the datapoints into the slots of Redis. The
+// datapoints of a slot are taken out once they reach the flushPoints of the
+// retention, except for the last retention of the schema.
+type RedisTier struct {
+	Redis redis.ReadWriter
+}
+
+var (
+	_ Tier        = &RedisTier{}
+	_ IdleClaimer = &RedisTier{}
+	_ Watermarker = &RedisTier{}
+)
+
+// Name returns the name of the tier.
+func (t *RedisTier) Name() string {
+	return "redis"
+}
+
+// Ping pings Redis.
+func (t *RedisTier) Ping() error {
+	return t.Redis.Ping()
+}
+
+// Fetch fetches datapoints from the slot.
+func (t *RedisTier) Fetch(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error) {
+	return t.Redis.FetchRetention(names, r, start, end)
+}
+
+// WriteBatch always fails because the slots are written by WriteRollup.
+func (t *RedisTier) WriteBatch(name string, r *schema.Retention, tv map[int64]*model.Aggregate) (map[int64]*model.Aggregate, error) {
+	return nil, errors.Errorf("redis tier is written only as the first tier")
+}
+
+// WriteRollup puts the datapoints into the slot, and rolls up the datapoints
+// taken out of each slot into the next one by a Redis script.
+func (t *RedisTier) WriteRollup(name string, rs []*schema.Retention, tv map[int64]*model.Aggregate, now time.Time) ([]*Claim, error) {
+	claims, err := t.Redis.PutAndRollup(rs, name, tv, now)
+	if err != nil {
+		return nil, err
+	}
+	return toClaims(rs, claims), nil
+}
+
+// toClaims converts the claims of Redis into the claims of the retentions of
+// their slots.
+func toClaims(rs []*schema.Retention, claims []*redis.Claim) []*Claim {
+	ret := make([]*Claim, 0, len(claims))
+	for _, c := range claims {
+		for _, r := range rs {
+			if r.Slot == c.Slot {
+				ret = append(ret, &Claim{Retention: r, ID: c.ID, Points: c.Points})
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// Ack deletes the claim pending in the slot.
+func (t *RedisTier) Ack(name string, c *Claim) error {
+	return t.Redis.Ack(c.Retention.Slot, name, c.ID)
+}
+
+// Retention returns the range of the datapoints left in the slot. The
+// datapoints of a series are taken out every flushPoints, and the datapoints of
+// an idle series are swept by the flusher after the idle age. The range is
+// bounded only if the flusher runs in-process, which is the only flusher known
+// to run. The last slot is never taken out except for the idle series, so it is
+// unbounded. The datapoints written late or backfilled are read by the flushed
+// timestamps of the series, except that the ones older than the timestamp are
+// missed until they are taken out, at most the same bound after they are written.
+func (t *RedisTier) Retention(r *schema.Retention) (time.Duration, time.Duration) {
+	if !config.Config.Flusher || r.Last {
+		return 0, 0
+	}
+	max := time.Duration(int64(r.FlushPoints+1)*r.Step) * time.Second
+	return 0, max + config.Config.FlusherIdleAge + config.Config.FlusherInterval
+}
+
+// Names returns the names of the series buffered or pending in the slot.
+func (t *RedisTier) Names(slot string) ([]string, error) {
+	return t.Redis.Names(slot)
+}
+
+// ClaimIdle takes out the datapoints of the series if it is idle, and rolls
+// them up.
+func (t *RedisTier) ClaimIdle(name string, rs []*schema.Retention, cutoff int64, now time.Time) ([]*Claim, error) {
+	claims, err := t.Redis.ClaimIdle(rs, name, cutoff, now)
+	if err != nil {
+		return nil, err
+	}
+	return toClaims(rs, claims), nil
+}
+
+// ClaimPending returns the claims pending in the slot since before the time.
+func (t *RedisTier) ClaimPending(name string, r *schema.Retention, before time.Time) ([]*Claim, error) {
+	claims, err := t.Redis.ClaimPending(r.Slot, name, before)
+	if err != nil {
+		return nil, err
+	}
+	return toClaims([]*schema.Retention{r}, claims), nil
+}
+
+// MarkFlushed records the newest timestamp of the datapoints taken out of the
+// slot. It is forgotten after the history of the retention unless the series
+// is flushed again, so the idle series are pruned.
+func (t *RedisTier) MarkFlushed(name string, r *schema.Retention, ts int64) error {
+	return t.Redis.MarkFlushed(r.Slot, name, ts, time.Duration(r.Period)*time.Second)
+}
+
+// Flushed returns the newest timestamps of the datapoints taken out of the
+// slot.
+func (t *RedisTier) Flushed(names []string, r *schema.Retention) (map[string]int64, error) {
+	return t.Redis.Flushed(r.Slot, names)
+}
+
+// DynamoDBTier is the tier persisting the datapoints into the items of
+// DynamoDB.
+type DynamoDBTier struct {
+	DynamoDB dynamodb.ReadWriter
+}
+
+var (
+	_ Tier        = &DynamoDBTier{}
+	_ Initializer = &DynamoDBTier{}
+)
+
+// Name returns the name of the tier.
+func (t *DynamoDBTier) Name() string {
+	return "dynamodb"
+}
+
+// Ping pings DynamoDB.
+func (t *DynamoDBTier) Ping() error {
+	return t.DynamoDB.Ping()
+}
+
+// Init creates the table.
+func (t *DynamoDBTier) Init() error {
+	return t.DynamoDB.CreateTable(&dynamodb.CreateTableParam{
+		Name: config.Config.DynamoDBTableName,
+		RCU:  config.Config.DynamoDBTableReadCapacityUnits,
+		WCU:  config.Config.DynamoDBTableWriteCapacityUnits,
+	})
+}
+
+// Fetch fetches datapoints from the items.
+func (t *DynamoDBTier) Fetch(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error) {
+	return t.DynamoDB.FetchRetention(names, r, start, end)
+}
+
+// WriteBatch puts the datapoints by item. If it fails, the datapoints of the
+// items not put are unwritten.
+func (t *DynamoDBTier) WriteBatch(name string, r *schema.Retention, tv map[int64]*model.Aggregate) (map[int64]*model.Aggregate, error) {
+	var (
+		unwritten = map[int64]*model.Aggregate{}
+		err       error
+	)
+	for itemEpoch, tv2 := range groupByItemEpoch(r, tv) {
+		if err == nil {
+			err = t.DynamoDB.Put(name, r.Slot, r.History, itemEpoch, tv2)
+		}
+		if err != nil {
+			for ts, a := range tv2 {
+				unwritten[ts] = a
+			}
+		}
+	}
+	if err != nil {
+		return nil, &WriteError{Err: err, Unwritten: unwritten}
+	}
+	return nil, nil
+}
+
+// Retention returns the unbounded range because the items are evicted by the
+// compactor only if the cold tier holds them.
+func (t *DynamoDBTier) Retention(r *schema.Retention) (time.Duration, time.Duration) {
+	return 0, 0
+}
+
+// ColdTier is the tier of the blocks compacted from DynamoDB. It is written by
+// the compactor instead of the chain.
+type ColdTier struct {
+	Cold cold.ReadWriter
+}
+
+var _ Tier = &ColdTier{}
+
+// Name returns the name of the tier.
+func (t *ColdTier) Name() string {
+	return "cold"
+}
+
+// Ping pings the object storage.
+func (t *ColdTier) Ping() error {
+	return t.Cold.Ping()
+}
+
+// Fetch fetches datapoints from the blocks.
+func (t *ColdTier) Fetch(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error) {
+	return t.Cold.FetchRetention(names, r, start, end)
+}
+
+// WriteBatch always fails because the blocks are written by the compactor.
+func (t *ColdTier) WriteBatch(name string, r *schema.Retention, tv map[int64]*model.Aggregate) (map[int64]*model.Aggregate, error) {
+	return nil, errors.Errorf("cold tier is written only by the compactor")
+}
+
+// Retention returns the range older than the age of the items compacted.
+func (t *ColdTier) Retention(r *schema.Retention) (time.Duration, time.Duration) {
+	return config.Config.CompactorAge, 0
+}
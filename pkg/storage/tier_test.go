@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+	pkgerrors "github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/config"
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/dynamodb"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
+)
+
+// fakeTier is the tier of the fake functions, which is restorable.
+type fakeTier struct {
+	name           string
+	min, max       time.Duration
+	fakeFetch      func(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error)
+	fakeWriteBatch func(name string, r *schema.Retention, tv map[int64]*model.Aggregate) (map[int64]*model.Aggregate, error)
+	restored       map[string]map[int64]float64
+}
+
+func (t *fakeTier) Name() string { return t.name }
+
+func (t *fakeTier) Ping() error { return nil }
+
+func (t *fakeTier) Fetch(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error) {
+	return t.fakeFetch(names, r, start, end)
+}
+
+func (t *fakeTier) WriteBatch(name string, r *schema.Retention, tv map[int64]*model.Aggregate) (map[int64]*model.Aggregate, error) {
+	return t.fakeWriteBatch(name, r, tv)
+}
+
+func (t *fakeTier) Retention(r *schema.Retention) (time.Duration, time.Duration) {
+	return t.min, t.max
+}
+
+func (t *fakeTier) Restore(name string, r *schema.Retention, tv map[int64]*model.Aggregate) error {
+	if t.restored == nil {
+		t.restored = map[string]map[int64]float64{}
+	}
+	t.restored[r.Slot+":"+name] = values(tv)
+	return nil
+}
+
+func TestDynamoDBTierWriteBatch(t *testing.T) {
+	r := schema.Default.Retentions[0]
+	tv := map[int64]*model.Aggregate{
+		0:                    model.NewAggregate(0, 1.0),
+		r.ItemEpochStep:      model.NewAggregate(r.ItemEpochStep, 2.0),
+		r.ItemEpochStep + 60: model.NewAggregate(r.ItemEpochStep+60, 3.0),
+		2 * r.ItemEpochStep:  model.NewAggregate(2*r.ItemEpochStep, 4.0),
+	}
+	throttled := errors.New("throttled")
+	var puts int
+	tier := &DynamoDBTier{DynamoDB: &dynamodb.FakeReadWriter{
+		FakePut: func(name, slot, history string, itemEpoch int64, tv map[int64]*model.Aggregate) error {
+			puts++
+			if itemEpoch == r.ItemEpochStep {
+				return throttled
+			}
+			return nil
+		},
+	}}
+
+	claimed, err := tier.WriteBatch("server1.loadavg5", r, tv)
+	if len(claimed) != 0 {
+		t.Fatalf("datapoints should not be taken out: %v", claimed)
+	}
+	werr, ok := err.(*WriteError)
+	if !ok {
+		t.Fatalf("err should be *WriteError: %#v", err)
+	}
+	if pkgerrors.Cause(err) != throttled {
+		t.Fatalf("cause should be %s: %s", throttled, pkgerrors.Cause(err))
+	}
+	// The items after the failed one are not put.
+	if _, ok := werr.Unwritten[r.ItemEpochStep]; !ok {
+		t.Fatalf("datapoints of the failed item should be unwritten: %v", values(werr.Unwritten))
+	}
+	if got := len(tv) - len(werr.Unwritten); got != puts-1 {
+		t.Fatalf("datapoints of the items put should be written: %d written by %d puts", got, puts)
+	}
+}
+
+func TestStoreFetch_Tiers(t *testing.T) {
+	fetch := func(fetched *bool, points ...*model.DataPoint) func([]string, *schema.Retention, time.Time, time.Time) (model.SeriesMap, error) {
+		return func(names []string, r *schema.Retention, start, end time.Time) (model.SeriesMap, error) {
+			*fetched = true
+			return model.SeriesMap{
+				"server1.loadavg5": model.NewSeriesPoint("server1.loadavg5", points, 60),
+			}, nil
+		}
+	}
+	now := time.Now()
+	start := now.Add(-1*time.Hour).Unix() / 60 * 60
+	var hot, warm, cold bool
+	s := NewStore(
+		&fakeTier{name: "hot", max: 2 * time.Hour, fakeFetch: fetch(&hot, model.NewDataPoint(start, 1.0))},
+		&fakeTier{name: "warm", fakeFetch: fetch(&warm, model.NewDataPoint(start, 2.0), model.NewDataPoint(start+60, 3.0))},
+		&fakeTier{name: "cold", min: 24 * time.Hour, fakeFetch: fetch(&cold, model.NewDataPoint(start-60, 4.0))},
+	)
+
+	ss, err := s.Fetch("server1.loadavg5", time.Unix(start, 0), now)
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	// The datapoints of the colder tier take precedence.
+	expected := model.SeriesSlice{model.NewSeries("server1.loadavg5", []float64{2.0, 3.0}, start, 60)}
+	if diff := pretty.Compare(ss, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	if !hot || !warm || cold {
+		t.Fatalf("only the hot and warm tiers should be fetched: hot %v, warm %v, cold %v", hot, warm, cold)
+	}
+
+	hot, warm, cold = false, false, false
+	if _, err := s.Fetch("server1.loadavg5", now.Add(-72*time.Hour), now.Add(-48*time.Hour)); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if hot || !warm || !cold {
+		t.Fatalf("only the warm and cold tiers should be fetched: hot %v, warm %v, cold %v", hot, warm, cold)
+	}
+}
+
+func TestRedisTierRetention(t *testing.T) {
+	defer func(flusher bool) { config.Config.Flusher = flusher }(config.Config.Flusher)
+	tier := &RedisTier{}
+	r := schema.Default.Retentions[0]
+	last := schema.Default.Retentions[len(schema.Default.Retentions)-1]
+
+	config.Config.Flusher = false
+	if _, max := tier.Retention(r); max != 0 {
+		t.Fatalf("retention should be unbounded without the flusher: %s", max)
+	}
+
+	config.Config.Flusher = true
+	expected := 6*time.Minute + config.Config.FlusherIdleAge + config.Config.FlusherInterval
+	if _, max := tier.Retention(r); max != expected {
+		t.Fatalf("retention should be bounded by the flush: %s, expected %s", max, expected)
+	}
+	if _, max := tier.Retention(last); max != 0 {
+		t.Fatalf("retention of the last slot should be unbounded: %s", max)
+	}
+}
+
+func TestStoreInsertMetric_Tiers(t *testing.T) {
+	// The datapoints taken out of Redis are buffered in the warm tier, and taken
+	// out of it into the persistent tier, which fails. The datapoints are kept in
+	// the warm tier, so the writer need not write them again.
+	hashes := newFakeRedisHashes(map[string]map[int64]float64{
+		"1m:server1.loadavg5": {0: 0.1, 60: 0.2, 120: 0.3, 180: 0.4},
+	})
+	warm := &fakeTier{
+		name: "warm",
+		fakeWriteBatch: func(name string, r *schema.Retention, tv map[int64]*model.Aggregate) (map[int64]*model.Aggregate, error) {
+			return tv, nil
+		},
+	}
+	s := NewStore(
+		&RedisTier{Redis: hashes.ReadWriter()},
+		warm,
+		&fakeTier{
+			name: "persistent",
+			fakeWriteBatch: func(name string, r *schema.Retention, tv map[int64]*model.Aggregate) (map[int64]*model.Aggregate, error) {
+				return nil, errors.New("unavailable")
+			},
+		},
+	)
+	err := s.InsertMetric(&model.Metric{
+		Name:       "server1.loadavg5",
+		Datapoints: []*model.Datapoint{{Timestamp: 240, Value: 0.5}},
+	})
+	if err != nil {
+		t.Fatalf("should not raise err of the datapoints restored: %s", err)
+	}
+	// The datapoints are put back into the warm tier, and rolled up because the
+	// warm tier has written them.
+	expectedRestored := map[string]map[int64]float64{
+		"1m:server1.loadavg5": {0: 0.1, 60: 0.2, 120: 0.3, 180: 0.4, 240: 0.5},
+	}
+	if diff := pretty.Compare(warm.restored, expectedRestored); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	expectedHashes := map[string]map[int64]float64{
+		"5m:server1.loadavg5": {0: 0.3},
+	}
+	if diff := pretty.Compare(hashes.Values(), expectedHashes); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
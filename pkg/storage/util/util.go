@@ -1,7 +1,11 @@
 package util
 
 import (
+	"math"
 	"strings"
+
+	"github.com/yuuki/diamondb/pkg/config"
+	"github.com/yuuki/diamondb/pkg/model"
 )
 
 // GroupNames groups the names by count.
@@ -34,3 +38,56 @@ func SplitName(name string) []string {
 	}
 	return names
 }
+
+// SanitizeNode replaces the characters having special meaning in a series name,
+// such as the separator and the braces expanded by SplitName, with '_'.
+// ex. host1.example.com:9100 => host1_example_com:9100
+func SanitizeNode(node string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ',', '{', '}', '(', ')', ' ', '\t', '\n', '\r':
+			return '_'
+		}
+		return r
+	}, node)
+}
+
+// Finalize sets the Value of the aggregate rolled up into the step by the
+// aggregation of the series.
+func Finalize(name string, step int64, a *model.Aggregate) {
+	if a.IsRaw() {
+		return
+	}
+	sch := config.Config.StorageSchemas.Match(name)
+	a.Value = config.Config.StorageAggregations.Match(name).Value(a, sch.RawPoints(step))
+}
+
+// Consolidate consolidates the datapoints of the series into the coarser step
+// by merging the datapoints in each step as they are rolled up. The series is
+// returned as it is if the step is not coarser.
+func Consolidate(sp *model.SeriesPoint, step int64) *model.SeriesPoint {
+	if int64(sp.Step()) >= step {
+		return sp
+	}
+	tv := map[int64]*model.Aggregate{}
+	for _, p := range sp.Points() {
+		a := p.Aggregate()
+		if a == nil {
+			if math.IsNaN(p.Value()) {
+				continue
+			}
+			a = model.NewAggregate(p.Timestamp(), p.Value())
+		}
+		t := p.Timestamp() - p.Timestamp()%step
+		if _, ok := tv[t]; !ok {
+			tv[t] = &model.Aggregate{RolledUp: true}
+		}
+		tv[t].Merge(a)
+	}
+	points := make(model.DataPoints, 0, len(tv))
+	for t, a := range tv {
+		Finalize(sp.Name(), step, a)
+		points = append(points, model.NewAggregatedDataPoint(t, a))
+	}
+	return model.NewSeriesPoint(sp.Name(), points, int(step))
+}
@@ -2,9 +2,12 @@ package util
 
 import (
 	"fmt"
+	"math"
 	"testing"
 
 	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
 )
 
 func TestGroupNames(t *testing.T) {
@@ -36,3 +39,47 @@ func TestSplitName(t *testing.T) {
 		t.Fatalf("diff: (-actual +expected)\n%s", diff)
 	}
 }
+
+func TestSanitizeNode(t *testing.T) {
+	tests := []struct {
+		node     string
+		expected string
+	}{
+		{"loadavg5", "loadavg5"},
+		{"host1.example.com:9100", "host1_example_com:9100"},
+		{"server{1,2}", "server_1_2_"},
+		{"disk (sda)", "disk__sda_"},
+	}
+	for _, tc := range tests {
+		if got := SanitizeNode(tc.node); got != tc.expected {
+			t.Fatalf("SanitizeNode(%q) should be %q, not %q", tc.node, tc.expected, got)
+		}
+	}
+}
+
+func TestConsolidate(t *testing.T) {
+	sp := model.NewSeriesPoint("server1.loadavg5", model.DataPoints{
+		model.NewDataPoint(0, 1.0),
+		model.NewDataPoint(60, 2.0),
+		model.NewDataPoint(300, 3.0),
+		model.NewDataPoint(360, math.NaN()),
+		model.NewAggregatedDataPoint(600, &model.Aggregate{
+			Value: 4.0, Min: 3.0, Max: 5.0, Sum: 8.0, Count: 2, Last: 5.0, LastTimestamp: 540, RolledUp: true,
+		}),
+		model.NewDataPoint(660, 7.0),
+	}, 60)
+
+	got := Consolidate(sp, 300)
+	if got.Step() != 300 || got.Start() != 0 {
+		t.Fatalf("series should start at 0 with step 300: start %d, step %d", got.Start(), got.Step())
+	}
+	// The rolled up datapoint is merged by its accumulators, and the null
+	// datapoint is ignored.
+	if diff := pretty.Compare(got.Values(), []float64{1.5, 3.0, 5.0}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	if got := Consolidate(sp, 60); got != sp {
+		t.Fatalf("series should not be consolidated into the same step")
+	}
+}
@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/model"
+)
+
+// ValidationPolicy is the policy to validate and normalize the metrics before written.
+type ValidationPolicy struct {
+	// SanitizeName replaces the invalid characters in a name with '_' and removes
+	// the empty nodes instead of rejecting the metric.
+	SanitizeName bool
+	// MaxNameLength is the maximum length of a name in bytes. 0 means no limit.
+	MaxNameLength int
+	// MaxNameDepth is the maximum number of the nodes of a name. 0 means no limit.
+	MaxNameDepth int
+	// MaxPast and MaxFuture are the accepted window of the timestamps relative to now.
+	// 0 means no limit.
+	MaxPast   time.Duration
+	MaxFuture time.Duration
+	// StampZeroTimestamp sets the server time to the datapoints with the timestamp 0
+	// instead of rejecting them.
+	StampZeroTimestamp bool
+	// DropNaN drops the datapoints with NaN or Inf silently instead of rejecting them.
+	DropNaN bool
+}
+
+// DatapointError represents a datapoint rejected by the validation. Index is the
+// position in the datapoints of the metric.
+type DatapointError struct {
+	Index     int    `json:"index"`
+	Timestamp int64  `json:"timestamp"`
+	Reason    string `json:"reason"`
+}
+
+// ValidationError represents a metric rejected as a whole, or some datapoints of
+// a metric rejected by the validation. The other datapoints are written.
+type ValidationError struct {
+	Name       string            `json:"name"`
+	Reason     string            `json:"reason,omitempty"`
+	Datapoints []*DatapointError `json:"datapoints,omitempty"`
+}
+
+func (e *ValidationError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("invalid metric %q: %s", e.Name, e.Reason)
+	}
+	if len(e.Datapoints) == 1 {
+		return fmt.Sprintf("invalid datapoint of %q: %s", e.Name, e.Datapoints[0].Reason)
+	}
+	return fmt.Sprintf("%d invalid datapoints of %q: %s", len(e.Datapoints), e.Name, e.Datapoints[0].Reason)
+}
+
+// IsPermanent returns whether writing the metric failed with the error never
+// succeeds by retrying, because it is rejected by the validation of diamondb or
+// DynamoDB.
+func IsPermanent(err error) bool {
+	switch cerr := errors.Cause(err).(type) {
+	case *ValidationError:
+		return true
+	case awserr.Error:
+		return cerr.Code() == "ValidationException"
+	}
+	return false
+}
+
+// isInvalidNameRune returns whether the rune breaks a name at query time, such as
+// the list separator and the braces expanded by util.SplitName and the wildcards.
+func isInvalidNameRune(r rune) bool {
+	switch r {
+	case ',', '{', '}', '(', ')', '*', '?', '[', ']':
+		return true
+	}
+	return unicode.IsSpace(r) || unicode.IsControl(r) || r == unicode.ReplacementChar
+}
+
+// normalizeName validates the name and sanitizes it if SanitizeName is set. It
+// returns the reason if the name is rejected.
+func (p *ValidationPolicy) normalizeName(name string) (string, string) {
+	if name == "" {
+		return "", "metric name is empty"
+	}
+	if i := strings.IndexFunc(name, isInvalidNameRune); i >= 0 {
+		if !p.SanitizeName {
+			return "", fmt.Sprintf("metric name contains invalid character %q", []rune(name[i:])[0])
+		}
+		name = strings.Map(func(r rune) rune {
+			if isInvalidNameRune(r) {
+				return '_'
+			}
+			return r
+		}, name)
+	}
+	nodes := strings.Split(name, ".")
+	for i := 0; i < len(nodes); i++ {
+		if nodes[i] != "" {
+			continue
+		}
+		if !p.SanitizeName {
+			return "", "metric name contains an empty node"
+		}
+		nodes = append(nodes[:i], nodes[i+1:]...)
+		i--
+	}
+	if len(nodes) == 0 {
+		return "", "metric name has no node"
+	}
+	name = strings.Join(nodes, ".")
+	if p.MaxNameLength > 0 && len(name) > p.MaxNameLength {
+		return "", fmt.Sprintf("metric name is longer than %d bytes", p.MaxNameLength)
+	}
+	if p.MaxNameDepth > 0 && len(nodes) > p.MaxNameDepth {
+		return "", fmt.Sprintf("metric name has more than %d nodes", p.MaxNameDepth)
+	}
+	return name, ""
+}
+
+// Normalize returns the metric with the normalized name and the accepted datapoints.
+// It returns the metric with no datapoints and the error if the name is rejected.
+func (p *ValidationPolicy) Normalize(m *model.Metric, now time.Time) (*model.Metric, *ValidationError) {
+	name, reason := p.normalizeName(m.Name)
+	if reason != "" {
+		return &model.Metric{Name: m.Name}, &ValidationError{Name: m.Name, Reason: reason}
+	}
+
+	nm := &model.Metric{Name: name, Datapoints: make([]*model.Datapoint, 0, len(m.Datapoints))}
+	var errs []*DatapointError
+	for i, dp := range m.Datapoints {
+		if dp == nil {
+			errs = append(errs, &DatapointError{Index: i, Reason: "datapoint is null"})
+			continue
+		}
+		if math.IsNaN(dp.Value) || math.IsInf(dp.Value, 0) {
+			if !p.DropNaN {
+				errs = append(errs, &DatapointError{Index: i, Timestamp: dp.Timestamp, Reason: "value is NaN or Inf"})
+			}
+			continue
+		}
+		ts := dp.Timestamp
+		if ts == 0 && p.StampZeroTimestamp {
+			ts = now.Unix()
+		}
+		switch {
+		case ts <= 0:
+			errs = append(errs, &DatapointError{Index: i, Timestamp: ts, Reason: "timestamp is not positive"})
+			continue
+		case p.MaxPast > 0 && ts < now.Add(-p.MaxPast).Unix():
+			errs = append(errs, &DatapointError{Index: i, Timestamp: ts, Reason: fmt.Sprintf("timestamp is older than %s", p.MaxPast)})
+			continue
+		case p.MaxFuture > 0 && ts > now.Add(p.MaxFuture).Unix():
+			errs = append(errs, &DatapointError{Index: i, Timestamp: ts, Reason: fmt.Sprintf("timestamp is later than %s from now", p.MaxFuture)})
+			continue
+		}
+		nm.Datapoints = append(nm.Datapoints, &model.Datapoint{Timestamp: ts, Value: dp.Value})
+	}
+	if len(errs) > 0 {
+		return nm, &ValidationError{Name: m.Name, Datapoints: errs}
+	}
+	return nm, nil
+}
+
+// Validator wraps a ReadWriter with the validation of the written metrics.
+type Validator struct {
+	ReadWriter
+	policy *ValidationPolicy
+	now    func() time.Time
+}
+
+var _ ReadWriter = &Validator{}
+
+// NewValidator creates a new Validator.
+func NewValidator(rw ReadWriter, policy *ValidationPolicy) *Validator {
+	return &Validator{ReadWriter: rw, policy: policy, now: time.Now}
+}
+
+// InsertMetric writes the accepted datapoints of the normalized metric. It returns
+// *ValidationError if the metric or any datapoints are rejected.
+func (v *Validator) InsertMetric(m *model.Metric) error {
+	nm, verr := v.policy.Normalize(m, v.now())
+	if len(nm.Datapoints) > 0 || (verr == nil && len(m.Datapoints) == 0) {
+		if err := v.ReadWriter.InsertMetric(nm); err != nil {
+			return err
+		}
+	}
+	if verr != nil {
+		return verr
+	}
+	return nil
+}
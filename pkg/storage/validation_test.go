@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+)
+
+func TestValidationPolicyNormalize(t *testing.T) {
+	now := time.Unix(10000, 0)
+	tests := []struct {
+		desc           string
+		policy         *ValidationPolicy
+		metric         *model.Metric
+		expectedMetric *model.Metric
+		expectedErr    *ValidationError
+	}{
+		{
+			"valid metric",
+			&ValidationPolicy{},
+			&model.Metric{Name: "server1.loadavg5", Datapoints: []*model.Datapoint{{Timestamp: 100, Value: 0.1}}},
+			&model.Metric{Name: "server1.loadavg5", Datapoints: []*model.Datapoint{{Timestamp: 100, Value: 0.1}}},
+			nil,
+		},
+		{
+			"empty name",
+			&ValidationPolicy{},
+			&model.Metric{Name: "", Datapoints: []*model.Datapoint{{Timestamp: 100, Value: 0.1}}},
+			&model.Metric{Name: ""},
+			&ValidationError{Name: "", Reason: "metric name is empty"},
+		},
+		{
+			"reject invalid characters",
+			&ValidationPolicy{},
+			&model.Metric{Name: "server 1.loadavg5", Datapoints: []*model.Datapoint{{Timestamp: 100, Value: 0.1}}},
+			&model.Metric{Name: "server 1.loadavg5"},
+			&ValidationError{Name: "server 1.loadavg5", Reason: "metric name contains invalid character ' '"},
+		},
+		{
+			"reject empty node",
+			&ValidationPolicy{},
+			&model.Metric{Name: "server1..loadavg5", Datapoints: []*model.Datapoint{{Timestamp: 100, Value: 0.1}}},
+			&model.Metric{Name: "server1..loadavg5"},
+			&ValidationError{Name: "server1..loadavg5", Reason: "metric name contains an empty node"},
+		},
+		{
+			"sanitize invalid characters and empty nodes",
+			&ValidationPolicy{SanitizeName: true},
+			&model.Metric{Name: ".server{1,2}..load avg5.", Datapoints: []*model.Datapoint{{Timestamp: 100, Value: 0.1}}},
+			&model.Metric{Name: "server_1_2_.load_avg5", Datapoints: []*model.Datapoint{{Timestamp: 100, Value: 0.1}}},
+			nil,
+		},
+		{
+			"max name length",
+			&ValidationPolicy{MaxNameLength: 10},
+			&model.Metric{Name: "server1.loadavg5", Datapoints: []*model.Datapoint{{Timestamp: 100, Value: 0.1}}},
+			&model.Metric{Name: "server1.loadavg5"},
+			&ValidationError{Name: "server1.loadavg5", Reason: "metric name is longer than 10 bytes"},
+		},
+		{
+			"max name depth",
+			&ValidationPolicy{MaxNameDepth: 2},
+			&model.Metric{Name: "roleA.server1.loadavg5", Datapoints: []*model.Datapoint{{Timestamp: 100, Value: 0.1}}},
+			&model.Metric{Name: "roleA.server1.loadavg5"},
+			&ValidationError{Name: "roleA.server1.loadavg5", Reason: "metric name has more than 2 nodes"},
+		},
+		{
+			"reject NaN and Inf",
+			&ValidationPolicy{},
+			&model.Metric{Name: "server1.loadavg5", Datapoints: []*model.Datapoint{
+				{Timestamp: 100, Value: math.NaN()}, {Timestamp: 160, Value: 0.1}, {Timestamp: 220, Value: math.Inf(1)},
+			}},
+			&model.Metric{Name: "server1.loadavg5", Datapoints: []*model.Datapoint{{Timestamp: 160, Value: 0.1}}},
+			&ValidationError{Name: "server1.loadavg5", Datapoints: []*DatapointError{
+				{Index: 0, Timestamp: 100, Reason: "value is NaN or Inf"},
+				{Index: 2, Timestamp: 220, Reason: "value is NaN or Inf"},
+			}},
+		},
+		{
+			"drop NaN",
+			&ValidationPolicy{DropNaN: true},
+			&model.Metric{Name: "server1.loadavg5", Datapoints: []*model.Datapoint{{Timestamp: 100, Value: math.NaN()}, {Timestamp: 160, Value: 0.1}}},
+			&model.Metric{Name: "server1.loadavg5", Datapoints: []*model.Datapoint{{Timestamp: 160, Value: 0.1}}},
+			nil,
+		},
+		{
+			"reject zero timestamp",
+			&ValidationPolicy{},
+			&model.Metric{Name: "server1.loadavg5", Datapoints: []*model.Datapoint{{Timestamp: 0, Value: 0.1}}},
+			&model.Metric{Name: "server1.loadavg5", Datapoints: []*model.Datapoint{}},
+			&ValidationError{Name: "server1.loadavg5", Datapoints: []*DatapointError{
+				{Index: 0, Timestamp: 0, Reason: "timestamp is not positive"},
+			}},
+		},
+		{
+			"stamp zero timestamp",
+			&ValidationPolicy{StampZeroTimestamp: true},
+			&model.Metric{Name: "server1.loadavg5", Datapoints: []*model.Datapoint{{Timestamp: 0, Value: 0.1}}},
+			&model.Metric{Name: "server1.loadavg5", Datapoints: []*model.Datapoint{{Timestamp: 10000, Value: 0.1}}},
+			nil,
+		},
+		{
+			"timestamp window",
+			&ValidationPolicy{MaxPast: time.Hour, MaxFuture: time.Minute},
+			&model.Metric{Name: "server1.loadavg5", Datapoints: []*model.Datapoint{
+				{Timestamp: 6399, Value: 0.1}, {Timestamp: 6400, Value: 0.2}, {Timestamp: 10060, Value: 0.3}, {Timestamp: 10061, Value: 0.4},
+			}},
+			&model.Metric{Name: "server1.loadavg5", Datapoints: []*model.Datapoint{{Timestamp: 6400, Value: 0.2}, {Timestamp: 10060, Value: 0.3}}},
+			&ValidationError{Name: "server1.loadavg5", Datapoints: []*DatapointError{
+				{Index: 0, Timestamp: 6399, Reason: "timestamp is older than 1h0m0s"},
+				{Index: 3, Timestamp: 10061, Reason: "timestamp is later than 1m0s from now"},
+			}},
+		},
+	}
+	for _, tc := range tests {
+		m, err := tc.policy.Normalize(tc.metric, now)
+		if diff := pretty.Compare(m, tc.expectedMetric); diff != "" {
+			t.Fatalf("desc: %s, diff: (-actual +expected)\n%s", tc.desc, diff)
+		}
+		if diff := pretty.Compare(err, tc.expectedErr); diff != "" {
+			t.Fatalf("desc: %s, diff: (-actual +expected)\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestValidatorInsertMetric(t *testing.T) {
+	var written []*model.Metric
+	v := NewValidator(&FakeReadWriter{
+		FakeInsertMetric: func(m *model.Metric) error {
+			written = append(written, m)
+			return nil
+		},
+	}, &ValidationPolicy{})
+
+	err := v.InsertMetric(&model.Metric{Name: "server1.loadavg5", Datapoints: []*model.Datapoint{{Timestamp: -1, Value: 0.1}}})
+	if _, ok := err.(*ValidationError); !ok {
+		t.Fatalf("should raise ValidationError: %v", err)
+	}
+	err = v.InsertMetric(&model.Metric{Name: "server1.loadavg5", Datapoints: []*model.Datapoint{{Timestamp: -1, Value: 0.1}, {Timestamp: 100, Value: 0.2}}})
+	if _, ok := err.(*ValidationError); !ok {
+		t.Fatalf("should raise ValidationError: %v", err)
+	}
+	expected := []*model.Metric{
+		{Name: "server1.loadavg5", Datapoints: []*model.Datapoint{{Timestamp: 100, Value: 0.2}}},
+	}
+	if diff := pretty.Compare(written, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
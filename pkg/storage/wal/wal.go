@@ -0,0 +1,466 @@
+// Package wal provides the write-ahead log on the local disk, which consists of
+// the segment files of the length-prefixed and checksummed entries.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultSegmentSize is the default size to rotate the segment.
+	DefaultSegmentSize = 64 * 1024 * 1024
+	// DefaultSyncInterval is the default interval to fsync with SyncInterval.
+	DefaultSyncInterval = 1 * time.Second
+
+	segmentSuffix  = ".wal"
+	checkpointFile = "checkpoint"
+	// headerSize is the size of the length and the CRC-32 of an entry.
+	headerSize = 8
+)
+
+// SyncPolicy is the policy to fsync the appended entries.
+type SyncPolicy int
+
+const (
+	// SyncInterval fsyncs periodically, which may lose the entries within the interval on a crash.
+	SyncInterval SyncPolicy = iota
+	// SyncAlways fsyncs every append.
+	SyncAlways
+	// SyncNever leaves fsync to the OS.
+	SyncNever
+)
+
+// ParseSyncPolicy parses "interval", "always" or "never".
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "", "interval":
+		return SyncInterval, nil
+	case "always":
+		return SyncAlways, nil
+	case "never":
+		return SyncNever, nil
+	}
+	return SyncInterval, errors.Errorf("invalid sync policy %q", s)
+}
+
+// Position is a position in the WAL.
+type Position struct {
+	Segment uint64
+	Offset  int64
+}
+
+// Less returns whether p is before q.
+func (p Position) Less(q Position) bool {
+	if p.Segment != q.Segment {
+		return p.Segment < q.Segment
+	}
+	return p.Offset < q.Offset
+}
+
+// String returns the position formatted as '<segment>:<offset>'.
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Segment, p.Offset)
+}
+
+// Option for the WAL.
+type Option struct {
+	Dir          string
+	SegmentSize  int64
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+}
+
+// WAL is the write-ahead log.
+type WAL struct {
+	dir          string
+	segmentSize  int64
+	sync         SyncPolicy
+	syncInterval time.Duration
+
+	mu         sync.Mutex
+	segments   []uint64 // sorted segment IDs
+	active     *os.File
+	end        Position
+	dirty      bool
+	checkpoint Position
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Open opens the WAL in the directory. The entries torn by a crash at the end of
+// the last segment are truncated.
+func Open(o *Option) (*WAL, error) {
+	w := &WAL{
+		dir:          o.Dir,
+		segmentSize:  o.SegmentSize,
+		sync:         o.Sync,
+		syncInterval: o.SyncInterval,
+		done:         make(chan struct{}),
+	}
+	if w.segmentSize <= 0 {
+		w.segmentSize = DefaultSegmentSize
+	}
+	if w.syncInterval <= 0 {
+		w.syncInterval = DefaultSyncInterval
+	}
+	if err := os.MkdirAll(w.dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create wal directory (%s)", w.dir)
+	}
+	if err := w.loadSegments(); err != nil {
+		return nil, err
+	}
+	if err := w.loadCheckpoint(); err != nil {
+		return nil, err
+	}
+	if len(w.segments) == 0 {
+		w.segments = []uint64{1}
+		if w.checkpoint.Segment > 1 {
+			w.segments[0] = w.checkpoint.Segment
+		}
+	}
+	last := w.segments[len(w.segments)-1]
+	size, err := w.recover(last)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(w.segmentPath(last), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open wal segment (%s)", w.segmentPath(last))
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "failed to truncate wal segment (%s)", w.segmentPath(last))
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "failed to seek wal segment (%s)", w.segmentPath(last))
+	}
+	w.active = f
+	w.end = Position{Segment: last, Offset: size}
+	if w.checkpoint.Segment == 0 {
+		w.checkpoint = Position{Segment: w.segments[0]}
+	}
+
+	if w.sync == SyncInterval {
+		w.wg.Add(1)
+		go w.syncLoop()
+	}
+	return w, nil
+}
+
+func (w *WAL) segmentPath(id uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+func (w *WAL) loadSegments() error {
+	files, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read wal directory (%s)", w.dir)
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		w.segments = append(w.segments, id)
+	}
+	sort.Slice(w.segments, func(i, j int) bool { return w.segments[i] < w.segments[j] })
+	return nil
+}
+
+// recover returns the size of the valid entries of the segment.
+func (w *WAL) recover(id uint64) (int64, error) {
+	f, err := os.Open(w.segmentPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, errors.Wrapf(err, "failed to open wal segment (%s)", w.segmentPath(id))
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var size int64
+	for {
+		data, err := readEntry(r)
+		if err != nil {
+			// io.EOF or the torn entry
+			return size, nil
+		}
+		size += headerSize + int64(len(data))
+	}
+}
+
+// Append appends the entry and returns the end position of the entry.
+func (w *WAL) Append(data []byte) (Position, error) {
+	buf := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	copy(buf[headerSize:], data)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.end.Offset > 0 && w.end.Offset+int64(len(buf)) > w.segmentSize {
+		if err := w.rotate(); err != nil {
+			return Position{}, err
+		}
+	}
+	if _, err := w.active.Write(buf); err != nil {
+		return Position{}, errors.Wrapf(err, "failed to write wal segment (%s)", w.active.Name())
+	}
+	w.end.Offset += int64(len(buf))
+	w.dirty = true
+	if w.sync == SyncAlways {
+		if err := w.syncLocked(); err != nil {
+			return Position{}, err
+		}
+	}
+	return w.end, nil
+}
+
+func (w *WAL) rotate() error {
+	if err := w.active.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to sync wal segment (%s)", w.active.Name())
+	}
+	if err := w.active.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close wal segment (%s)", w.active.Name())
+	}
+	next := w.end.Segment + 1
+	f, err := os.OpenFile(w.segmentPath(next), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create wal segment (%s)", w.segmentPath(next))
+	}
+	w.active = f
+	w.segments = append(w.segments, next)
+	w.end = Position{Segment: next}
+	w.dirty = false
+	return nil
+}
+
+// Sync fsyncs the active segment.
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.syncLocked()
+}
+
+func (w *WAL) syncLocked() error {
+	if !w.dirty {
+		return nil
+	}
+	if err := w.active.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to sync wal segment (%s)", w.active.Name())
+	}
+	w.dirty = false
+	return nil
+}
+
+func (w *WAL) syncLoop() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Sync(); err != nil {
+				log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// End returns the end position of the appended entries.
+func (w *WAL) End() Position {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.end
+}
+
+// Checkpoint returns the position before which the entries are no longer needed.
+func (w *WAL) Checkpoint() Position {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.checkpoint
+}
+
+func (w *WAL) loadCheckpoint() error {
+	b, err := ioutil.ReadFile(filepath.Join(w.dir, checkpointFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "failed to read wal checkpoint")
+	}
+	var p Position
+	if _, err := fmt.Sscanf(string(b), "%d:%d", &p.Segment, &p.Offset); err != nil {
+		return errors.Wrapf(err, "failed to parse wal checkpoint %q", b)
+	}
+	w.checkpoint = p
+	return nil
+}
+
+// SetCheckpoint stores the position before which the entries are no longer needed,
+// and removes the segments before the position.
+func (w *WAL) SetCheckpoint(p Position) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if p.Less(w.checkpoint) || p == w.checkpoint {
+		return nil
+	}
+
+	path := filepath.Join(w.dir, checkpointFile)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(p.String()), 0644); err != nil {
+		return errors.Wrap(err, "failed to write wal checkpoint")
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Wrap(err, "failed to rename wal checkpoint")
+	}
+	w.checkpoint = p
+
+	var kept []uint64
+	for _, id := range w.segments {
+		if id >= p.Segment {
+			kept = append(kept, id)
+			continue
+		}
+		if err := os.Remove(w.segmentPath(id)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "failed to remove wal segment (%s)", w.segmentPath(id))
+		}
+	}
+	w.segments = kept
+	return nil
+}
+
+// Close fsyncs and closes the WAL.
+func (w *WAL) Close() error {
+	close(w.done)
+	w.wg.Wait()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.syncLocked(); err != nil {
+		return err
+	}
+	return w.active.Close()
+}
+
+// nextSegment returns the segment after id, or false if id is the last one.
+func (w *WAL) nextSegment(id uint64) (uint64, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, s := range w.segments {
+		if s > id {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+func readEntry(r io.Reader) ([]byte, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("wal: torn entry header")
+		}
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, errors.New("wal: torn entry")
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New("wal: checksum mismatch")
+	}
+	return data, nil
+}
+
+// Reader reads the entries from a position.
+type Reader struct {
+	wal *WAL
+	pos Position
+	f   *os.File
+	r   *bufio.Reader
+}
+
+// NewReader returns a reader starting at the position.
+func (w *WAL) NewReader(from Position) *Reader {
+	return &Reader{wal: w, pos: from}
+}
+
+// Position returns the position of the next entry.
+func (r *Reader) Position() Position {
+	return r.pos
+}
+
+// Next returns the next entry and the end position of the entry. It returns io.EOF
+// if it reaches the end of the appended entries, and the entries appended later
+// are read by the next call.
+func (r *Reader) Next() ([]byte, Position, error) {
+	for {
+		end := r.wal.End()
+		if !r.pos.Less(end) {
+			return nil, r.pos, io.EOF
+		}
+		if r.f == nil {
+			f, err := os.Open(r.wal.segmentPath(r.pos.Segment))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, r.pos, errors.Wrapf(err, "failed to open wal segment (%s)", r.wal.segmentPath(r.pos.Segment))
+			}
+			if err == nil {
+				if _, err := f.Seek(r.pos.Offset, io.SeekStart); err != nil {
+					f.Close()
+					return nil, r.pos, errors.Wrapf(err, "failed to seek wal segment (%s)", f.Name())
+				}
+				r.f, r.r = f, bufio.NewReader(f)
+			}
+		}
+		// The entries in the segment are read up to the end if it is the active one.
+		if r.f != nil && (r.pos.Segment < end.Segment || r.pos.Offset < end.Offset) {
+			data, err := readEntry(r.r)
+			if err == nil {
+				r.pos.Offset += headerSize + int64(len(data))
+				return data, r.pos, nil
+			}
+			if err != io.EOF {
+				return nil, r.pos, errors.Wrapf(err, "failed to read wal segment (%s) at %s", r.f.Name(), r.pos)
+			}
+		}
+		// Move to the next segment.
+		next, ok := r.wal.nextSegment(r.pos.Segment)
+		if !ok {
+			return nil, r.pos, io.EOF
+		}
+		r.Close()
+		r.pos = Position{Segment: next}
+	}
+}
+
+// Close closes the segment file opened by the reader.
+func (r *Reader) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f, r.r = nil, nil
+	return err
+}
@@ -0,0 +1,186 @@
+package wal
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func newTestDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "diamondb-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func readAll(t *testing.T, r *Reader) []string {
+	var got []string
+	for {
+		data, _, err := r.Next()
+		if err == io.EOF {
+			return got
+		}
+		if err != nil {
+			t.Fatalf("should not raise err: %s", err)
+		}
+		got = append(got, string(data))
+	}
+}
+
+func TestWAL_AppendAndRead(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	// Each segment has two entries of 8 bytes header and 3 bytes data.
+	w, err := Open(&Option{Dir: dir, SegmentSize: 22, Sync: SyncAlways})
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	defer w.Close()
+
+	var ends []Position
+	for _, s := range []string{"aaa", "bbb", "ccc", "ddd", "eee"} {
+		end, err := w.Append([]byte(s))
+		if err != nil {
+			t.Fatalf("should not raise err: %s", err)
+		}
+		ends = append(ends, end)
+	}
+	expected := []Position{{1, 11}, {1, 22}, {2, 11}, {2, 22}, {3, 11}}
+	if diff := pretty.Compare(ends, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	r := w.NewReader(Position{Segment: 1, Offset: 11})
+	defer r.Close()
+	got := readAll(t, r)
+	if diff := pretty.Compare(got, []string{"bbb", "ccc", "ddd", "eee"}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	// The reader continues to read the entries appended later.
+	if _, err := w.Append([]byte("fff")); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	got = readAll(t, r)
+	if diff := pretty.Compare(got, []string{"fff"}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	if r.Position() != w.End() {
+		t.Fatalf("reader position should be %s, not %s", w.End(), r.Position())
+	}
+}
+
+func TestWAL_SetCheckpoint(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	w, err := Open(&Option{Dir: dir, SegmentSize: 22, Sync: SyncNever})
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	for _, s := range []string{"aaa", "bbb", "ccc", "ddd", "eee"} {
+		if _, err := w.Append([]byte(s)); err != nil {
+			t.Fatalf("should not raise err: %s", err)
+		}
+	}
+	if err := w.SetCheckpoint(Position{Segment: 2, Offset: 11}); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if len(files) != 2 {
+		t.Fatalf("the segments before the checkpoint should be removed: %v", files)
+	}
+	// The older checkpoint is ignored.
+	if err := w.SetCheckpoint(Position{Segment: 1, Offset: 11}); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+
+	w, err = Open(&Option{Dir: dir, SegmentSize: 22})
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	defer w.Close()
+	if cp := w.Checkpoint(); cp != (Position{Segment: 2, Offset: 11}) {
+		t.Fatalf("checkpoint should be 2:11, not %s", cp)
+	}
+	r := w.NewReader(w.Checkpoint())
+	defer r.Close()
+	got := readAll(t, r)
+	if diff := pretty.Compare(got, []string{"ddd", "eee"}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestOpen_TornEntry(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	w, err := Open(&Option{Dir: dir, Sync: SyncAlways})
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	for _, s := range []string{"aaa", "bbb"} {
+		if _, err := w.Append([]byte(s)); err != nil {
+			t.Fatalf("should not raise err: %s", err)
+		}
+	}
+	w.Close()
+
+	// Simulate the crash in the middle of writing an entry.
+	f, err := os.OpenFile(filepath.Join(dir, "00000000000000000001.wal"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 3, 1, 2})
+	f.Close()
+
+	w, err = Open(&Option{Dir: dir, Sync: SyncAlways})
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	defer w.Close()
+	if end := w.End(); end != (Position{Segment: 1, Offset: 22}) {
+		t.Fatalf("torn entry should be truncated: end %s", end)
+	}
+	if _, err := w.Append([]byte("ccc")); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	r := w.NewReader(Position{Segment: 1})
+	defer r.Close()
+	got := readAll(t, r)
+	if diff := pretty.Compare(got, []string{"aaa", "bbb", "ccc"}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	tests := []struct {
+		in     string
+		policy SyncPolicy
+		err    bool
+	}{
+		{"", SyncInterval, false},
+		{"interval", SyncInterval, false},
+		{"always", SyncAlways, false},
+		{"never", SyncNever, false},
+		{"sometimes", SyncInterval, true},
+	}
+	for _, tc := range tests {
+		policy, err := ParseSyncPolicy(tc.in)
+		if (err != nil) != tc.err {
+			t.Fatalf("ParseSyncPolicy(%q) err: %v", tc.in, err)
+		}
+		if policy != tc.policy {
+			t.Fatalf("ParseSyncPolicy(%q) should be %d, not %d", tc.in, tc.policy, policy)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package storage
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/wal"
+)
+
+// walDrainInterval is the interval to check whether the store is back and to save the checkpoint.
+var walDrainInterval = 1 * time.Second
+
+// WALStore wraps a ReadWriter with the write-ahead log. InsertMetric appends the
+// metric into the WAL before writing it into the store, so the metric is
+// acknowledged even if the store is unreachable. The metrics failed to be written
+// while the store is unreachable are spooled in the WAL, and all the metrics
+// after them are only appended until the background drainer replays them into
+// the store. The spooled metrics are not read by Fetch until they are drained.
+type WALStore struct {
+	ReadWriter
+	wal *wal.WAL
+
+	mu       sync.Mutex
+	spooling bool
+	// drainPos is the position of the next entry replayed by the drainer while spooling.
+	drainPos wal.Position
+	// pending is the entries written directly into the store in the appended order.
+	pending    []*walEntry
+	pendingMap map[wal.Position]*walEntry
+	// watermark is the end of the last entry before which all the pending entries are written.
+	watermark wal.Position
+
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	appended uint64
+	spooled  uint64
+	drained  uint64
+	dropped  uint64
+}
+
+type walEntry struct {
+	end  wal.Position
+	done bool
+}
+
+// WALStats represents the counters of the WALStore.
+type WALStats struct {
+	Appended uint64 `json:"appended"`
+	Spooled  uint64 `json:"spooled"`
+	Drained  uint64 `json:"drained"`
+	Dropped  uint64 `json:"dropped"`
+	Spooling bool   `json:"spooling"`
+}
+
+var _ ReadWriter = &WALStore{}
+
+// NewWALStore creates a new WALStore on the opened WAL. The entries after the
+// checkpoint of the WAL are replayed by Init.
+func NewWALStore(rw ReadWriter, w *wal.WAL) *WALStore {
+	s := &WALStore{
+		ReadWriter: rw,
+		wal:        w,
+		pendingMap: map[wal.Position]*walEntry{},
+		watermark:  w.Checkpoint(),
+		done:       make(chan struct{}),
+	}
+	if cp := w.Checkpoint(); cp.Less(w.End()) {
+		s.spooling = true
+		s.drainPos = cp
+	}
+	return s
+}
+
+// Init initializes the store, replays the entries left in the WAL and starts the drainer.
+// The entries are left spooled if the store is unreachable.
+func (s *WALStore) Init() error {
+	if err := s.ReadWriter.Init(); err != nil {
+		return err
+	}
+	if s.Stats().Spooling {
+		log.Printf("Replaying the write-ahead log from %s\n", s.wal.Checkpoint())
+		s.drain()
+		if err := s.saveCheckpoint(); err != nil {
+			return err
+		}
+	}
+	s.wg.Add(1)
+	go s.drainLoop()
+	return nil
+}
+
+// InsertMetric appends the metric into the WAL and writes it into the store unless
+// spooling. The metric failed to be written is spooled only if the store is
+// unreachable, and the error of the metric rejected by the store is returned.
+func (s *WALStore) InsertMetric(m *model.Metric) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode metric (%s)", m.Name)
+	}
+
+	s.mu.Lock()
+	end, err := s.wal.Append(data)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	atomic.AddUint64(&s.appended, 1)
+	if s.spooling {
+		s.mu.Unlock()
+		atomic.AddUint64(&s.spooled, 1)
+		return nil
+	}
+	e := &walEntry{end: end}
+	s.pending = append(s.pending, e)
+	s.pendingMap[end] = e
+	s.mu.Unlock()
+
+	if err := s.ReadWriter.InsertMetric(m); err != nil {
+		if perr := s.ReadWriter.Ping(); perr == nil {
+			// The store is reachable, so the metric itself is rejected, and it
+			// is never replayed.
+			s.mu.Lock()
+			s.markWritten(end)
+			s.mu.Unlock()
+			return err
+		}
+		log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+		atomic.AddUint64(&s.spooled, 1)
+		s.mu.Lock()
+		if !s.spooling {
+			log.Println("Spooling the metrics into the write-ahead log")
+			s.spooling = true
+			// The entries after the watermark include the failed one.
+			s.drainPos = s.watermark
+		}
+		s.mu.Unlock()
+		return nil
+	}
+
+	s.mu.Lock()
+	s.markWritten(end)
+	s.mu.Unlock()
+	return nil
+}
+
+// markWritten marks the pending entry as written and advances the watermark.
+func (s *WALStore) markWritten(end wal.Position) {
+	if e, ok := s.pendingMap[end]; ok {
+		e.done = true
+	}
+	for len(s.pending) > 0 && s.pending[0].done {
+		s.watermark = s.pending[0].end
+		delete(s.pendingMap, s.pending[0].end)
+		s.pending = s.pending[1:]
+	}
+}
+
+// Stats returns the snapshot of the counters.
+func (s *WALStore) Stats() WALStats {
+	s.mu.Lock()
+	spooling := s.spooling
+	s.mu.Unlock()
+	return WALStats{
+		Appended: atomic.LoadUint64(&s.appended),
+		Spooled:  atomic.LoadUint64(&s.spooled),
+		Drained:  atomic.LoadUint64(&s.drained),
+		Dropped:  atomic.LoadUint64(&s.dropped),
+		Spooling: spooling,
+	}
+}
+
+// Close stops the drainer, saves the checkpoint and closes the WAL.
+func (s *WALStore) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	if err := s.saveCheckpoint(); err != nil {
+		return err
+	}
+	return s.wal.Close()
+}
+
+func (s *WALStore) drainLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(walDrainInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.drain()
+			if err := s.saveCheckpoint(); err != nil {
+				log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// drain replays the spooled entries into the store if it is reachable, and stops
+// spooling when it catches up with the end of the WAL. It stops at the entry
+// failed to be replayed transiently, which is replayed again by the next drain,
+// and skips the entry rejected permanently.
+func (s *WALStore) drain() {
+	s.mu.Lock()
+	spooling, from := s.spooling, s.drainPos
+	s.mu.Unlock()
+	if !spooling {
+		return
+	}
+	if err := s.ReadWriter.Ping(); err != nil {
+		return
+	}
+
+	r := s.wal.NewReader(from)
+	defer r.Close()
+	for {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		data, end, err := r.Next()
+		if err == io.EOF {
+			s.mu.Lock()
+			// No entry is appended while holding the lock.
+			if r.Position() == s.wal.End() {
+				s.spooling = false
+				s.drainPos = end
+				s.mu.Unlock()
+				log.Println("Drained the metrics spooled in the write-ahead log")
+				return
+			}
+			s.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+			return
+		}
+		var m model.Metric
+		if err := json.Unmarshal(data, &m); err != nil {
+			// The broken entry never succeeds, so it is skipped.
+			atomic.AddUint64(&s.dropped, 1)
+			log.Printf("%+v\n", errors.Wrapf(err, "failed to decode metric in the write-ahead log at %s", end))
+		} else if err := s.ReadWriter.InsertMetric(&m); IsPermanent(err) {
+			// The metric rejected permanently never succeeds either, so it is
+			// skipped not to block the spool.
+			atomic.AddUint64(&s.dropped, 1)
+			log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+		} else if err != nil {
+			if perr := s.ReadWriter.Ping(); perr == nil {
+				// The metric has been acknowledged, so it is retried by the
+				// next drain instead of being dropped.
+				log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+			}
+			return
+		} else {
+			atomic.AddUint64(&s.drained, 1)
+		}
+		s.mu.Lock()
+		s.drainPos = end
+		s.markWritten(end)
+		s.mu.Unlock()
+	}
+}
+
+// saveCheckpoint saves the position before which all the entries are written into the store.
+func (s *WALStore) saveCheckpoint() error {
+	s.mu.Lock()
+	cp := s.wal.End()
+	if s.spooling {
+		cp = s.drainPos
+	}
+	if len(s.pending) > 0 && s.watermark.Less(cp) {
+		cp = s.watermark
+	}
+	s.mu.Unlock()
+	return s.wal.SetCheckpoint(cp)
+}
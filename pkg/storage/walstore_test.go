@@ -0,0 +1,314 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/wal"
+)
+
+// fakeUnreachableStore records the written metrics while it is reachable.
+type fakeUnreachableStore struct {
+	mu        sync.Mutex
+	down      bool
+	reject    string
+	permanent bool
+	written   []string
+}
+
+func (s *fakeUnreachableStore) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+// setReject makes the store reject the metric of the name while it is reachable.
+func (s *fakeUnreachableStore) setReject(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reject = name
+}
+
+// setRejectPermanently makes the store reject the metric of the name by the
+// validation while it is reachable.
+func (s *fakeUnreachableStore) setRejectPermanently(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reject, s.permanent = name, true
+}
+
+func (s *fakeUnreachableStore) Written() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.written...)
+}
+
+func (s *fakeUnreachableStore) ReadWriter() *FakeReadWriter {
+	return &FakeReadWriter{
+		FakePing: func() error {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.down {
+				return errors.New("connection refused")
+			}
+			return nil
+		},
+		FakeInit: func() error { return nil },
+		FakeInsertMetric: func(m *model.Metric) error {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.down {
+				return errors.New("connection refused")
+			}
+			if m.Name == s.reject && s.permanent {
+				return &ValidationError{Name: m.Name, Reason: "invalid"}
+			}
+			if m.Name == s.reject {
+				return errors.New("rejected")
+			}
+			s.written = append(s.written, m.Name)
+			return nil
+		},
+	}
+}
+
+func newTestWAL(t *testing.T, dir string) *wal.WAL {
+	w, err := wal.Open(&wal.Option{Dir: dir, Sync: wal.SyncAlways})
+	if err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	return w
+}
+
+func insertMetrics(t *testing.T, s *WALStore, names ...string) {
+	for _, name := range names {
+		err := s.InsertMetric(&model.Metric{
+			Name:       name,
+			Datapoints: []*model.Datapoint{{Timestamp: 100, Value: 1.0}},
+		})
+		if err != nil {
+			t.Fatalf("should not raise err: %s", err)
+		}
+	}
+}
+
+func TestWALStore_Spool(t *testing.T) {
+	defer func(d time.Duration) { walDrainInterval = d }(walDrainInterval)
+	// The spool is drained by calling drain explicitly.
+	walDrainInterval = time.Hour
+
+	dir, err := ioutil.TempDir("", "diamondb-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake := &fakeUnreachableStore{}
+	s := NewWALStore(fake.ReadWriter(), newTestWAL(t, dir))
+	if err := s.Init(); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+
+	insertMetrics(t, s, "a")
+	fake.setDown(true)
+	insertMetrics(t, s, "b", "c")
+	if !s.Stats().Spooling {
+		t.Fatal("should be spooling while the store is down")
+	}
+	fake.setDown(false)
+	// Appended after the store is back, but before the spool is drained.
+	insertMetrics(t, s, "d")
+
+	s.drain()
+	if s.Stats().Spooling {
+		t.Fatal("spool should be drained")
+	}
+	insertMetrics(t, s, "e")
+	if err := s.Close(); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+
+	if diff := pretty.Compare(fake.Written(), []string{"a", "b", "c", "d", "e"}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	expected := WALStats{Appended: 5, Spooled: 3, Drained: 3, Dropped: 0, Spooling: false}
+	if diff := pretty.Compare(s.Stats(), expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestWALStore_Replay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diamondb-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The metrics are spooled and the process exits while the store is down.
+	fake := &fakeUnreachableStore{down: true}
+	s := NewWALStore(fake.ReadWriter(), newTestWAL(t, dir))
+	if err := s.Init(); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	insertMetrics(t, s, "a", "b")
+	if err := s.Close(); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+
+	fake.setDown(false)
+	s = NewWALStore(fake.ReadWriter(), newTestWAL(t, dir))
+	if err := s.Init(); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if s.Stats().Spooling {
+		t.Fatal("spool should be replayed by Init")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if diff := pretty.Compare(fake.Written(), []string{"a", "b"}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	// The replayed metrics are not replayed again.
+	s = NewWALStore(fake.ReadWriter(), newTestWAL(t, dir))
+	if err := s.Init(); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if diff := pretty.Compare(fake.Written(), []string{"a", "b"}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestWALStore_Reject(t *testing.T) {
+	defer func(d time.Duration) { walDrainInterval = d }(walDrainInterval)
+	// The spool is drained by calling drain explicitly.
+	walDrainInterval = time.Hour
+
+	dir, err := ioutil.TempDir("", "diamondb-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake := &fakeUnreachableStore{}
+	s := NewWALStore(fake.ReadWriter(), newTestWAL(t, dir))
+	if err := s.Init(); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+
+	// The metric rejected by the reachable store is returned without spooling.
+	fake.setReject("a")
+	err = s.InsertMetric(&model.Metric{
+		Name:       "a",
+		Datapoints: []*model.Datapoint{{Timestamp: 100, Value: 1.0}},
+	})
+	if err == nil {
+		t.Fatal("should raise err of the rejected metric")
+	}
+	if s.Stats().Spooling {
+		t.Fatal("should not be spooling while the store is reachable")
+	}
+
+	// The spooled metric failed transiently by the reachable store is not
+	// dropped, but replayed again by the next drain.
+	fake.setDown(true)
+	fake.setReject("b")
+	insertMetrics(t, s, "b", "c")
+	fake.setDown(false)
+	s.drain()
+	if !s.Stats().Spooling {
+		t.Fatal("should be spooling until the rejected metric is replayed")
+	}
+	fake.setReject("")
+	s.drain()
+	if s.Stats().Spooling {
+		t.Fatal("spool should be drained")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+
+	if diff := pretty.Compare(fake.Written(), []string{"b", "c"}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	expected := WALStats{Appended: 3, Spooled: 2, Drained: 2, Dropped: 0, Spooling: false}
+	if diff := pretty.Compare(s.Stats(), expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	// The rejected metric is not replayed after restart.
+	s = NewWALStore(fake.ReadWriter(), newTestWAL(t, dir))
+	if err := s.Init(); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if diff := pretty.Compare(fake.Written(), []string{"b", "c"}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestWALStore_RejectPermanently(t *testing.T) {
+	defer func(d time.Duration) { walDrainInterval = d }(walDrainInterval)
+	// The spool is drained by calling drain explicitly.
+	walDrainInterval = time.Hour
+
+	dir, err := ioutil.TempDir("", "diamondb-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake := &fakeUnreachableStore{}
+	s := NewWALStore(fake.ReadWriter(), newTestWAL(t, dir))
+	if err := s.Init(); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+
+	// The spooled metric rejected permanently in the middle of the spool is
+	// dropped, and the others are drained.
+	fake.setDown(true)
+	fake.setRejectPermanently("b")
+	insertMetrics(t, s, "a", "b", "c")
+	fake.setDown(false)
+	s.drain()
+	if s.Stats().Spooling {
+		t.Fatal("spool should be drained")
+	}
+	insertMetrics(t, s, "d")
+	if err := s.Close(); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+
+	if diff := pretty.Compare(fake.Written(), []string{"a", "c", "d"}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	expected := WALStats{Appended: 4, Spooled: 3, Drained: 2, Dropped: 1, Spooling: false}
+	if diff := pretty.Compare(s.Stats(), expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	// The checkpoint passes the dropped metric, so it is not replayed again.
+	s = NewWALStore(fake.ReadWriter(), newTestWAL(t, dir))
+	if err := s.Init(); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("should not raise err: %s", err)
+	}
+	if diff := pretty.Compare(fake.Written(), []string{"a", "c", "d"}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
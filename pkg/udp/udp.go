@@ -0,0 +1,103 @@
+// Package udp serves the datagram protocols shared by the listeners.
+package udp
+
+import (
+	"log"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MaxPacketSize is the maximum size of an UDP datagram.
+	MaxPacketSize = 65535
+)
+
+// Handler handles a received packet. The packet is reused after it returns.
+type Handler func(packet []byte)
+
+// Listener reads the packets on the UDP address and passes them to the handler.
+type Listener struct {
+	name    string
+	addr    string
+	handler Handler
+
+	mu     sync.Mutex
+	conn   net.PacketConn
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewListener creates a new Listener. The name is the protocol name in the logs.
+func NewListener(name, addr string, handler Handler) *Listener {
+	return &Listener{name: name, addr: addr, handler: handler}
+}
+
+// Listen listens on the UDP address and serves the packets in the background
+// until Close is called. Listen after Close closes the listener immediately.
+func (l *Listener) Listen() error {
+	conn, err := net.ListenPacket("udp", l.addr)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen %s udp (%s)", l.name, l.addr)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return conn.Close()
+	}
+	l.conn = conn
+	log.Printf("Listening %s on udp %s\n", l.name, l.addr)
+	l.wg.Add(1)
+	go l.serve(conn)
+	return nil
+}
+
+// Close closes the listener and waits for the packet being handled.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	conn := l.conn
+	l.mu.Unlock()
+	if conn != nil {
+		if err := conn.Close(); err != nil {
+			return errors.Wrapf(err, "failed to close %s udp listener", l.name)
+		}
+	}
+	l.wg.Wait()
+	return nil
+}
+
+func (l *Listener) serve(conn net.PacketConn) {
+	defer l.wg.Done()
+	buf := make([]byte, MaxPacketSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			l.mu.Lock()
+			closed := l.closed
+			l.mu.Unlock()
+			if closed {
+				return
+			}
+			log.Printf("failed to read %s packet: %s\n", l.name, err)
+			continue
+		}
+		l.handler(buf[:n])
+	}
+}
+
+// SplitLines calls fn with each line of the packet of a line protocol.
+// The last line may not be terminated by a newline.
+func SplitLines(packet []byte, fn func(line string)) {
+	start := 0
+	for i, b := range packet {
+		if b == '\n' {
+			fn(string(packet[start:i]))
+			start = i + 1
+		}
+	}
+	if start < len(packet) {
+		fn(string(packet[start:]))
+	}
+}
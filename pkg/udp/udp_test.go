@@ -0,0 +1,73 @@
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestSplitLines(t *testing.T) {
+	tests := []struct {
+		packet   string
+		expected []string
+	}{
+		{"", nil},
+		{"a 1 2", []string{"a 1 2"}},
+		{"a 1 2\n", []string{"a 1 2"}},
+		{"a 1 2\nb 3 4", []string{"a 1 2", "b 3 4"}},
+		{"a 1 2\n\nb 3 4\n", []string{"a 1 2", "", "b 3 4"}},
+	}
+	for _, tc := range tests {
+		var lines []string
+		SplitLines([]byte(tc.packet), func(line string) { lines = append(lines, line) })
+		if diff := pretty.Compare(lines, tc.expected); diff != "" {
+			t.Fatalf("packet: %q, diff: (-actual +expected)\n%s", tc.packet, diff)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	received := make(chan string, 1)
+	l := NewListener("test", "127.0.0.1:0", func(packet []byte) {
+		received <- string(packet)
+	})
+	if err := l.Listen(); err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+
+	conn, err := net.Dial("udp", l.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	select {
+	case packet := <-received:
+		if diff := pretty.Compare(packet, "hello"); diff != "" {
+			t.Fatalf("diff: (-actual +expected)\n%s", diff)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet should be received")
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+}
+
+func TestListener_CloseBeforeListen(t *testing.T) {
+	l := NewListener("test", "127.0.0.1:0", func(packet []byte) {})
+	if err := l.Close(); err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if err := l.Listen(); err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if l.conn != nil {
+		t.Fatal("listener should not serve after Close")
+	}
+}
@@ -0,0 +1,170 @@
+package web
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/yuuki/diamondb/pkg/config"
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// BatchWriteResult represents the result of writing each metric of /datapoints/batch.
+// Datapoints is set if only the datapoints are rejected by the validation, and
+// the other datapoints of the metric are written.
+type BatchWriteResult struct {
+	Index      int                       `json:"index"`
+	Name       string                    `json:"name"`
+	Error      string                    `json:"error,omitempty"`
+	Datapoints []*storage.DatapointError `json:"datapoints,omitempty"`
+
+	invalid  bool // rejected by the validation, not failed to write
+	rejected int  // the number of the datapoints rejected by the validation
+}
+
+// BatchWriteResponse reprensents a response of /datapoints/batch.
+type BatchWriteResponse struct {
+	Accepted int                 `json:"accepted"`
+	Failed   int                 `json:"failed"`
+	Errors   []*BatchWriteResult `json:"errors"`
+}
+
+// decodeMetrics decodes the request body into metrics. The body is either
+// a JSON array of metrics or newline-delimited JSON metrics.
+func decodeMetrics(r *http.Request) ([]*model.Metric, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != ndjsonContentType {
+		var metrics []*model.Metric
+		if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+			return nil, err
+		}
+		return metrics, nil
+	}
+
+	var metrics []*model.Metric
+	dec := json.NewDecoder(r.Body)
+	for {
+		var m *model.Metric
+		if err := dec.Decode(&m); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+func (h *Handler) insertMetrics(metrics []*model.Metric) *BatchWriteResponse {
+	results := make([]*BatchWriteResult, len(metrics))
+	concurrency := config.Config.HTTPWriteConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, m := range metrics {
+		if m == nil || m.Name == "" {
+			result := &BatchWriteResult{Index: i, Error: "metric name is empty", invalid: true}
+			if m != nil {
+				result.rejected = len(m.Datapoints)
+			}
+			results[i] = result
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, m *model.Metric) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := h.store.InsertMetric(m); err != nil {
+				result := &BatchWriteResult{
+					Index: i,
+					Name:  m.Name,
+					Error: errors.Cause(err).Error(),
+				}
+				if verr, ok := errors.Cause(err).(*storage.ValidationError); ok {
+					result.Datapoints = verr.Datapoints
+					result.invalid = true
+					result.rejected = len(verr.Datapoints)
+					if verr.Reason != "" {
+						result.rejected = len(m.Datapoints)
+					}
+				} else {
+					log.Printf("%+v\n", err) // Print stack trace by pkg/errors
+				}
+				results[i] = result
+			}
+		}(i, m)
+	}
+	wg.Wait()
+
+	resp := &BatchWriteResponse{Errors: []*BatchWriteResult{}}
+	for _, result := range results {
+		if result == nil {
+			resp.Accepted++
+			continue
+		}
+		resp.Failed++
+		resp.Errors = append(resp.Errors, result)
+	}
+	return resp
+}
+
+// storeError returns the first result failed to write into the store, or nil if
+// all failures are rejected by the validation. The request should be retried
+// only on the store failures since the rejected metrics are never accepted.
+func (r *BatchWriteResponse) storeError() *BatchWriteResult {
+	for _, result := range r.Errors {
+		if !result.invalid {
+			return result
+		}
+	}
+	return nil
+}
+
+// rejected returns the number of the datapoints rejected by the validation.
+func (r *BatchWriteResponse) rejected() int {
+	n := 0
+	for _, result := range r.Errors {
+		n += result.rejected
+	}
+	return n
+}
+
+// batchWriteHandler returns a HTTP handler for the endpoint to write multiple metrics.
+// It returns 200 if all metrics are written and 207 with the failed metrics otherwise.
+func (h *Handler) batchWriteHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil {
+			badRequest(w, "No request body")
+			return
+		}
+		metrics, err := decodeMetrics(r)
+		if err != nil {
+			badRequest(w, err.Error())
+			return
+		}
+		if len(metrics) == 0 {
+			badRequest(w, "No metrics")
+			return
+		}
+
+		resp := h.insertMetrics(metrics)
+		if resp.Failed > 0 {
+			renderJSON(w, http.StatusMultiStatus, resp)
+			return
+		}
+		renderJSON(w, http.StatusOK, resp)
+	})
+}
@@ -0,0 +1,101 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/config"
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage"
+)
+
+func TestBatchWriteHandler(t *testing.T) {
+	config.Config.HTTPWriteConcurrency = 2
+	fakewriter := &storage.FakeReadWriter{
+		FakeInsertMetric: func(m *model.Metric) error {
+			if m.Name == "server2.loadavg5" {
+				return errors.New("failed to write")
+			}
+			return nil
+		},
+	}
+	h := New(&Option{
+		Store: fakewriter,
+		Port:  "dummy",
+	})
+
+	tests := []struct {
+		desc             string
+		contentType      string
+		body             string
+		expectedCode     int
+		expectedResponse *BatchWriteResponse
+	}{
+		{
+			"json array",
+			"application/json",
+			`[{"name":"server1.loadavg5","datapoints":[{"timestamp":100,"value":0.1}]},
+			  {"name":"server3.loadavg5","datapoints":[{"timestamp":100,"value":0.1}]}]`,
+			http.StatusOK,
+			&BatchWriteResponse{Accepted: 2, Failed: 0, Errors: []*BatchWriteResult{}},
+		},
+		{
+			"newline-delimited json with failures",
+			"application/x-ndjson",
+			`{"name":"server1.loadavg5","datapoints":[{"timestamp":100,"value":0.1}]}
+{"name":"server2.loadavg5","datapoints":[{"timestamp":100,"value":0.1}]}
+{"name":"","datapoints":[{"timestamp":100,"value":0.1}]}
+`,
+			http.StatusMultiStatus,
+			&BatchWriteResponse{Accepted: 1, Failed: 2, Errors: []*BatchWriteResult{
+				{Index: 1, Name: "server2.loadavg5", Error: "failed to write"},
+				{Index: 2, Error: "metric name is empty"},
+			}},
+		},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/datapoints/batch", strings.NewReader(tc.body))
+		if err != nil {
+			panic(err)
+		}
+		req.Header.Set("Content-Type", tc.contentType)
+		h.batchWriteHandler().ServeHTTP(r, req)
+
+		if r.Code != tc.expectedCode {
+			t.Fatalf("desc: %s, response code should be %d, not %d", tc.desc, tc.expectedCode, r.Code)
+		}
+		var got BatchWriteResponse
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatalf("desc: %s, err: %s", tc.desc, err)
+		}
+		if diff := pretty.Compare(&got, tc.expectedResponse); diff != "" {
+			t.Fatalf("desc: %s, diff: (-actual +expected)\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestBatchWriteHandler_BadRequest(t *testing.T) {
+	h := New(&Option{
+		Store: &storage.FakeReadWriter{},
+		Port:  "dummy",
+	})
+	for _, body := range []string{"", "[]", `{"metric":{}}`} {
+		r := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/datapoints/batch", bytes.NewBufferString(body))
+		if err != nil {
+			panic(err)
+		}
+		h.batchWriteHandler().ServeHTTP(r, req)
+		if r.Code != http.StatusBadRequest {
+			t.Fatalf("body: %q, response code should be 400, not %d", body, r.Code)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package web
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/yuuki/diamondb/pkg/influxdb"
+)
+
+// influxWriteHandler returns a HTTP handler for the endpoint compatible with
+// /write of InfluxDB v1.
+func (h *Handler) influxWriteHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		unit, err := influxdb.PrecisionToDuration(r.URL.Query().Get("precision"))
+		if err != nil {
+			badRequest(w, err.Error())
+			return
+		}
+		if r.Body == nil {
+			badRequest(w, "No request body")
+			return
+		}
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				badRequest(w, err.Error())
+				return
+			}
+			defer gz.Close()
+			body = gz
+		}
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			badRequest(w, err.Error())
+			return
+		}
+
+		points, errs := influxdb.ParsePoints(b, unit, time.Now())
+		resp := h.insertMetrics(influxdb.ToMetrics(points, h.influxTemplate))
+		if result := resp.storeError(); result != nil {
+			serverError(w, result.Error)
+			return
+		}
+		if len(errs) > 0 || resp.Failed > 0 {
+			// Same as InfluxDB, the valid points are written even if some lines are
+			// malformed or rejected by the validation.
+			var msg string
+			if len(errs) > 0 {
+				msg = errs[0].Error()
+			} else {
+				msg = resp.Errors[0].Error
+			}
+			badRequest(w, fmt.Sprintf("partial write: %s dropped=%d", msg, len(errs)+resp.rejected()))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,165 @@
+package web
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage"
+)
+
+func TestInfluxWriteHandler(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got []*model.Metric
+	)
+	h := New(&Option{
+		Store: &storage.FakeReadWriter{
+			FakeInsertMetric: func(m *model.Metric) error {
+				mu.Lock()
+				defer mu.Unlock()
+				got = append(got, m)
+				return nil
+			},
+		},
+		Port: "dummy",
+	})
+
+	body := new(bytes.Buffer)
+	gz := gzip.NewWriter(body)
+	gz.Write([]byte("cpu,host=server1 user=0.5,system=1i 1500000000000\n"))
+	gz.Close()
+
+	r := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/write?db=telegraf&precision=ms", body)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+	h.influxWriteHandler().ServeHTTP(r, req)
+
+	if r.Code != http.StatusNoContent {
+		t.Fatalf("response code should be 204, not %d", r.Code)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].Name < got[j].Name })
+	expected := []*model.Metric{
+		{
+			Name:       "cpu.server1.system",
+			Datapoints: []*model.Datapoint{{Timestamp: 1500000000, Value: 1}},
+		},
+		{
+			Name:       "cpu.server1.user",
+			Datapoints: []*model.Datapoint{{Timestamp: 1500000000, Value: 0.5}},
+		},
+	}
+	if diff := pretty.Compare(got, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestInfluxWriteHandler_PartialWrite(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got []string
+	)
+	h := New(&Option{
+		Store: &storage.FakeReadWriter{
+			FakeInsertMetric: func(m *model.Metric) error {
+				mu.Lock()
+				defer mu.Unlock()
+				got = append(got, m.Name)
+				return nil
+			},
+		},
+		Port: "dummy",
+	})
+
+	r := httptest.NewRecorder()
+	body := "cpu value=1 1500000000\ncpu value=abc 1500000000\n"
+	req, err := http.NewRequest("POST", "/write?precision=s", strings.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	h.influxWriteHandler().ServeHTTP(r, req)
+	if r.Code != http.StatusBadRequest {
+		t.Fatalf("response code should be 400, not %d", r.Code)
+	}
+	// The valid line is written even if the other line is malformed.
+	if diff := pretty.Compare(got, []string{"cpu"}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestInfluxWriteHandler_Error(t *testing.T) {
+	tests := []struct {
+		desc         string
+		err          error
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			"validation failure",
+			&storage.ValidationError{Name: "mem", Datapoints: []*storage.DatapointError{{Index: 0, Timestamp: 1500000000, Reason: "too old"}}},
+			http.StatusBadRequest,
+			`{"error":"partial write: invalid datapoint of \"mem\": too old dropped=1"}`,
+		},
+		{
+			"store failure",
+			errors.New("failed to write"),
+			http.StatusInternalServerError,
+			`{"error":"failed to write"}`,
+		},
+	}
+	for _, tc := range tests {
+		h := New(&Option{
+			Store: &storage.FakeReadWriter{
+				FakeInsertMetric: func(m *model.Metric) error {
+					if m.Name == "mem" {
+						return tc.err
+					}
+					return nil
+				},
+			},
+			Port: "dummy",
+		})
+		r := httptest.NewRecorder()
+		body := "cpu value=1 1500000000\nmem value=2 1500000000\n"
+		req, err := http.NewRequest("POST", "/write?precision=s", strings.NewReader(body))
+		if err != nil {
+			panic(err)
+		}
+		h.influxWriteHandler().ServeHTTP(r, req)
+		if r.Code != tc.expectedCode {
+			t.Fatalf("desc: %s, response code should be %d, not %d", tc.desc, tc.expectedCode, r.Code)
+		}
+		if diff := pretty.Compare(r.Body.String(), tc.expectedBody); diff != "" {
+			t.Fatalf("desc: %s, diff: (-actual +expected)\n%s", tc.desc, diff)
+		}
+	}
+}
+
+func TestInfluxWriteHandler_InvalidPrecision(t *testing.T) {
+	h := New(&Option{
+		Store: &storage.FakeReadWriter{},
+		Port:  "dummy",
+	})
+
+	r := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/write?precision=d", strings.NewReader("cpu value=1 1\n"))
+	if err != nil {
+		panic(err)
+	}
+	h.influxWriteHandler().ServeHTTP(r, req)
+	if r.Code != http.StatusBadRequest {
+		t.Fatalf("response code should be 400, not %d", r.Code)
+	}
+}
@@ -0,0 +1,113 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/opentsdb"
+)
+
+// OpenTSDBPutError represents an error of a datapoint of /api/put.
+type OpenTSDBPutError struct {
+	DataPoint *opentsdb.DataPoint `json:"datapoint"`
+	Error     string              `json:"error"`
+}
+
+// OpenTSDBPutResponse represents a response of /api/put with summary or details.
+type OpenTSDBPutResponse struct {
+	Errors  []*OpenTSDBPutError `json:"errors,omitempty"`
+	Failed  int                 `json:"failed"`
+	Success int                 `json:"success"`
+}
+
+// openTSDBPutHandler returns a HTTP handler for the endpoint compatible with
+// /api/put of OpenTSDB.
+func (h *Handler) openTSDBPutHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil {
+			badRequest(w, "No request body")
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			badRequest(w, err.Error())
+			return
+		}
+		points, err := opentsdb.DecodePut(b)
+		if err != nil {
+			badRequest(w, err.Error())
+			return
+		}
+
+		resp := &OpenTSDBPutResponse{}
+		var (
+			metrics []*model.Metric
+			indices = map[string]int{}
+			sources [][]*opentsdb.DataPoint
+		)
+		for _, point := range points {
+			name, p, err := point.ToDatapoint()
+			if err != nil {
+				resp.Failed++
+				resp.Errors = append(resp.Errors, &OpenTSDBPutError{DataPoint: point, Error: err.Error()})
+				continue
+			}
+			i, ok := indices[name]
+			if !ok {
+				i = len(metrics)
+				indices[name] = i
+				metrics = append(metrics, &model.Metric{Name: name})
+				sources = append(sources, nil)
+			}
+			metrics[i].Datapoints = append(metrics[i].Datapoints, p)
+			sources[i] = append(sources[i], point)
+		}
+		wr := h.insertMetrics(metrics)
+		resp.Success += len(points) - resp.Failed
+		for _, e := range wr.Errors {
+			if len(e.Datapoints) > 0 {
+				// Only the datapoints rejected by the validation are failed.
+				for _, de := range e.Datapoints {
+					resp.Failed++
+					resp.Success--
+					resp.Errors = append(resp.Errors, &OpenTSDBPutError{DataPoint: sources[e.Index][de.Index], Error: de.Reason})
+				}
+				continue
+			}
+			for _, point := range sources[e.Index] {
+				resp.Failed++
+				resp.Success--
+				resp.Errors = append(resp.Errors, &OpenTSDBPutError{DataPoint: point, Error: e.Error})
+			}
+		}
+
+		status := http.StatusNoContent
+		if resp.Failed > 0 {
+			status = http.StatusBadRequest
+		}
+		q := r.URL.Query()
+		_, details := q["details"]
+		_, summary := q["summary"]
+		switch {
+		case details:
+			if status == http.StatusNoContent {
+				status = http.StatusOK
+			}
+			if resp.Errors == nil {
+				resp.Errors = []*OpenTSDBPutError{}
+			}
+			renderJSON(w, status, resp)
+		case summary:
+			if status == http.StatusNoContent {
+				status = http.StatusOK
+			}
+			resp.Errors = nil
+			renderJSON(w, status, resp)
+		case resp.Failed > 0:
+			badRequest(w, resp.Errors[0].Error)
+		default:
+			w.WriteHeader(status)
+		}
+	})
+}
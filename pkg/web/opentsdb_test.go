@@ -0,0 +1,112 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/opentsdb"
+	"github.com/yuuki/diamondb/pkg/storage"
+)
+
+func TestOpenTSDBPutHandler(t *testing.T) {
+	h := New(&Option{
+		Store: &storage.FakeReadWriter{
+			FakeInsertMetric: func(m *model.Metric) error {
+				if m.Name == "sys.cpu.nice.host.web01" {
+					return errors.New("failed to write")
+				}
+				return nil
+			},
+		},
+		Port: "dummy",
+	})
+
+	body := `[
+	  {"metric":"sys.cpu.user","timestamp":1500000000,"value":1,"tags":{"host":"web01"}},
+	  {"metric":"sys.cpu.user","timestamp":1500000060,"value":2,"tags":{"host":"web01"}},
+	  {"metric":"sys.cpu.nice","timestamp":1500000000,"value":3,"tags":{"host":"web01"}},
+	  {"metric":"","timestamp":1500000000,"value":4,"tags":{"host":"web01"}}
+	]`
+	tests := []struct {
+		desc             string
+		url              string
+		body             string
+		expectedCode     int
+		expectedResponse *OpenTSDBPutResponse
+	}{
+		{
+			"no response body",
+			"/api/put",
+			`{"metric":"sys.cpu.user","timestamp":1500000000,"value":1,"tags":{"host":"web01"}}`,
+			http.StatusNoContent,
+			nil,
+		},
+		{
+			"summary",
+			"/api/put?summary",
+			body,
+			http.StatusBadRequest,
+			&OpenTSDBPutResponse{Failed: 2, Success: 2},
+		},
+		{
+			"details",
+			"/api/put?details",
+			body,
+			http.StatusBadRequest,
+			&OpenTSDBPutResponse{
+				Errors: []*OpenTSDBPutError{
+					{
+						DataPoint: &opentsdb.DataPoint{
+							Metric: "", Timestamp: "1500000000", Value: "4", Tags: map[string]string{"host": "web01"},
+						},
+						Error: "metric name is empty",
+					},
+					{
+						DataPoint: &opentsdb.DataPoint{
+							Metric: "sys.cpu.nice", Timestamp: "1500000000", Value: "3", Tags: map[string]string{"host": "web01"},
+						},
+						Error: "failed to write",
+					},
+				},
+				Failed:  2,
+				Success: 2,
+			},
+		},
+		{
+			"details without failures",
+			"/api/put?details",
+			`{"metric":"sys.cpu.user","timestamp":1500000000,"value":1,"tags":{"host":"web01"}}`,
+			http.StatusOK,
+			&OpenTSDBPutResponse{Errors: []*OpenTSDBPutError{}, Failed: 0, Success: 1},
+		},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", tc.url, strings.NewReader(tc.body))
+		if err != nil {
+			panic(err)
+		}
+		h.openTSDBPutHandler().ServeHTTP(r, req)
+
+		if r.Code != tc.expectedCode {
+			t.Fatalf("desc: %s, response code should be %d, not %d", tc.desc, tc.expectedCode, r.Code)
+		}
+		if tc.expectedResponse == nil {
+			continue
+		}
+		var got OpenTSDBPutResponse
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatalf("desc: %s, err: %s", tc.desc, err)
+		}
+		if diff := pretty.Compare(&got, tc.expectedResponse); diff != "" {
+			t.Fatalf("desc: %s, diff: (-actual +expected)\n%s", tc.desc, diff)
+		}
+	}
+}
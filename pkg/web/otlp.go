@@ -0,0 +1,76 @@
+package web
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/yuuki/diamondb/pkg/otlp"
+)
+
+// otlpWriteHandler returns a HTTP handler for the endpoint to receive the metrics
+// by OTLP/HTTP in the binary protobuf encoding.
+func (h *Handler) otlpWriteHandler() http.Handler {
+	converter := otlp.NewConverter(h.otlpTemplate)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/x-protobuf" {
+			http.Error(w, fmt.Sprintf("unsupported content type %q", ct), http.StatusUnsupportedMediaType)
+			return
+		}
+		if r.Body == nil {
+			badRequest(w, "No request body")
+			return
+		}
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				badRequest(w, err.Error())
+				return
+			}
+			defer gz.Close()
+			body = gz
+		}
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			badRequest(w, err.Error())
+			return
+		}
+		rms, err := otlp.DecodeExportRequest(b)
+		if err != nil {
+			badRequest(w, err.Error())
+			return
+		}
+
+		metrics, rejected := converter.ToMetrics(rms)
+		resp := h.insertMetrics(metrics)
+		if result := resp.storeError(); result != nil {
+			// OTLP exporters retry the request on 503.
+			unavaliableError(w, result.Error)
+			return
+		}
+		// The datapoints rejected by the validation are reported as a partial success
+		// so that the exporters don't retry them.
+		var msg string
+		if resp.Failed > 0 {
+			msg = resp.Errors[0].Error
+		} else if rejected > 0 {
+			msg = "exponential histograms and summaries are not supported"
+		}
+		rejected += resp.rejected()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(otlp.EncodeExportResponse(rejected, msg)); err != nil {
+			log.Println(err)
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package web
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/otlp"
+	"github.com/yuuki/diamondb/pkg/protowire"
+	"github.com/yuuki/diamondb/pkg/storage"
+)
+
+// testOTLPRequest builds an ExportMetricsServiceRequest with a gauge 'up' and a summary.
+func testOTLPRequest() []byte {
+	point := &protowire.Writer{}
+	point.Fixed64(3, 1500000000*1e9)
+	point.Double(4, 1)
+	gauge := &protowire.Writer{}
+	gauge.BytesField(1, point.Bytes())
+	up := &protowire.Writer{}
+	up.String(1, "up")
+	up.BytesField(5, gauge.Bytes())
+
+	summary := &protowire.Writer{}
+	summary.BytesField(1, nil)
+	rpc := &protowire.Writer{}
+	rpc.String(1, "rpc.duration")
+	rpc.BytesField(11, summary.Bytes())
+
+	sm := &protowire.Writer{}
+	sm.BytesField(2, up.Bytes())
+	sm.BytesField(2, rpc.Bytes())
+	rm := &protowire.Writer{}
+	rm.BytesField(2, sm.Bytes())
+	req := &protowire.Writer{}
+	req.BytesField(1, rm.Bytes())
+	return req.Bytes()
+}
+
+func TestOTLPWriteHandler(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got []*model.Metric
+	)
+	h := New(&Option{
+		Store: &storage.FakeReadWriter{
+			FakeInsertMetric: func(m *model.Metric) error {
+				mu.Lock()
+				defer mu.Unlock()
+				got = append(got, m)
+				return nil
+			},
+		},
+		Port: "dummy",
+	})
+
+	r := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/v1/metrics", bytes.NewReader(testOTLPRequest()))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	h.otlpWriteHandler().ServeHTTP(r, req)
+
+	if r.Code != http.StatusOK {
+		t.Fatalf("response code should be %d, not %d: %s", http.StatusOK, r.Code, r.Body.String())
+	}
+	expectedBody := otlp.EncodeExportResponse(1, "exponential histograms and summaries are not supported")
+	if diff := pretty.Compare(r.Body.Bytes(), expectedBody); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	expected := []*model.Metric{
+		{Name: "up", Datapoints: []*model.Datapoint{{Timestamp: 1500000000, Value: 1}}},
+	}
+	if diff := pretty.Compare(got, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestOTLPWriteHandler_Error(t *testing.T) {
+	h := New(&Option{
+		Store: &storage.FakeReadWriter{
+			FakeInsertMetric: func(m *model.Metric) error {
+				return errors.New("failed to write")
+			},
+		},
+		Port: "dummy",
+	})
+	payload := testOTLPRequest()
+
+	tests := []struct {
+		desc         string
+		contentType  string
+		body         []byte
+		expectedCode int
+	}{
+		{"json is not supported", "application/json", payload, http.StatusUnsupportedMediaType},
+		{"truncated payload", "application/x-protobuf", payload[:len(payload)-1], http.StatusBadRequest},
+		{"store failure", "application/x-protobuf", payload, http.StatusServiceUnavailable},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/v1/metrics", bytes.NewReader(tc.body))
+		if err != nil {
+			panic(err)
+		}
+		req.Header.Set("Content-Type", tc.contentType)
+		h.otlpWriteHandler().ServeHTTP(r, req)
+
+		if r.Code != tc.expectedCode {
+			t.Fatalf("desc: %s, response code should be %d, not %d", tc.desc, tc.expectedCode, r.Code)
+		}
+	}
+}
+
+func TestOTLPWriteHandler_ValidationError(t *testing.T) {
+	h := New(&Option{
+		Store: &storage.FakeReadWriter{
+			FakeInsertMetric: func(m *model.Metric) error {
+				return &storage.ValidationError{Name: m.Name, Reason: "invalid name"}
+			},
+		},
+		Port: "dummy",
+	})
+	r := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/v1/metrics", bytes.NewReader(testOTLPRequest()))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	h.otlpWriteHandler().ServeHTTP(r, req)
+
+	// The rejected datapoint is reported as a partial success not to be retried.
+	if r.Code != http.StatusOK {
+		t.Fatalf("response code should be %d, not %d: %s", http.StatusOK, r.Code, r.Body.String())
+	}
+	expectedBody := otlp.EncodeExportResponse(2, `invalid metric "up": invalid name`)
+	if diff := pretty.Compare(r.Body.Bytes(), expectedBody); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
@@ -0,0 +1,42 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/yuuki/diamondb/pkg/prometheus"
+)
+
+// promWriteHandler returns a HTTP handler for the endpoint to receive
+// the samples by Prometheus remote_write.
+func (h *Handler) promWriteHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil {
+			badRequest(w, "No request body")
+			return
+		}
+		compressed, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			badRequest(w, err.Error())
+			return
+		}
+		tss, err := prometheus.DecodeWriteRequest(compressed)
+		if err != nil {
+			badRequest(w, err.Error())
+			return
+		}
+
+		resp := h.insertMetrics(prometheus.ToMetrics(tss, h.promTemplate))
+		if result := resp.storeError(); result != nil {
+			// Prometheus retries the request on 5xx.
+			serverError(w, result.Error)
+			return
+		}
+		if resp.Failed > 0 {
+			// Prometheus drops the request on 4xx instead of retrying the invalid samples.
+			badRequest(w, resp.Errors[0].Error)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,128 @@
+package web
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage"
+)
+
+func TestPromWriteHandler(t *testing.T) {
+	payload, err := ioutil.ReadFile("testdata/prom_write_request.snappy")
+	if err != nil {
+		panic(err)
+	}
+
+	var (
+		mu  sync.Mutex
+		got []*model.Metric
+	)
+	fakewriter := &storage.FakeReadWriter{
+		FakeInsertMetric: func(m *model.Metric) error {
+			mu.Lock()
+			defer mu.Unlock()
+			got = append(got, m)
+			return nil
+		},
+	}
+	h := New(&Option{
+		Store: fakewriter,
+		Port:  "dummy",
+	})
+
+	r := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/api/v1/prom/write", bytes.NewReader(payload))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	h.promWriteHandler().ServeHTTP(r, req)
+
+	if r.Code != http.StatusNoContent {
+		t.Fatalf("response code should be 204, not %d", r.Code)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].Name < got[j].Name })
+	expected := []*model.Metric{
+		{
+			Name: "node_load1.instance.host1:9100.job.node",
+			Datapoints: []*model.Datapoint{
+				{Timestamp: 1500000000, Value: 1.5},
+				{Timestamp: 1500000015, Value: 1.75},
+			},
+		},
+		{
+			Name: "up.instance.host1:9100.job.node",
+			Datapoints: []*model.Datapoint{
+				{Timestamp: 1500000000, Value: 1},
+			},
+		},
+	}
+	if diff := pretty.Compare(got, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestPromWriteHandler_BadRequest(t *testing.T) {
+	h := New(&Option{
+		Store: &storage.FakeReadWriter{},
+		Port:  "dummy",
+	})
+	r := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/api/v1/prom/write", bytes.NewBufferString("invalid"))
+	if err != nil {
+		panic(err)
+	}
+	h.promWriteHandler().ServeHTTP(r, req)
+	if r.Code != http.StatusBadRequest {
+		t.Fatalf("response code should be 400, not %d", r.Code)
+	}
+}
+
+func TestPromWriteHandler_Error(t *testing.T) {
+	payload, err := ioutil.ReadFile("testdata/prom_write_request.snappy")
+	if err != nil {
+		panic(err)
+	}
+
+	tests := []struct {
+		desc         string
+		err          error
+		expectedCode int
+	}{
+		{"validation failure", &storage.ValidationError{Name: "up", Reason: "invalid name"}, http.StatusBadRequest},
+		{"store failure", errors.New("failed to write"), http.StatusInternalServerError},
+	}
+	for _, tc := range tests {
+		h := New(&Option{
+			Store: &storage.FakeReadWriter{
+				FakeInsertMetric: func(m *model.Metric) error {
+					if strings.HasPrefix(m.Name, "up.") {
+						return tc.err
+					}
+					return nil
+				},
+			},
+			Port: "dummy",
+		})
+		r := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/api/v1/prom/write", bytes.NewReader(payload))
+		if err != nil {
+			panic(err)
+		}
+		h.promWriteHandler().ServeHTTP(r, req)
+		if r.Code != tc.expectedCode {
+			t.Fatalf("desc: %s, response code should be %d, not %d", tc.desc, tc.expectedCode, r.Code)
+		}
+	}
+}
@@ -17,7 +17,10 @@ import (
 	"github.com/urfave/negroni"
 
 	"github.com/yuuki/diamondb/pkg/config"
+	"github.com/yuuki/diamondb/pkg/influxdb"
 	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/otlp"
+	"github.com/yuuki/diamondb/pkg/prometheus"
 	"github.com/yuuki/diamondb/pkg/query"
 	"github.com/yuuki/diamondb/pkg/storage"
 	"github.com/yuuki/diamondb/pkg/timeparser"
@@ -26,18 +29,36 @@ import (
 const (
 	// DayTime is one day period.
 	DayTime = time.Duration(24*60*60) * time.Second
+
+	// warningHeader is the header of the render response which warns that some
+	// of the datapoints are not fetched.
+	warningHeader = "X-Diamondb-Warning"
 )
 
 // Handler serves various HTTP endpoints of the Diamond server
 type Handler struct {
-	server *http.Server
-	store  storage.ReadWriter
+	server    *http.Server
+	store     storage.ReadWriter
+	tierStats func() []storage.TierStats
+
+	promTemplate   prometheus.NameTemplate
+	influxTemplate influxdb.NameTemplate
+	otlpTemplate   otlp.NameTemplate
 }
 
 // Options for the web Handler.
 type Option struct {
 	Port  string
 	Store storage.ReadWriter
+	// TierStats returns the fetch counters of the tiers of the store served by
+	// /stats, which is not served if nil.
+	TierStats func() []storage.TierStats
+
+	// The templates to name the series written by each protocol. The default
+	// template of the protocol is used if nil.
+	PrometheusNameTemplate prometheus.NameTemplate
+	InfluxDBNameTemplate   influxdb.NameTemplate
+	OTLPNameTemplate       otlp.NameTemplate
 }
 
 // New initializes a new web Handler.
@@ -55,17 +76,39 @@ func New(o *Option) *Handler {
 	srv := &http.Server{Addr: ":" + o.Port, Handler: n}
 
 	h := &Handler{
-		server: srv,
-		store:  o.Store,
+		server:         srv,
+		store:          o.Store,
+		tierStats:      o.TierStats,
+		promTemplate:   o.PrometheusNameTemplate,
+		influxTemplate: o.InfluxDBNameTemplate,
+		otlpTemplate:   o.OTLPNameTemplate,
+	}
+	// The default templates are always parsed successfully.
+	if h.promTemplate == nil {
+		h.promTemplate, _ = prometheus.ParseNameTemplate(prometheus.DefaultNameTemplate)
+	}
+	if h.influxTemplate == nil {
+		h.influxTemplate, _ = influxdb.ParseNameTemplate(influxdb.DefaultNameTemplate)
+	}
+	if h.otlpTemplate == nil {
+		h.otlpTemplate, _ = otlp.ParseNameTemplate(otlp.DefaultNameTemplate)
 	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/ping", h.pingHandler())
 	mux.Handle("/inspect", h.inspectHandler())
+	if h.tierStats != nil {
+		mux.Handle("/stats", h.statsHandler())
+	}
 	mux.Handle("/render", http.TimeoutHandler(
 		h.renderHandler(), config.Config.HTTPRenderTimeout, "/render timeout"),
 	)
 	mux.Handle("/datapoints", h.writeHandler())
+	mux.Handle("/datapoints/batch", h.batchWriteHandler())
+	mux.Handle("/api/v1/prom/write", h.promWriteHandler())
+	mux.Handle("/write", h.influxWriteHandler())
+	mux.Handle("/api/put", h.openTSDBPutHandler())
+	mux.Handle("/v1/metrics", h.otlpWriteHandler())
 	n.UseHandler(mux)
 
 	return h
@@ -109,6 +152,16 @@ func (h *Handler) inspectHandler() http.Handler {
 	})
 }
 
+// StatsHandler returns a HTTP handler for the endpoint to show the fetch
+// counters of the tiers.
+func (h *Handler) statsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		renderJSONIndent(w, http.StatusOK, struct {
+			Tiers []storage.TierStats `json:"tiers"`
+		}{h.tierStats()})
+	})
+}
+
 // RenderHandler returns a HTTP handler for the endpoint to read data.
 func (h *Handler) renderHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -141,6 +194,12 @@ func (h *Handler) renderHandler() http.Handler {
 		}
 
 		seriesSlice, err := query.EvalTargets(h.store, targets, from, until)
+		if perr, ok := err.(*storage.PartialError); ok {
+			// Render the series fetched with the warning of the datapoints given up.
+			logErrorWithQuery(perr, targets, from, until)
+			w.Header().Set(warningHeader, perr.Error())
+			err = nil
+		}
 		if err != nil {
 			switch err := errors.Cause(err).(type) {
 			case *query.ParserError, *query.UnsupportedFunctionError,
@@ -168,6 +227,15 @@ type WriteRequest struct {
 	Metric *model.Metric `json:"metric"`
 }
 
+// WriteErrorResponse represents an error response of /datapoints. Datapoints is
+// set if only the datapoints are rejected by the validation, and the other
+// datapoints are written.
+type WriteErrorResponse struct {
+	Error      string                    `json:"error"`
+	Reason     string                    `json:"reason,omitempty"`
+	Datapoints []*storage.DatapointError `json:"datapoints,omitempty"`
+}
+
 func (h *Handler) writeHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var wr WriteRequest
@@ -185,9 +253,15 @@ func (h *Handler) writeHandler() http.Handler {
 		}
 
 		if err := h.store.InsertMetric(wr.Metric); err != nil {
-			log.Printf("%+v\n", err) // Print stack trace by pkg/errors
-			switch err.(type) {
+			switch verr := errors.Cause(err).(type) {
+			case *storage.ValidationError:
+				renderJSON(w, http.StatusBadRequest, &WriteErrorResponse{
+					Error:      verr.Error(),
+					Reason:     verr.Reason,
+					Datapoints: verr.Datapoints,
+				})
 			default:
+				log.Printf("%+v\n", err) // Print stack trace by pkg/errors
 				serverError(w, errors.Cause(err).Error())
 			}
 			return
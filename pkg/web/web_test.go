@@ -15,8 +15,43 @@ import (
 	"github.com/yuuki/diamondb/pkg/model"
 	. "github.com/yuuki/diamondb/pkg/model"
 	"github.com/yuuki/diamondb/pkg/storage"
+	"github.com/yuuki/diamondb/pkg/storage/dynamodb"
+	"github.com/yuuki/diamondb/pkg/storage/redis"
 )
 
+func TestStatsHandler(t *testing.T) {
+	store := storage.NewStore(
+		&storage.RedisTier{Redis: &redis.FakeReadWriter{}},
+		&storage.DynamoDBTier{DynamoDB: &dynamodb.FakeReadWriter{}},
+	)
+	r := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/stats", nil)
+	if err != nil {
+		panic(err)
+	}
+
+	h := New(&Option{
+		Store:     store,
+		TierStats: store.Stats,
+		Port:      "dummy",
+	})
+	h.statsHandler().ServeHTTP(r, req)
+
+	if r.Code != 200 {
+		t.Fatalf("response code should be 200, not %d", r.Code)
+	}
+	var got struct {
+		Tiers []storage.TierStats `json:"tiers"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := []storage.TierStats{{Name: "redis"}, {Name: "dynamodb"}}
+	if diff := pretty.Compare(got.Tiers, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
 func TestRenderHandler(t *testing.T) {
 	fakefetcher := &storage.FakeReadWriter{
 		FakeFetch: func(name string, start, end time.Time) (SeriesSlice, error) {
@@ -55,6 +90,43 @@ func TestRenderHandler(t *testing.T) {
 	}
 }
 
+func TestRenderHandler_Partial(t *testing.T) {
+	fakefetcher := &storage.FakeReadWriter{
+		FakeFetch: func(name string, start, end time.Time) (SeriesSlice, error) {
+			return SeriesSlice{
+				NewSeries("server1.loadavg5", []float64{10.0, 11.0}, 1000, 60),
+			}, &storage.PartialError{Err: fmt.Errorf("1 dynamodb items not fetched")}
+		},
+	}
+	r := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/render?target=server1.loadavg5", nil)
+	if err != nil {
+		panic(err)
+	}
+
+	h := New(&Option{
+		Store: fakefetcher,
+		Port:  "dummy",
+	})
+	h.renderHandler().ServeHTTP(r, req)
+
+	// The series fetched are rendered with the warning.
+	if r.Code != 200 {
+		t.Fatalf("response code should be 200, not %d", r.Code)
+	}
+	got, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := "[{\"target\":\"server1.loadavg5\",\"datapoints\":[[10,1000],[11,1060]]}]"
+	if diff := pretty.Compare(fmt.Sprintf("%s", got), expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	if v := r.HeaderMap.Get("X-Diamondb-Warning"); v != "1 dynamodb items not fetched" {
+		t.Fatalf("response should have the warning: %q", v)
+	}
+}
+
 func TestWriteHandler(t *testing.T) {
 	fakewriter := &storage.FakeReadWriter{
 		FakeInsertMetric: func(*model.Metric) error {
@@ -90,3 +162,77 @@ func TestWriteHandler(t *testing.T) {
 		t.Fatalf("/datapoints response code should be 204")
 	}
 }
+
+func TestWriteHandler_ValidationError(t *testing.T) {
+	var written *model.Metric
+	fakewriter := storage.NewValidator(&storage.FakeReadWriter{
+		FakeInsertMetric: func(m *model.Metric) error {
+			written = m
+			return nil
+		},
+	}, &storage.ValidationPolicy{})
+
+	tests := []struct {
+		desc             string
+		metric           *model.Metric
+		expectedResponse *WriteErrorResponse
+		expectedWritten  *model.Metric
+	}{
+		{
+			"invalid name",
+			&model.Metric{
+				Name:       "server1.loadavg{5}",
+				Datapoints: []*model.Datapoint{{Timestamp: 100, Value: 0.1}},
+			},
+			&WriteErrorResponse{
+				Error:  `invalid metric "server1.loadavg{5}": metric name contains invalid character '{'`,
+				Reason: "metric name contains invalid character '{'",
+			},
+			nil,
+		},
+		{
+			"invalid datapoint",
+			&model.Metric{
+				Name:       "server1.loadavg5",
+				Datapoints: []*model.Datapoint{{Timestamp: 100, Value: 0.1}, {Timestamp: -1, Value: 0.2}},
+			},
+			&WriteErrorResponse{
+				Error:      `invalid datapoint of "server1.loadavg5": timestamp is not positive`,
+				Datapoints: []*storage.DatapointError{{Index: 1, Timestamp: -1, Reason: "timestamp is not positive"}},
+			},
+			&model.Metric{
+				Name:       "server1.loadavg5",
+				Datapoints: []*model.Datapoint{{Timestamp: 100, Value: 0.1}},
+			},
+		},
+	}
+	h := New(&Option{
+		Store: fakewriter,
+		Port:  "dummy",
+	})
+	for _, tc := range tests {
+		written = nil
+		b := new(bytes.Buffer)
+		json.NewEncoder(b).Encode(&WriteRequest{Metric: tc.metric})
+		r := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/datapoints", b)
+		if err != nil {
+			panic(err)
+		}
+		h.writeHandler().ServeHTTP(r, req)
+
+		if r.Code != http.StatusBadRequest {
+			t.Fatalf("desc: %s, response code should be 400, not %d", tc.desc, r.Code)
+		}
+		var got WriteErrorResponse
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatalf("desc: %s, err: %s", tc.desc, err)
+		}
+		if diff := pretty.Compare(&got, tc.expectedResponse); diff != "" {
+			t.Fatalf("desc: %s, diff: (-actual +expected)\n%s", tc.desc, diff)
+		}
+		if diff := pretty.Compare(written, tc.expectedWritten); diff != "" {
+			t.Fatalf("desc: %s, diff: (-actual +expected)\n%s", tc.desc, diff)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+// +build integration
+
+package buffer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
+	"github.com/yuuki/diamondb/test/integration/framework"
+)
+
+func TestPutAndRollup_CompactNeverClaimed(t *testing.T) {
+	r := framework.Redis("blob")
+	name := "integration.blob.compact"
+	rs := []*schema.Retention{{Slot: "1d", Step: 86400, Last: true}}
+	if err := r.Delete("1d", name); err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+
+	// The rolled up records of the same timestamps are appended every flush of
+	// the finer slot into the last slot, which is never taken out.
+	for i := 0; i < 1000; i++ {
+		tv := map[int64]*model.Aggregate{
+			86400 * int64(i%3): {Min: 1, Max: 1, Sum: 1, Count: 1, Last: 1, LastTimestamp: int64(i), RolledUp: true},
+		}
+		claims, err := r.PutAndRollup(rs, name, tv, time.Now())
+		if err != nil {
+			t.Fatalf("should not raise error: %s", err)
+		}
+		if len(claims) != 0 {
+			t.Fatalf("datapoints should not be taken out: %v", claims)
+		}
+	}
+
+	n, err := framework.StrLen("1d:{" + name + "}")
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if n >= 4096+57 {
+		t.Fatalf("blob should be compacted, but %d bytes", n)
+	}
+	got, err := r.Get("1d", name)
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("blob should have 3 timestamps: %v", got)
+	}
+}
@@ -0,0 +1,169 @@
+// +build integration
+
+package buffer
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/redis"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
+	"github.com/yuuki/diamondb/test/integration/framework"
+)
+
+// flushedElement is an element of the binary set of a DynamoDB item.
+type flushedElement struct {
+	timestamp int64
+	aggregate model.Aggregate
+}
+
+// TestPutAndRollup_Batch checks the property of the scripts that the datapoints
+// finally taken out of the slots are the same as the ones rolled up from all the
+// raw datapoints at once, however the raw datapoints are written in batches out
+// of order, delivered again, and left pending or flushed again.
+func TestPutAndRollup_Batch(t *testing.T) {
+	rs := schema.Default.Retentions
+	now := time.Unix(1000, 0)
+
+	for _, enc := range []string{"hash", "blob"} {
+		r := framework.Redis(enc)
+		name := "integration.rollup.batch." + enc
+
+		f := func(seed int64) bool {
+			rnd := rand.New(rand.NewSource(seed))
+			deleteSlots(t, r, name)
+
+			// The raw datapoints in 2 days of integer values, which are summed
+			// exactly in any order.
+			raw := map[int64]float64{}
+			for n := 1 + rnd.Intn(200); len(raw) < n; {
+				raw[int64(rnd.Intn(2*1440))*60] = float64(rnd.Intn(201) - 100)
+			}
+			timestamps := make([]int64, 0, len(raw))
+			for ts := range raw {
+				timestamps = append(timestamps, ts)
+			}
+			sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+			for i := range timestamps {
+				j := i + rnd.Intn(10)
+				if j < len(timestamps) {
+					timestamps[i], timestamps[j] = timestamps[j], timestamps[i]
+				}
+			}
+
+			flushed := map[string]map[flushedElement]bool{}
+			// flush writes the claims into the flushed set, and acks them except
+			// for the ones failed to be flushed or acked, which are left pending.
+			flush := func(claims []*redis.Claim, failing bool) bool {
+				for _, c := range claims {
+					if failing && rnd.Intn(5) == 0 {
+						continue
+					}
+					if flushed[c.Slot] == nil {
+						flushed[c.Slot] = map[flushedElement]bool{}
+					}
+					for ts, a := range c.Points {
+						flushed[c.Slot][flushedElement{timestamp: ts, aggregate: *a}] = true
+					}
+					if failing && rnd.Intn(5) == 0 {
+						continue
+					}
+					if err := r.Ack(c.Slot, name, c.ID); err != nil {
+						t.Logf("seed %d: should not raise err: %s", seed, err)
+						return false
+					}
+				}
+				return true
+			}
+
+			for len(timestamps) > 0 {
+				n := 1 + rnd.Intn(10)
+				if n > len(timestamps) {
+					n = len(timestamps)
+				}
+				tv := map[int64]*model.Aggregate{}
+				for _, ts := range timestamps[:n] {
+					tv[ts] = model.NewAggregate(ts, raw[ts])
+				}
+				timestamps = timestamps[n:]
+				claims, err := r.PutAndRollup(rs, name, tv, now)
+				if err != nil {
+					t.Logf("seed %d: should not raise err: %s", seed, err)
+					return false
+				}
+				// The datapoints not taken out are delivered again.
+				if len(claims) == 0 && rnd.Intn(5) == 0 {
+					if claims, err = r.PutAndRollup(rs, name, tv, now); err != nil {
+						t.Logf("seed %d: should not raise err: %s", seed, err)
+						return false
+					}
+				}
+				if !flush(claims, true) {
+					return false
+				}
+			}
+
+			// The pending claims are flushed again, and the idle slots are taken
+			// out as the sweep does.
+			for i, rt := range rs {
+				claims, err := r.ClaimPending(rt.Slot, name, now.Add(time.Second))
+				if err != nil {
+					t.Logf("seed %d: should not raise err: %s", seed, err)
+					return false
+				}
+				idle, err := r.ClaimIdle(rs[i:], name, 1<<32, now)
+				if err != nil {
+					t.Logf("seed %d: should not raise err: %s", seed, err)
+					return false
+				}
+				if !flush(append(claims, idle...), false) {
+					return false
+				}
+			}
+			for _, rt := range rs {
+				if n, err := r.Len(rt.Slot, name); err != nil || n != 0 {
+					t.Logf("seed %d: datapoints should not be left in %s: %d, %v", seed, rt.Slot, n, err)
+					return false
+				}
+			}
+
+			for _, rt := range rs {
+				got := map[int64]*model.Aggregate{}
+				for e := range flushed[rt.Slot] {
+					a := e.aggregate
+					if prev, ok := got[e.timestamp]; ok {
+						prev.Merge(&a)
+					} else {
+						got[e.timestamp] = &a
+					}
+				}
+				expected := map[int64]*model.Aggregate{}
+				for ts, v := range raw {
+					if rt == rs[0] {
+						expected[ts] = model.NewAggregate(ts, v)
+						continue
+					}
+					aligned := rt.AlignTimestamp(ts)
+					if expected[aligned] == nil {
+						expected[aligned] = &model.Aggregate{RolledUp: true}
+					}
+					expected[aligned].Merge(model.NewAggregate(ts, v))
+				}
+				if diff := pretty.Compare(got, expected); diff != "" {
+					t.Logf("encoding: %s, seed %d, slot %s: diff: (-actual +expected)\n%s", enc, seed, rt.Slot, diff)
+					return false
+				}
+			}
+			return true
+		}
+		if err := quick.Check(f, &quick.Config{MaxCount: 20}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
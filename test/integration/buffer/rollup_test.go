@@ -0,0 +1,173 @@
+// +build integration
+
+package buffer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/yuuki/diamondb/pkg/model"
+	"github.com/yuuki/diamondb/pkg/storage/redis"
+	"github.com/yuuki/diamondb/pkg/storage/schema"
+	"github.com/yuuki/diamondb/test/integration/framework"
+)
+
+func deleteSlots(t *testing.T, r *redis.Redis, name string) {
+	for _, rt := range schema.Default.Retentions {
+		if err := r.Delete(rt.Slot, name); err != nil {
+			t.Fatalf("should not raise error: %s", err)
+		}
+	}
+}
+
+func TestPutAndRollup_Pending(t *testing.T) {
+	rs := schema.Default.Retentions
+	now := time.Unix(1000, 0)
+	for _, enc := range []string{"hash", "blob"} {
+		r := framework.Redis(enc)
+		name := "integration.rollup.pending." + enc
+		deleteSlots(t, r, name)
+
+		tv := map[int64]*model.Aggregate{}
+		for i := int64(0); i < 4; i++ {
+			tv[i*60] = model.NewAggregate(i*60, float64(i+1))
+		}
+		claims, err := r.PutAndRollup(rs, name, tv, now)
+		if err != nil {
+			t.Fatalf("should not raise error: %s", err)
+		}
+		if len(claims) != 0 {
+			t.Fatalf("encoding: %s, datapoints should not be taken out: %v", enc, claims)
+		}
+		claims, err = r.PutAndRollup(rs, name, map[int64]*model.Aggregate{240: model.NewAggregate(240, 5)}, now)
+		if err != nil {
+			t.Fatalf("should not raise error: %s", err)
+		}
+		tv[240] = model.NewAggregate(240, 5)
+		if len(claims) != 1 || claims[0].Slot != "1m" {
+			t.Fatalf("encoding: %s, the 1m slot should be taken out: %v", enc, claims)
+		}
+		if diff := pretty.Compare(claims[0].Points, tv); diff != "" {
+			t.Fatalf("encoding: %s, diff: (-actual +expected)\n%s", enc, diff)
+		}
+
+		// The datapoints taken out are rolled up by the script, and read from the
+		// pending hash until they are acked.
+		for slot, expected := range map[string]map[int64]float64{
+			"1m": {0: 1, 60: 2, 120: 3, 180: 4, 240: 5},
+			"5m": {0: 3},
+		} {
+			got, err := r.Get(slot, name)
+			if err != nil {
+				t.Fatalf("should not raise error: %s", err)
+			}
+			if diff := pretty.Compare(got, expected); diff != "" {
+				t.Fatalf("encoding: %s, slot: %s, diff: (-actual +expected)\n%s", enc, slot, diff)
+			}
+		}
+		pending, err := r.ClaimPending("1m", name, now.Add(time.Second))
+		if err != nil {
+			t.Fatalf("should not raise error: %s", err)
+		}
+		if diff := pretty.Compare(pending, claims); diff != "" {
+			t.Fatalf("encoding: %s, diff: (-actual +expected)\n%s", enc, diff)
+		}
+		if err := r.Ack("1m", name, claims[0].ID); err != nil {
+			t.Fatalf("should not raise error: %s", err)
+		}
+		if n, err := r.Len("1m", name); err != nil || n != 0 {
+			t.Fatalf("encoding: %s, the datapoints acked should be deleted: %d, %v", enc, n, err)
+		}
+	}
+}
+
+func TestClaimIdle_Legacy(t *testing.T) {
+	rs := schema.Default.Retentions
+	now := time.Unix(1000, 0)
+	r := framework.Redis("hash")
+	name := "integration.rollup.legacy"
+	deleteSlots(t, r, name)
+
+	// The key written before the keys have the hash tag is adopted by the sweep.
+	if err := framework.HMSet("1m:"+name, map[string]string{"0": "1", "60": "3"}); err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	claims, err := r.ClaimIdle(rs, name, 60, now)
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if len(claims) != 0 {
+		t.Fatalf("the series should not be idle: %v", claims)
+	}
+	claims, err = r.ClaimIdle(rs, name, 120, now)
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	expected := map[int64]*model.Aggregate{0: model.NewAggregate(0, 1), 60: model.NewAggregate(60, 3)}
+	if len(claims) != 1 || claims[0].Slot != "1m" {
+		t.Fatalf("the 1m slot should be taken out: %v", claims)
+	}
+	if diff := pretty.Compare(claims[0].Points, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+	if n, err := framework.StrLen("1m:" + name); err != nil || n != 0 {
+		t.Fatalf("the legacy key should be deleted: %d, %v", n, err)
+	}
+	got, err := r.Get("5m", name)
+	if err != nil {
+		t.Fatalf("should not raise error: %s", err)
+	}
+	if diff := pretty.Compare(got, map[int64]float64{0: 2}); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestPutAndRollup_Redelivered(t *testing.T) {
+	rs := schema.Default.Retentions
+	now := time.Unix(1000, 0)
+	for _, enc := range []string{"hash", "blob"} {
+		r := framework.Redis(enc)
+		name := "integration.rollup.redelivered." + enc
+		deleteSlots(t, r, name)
+
+		batch := func(start int64, offset float64) map[int64]*model.Aggregate {
+			tv := map[int64]*model.Aggregate{}
+			for i := int64(0); i < 5; i++ {
+				tv[start+i*60] = model.NewAggregate(start+i*60, float64(i)+offset)
+			}
+			return tv
+		}
+		// The batch A is delivered again after the batch B, and the batch of the
+		// same timestamps as A but the distinct values is rolled up with the same
+		// last timestamp.
+		a, b, c := batch(0, 1), batch(300, 1), batch(0, 10)
+		for _, tv := range []map[int64]*model.Aggregate{a, b, a, c} {
+			claims, err := r.PutAndRollup(rs, name, tv, now)
+			if err != nil {
+				t.Fatalf("should not raise error: %s", err)
+			}
+			if len(claims) != 1 || claims[0].Slot != "1m" {
+				t.Fatalf("encoding: %s, the 1m slot should be taken out: %v", enc, claims)
+			}
+		}
+
+		expected := map[int64]*model.Aggregate{0: {RolledUp: true}, 300: {RolledUp: true}}
+		for _, tv := range []map[int64]*model.Aggregate{a, b, c} {
+			for ts, v := range tv {
+				expected[rs[1].AlignTimestamp(ts)].Merge(v)
+			}
+		}
+		claims, err := r.ClaimIdle(rs[1:], name, 1<<32, now)
+		if err != nil {
+			t.Fatalf("should not raise error: %s", err)
+		}
+		if len(claims) == 0 || claims[0].Slot != "5m" {
+			t.Fatalf("encoding: %s, the 5m slot should be taken out: %v", enc, claims)
+		}
+		if diff := pretty.Compare(claims[0].Points, expected); diff != "" {
+			t.Fatalf("encoding: %s, diff: (-actual +expected)\n%s", enc, diff)
+		}
+	}
+}
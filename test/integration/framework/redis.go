@@ -0,0 +1,36 @@
+// +build integration
+
+package framework
+
+import (
+	goredis "gopkg.in/redis.v5"
+
+	"github.com/yuuki/diamondb/pkg/config"
+	"github.com/yuuki/diamondb/pkg/storage/redis"
+)
+
+const REDIS_ADDR = "redis:6379"
+
+// Redis returns the client of the Redis which the server writes into, to run
+// the scripts against the real Redis.
+func Redis(encoding string) *redis.Redis {
+	config.Config.RedisAddrs = []string{REDIS_ADDR}
+	config.Config.RedisPoolSize = 4
+	config.Config.RedisBufferEncoding = encoding
+	return redis.New()
+}
+
+// StrLen returns the length of the string of the key.
+func StrLen(key string) (int64, error) {
+	c := goredis.NewClient(&goredis.Options{Addr: REDIS_ADDR})
+	defer c.Close()
+	return c.StrLen(key).Result()
+}
+
+// HMSet sets the fields of the hash of the key, to write the keys as the nodes
+// of the older versions do.
+func HMSet(key string, fields map[string]string) error {
+	c := goredis.NewClient(&goredis.Options{Addr: REDIS_ADDR})
+	defer c.Close()
+	return c.HMSet(key, fields).Err()
+}
@@ -4,6 +4,7 @@ package writer
 
 import (
 	"net/http"
+	"sync"
 	"testing"
 
 	"github.com/yuuki/diamondb/pkg/model"
@@ -22,3 +23,26 @@ func TestWrite(t *testing.T) {
 		t.Errorf("status code shoud be 204: %v", status)
 	}
 }
+
+func TestWriteConcurrently(t *testing.T) {
+	// The writers of the same series race to roll up and flush the datapoints.
+	var wg sync.WaitGroup
+	statuses := make(chan int, 12)
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses <- framework.Write(&model.Metric{
+				Name:       "server2.loadavg5",
+				Datapoints: []*model.Datapoint{{Timestamp: int64(60 * (i + 1)), Value: float64(i)}},
+			})
+		}(i)
+	}
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		if status != http.StatusNoContent {
+			t.Errorf("status code shoud be 204: %v", status)
+		}
+	}
+}